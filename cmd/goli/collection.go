@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/raman20/index/hnsw"
+)
+
+const collectionConfigFile = "collection.json"
+
+// collectionConfig is the vector index configuration of a collection, declared when
+// the collection is created and stored in its directory. A Dim of zero accepts
+// vectors of any dimension.
+type collectionConfig struct {
+	Metric         string `json:"metric"`
+	Dim            int    `json:"dim,omitempty"`
+	M              int    `json:"m"`
+	EfConstruction int    `json:"ef_construction"`
+	EfSearch       int    `json:"ef_search"`
+	Quantization   string `json:"quantization,omitempty"` // none, sq8 or pq
+	PQSubspaces    int    `json:"pq_subspaces,omitempty"`
+	TrainSize      int    `json:"train_size,omitempty"`
+	Rerank         int    `json:"rerank,omitempty"`
+}
+
+// defaultCollectionConfig applies to collections created without options, and to
+// collections created before configurations were stored.
+var defaultCollectionConfig = collectionConfig{Metric: "cosine", M: 16, EfConstruction: 64, EfSearch: 32}
+
+// parseCollectionConfig parses the options of `collection create`, such as
+// --metric=dot --dim=768, over the defaults.
+func parseCollectionConfig(args []string) (collectionConfig, error) {
+	cfg := defaultCollectionConfig
+	fs := flag.NewFlagSet("collection create", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&cfg.Metric, "metric", cfg.Metric, "distance metric: euclidean, cosine, dot, manhattan or hamming")
+	fs.IntVar(&cfg.Dim, "dim", cfg.Dim, "vector dimension, 0 for any")
+	fs.IntVar(&cfg.M, "m", cfg.M, "max connections per node per layer")
+	fs.IntVar(&cfg.EfConstruction, "ef-construction", cfg.EfConstruction, "candidate list size during construction")
+	fs.IntVar(&cfg.EfSearch, "ef-search", cfg.EfSearch, "candidate list size during search")
+	fs.StringVar(&cfg.Quantization, "quantization", "none", "vector quantization: none, sq8 or pq")
+	fs.IntVar(&cfg.PQSubspaces, "pq-subspaces", 0, "PQ subvectors per vector, 0 for one per 4 components")
+	fs.IntVar(&cfg.TrainSize, "train-size", 0, "vectors indexed before the quantizer is trained, 0 for 4096")
+	fs.IntVar(&cfg.Rerank, "rerank", 0, "candidates re-ranked by exact distance, 0 to disable")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	if err := cfg.validate(); err != nil {
+		return cfg, err
+	}
+
+	// Store the canonical name of metric aliases such as l2 or ip
+	metric, _ := hnsw.ParseMetric(cfg.Metric)
+	cfg.Metric = metric.String()
+	return cfg, nil
+}
+
+func (c collectionConfig) validate() error {
+	if _, err := hnsw.ParseMetric(c.Metric); err != nil {
+		return err
+	}
+	if c.Dim < 0 || c.M <= 0 || c.EfConstruction <= 0 || c.EfSearch <= 0 {
+		return errors.New("dim must not be negative, and m and ef must be positive")
+	}
+	if _, err := c.quantization(); err != nil {
+		return err
+	}
+	if c.PQSubspaces < 0 || c.TrainSize < 0 || c.Rerank < 0 {
+		return errors.New("pq-subspaces, train-size and rerank must not be negative")
+	}
+	if c.Dim > 0 && c.PQSubspaces > 0 && c.Dim%c.PQSubspaces != 0 {
+		return fmt.Errorf("%d dimensions do not split into %d PQ subspaces", c.Dim, c.PQSubspaces)
+	}
+	return nil
+}
+
+// quantization returns the vector quantization the collection declares.
+func (c collectionConfig) quantization() (hnsw.Quantization, error) {
+	q := hnsw.Quantization{Subspaces: c.PQSubspaces, TrainSize: c.TrainSize, Rerank: c.Rerank}
+	if c.Quantization == "" {
+		return q, nil
+	}
+	kind, err := hnsw.ParseQuantizer(c.Quantization)
+	q.Kind = kind
+	return q, err
+}
+
+// loadCollectionConfig reads the configuration stored in a collection directory.
+func loadCollectionConfig(colPath string) (collectionConfig, error) {
+	data, err := os.ReadFile(filepath.Join(colPath, collectionConfigFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return defaultCollectionConfig, nil
+	}
+	if err != nil {
+		return collectionConfig{}, fmt.Errorf("failed to read collection config: %w", err)
+	}
+
+	var cfg collectionConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return collectionConfig{}, fmt.Errorf("failed to parse collection config: %w", err)
+	}
+	if err := cfg.validate(); err != nil {
+		return collectionConfig{}, fmt.Errorf("invalid collection config: %w", err)
+	}
+	return cfg, nil
+}
+
+// saveCollectionConfig stores cfg in a collection directory. It fails if the
+// collection already has a configuration.
+func saveCollectionConfig(colPath string, cfg collectionConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(colPath, collectionConfigFile), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return errors.New("collection is already configured")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create collection config: %w", err)
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write collection config: %w", err)
+	}
+	return file.Close()
+}
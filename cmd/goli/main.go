@@ -21,6 +21,7 @@ type MultiModelDB struct {
 	openedDBs   map[string]*storage.DB
 	openedLSMs  map[string]*lsm.LSMIndex
 	openedHNSWs map[string]*hnsw.HNSWIndex
+	configs     map[string]collectionConfig
 }
 
 func main() {
@@ -34,6 +35,7 @@ func main() {
 		openedDBs:   make(map[string]*storage.DB),
 		openedLSMs:  make(map[string]*lsm.LSMIndex),
 		openedHNSWs: make(map[string]*hnsw.HNSWIndex),
+		configs:     make(map[string]collectionConfig),
 	}
 
 	// Dynamic Collection Auto-Discovery
@@ -108,6 +110,11 @@ func (m *MultiModelDB) GetActiveDB() (*storage.DB, *lsm.LSMIndex, *hnsw.HNSWInde
 		return nil, nil, nil, err
 	}
 
+	if report := db.RecoveryReport(); report.DiscardedBytes > 0 {
+		fmt.Printf("Recovered collection %s: discarded %d torn byte(s) from segment %d\n",
+			m.activeName, report.DiscardedBytes, report.SegmentID)
+	}
+
 	m.openedDBs[m.activeName] = db
 	m.openedLSMs[m.activeName] = lsmIdx
 	m.openedHNSWs[m.activeName] = nil // Lazy-loaded on demand
@@ -115,6 +122,68 @@ func (m *MultiModelDB) GetActiveDB() (*storage.DB, *lsm.LSMIndex, *hnsw.HNSWInde
 	return db, lsmIdx, nil, nil
 }
 
+// VectorIndex returns the active collection's HNSW lens, loading its persisted
+// graph on first use. When create is false and no graph exists on disk yet, it
+// returns nil so read-only commands don't allocate an empty index.
+func (m *MultiModelDB) VectorIndex(db *storage.DB, create bool) (*hnsw.HNSWIndex, error) {
+	if hnswIdx := m.openedHNSWs[m.activeName]; hnswIdx != nil {
+		return hnswIdx, nil
+	}
+
+	vecPath := filepath.Join(m.opts.DataDir, "collections", m.activeName, "vector")
+	if !create {
+		if _, err := os.Stat(vecPath); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+
+	cfg, err := m.Config()
+	if err != nil {
+		return nil, err
+	}
+	metric, _ := hnsw.ParseMetric(cfg.Metric)
+	hnswIdx, err := hnsw.OpenHNSWIndex(vecPath, metric, cfg.M, cfg.EfConstruction, cfg.EfSearch, m.opts.SyncPolicy())
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Dim > 0 {
+		if err := hnswIdx.LockDimension(cfg.Dim); err != nil {
+			hnswIdx.Close()
+			return nil, err
+		}
+	}
+	if q, _ := cfg.quantization(); q.Kind != hnsw.NoQuantization {
+		// Re-rank against the full-precision vectors kept in the segment records
+		if err := hnswIdx.SetQuantization(q, hnsw.SegmentVectors(db)); err != nil {
+			hnswIdx.Close()
+			return nil, err
+		}
+	}
+	db.RegisterIndex("vector", hnswIdx)
+	m.openedHNSWs[m.activeName] = hnswIdx
+
+	// Drop vectors whose records were lost in a torn tail, even one truncated while
+	// the lens was not loaded
+	if err := db.ReconcileIndex("vector"); err != nil {
+		return nil, err
+	}
+	return hnswIdx, nil
+}
+
+// Config returns the active collection's vector index configuration.
+func (m *MultiModelDB) Config() (collectionConfig, error) {
+	if cfg, ok := m.configs[m.activeName]; ok {
+		return cfg, nil
+	}
+
+	cfg, err := loadCollectionConfig(filepath.Join(m.opts.DataDir, "collections", m.activeName))
+	if err != nil {
+		return cfg, err
+	}
+	m.configs[m.activeName] = cfg
+	return cfg, nil
+}
+
 func (m *MultiModelDB) Close() {
 	for _, db := range m.openedDBs {
 		db.Close()
@@ -141,20 +210,34 @@ func runSingleCommand(db *MultiModelDB, args []string) {
 	switch cmd {
 	case "collection":
 		if len(args) < 2 {
-			fmt.Println("Usage: goli collection create <name> | collection list")
+			fmt.Println("Usage: goli collection create <name> [options] | collection list")
 			return
 		}
 		subCmd := strings.ToLower(args[1])
 
 		if subCmd == "create" {
 			if len(args) < 3 {
-				fmt.Println("Usage: goli collection create <name>")
+				fmt.Println("Usage: goli collection create <name> [--metric=cosine] [--dim=0] [--m=16] [--ef-construction=64] [--ef-search=32]")
+				fmt.Println("       [--quantization=none|sq8|pq] [--pq-subspaces=0] [--train-size=0] [--rerank=0]")
 				return
 			}
 			name := args[2]
+			cfg, err := parseCollectionConfig(args[3:])
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
 			colPath := filepath.Join(db.opts.DataDir, "collections", name)
-			_ = os.MkdirAll(colPath, 0755)
+			if err := os.MkdirAll(colPath, 0755); err != nil {
+				fmt.Printf("Error creating collection: %v\n", err)
+				return
+			}
+			if err := saveCollectionConfig(colPath, cfg); err != nil {
+				fmt.Printf("Error creating collection %q: %v\n", name, err)
+				return
+			}
 			db.collections[name] = true
+			db.configs[name] = cfg
 			fmt.Println("OK")
 			return
 
@@ -221,28 +304,72 @@ func runSingleCommand(db *MultiModelDB, args []string) {
 			fmt.Println("Usage: goli delete <key>")
 			return
 		}
+		// Deleting a vector ID only removes it from the graph when the vector lens is loaded
+		if _, err := db.VectorIndex(kvDB, false); err != nil {
+			fmt.Printf("Error loading vector index: %v\n", err)
+			return
+		}
 		if err := kvDB.Delete(args[1]); err != nil {
 			fmt.Printf("Error: %v\n", err)
 			return
 		}
 		fmt.Println("OK")
 
+	case "delrange":
+		if len(args) < 3 {
+			fmt.Println("Usage: goli delrange <start> <end>")
+			return
+		}
+		if err := kvDB.DeleteRange(args[1], args[2]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("OK")
+
+	case "scanrange":
+		if len(args) < 3 {
+			fmt.Println("Usage: goli scanrange <start> <end> [limit]")
+			return
+		}
+		limit := 0
+		if len(args) > 3 {
+			if _, err := fmt.Sscanf(args[3], "%d", &limit); err != nil {
+				fmt.Printf("Invalid limit: %s\n", args[3])
+				return
+			}
+		}
+		results, err := kvDB.ScanRange(args[1], args[2], limit)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if len(results) == 0 {
+			fmt.Println("(empty)")
+		}
+		for _, kv := range results {
+			fmt.Printf("%s => %s\n", kv.Key, kv.Value)
+		}
+
 	case "scan":
 		if len(args) < 2 {
 			fmt.Println("Usage: goli scan <prefix>")
 			return
 		}
-		results, err := kvDB.Scan(args[1])
+		it, err := kvDB.NewIterator(storage.PrefixBounds([]byte(args[1])))
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			return
 		}
-		if len(results) == 0 {
+		defer it.Close()
+		count := 0
+		for ok := it.First(); ok; ok = it.Next() {
+			fmt.Printf("%s => %s\n", it.Key(), it.Value())
+			count++
+		}
+		if err := it.Error(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else if count == 0 {
 			fmt.Println("(empty)")
-		} else {
-			for k, v := range results {
-				fmt.Printf("%s => %s\n", k, v)
-			}
 		}
 
 	case "stats":
@@ -250,6 +377,68 @@ func runSingleCommand(db *MultiModelDB, args []string) {
 		fmt.Printf("Active Memtable Size:     %d bytes\n", stats.MemtableSize)
 		fmt.Printf("Immutable Memtable Count: %d\n", stats.ImmutableCount)
 		fmt.Printf("SSTable File Count:       %d\n", stats.SSTableCount)
+		for level, files := range stats.LevelFiles {
+			if files > 0 {
+				fmt.Printf("  L%d:                     %d files, %d bytes\n", level, files, stats.LevelBytes[level])
+			}
+		}
+		if stats.FlushedBytes > 0 {
+			fmt.Printf("Compaction Write Amp:     %.2fx\n", float64(stats.CompactedBytes)/float64(stats.FlushedBytes))
+		}
+		if stats.WriteStalls > 0 {
+			fmt.Printf("Write Stalls:             %d (%v)\n", stats.WriteStalls, stats.StallTime)
+		}
+		fmt.Printf("Bloom Filter Checks:      %d\n", stats.BloomChecks)
+		if stats.BloomChecks > 0 {
+			// False positives are measured against the lookups for absent keys
+			absent := stats.BloomNegatives + stats.BloomFalsePositives
+			fmt.Printf("Bloom Filter Skips:       %d (%.1f%%)\n", stats.BloomNegatives,
+				100*float64(stats.BloomNegatives)/float64(stats.BloomChecks))
+			if absent > 0 {
+				fmt.Printf("Bloom False Positives:    %d (%.2f%%)\n", stats.BloomFalsePositives,
+					100*float64(stats.BloomFalsePositives)/float64(absent))
+			}
+		}
+
+	case "reindex":
+		if len(args) < 2 {
+			fmt.Println("Usage: goli reindex <index>")
+			return
+		}
+		name := args[1]
+		if name == "vector" {
+			if _, err := db.VectorIndex(kvDB, true); err != nil {
+				fmt.Printf("Error loading vector index: %v\n", err)
+				return
+			}
+		}
+		if err := kvDB.RebuildIndex(name); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("OK")
+
+	case "gc":
+		ratio := 0.5
+		if len(args) >= 2 {
+			r, err := strconv.ParseFloat(args[1], 64)
+			if err != nil {
+				fmt.Printf("Invalid discard ratio: %v\n", err)
+				return
+			}
+			ratio = r
+		}
+		// Vector records can only be relocated when the vector lens is loaded
+		if _, err := db.VectorIndex(kvDB, false); err != nil {
+			fmt.Printf("Error loading vector index: %v\n", err)
+			return
+		}
+		n, err := kvDB.RunValueLogGC(ratio)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Rewrote %d segment(s)\n", n)
 
 	case "vset":
 		if len(args) < 4 {
@@ -265,11 +454,10 @@ func runSingleCommand(db *MultiModelDB, args []string) {
 		metadata := strings.Join(args[3:], " ")
 
 		// Lazy initialize the HNSW vector index on the first write
-		_ = kvDB.GetOrInitIndex("vector", func() storage.Index {
-			hnswIdx := hnsw.NewHNSWIndex(hnsw.Cosine, 16, 64, 32)
-			db.openedHNSWs[db.activeName] = hnswIdx
-			return hnswIdx
-		})
+		if _, err := db.VectorIndex(kvDB, true); err != nil {
+			fmt.Printf("Error loading vector index: %v\n", err)
+			return
+		}
 
 		compositeKey := hnsw.EncodeKey(id, vec)
 		if err := kvDB.InsertVector(compositeKey, metadata); err != nil {
@@ -279,8 +467,8 @@ func runSingleCommand(db *MultiModelDB, args []string) {
 		fmt.Println("OK")
 
 	case "vsearch":
-		if len(args) < 3 {
-			fmt.Println("Usage: goli vsearch <vector_csv> <k>")
+		if len(args) < 3 || len(args) > 3 && (len(args) != 5 || strings.ToLower(args[3]) != "where") {
+			fmt.Println("Usage: goli vsearch <vector_csv> <k> [where <id_prefix>]")
 			return
 		}
 		vec, err := parseVector(args[1])
@@ -294,14 +482,29 @@ func runSingleCommand(db *MultiModelDB, args []string) {
 			return
 		}
 
-		idx, exists := kvDB.GetIndex("vector")
-		if !exists {
+		hnswIdx, err := db.VectorIndex(kvDB, false)
+		if err != nil {
+			fmt.Printf("Error loading vector index: %v\n", err)
+			return
+		}
+		if hnswIdx == nil {
 			fmt.Println("(empty - no vectors indexed yet)")
 			return
 		}
-		hnswIdx := idx.(*hnsw.HNSWIndex)
 
-		refs, distances, err := hnswIdx.Search(vec, k)
+		// Restrict the search to the vector IDs under a prefix of the primary index
+		var filter hnsw.Filter
+		if len(args) == 5 {
+			primary, _ := kvDB.GetIndex("primary")
+			allowed, err := primary.Scan([]byte(args[4]))
+			if err != nil {
+				fmt.Printf("Error scanning prefix: %v\n", err)
+				return
+			}
+			filter = hnsw.AllowRefs(allowed)
+		}
+
+		refs, distances, err := hnswIdx.SearchFiltered(vec, k, filter)
 		if err != nil {
 			fmt.Printf("Vector search error: %v\n", err)
 			return
@@ -321,17 +524,39 @@ func runSingleCommand(db *MultiModelDB, args []string) {
 		}
 
 	case "vstats":
-		idx, exists := kvDB.GetIndex("vector")
-		if !exists {
+		cfg, err := db.Config()
+		if err != nil {
+			fmt.Printf("Error loading collection config: %v\n", err)
+			return
+		}
+		dim := "any"
+		if cfg.Dim > 0 {
+			dim = strconv.Itoa(cfg.Dim)
+		}
+		fmt.Printf("Metric: %s | Dimension: %s | M: %d | efConstruction: %d | efSearch: %d\n",
+			cfg.Metric, dim, cfg.M, cfg.EfConstruction, cfg.EfSearch)
+
+		hnswIdx, err := db.VectorIndex(kvDB, false)
+		if err != nil {
+			fmt.Printf("Error loading vector index: %v\n", err)
+			return
+		}
+		if hnswIdx == nil {
 			fmt.Println("HNSW Indexed Vectors: 0")
 			return
 		}
-		hnswIdx := idx.(*hnsw.HNSWIndex)
+		if q, _ := cfg.quantization(); q.Kind != hnsw.NoQuantization {
+			state := "untrained"
+			if hnswIdx.Quantized() {
+				state = "trained"
+			}
+			fmt.Printf("Quantization: %s (%s) | Rerank: %d\n", q.Kind, state, q.Rerank)
+		}
 		stats := hnswIdx.Stats()
 		fmt.Printf("HNSW Indexed Vectors: %d\n", stats.MemtableSize)
 
 	default:
-		fmt.Printf("Unknown command: %s. Supported: set, get, delete, scan, stats, vset, vsearch, vstats, collection, use\n", cmd)
+		fmt.Printf("Unknown command: %s. Supported: set, get, delete, delrange, scan, scanrange, stats, reindex, gc, vset, vsearch, vstats, collection, use\n", cmd)
 	}
 }
 
@@ -361,16 +586,21 @@ func runREPL(db *MultiModelDB) {
 
 		if cmd == "help" {
 			fmt.Println("Available commands:")
-			fmt.Println("  collection create <name>           - Create a collection")
+			fmt.Println("  collection create <name> [opts]    - Create a collection (--metric, --dim, --m, --ef-construction, --ef-search,")
+			fmt.Println("                                       --quantization, --pq-subspaces, --train-size, --rerank)")
 			fmt.Println("  collection list                    - List all collections")
 			fmt.Println("  use <collection_name>              - Switch the active collection")
 			fmt.Println("  set <key> <value>                  - Store a KV entry")
 			fmt.Println("  get <key>                          - Retrieve a KV entry (works on vector metadata too!)")
 			fmt.Println("  delete <key>                       - Delete a KV entry (removes from all indexes!)")
+			fmt.Println("  delrange <start> <end>             - Delete every key in [start, end)")
 			fmt.Println("  scan <prefix>                      - Scan KV by prefix")
+			fmt.Println("  scanrange <start> <end> [limit]    - Scan keys in [start, end) in order")
 			fmt.Println("  stats                              - Show active collection engine metrics")
-			fmt.Println("  vset <id> <vector> <val>           - Insert vector node (auto-activates HNSW graph)")
-			fmt.Println("  vsearch <vector> <k>               - Search nearest vectors (only if vectors indexed)")
+			fmt.Println("  reindex <index>                    - Rebuild an index (primary/vector) from the segment log")
+			fmt.Println("  gc [discard_ratio]                 - Reclaim space in segments with mostly dead records")
+			fmt.Println("  vset <id> <vector> <val>           - Insert or replace vector node (auto-activates HNSW graph)")
+			fmt.Println("  vsearch <vector> <k> [where <p>]   - Search nearest vectors, optionally with IDs under prefix p")
 			fmt.Println("  vstats                             - Show HNSW vector index metrics")
 			fmt.Println("  exit / quit                        - Exit the shell")
 			continue
@@ -1,5 +1,3 @@
 module github.com/raman20
 
 go 1.23.3
-
-require github.com/google/uuid v1.6.0
@@ -1,12 +1,15 @@
 package hnsw
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"math"
 	"math/rand"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/raman20/storage"
@@ -17,27 +20,126 @@ type DistanceMetric int
 const (
 	Euclidean DistanceMetric = iota
 	Cosine
+	DotProduct // 1 - inner product; ranks normalized embeddings for maximum inner product search
+	Manhattan  // L1 distance
+	Hamming    // Number of differing components, for binary codes stored as 0/1 vectors
 )
 
+var metricNames = map[string]DistanceMetric{
+	"euclidean": Euclidean,
+	"l2":        Euclidean,
+	"cosine":    Cosine,
+	"dot":       DotProduct,
+	"ip":        DotProduct,
+	"manhattan": Manhattan,
+	"l1":        Manhattan,
+	"hamming":   Hamming,
+}
+
+var (
+	// ErrDimensionMismatch is returned for vectors whose dimension differs from the
+	// one the index is locked to.
+	ErrDimensionMismatch = errors.New("vector dimension mismatch")
+	// ErrInvalidVector is returned for empty vectors and for vectors with a NaN or
+	// infinite component.
+	ErrInvalidVector = errors.New("invalid vector")
+	// ErrZeroVector is returned for zero vectors under cosine distance, which have no
+	// direction to compare.
+	ErrZeroVector = errors.New("zero vector has no cosine distance")
+)
+
+// ParseMetric returns the metric with the given name: euclidean (l2), cosine, dot
+// (ip), manhattan (l1) or hamming.
+func ParseMetric(name string) (DistanceMetric, error) {
+	metric, ok := metricNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown distance metric %q", name)
+	}
+	return metric, nil
+}
+
+func (m DistanceMetric) String() string {
+	switch m {
+	case Euclidean:
+		return "euclidean"
+	case Cosine:
+		return "cosine"
+	case DotProduct:
+		return "dot"
+	case Manhattan:
+		return "manhattan"
+	case Hamming:
+		return "hamming"
+	default:
+		return fmt.Sprintf("DistanceMetric(%d)", int(m))
+	}
+}
+
 type HNSWIndex struct {
-	mu           sync.RWMutex
-	nodes        map[string]*HNSWNode
-	enterPoint   *HNSWNode
-	maxLayer     int
-	metric       DistanceMetric
-	m            int     // Max connections per node per layer
-	m0           int     // Max connections for layer 0
-	efConstruction int   // Size of dynamic candidate list during construction
-	efSearch       int   // Size of dynamic candidate list during search
-	levelMult    float64 // Normalization factor for level generation
-	closed       bool
+	mu             sync.RWMutex
+	nodes          map[string]*HNSWNode
+	enterPoint     *HNSWNode
+	maxLayer       int
+	metric         DistanceMetric
+	m              int     // Max connections per node per layer
+	m0             int     // Max connections for layer 0
+	efConstruction int     // Size of dynamic candidate list during construction
+	efSearch       int     // Size of dynamic candidate list during search
+	levelMult      float64 // Normalization factor for level generation
+	dim            int     // Dimension every vector must have; zero until locked
+	closed         bool
+
+	// Quantization state. Once quantizer is trained, nodes keep codes in place of vectors.
+	quant     Quantization
+	quantizer quantizer
+	read      VectorReader // Reads full-precision vectors back for re-ranking
+
+	// Persistence state, only set for indexes opened with OpenHNSWIndex
+	dir        string
+	wal        *storage.WAL
+	policy     storage.SyncPolicy // When the WAL is synced
+	generation uint64             // Checkpoint generation; names the active WAL file
+	logged     int                // Operations logged since the last checkpoint
+}
+
+// Filter reports whether SearchFiltered may return the node with id, whose vector
+// record is at ref.
+type Filter func(id string, ref storage.RecordRef) bool
+
+// AllowRefs returns a filter admitting the nodes whose vector record is one of refs,
+// such as the refs a prefix scan of the primary index returns for the vector IDs
+// under the prefix.
+func AllowRefs(refs []storage.RecordRef) Filter {
+	allowed := make(map[storage.RecordRef]bool, len(refs))
+	for _, ref := range refs {
+		allowed[ref] = true
+	}
+	return func(_ string, ref storage.RecordRef) bool {
+		return allowed[ref]
+	}
+}
+
+func (f Filter) admits(node *HNSWNode) bool {
+	return f == nil || f(node.ID, node.DataRef)
 }
 
+const (
+	// filterSample is the number of nodes sampled to tell how selective a filter is
+	filterSample = 256
+	// bruteForceSelectivity is the fraction of nodes below which a filter is too
+	// selective for a walk of the graph, which would visit most nodes before it
+	// found enough that the filter admits
+	bruteForceSelectivity = 0.05
+)
+
 type HNSWNode struct {
 	ID        string
-	Vector    []float32
+	Vector    []float32  // Full-precision vector; nil once the index is quantized
+	Code      []byte     // Quantized vector, set once the index is quantized
 	Neighbors [][]string // Neighbors[level] is a list of node IDs at that level
 	DataRef   storage.RecordRef
+
+	linkedFrom map[string]int // Links to this node on any level, by the ID of the linking node
 }
 
 func NewHNSWIndex(metric DistanceMetric, m, efConstruction, efSearch int) *HNSWIndex {
@@ -63,6 +165,140 @@ func NewHNSWIndex(metric DistanceMetric, m, efConstruction, efSearch int) *HNSWI
 	}
 }
 
+// Dimension returns the dimension the index is locked to, or zero if it is not
+// locked yet.
+func (h *HNSWIndex) Dimension() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.dim
+}
+
+// LockDimension locks the index to vectors of dim components, as its first insert
+// would, so a configured dimension is enforced before any vector is written. It
+// fails if the index is already locked to another dimension.
+func (h *HNSWIndex) LockDimension(dim int) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if dim <= 0 {
+		return fmt.Errorf("%w: dimension must be positive, got %d", ErrInvalidVector, dim)
+	}
+	if h.dim > 0 && h.dim != dim {
+		return fmt.Errorf("%w: index has %d dimensions, not %d", ErrDimensionMismatch, h.dim, dim)
+	}
+	h.dim = dim
+	return nil
+}
+
+// checkVector reports why vec may not be inserted into or searched against an index
+// locked to dim components, where zero leaves the dimension open.
+func (h *HNSWIndex) checkVector(vec []float32, dim int) error {
+	if len(vec) == 0 {
+		return fmt.Errorf("%w: vector is empty", ErrInvalidVector)
+	}
+	if dim > 0 && len(vec) != dim {
+		return fmt.Errorf("%w: vector has %d dimensions, index has %d", ErrDimensionMismatch, len(vec), dim)
+	}
+	if dim == 0 {
+		if err := h.quant.checkDimension(len(vec)); err != nil {
+			return err
+		}
+	}
+
+	zero := true
+	for i, v := range vec {
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return fmt.Errorf("%w: component %d is %v", ErrInvalidVector, i, v)
+		}
+		if v != 0 {
+			zero = false
+		}
+	}
+	if zero && h.metric == Cosine {
+		return ErrZeroVector
+	}
+	return nil
+}
+
+// SetQuantization configures vector quantization and, when read is not nil, exact
+// re-ranking of the q.Rerank closest candidates of every search by the vectors read
+// returns. An index that already holds TrainSize vectors is quantized at once. A
+// quantized index keeps its trained codebook, persisted with its checkpoints, so only
+// the re-ranking parameters of a quantized index may change.
+func (h *HNSWIndex) SetQuantization(q Quantization, read VectorReader) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return storage.ErrDBClosed
+	}
+	if err := q.validate(); err != nil {
+		return err
+	}
+	if h.quantizer != nil {
+		if q.Kind != h.quant.Kind {
+			return fmt.Errorf("index is already quantized with %v", h.quant.Kind)
+		}
+		h.quant.Rerank = q.Rerank
+		h.read = read
+		return nil
+	}
+	if h.dim > 0 {
+		if err := q.checkDimension(h.dim); err != nil {
+			return err
+		}
+	}
+
+	h.quant = q
+	h.read = read
+	if h.trainable() {
+		h.train()
+		return h.checkpoint()
+	}
+	return nil
+}
+
+// Quantized reports whether the index keeps quantized codes in place of vectors.
+func (h *HNSWIndex) Quantized() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.quantizer != nil
+}
+
+// trainable reports whether the quantizer is due for training. Must hold h.mu.
+func (h *HNSWIndex) trainable() bool {
+	return h.quant.Kind != NoQuantization && h.quantizer == nil &&
+		len(h.nodes) > 0 && len(h.nodes) >= h.quant.withDefaults(h.dim).TrainSize
+}
+
+// train trains the quantizer on the vectors of every node and replaces the vectors
+// with their codes. Must hold h.mu.
+func (h *HNSWIndex) train() {
+	h.quant = h.quant.withDefaults(h.dim)
+	h.quant.Centroids = min(h.quant.Centroids, len(h.nodes)) // k-means needs a point per centroid
+	vectors := make([][]float32, 0, len(h.nodes))
+	for _, node := range h.nodes {
+		vectors = append(vectors, node.Vector)
+	}
+
+	h.quantizer = trainQuantizer(h.quant, h.dim, vectors)
+	for _, node := range h.nodes {
+		node.Code = h.quantizer.encode(node.Vector)
+		node.Vector = nil
+	}
+}
+
+// vectorOf returns the vector of node, decoded from its code once the index is
+// quantized. Must hold h.mu.
+func (h *HNSWIndex) vectorOf(node *HNSWNode) []float32 {
+	if node.Vector != nil {
+		return node.Vector
+	}
+	return h.quantizer.decode(node.Code)
+}
+
 // distance calculates the distance between two vectors.
 func (h *HNSWIndex) distance(v1, v2 []float32) float32 {
 	if len(v1) != len(v2) {
@@ -89,6 +325,29 @@ func (h *HNSWIndex) distance(v1, v2 []float32) float32 {
 			sum += diff * diff
 		}
 		return float32(math.Sqrt(float64(sum)))
+
+	case DotProduct:
+		var dot float32
+		for i := 0; i < len(v1); i++ {
+			dot += v1[i] * v2[i]
+		}
+		return 1.0 - dot
+
+	case Manhattan:
+		var sum float32
+		for i := 0; i < len(v1); i++ {
+			sum += float32(math.Abs(float64(v1[i] - v2[i])))
+		}
+		return sum
+
+	case Hamming:
+		var differing float32
+		for i := 0; i < len(v1); i++ {
+			if v1[i] != v2[i] {
+				differing++
+			}
+		}
+		return differing
 	default:
 		return math.MaxFloat32
 	}
@@ -147,28 +406,175 @@ func (h *HNSWIndex) Put(key []byte, ref storage.RecordRef) error {
 	if h.closed {
 		return storage.ErrDBClosed
 	}
+	return h.apply([]storage.IndexOp{{Key: key, Ref: ref}})
+}
+
+// ApplyBatch applies every insert and delete in ops, in order, or none of them: the
+// batch is validated up front and logged as a single WAL transaction.
+func (h *HNSWIndex) ApplyBatch(ops []storage.IndexOp) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return storage.ErrDBClosed
+	}
+	return h.apply(ops)
+}
+
+// ValidateBatch reports whether ApplyBatch would accept ops, without modifying the index.
+func (h *HNSWIndex) ValidateBatch(ops []storage.IndexOp) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	_, err := h.validate(ops)
+	return err
+}
+
+// validate decodes the composite keys of the inserts in ops, checks their vectors
+// against the dimension of the index, or of the first insert if it is not locked
+// yet, and resolves the node IDs of the deletes. Must hold h.mu.
+func (h *HNSWIndex) validate(ops []storage.IndexOp) ([][]byte, error) {
+	rawKeys := make([][]byte, len(ops))
+	dim := h.dim
+	for i, op := range ops {
+		if op.Delete {
+			rawKeys[i] = nodeID(op)
+			continue
+		}
+		rawKey := op.Key
+		if decoded, err := hex.DecodeString(string(op.Key)); err == nil {
+			rawKey = decoded
+		}
+
+		id, vector, err := DecodeKey(rawKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.checkVector(vector, dim); err != nil {
+			return nil, fmt.Errorf("node %q: %w", id, err)
+		}
+		dim = len(vector)
+		rawKeys[i] = rawKey
+	}
+	return rawKeys, nil
+}
+
+// nodeID returns the ID of the node a delete removes. It is carried explicitly in
+// the op, since the key may be a composite key whose bytes are not the ID.
+func nodeID(op storage.IndexOp) []byte {
+	if op.ID != nil {
+		return op.ID
+	}
+	return op.Key
+}
+
+// apply validates, logs and applies ops. Must hold h.mu.
+func (h *HNSWIndex) apply(ops []storage.IndexOp) error {
+	rawKeys, err := h.validate(ops)
+	if err != nil {
+		return err
+	}
+	if rawKeys, ops = h.skipAbsent(rawKeys, ops); len(ops) == 0 {
+		return nil
+	}
+
+	if h.wal != nil {
+		if err := h.logOps(rawKeys, ops); err != nil {
+			return err
+		}
+	}
+
+	quantized := h.quantizer != nil
+	for i, op := range ops {
+		if op.Delete {
+			h.remove(string(rawKeys[i]))
+			continue
+		}
+		if err := h.insert(rawKeys[i], op.Ref); err != nil {
+			return err
+		}
+	}
+	if h.trainable() {
+		h.train()
+	}
+
+	// A freshly trained codebook is checkpointed at once, so reopening the index
+	// does not load every vector at full precision to train it again
+	if h.wal != nil && (h.logged >= checkpointEvery || h.quantizer != nil && !quantized) {
+		return h.checkpoint()
+	}
+	return nil
+}
 
-	rawKey := key
-	if decoded, err := hex.DecodeString(string(key)); err == nil {
-		rawKey = decoded
+// skipAbsent drops the deletes of IDs that are not indexed when they are applied,
+// like those the deletes of plain KV keys cause, so they are not logged. Must hold h.mu.
+func (h *HNSWIndex) skipAbsent(rawKeys [][]byte, ops []storage.IndexOp) ([][]byte, []storage.IndexOp) {
+	present := make(map[string]bool) // IDs inserted or deleted earlier in ops
+	keptKeys := rawKeys[:0:0]
+	kept := ops[:0:0]
+	for i, op := range ops {
+		id := string(rawKeys[i])
+		if !op.Delete {
+			id, _, _ = DecodeKey(rawKeys[i])
+		}
+		exists, changed := present[id]
+		if !changed {
+			_, exists = h.nodes[id]
+		}
+		if op.Delete && !exists {
+			continue
+		}
+		present[id] = !op.Delete
+		keptKeys = append(keptKeys, rawKeys[i])
+		kept = append(kept, op)
 	}
+	return keptKeys, kept
+}
 
+// insert adds a decoded composite key to the graph without logging it, replacing
+// the node of an ID that is already indexed.
+func (h *HNSWIndex) insert(rawKey []byte, ref storage.RecordRef) error {
 	id, vector, err := DecodeKey(rawKey)
 	if err != nil {
 		return err
 	}
 
-	// 1. Check if node already exists
-	if _, exists := h.nodes[id]; exists {
-		return fmt.Errorf("vector node %s already exists", id)
+	if h.dim == 0 {
+		h.dim = len(vector) // The first insert locks the dimension
+	}
+
+	// A quantized index keeps only the code of the vector
+	var code []byte
+	if h.quantizer != nil {
+		code = h.quantizer.encode(vector)
+	}
+
+	// 1. Check if node already exists. Re-putting the same vector only repoints its
+	// payload, which is how relocated records are tracked after value-log GC; a new
+	// vector is linked into the graph afresh.
+	if node, exists := h.nodes[id]; exists {
+		same := equalVectors(node.Vector, vector)
+		if code != nil {
+			same = bytes.Equal(node.Code, code)
+		}
+		if same {
+			node.DataRef = ref
+			return nil
+		}
+		h.remove(id)
 	}
 
 	insertLevel := h.generateRandomLevel()
 	newNode := &HNSWNode{
-		ID:        id,
-		Vector:    vector,
-		Neighbors: make([][]string, insertLevel+1),
-		DataRef:   ref,
+		ID:         id,
+		Vector:     vector,
+		Code:       code,
+		Neighbors:  make([][]string, insertLevel+1),
+		DataRef:    ref,
+		linkedFrom: make(map[string]int),
+	}
+	if code != nil {
+		newNode.Vector = nil
 	}
 	for l := 0; l <= insertLevel; l++ {
 		newNode.Neighbors[l] = []string{}
@@ -184,14 +590,14 @@ func (h *HNSWIndex) Put(key []byte, ref storage.RecordRef) error {
 	}
 
 	// Step A: Search down from maxLayer to insertLevel
-	dist := h.distance(vector, currEP.Vector)
+	dist := h.distance(vector, h.vectorOf(currEP))
 	for l := h.maxLayer; l > insertLevel; l-- {
 		changed := true
 		for changed {
 			changed = false
 			for _, nID := range currEP.Neighbors[l] {
 				neighbor := h.nodes[nID]
-				d := h.distance(vector, neighbor.Vector)
+				d := h.distance(vector, h.vectorOf(neighbor))
 				if d < dist {
 					dist = d
 					currEP = neighbor
@@ -204,19 +610,15 @@ func (h *HNSWIndex) Put(key []byte, ref storage.RecordRef) error {
 	// Step B: Search and connect at each level from insertLevel down to 0
 	eps := []*HNSWNode{currEP}
 	for l := min(insertLevel, h.maxLayer); l >= 0; l-- {
-		eps = h.searchLayer(vector, eps, h.efConstruction, l)
-		
+		eps = h.searchLayer(vector, eps, h.efConstruction, l, nil)
+
 		// Connect neighbors to newNode at level l
 		for _, ep := range eps {
-			newNode.Neighbors[l] = append(newNode.Neighbors[l], ep.ID)
-			ep.Neighbors[l] = append(ep.Neighbors[l], newNode.ID)
+			h.link(newNode, ep, l)
+			h.link(ep, newNode, l)
 
 			// Prune connections if they exceed limit M
-			maxConn := h.m
-			if l == 0 {
-				maxConn = h.m0
-			}
-			if len(ep.Neighbors[l]) > maxConn {
+			if maxConn := h.maxConn(l); len(ep.Neighbors[l]) > maxConn {
 				h.pruneNeighbors(ep, l, maxConn)
 			}
 		}
@@ -230,6 +632,153 @@ func (h *HNSWIndex) Put(key []byte, ref storage.RecordRef) error {
 	return nil
 }
 
+// remove unlinks the node with id from the graph without logging it. Every node that
+// linked to it is reconnected to the removed node's neighbors on that level, keeping
+// the closest, so nodes that were reached through it stay reachable. Only the nodes
+// linked to or from it are touched.
+func (h *HNSWIndex) remove(id string) {
+	node, exists := h.nodes[id]
+	if !exists {
+		return
+	}
+	delete(h.nodes, id)
+
+	linkers := make([]string, 0, len(node.linkedFrom))
+	for linker := range node.linkedFrom {
+		linkers = append(linkers, linker)
+	}
+	for _, linker := range linkers {
+		other := h.nodes[linker]
+		if other == nil {
+			continue
+		}
+		for l := 0; l < len(other.Neighbors) && l < len(node.Neighbors); l++ {
+			if i := indexOf(other.Neighbors[l], id); i >= 0 {
+				h.repairNeighbors(other, node, l, i)
+			}
+		}
+	}
+	if h.enterPoint == node {
+		h.replaceEntryPoint(node)
+	}
+	for l := range node.Neighbors {
+		h.setNeighbors(node, l, nil)
+	}
+}
+
+// replaceEntryPoint makes the highest neighbor of removed, the former entry point,
+// the new one. Only if removed had no neighbors left are all nodes searched.
+func (h *HNSWIndex) replaceEntryPoint(removed *HNSWNode) {
+	var top *HNSWNode
+	for l := len(removed.Neighbors) - 1; l >= 0 && top == nil; l-- {
+		for _, nID := range removed.Neighbors[l] {
+			if n := h.nodes[nID]; n != nil && (top == nil || len(n.Neighbors) > len(top.Neighbors)) {
+				top = n
+			}
+		}
+	}
+	if top == nil {
+		for _, other := range h.nodes {
+			if top == nil || len(other.Neighbors) > len(top.Neighbors) {
+				top = other
+			}
+		}
+	}
+
+	h.enterPoint = top
+	h.maxLayer = -1
+	if top != nil {
+		h.maxLayer = len(top.Neighbors) - 1
+	}
+}
+
+// repairNeighbors replaces the link at position i of node's level neighbors, which
+// points to removed, with removed's own neighbors on that level.
+func (h *HNSWIndex) repairNeighbors(node, removed *HNSWNode, level, i int) {
+	old := node.Neighbors[level]
+	links := append(old[:i:i], old[i+1:]...)
+	for _, nID := range removed.Neighbors[level] {
+		if nID != node.ID && indexOf(links, nID) < 0 {
+			links = append(links, nID)
+		}
+	}
+	h.setNeighbors(node, level, links)
+
+	if maxConn := h.maxConn(level); len(links) > maxConn {
+		h.pruneNeighbors(node, level, maxConn)
+	}
+}
+
+// link adds a link from node to target on level.
+func (h *HNSWIndex) link(node, target *HNSWNode, level int) {
+	node.Neighbors[level] = append(node.Neighbors[level], target.ID)
+	target.linkedFrom[node.ID]++
+}
+
+// setNeighbors replaces node's links on level, keeping the linkedFrom counts of the
+// nodes it stops and starts linking to in step.
+func (h *HNSWIndex) setNeighbors(node *HNSWNode, level int, links []string) {
+	old := node.Neighbors[level]
+	for _, nID := range old {
+		if n := h.nodes[nID]; n != nil && indexOf(links, nID) < 0 {
+			if n.linkedFrom[node.ID]--; n.linkedFrom[node.ID] <= 0 {
+				delete(n.linkedFrom, node.ID)
+			}
+		}
+	}
+	for _, nID := range links {
+		if n := h.nodes[nID]; n != nil && indexOf(old, nID) < 0 {
+			n.linkedFrom[node.ID]++
+		}
+	}
+	node.Neighbors[level] = links
+}
+
+// linkNodes rebuilds the linkedFrom counts of every node from their links.
+func linkNodes(nodes map[string]*HNSWNode) {
+	for _, node := range nodes {
+		node.linkedFrom = make(map[string]int)
+	}
+	for _, node := range nodes {
+		for _, links := range node.Neighbors {
+			for _, nID := range links {
+				if n := nodes[nID]; n != nil {
+					n.linkedFrom[node.ID]++
+				}
+			}
+		}
+	}
+}
+
+// maxConn returns the maximum number of connections a node keeps on level.
+func (h *HNSWIndex) maxConn(level int) int {
+	if level == 0 {
+		return h.m0
+	}
+	return h.m
+}
+
+func indexOf(ids []string, id string) int {
+	for i, nID := range ids {
+		if nID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func equalVectors(v1, v2 []float32) bool {
+	if len(v1) != len(v2) {
+		return false
+	}
+	for i := range v1 {
+		if v1[i] != v2[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -237,7 +786,11 @@ func min(a, b int) int {
 	return b
 }
 
-func (h *HNSWIndex) searchLayer(query []float32, enterPoints []*HNSWNode, ef int, level int) []*HNSWNode {
+// searchLayer returns up to ef nodes on level that filter admits, closest to query
+// first, found by a best-first walk from enterPoints. Nodes the filter rejects are
+// walked through but not returned, and the walk goes on until ef admitted nodes are
+// found or no closer ones can be.
+func (h *HNSWIndex) searchLayer(query []float32, enterPoints []*HNSWNode, ef int, level int, filter Filter) []*HNSWNode {
 	visited := make(map[string]bool)
 	for _, ep := range enterPoints {
 		visited[ep.ID] = true
@@ -246,21 +799,42 @@ func (h *HNSWIndex) searchLayer(query []float32, enterPoints []*HNSWNode, ef int
 	candidates := make([]*HNSWNode, len(enterPoints))
 	copy(candidates, enterPoints)
 
-	results := make([]*HNSWNode, len(enterPoints))
-	copy(results, enterPoints)
+	results := make([]*HNSWNode, 0, len(enterPoints))
+	for _, ep := range enterPoints {
+		if filter.admits(ep) {
+			results = append(results, ep)
+		}
+	}
+
+	// Distances are computed once per node, as quantized nodes decode their codes
+	distances := make(map[*HNSWNode]float32)
+	distanceTo := func(node *HNSWNode) float32 {
+		d, ok := distances[node]
+		if !ok {
+			d = h.distance(query, h.vectorOf(node))
+			distances[node] = d
+		}
+		return d
+	}
 
 	// Sort helper: sort candidates by distance (closest first)
 	sortByDistance := func(arr []*HNSWNode) {
 		for i := 1; i < len(arr); i++ {
 			key := arr[i]
 			j := i - 1
-			for j >= 0 && h.distance(query, arr[j].Vector) > h.distance(query, key.Vector) {
+			for j >= 0 && distanceTo(arr[j]) > distanceTo(key) {
 				arr[j+1] = arr[j]
 				j = j - 1
 			}
 			arr[j+1] = key
 		}
 	}
+	furthestResultDist := func() float32 {
+		if len(results) < ef {
+			return math.MaxFloat32
+		}
+		return distanceTo(results[len(results)-1])
+	}
 
 	sortByDistance(candidates)
 	sortByDistance(results)
@@ -270,8 +844,7 @@ func (h *HNSWIndex) searchLayer(query []float32, enterPoints []*HNSWNode, ef int
 		curr := candidates[0]
 		candidates = candidates[1:]
 
-		furthestResultDist := h.distance(query, results[len(results)-1].Vector)
-		if h.distance(query, curr.Vector) > furthestResultDist {
+		if distanceTo(curr) > furthestResultDist() {
 			break
 		}
 
@@ -279,17 +852,16 @@ func (h *HNSWIndex) searchLayer(query []float32, enterPoints []*HNSWNode, ef int
 			neighbor := h.nodes[nID]
 			if !visited[nID] {
 				visited[nID] = true
-				d := h.distance(query, neighbor.Vector)
-				furthestResultDist = h.distance(query, results[len(results)-1].Vector)
-
-				if d < furthestResultDist || len(results) < ef {
+				if distanceTo(neighbor) < furthestResultDist() {
 					candidates = append(candidates, neighbor)
-					results = append(results, neighbor)
 					sortByDistance(candidates)
-					sortByDistance(results)
 
-					if len(results) > ef {
-						results = results[:ef]
+					if filter.admits(neighbor) {
+						results = append(results, neighbor)
+						sortByDistance(results)
+						if len(results) > ef {
+							results = results[:ef]
+						}
 					}
 				}
 			}
@@ -306,41 +878,117 @@ func (h *HNSWIndex) pruneNeighbors(node *HNSWNode, level int, maxConn int) {
 	}
 
 	// Simple heuristic: keep the closest neighbors
-	for i := 1; i < len(neighbors); i++ {
-		key := neighbors[i]
-		j := i - 1
-		for j >= 0 && h.distance(node.Vector, neighbors[j].Vector) > h.distance(node.Vector, key.Vector) {
-			neighbors[j+1] = neighbors[j]
-			j = j - 1
-		}
-		neighbors[j+1] = key
+	vector := h.vectorOf(node)
+	distances := make([]float32, len(neighbors))
+	for i, neighbor := range neighbors {
+		distances[i] = h.distance(vector, h.vectorOf(neighbor))
 	}
+	sort.Stable(byDistance{neighbors, distances})
 
 	if len(neighbors) > maxConn {
 		neighbors = neighbors[:maxConn]
 	}
 
-	node.Neighbors[level] = make([]string, len(neighbors))
+	links := make([]string, len(neighbors))
 	for i, n := range neighbors {
-		node.Neighbors[level][i] = n.ID
+		links[i] = n.ID
 	}
+	h.setNeighbors(node, level, links)
 }
 
 // Search queries the top-K closest vectors in the index.
 func (h *HNSWIndex) Search(query []float32, k int) ([]storage.RecordRef, []float32, error) {
+	return h.SearchFiltered(query, k, nil)
+}
+
+// SearchFiltered queries the top-K closest vectors among the nodes filter admits. The
+// filter is applied while walking the graph, so K admitted nodes are returned however
+// few of the nearest ones it admits. When a sample of the nodes shows the filter to
+// admit too few of them for the walk to find, or the walk comes back short, every
+// node is scanned instead. A nil filter admits every node. A query of the wrong
+// dimension, or one the index would not accept as a vector, fails with
+// ErrDimensionMismatch, ErrInvalidVector or ErrZeroVector.
+//
+// A quantized index returns distances to the decoded codes, unless it re-ranks the
+// candidates by their exact distances.
+func (h *HNSWIndex) SearchFiltered(query []float32, k int, filter Filter) ([]storage.RecordRef, []float32, error) {
+	refs, distances, read, err := h.candidates(query, k, filter)
+	if err != nil || read == nil {
+		return refs, distances, err
+	}
+	// Re-ranking reads records from the segments, so it runs without holding h.mu
+	return h.rerank(query, k, refs, read)
+}
+
+// candidates returns the refs of the nodes filter admits closest to query, with their
+// distances: the k closest, or as many as are re-ranked, along with the reader to
+// re-rank them with.
+func (h *HNSWIndex) candidates(query []float32, k int, filter Filter) ([]storage.RecordRef, []float32, VectorReader, error) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
 	if h.closed {
-		return nil, nil, storage.ErrDBClosed
+		return nil, nil, nil, storage.ErrDBClosed
+	}
+	if err := h.checkVector(query, h.dim); err != nil {
+		return nil, nil, nil, err
 	}
 
-	currEP := h.enterPoint
-	if currEP == nil || k <= 0 {
-		return nil, nil, nil
+	if h.enterPoint == nil || k <= 0 {
+		return nil, nil, nil, nil
 	}
 
-	dist := h.distance(query, currEP.Vector)
+	var read VectorReader
+	n := k
+	if h.quantizer != nil && h.read != nil && h.quant.Rerank > 0 {
+		read = h.read
+		n = max(k, h.quant.Rerank)
+	}
+
+	var results []*HNSWNode
+	if filter != nil && h.selective(filter) {
+		results = h.scan(query, n, filter)
+	} else {
+		results = h.searchGraph(query, n, filter)
+		if filter != nil && len(results) < n {
+			results = h.scan(query, n, filter)
+		}
+	}
+
+	refs := make([]storage.RecordRef, len(results))
+	distances := make([]float32, len(results))
+	for i, res := range results {
+		refs[i] = res.DataRef
+		distances[i] = h.distance(query, h.vectorOf(res))
+	}
+
+	return refs, distances, read, nil
+}
+
+// rerank orders refs by the exact distance from query to the vectors read returns
+// for them, and returns the k closest.
+func (h *HNSWIndex) rerank(query []float32, k int, refs []storage.RecordRef, read VectorReader) ([]storage.RecordRef, []float32, error) {
+	distances := make([]float32, len(refs))
+	for i, ref := range refs {
+		vector, err := read(ref)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read vector for re-ranking: %w", err)
+		}
+		distances[i] = h.distance(query, vector)
+	}
+
+	sort.Stable(byRefDistance{refs, distances})
+	if len(refs) > k {
+		refs, distances = refs[:k], distances[:k]
+	}
+	return refs, distances, nil
+}
+
+// searchGraph walks the graph for the k nodes filter admits closest to query. Must
+// hold h.mu.
+func (h *HNSWIndex) searchGraph(query []float32, k int, filter Filter) []*HNSWNode {
+	currEP := h.enterPoint
+	dist := h.distance(query, h.vectorOf(currEP))
 	// Navigate down layers
 	for l := h.maxLayer; l > 0; l-- {
 		changed := true
@@ -348,7 +996,7 @@ func (h *HNSWIndex) Search(query []float32, k int) ([]storage.RecordRef, []float
 			changed = false
 			for _, nID := range currEP.Neighbors[l] {
 				neighbor := h.nodes[nID]
-				d := h.distance(query, neighbor.Vector)
+				d := h.distance(query, h.vectorOf(neighbor))
 				if d < dist {
 					dist = d
 					currEP = neighbor
@@ -360,62 +1008,184 @@ func (h *HNSWIndex) Search(query []float32, k int) ([]storage.RecordRef, []float
 
 	// Final search in Layer 0
 	eps := []*HNSWNode{currEP}
-	results := h.searchLayer(query, eps, h.efSearch, 0)
+	results := h.searchLayer(query, eps, max(h.efSearch, k), 0, filter)
 
 	// Trim results to K
 	if len(results) > k {
 		results = results[:k]
 	}
-
-	refs := make([]storage.RecordRef, len(results))
-	distances := make([]float32, len(results))
-	for i, res := range results {
-		refs[i] = res.DataRef
-		distances[i] = h.distance(query, res.Vector)
-	}
-
-	return refs, distances, nil
+	return results
 }
 
-func (h *HNSWIndex) Get(key []byte) (storage.RecordRef, bool, error) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+// scan compares query against every node filter admits and returns the k closest.
+// Must hold h.mu.
+func (h *HNSWIndex) scan(query []float32, k int, filter Filter) []*HNSWNode {
+	var results []*HNSWNode
+	var distances []float32
+	for _, node := range h.nodes {
+		if filter.admits(node) {
+			results = append(results, node)
+			distances = append(distances, h.distance(query, h.vectorOf(node)))
+		}
+	}
 
-	rawKey := key
-	if decoded, err := hex.DecodeString(string(key)); err == nil {
-		rawKey = decoded
+	sort.Sort(byDistance{results, distances})
+	if len(results) > k {
+		results = results[:k]
 	}
+	return results
+}
 
-	id, _, err := DecodeKey(rawKey)
-	if err != nil {
-		node, found := h.nodes[string(key)]
-		if found {
-			return node.DataRef, true, nil
+// selective reports whether filter admits fewer than bruteForceSelectivity of a
+// sample of the nodes. Must hold h.mu.
+func (h *HNSWIndex) selective(filter Filter) bool {
+	sampled, admitted := 0, 0
+	for _, node := range h.nodes { // Map iteration starts at a random node
+		if sampled == filterSample {
+			break
+		}
+		sampled++
+		if filter.admits(node) {
+			admitted++
 		}
-		return storage.RecordRef{}, false, err
 	}
+	return float64(admitted) < bruteForceSelectivity*float64(sampled)
+}
+
+type byDistance struct {
+	nodes     []*HNSWNode
+	distances []float32
+}
+
+func (b byDistance) Len() int           { return len(b.nodes) }
+func (b byDistance) Less(i, j int) bool { return b.distances[i] < b.distances[j] }
+func (b byDistance) Swap(i, j int) {
+	b.nodes[i], b.nodes[j] = b.nodes[j], b.nodes[i]
+	b.distances[i], b.distances[j] = b.distances[j], b.distances[i]
+}
+
+type byRefDistance struct {
+	refs      []storage.RecordRef
+	distances []float32
+}
+
+func (b byRefDistance) Len() int           { return len(b.refs) }
+func (b byRefDistance) Less(i, j int) bool { return b.distances[i] < b.distances[j] }
+func (b byRefDistance) Swap(i, j int) {
+	b.refs[i], b.refs[j] = b.refs[j], b.refs[i]
+	b.distances[i], b.distances[j] = b.distances[j], b.distances[i]
+}
 
-	node, found := h.nodes[id]
+// Get returns the RecordRef of the node with the given ID.
+func (h *HNSWIndex) Get(id []byte) (storage.RecordRef, bool, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	node, found := h.nodes[string(id)]
 	if !found {
 		return storage.RecordRef{}, false, nil
 	}
-
 	return node.DataRef, true, nil
 }
 
-func (h *HNSWIndex) Delete(key []byte) error {
-	return errors.New("HNSW direct index node deletion not supported (rebuild HNSW index for deletion)")
+// Delete removes the node with the given ID and repairs the links of the nodes
+// around it. Deleting an absent node is a no-op.
+func (h *HNSWIndex) Delete(id []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return storage.ErrDBClosed
+	}
+	return h.apply([]storage.IndexOp{{Key: id, ID: id, Delete: true}})
+}
+
+// DropRefs removes every node whose RecordRef matches dangling, logging the removals
+// like deletes, and returns the IDs of the dropped nodes.
+func (h *HNSWIndex) DropRefs(dangling func(ref storage.RecordRef) bool) ([][]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, storage.ErrDBClosed
+	}
+
+	var dropped [][]byte
+	var ops []storage.IndexOp
+	for id, node := range h.nodes {
+		if dangling(node.DataRef) {
+			dropped = append(dropped, []byte(id))
+			ops = append(ops, storage.IndexOp{Key: []byte(id), ID: []byte(id), Delete: true})
+		}
+	}
+	if len(ops) == 0 {
+		return nil, nil
+	}
+	if err := h.apply(ops); err != nil {
+		return nil, err
+	}
+	return dropped, nil
 }
 
 func (h *HNSWIndex) Scan(prefix []byte) ([]storage.RecordRef, error) {
 	return nil, errors.New("vector scan not supported, use search")
 }
 
+// NewIterator returns an iterator over node IDs in ascending order, each mapped to
+// the RecordRef of its vector record.
+func (h *HNSWIndex) NewIterator(opts storage.IterOptions) (storage.IndexIterator, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.closed {
+		return nil, storage.ErrDBClosed
+	}
+
+	entries := make([]storage.IterEntry, 0, len(h.nodes))
+	for id, node := range h.nodes {
+		entries = append(entries, storage.IterEntry{Key: []byte(id), Ref: node.DataRef})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return string(entries[i].Key) < string(entries[j].Key)
+	})
+	return storage.NewSliceIterator(entries, opts), nil
+}
+
+// Reset removes every node from the graph. Persistent indexes write an empty
+// checkpoint so the discarded nodes are not recovered on the next open.
+func (h *HNSWIndex) Reset() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return storage.ErrDBClosed
+	}
+
+	h.nodes = make(map[string]*HNSWNode)
+	h.enterPoint = nil
+	h.maxLayer = -1
+	return h.checkpoint()
+}
+
 func (h *HNSWIndex) Close() error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
 	h.closed = true
-	return nil
+
+	if h.wal == nil {
+		return nil
+	}
+	if h.logged > 0 {
+		if err := h.checkpoint(); err != nil {
+			h.wal.Close()
+			return err
+		}
+	}
+	return h.wal.Close()
 }
 
 func (h *HNSWIndex) Stats() storage.IndexStats {
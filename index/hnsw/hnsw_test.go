@@ -1,7 +1,13 @@
 package hnsw
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/raman20/storage"
@@ -80,6 +86,22 @@ func TestHNSWBasicSearch(t *testing.T) {
 	if len(refsD) != 1 || refsD[0].Offset != int64('D') {
 		t.Errorf("expected closest to be D, got %+v", refsD)
 	}
+	// 3. Iteration walks node IDs in order
+	it, err := idx.NewIterator(storage.IterOptions{LowerBound: []byte("B")})
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+	defer it.Close()
+	var ids string
+	for ok := it.Last(); ok; ok = it.Prev() {
+		ids += string(it.Key())
+		if it.Value().Offset != int64(it.Key()[0]) {
+			t.Errorf("node %s: unexpected ref %+v", it.Key(), it.Value())
+		}
+	}
+	if ids != "DCB" {
+		t.Errorf("expected reverse iteration DCB, got %s", ids)
+	}
 }
 
 func TestHNSWEuclideanSearch(t *testing.T) {
@@ -106,3 +128,372 @@ func TestHNSWEuclideanSearch(t *testing.T) {
 		t.Errorf("expected closest point to be index 10 (offset 10), got %+v", refs)
 	}
 }
+
+func TestHNSWMetrics(t *testing.T) {
+	a := []float32{3, 0, 2, 0}
+	b := []float32{0, 0, 2, 4}
+
+	// 1. Distances under each metric
+	cases := []struct {
+		metric DistanceMetric
+		want   float32
+	}{
+		{Euclidean, 5},   // sqrt(9 + 16)
+		{DotProduct, -3}, // 1 - 4
+		{Manhattan, 7},   // 3 + 4
+		{Hamming, 2},     // Components 0 and 3 differ
+	}
+	for _, c := range cases {
+		idx := NewHNSWIndex(c.metric, 4, 16, 16)
+		if got := idx.distance(a, b); got != c.want {
+			t.Errorf("%v: expected distance %v, got %v", c.metric, c.want, got)
+		}
+	}
+
+	// 2. Names round-trip, and aliases resolve to the same metric
+	for _, metric := range []DistanceMetric{Euclidean, Cosine, DotProduct, Manhattan, Hamming} {
+		parsed, err := ParseMetric(metric.String())
+		if err != nil || parsed != metric {
+			t.Errorf("expected %v to round-trip, got %v (err=%v)", metric, parsed, err)
+		}
+	}
+	if metric, err := ParseMetric("IP"); err != nil || metric != DotProduct {
+		t.Errorf("expected IP to parse as dot, got %v (err=%v)", metric, err)
+	}
+	if _, err := ParseMetric("chebyshev"); err == nil {
+		t.Errorf("expected an error for an unknown metric")
+	}
+
+	// 3. Inner product search ranks by magnitude along the query, not by angle
+	idx := NewHNSWIndex(DotProduct, 6, 32, 16)
+	for i := 1; i <= 20; i++ {
+		vec := []float32{float32(i), float32(20 - i)}
+		idx.Put(EncodeKey(fmt.Sprintf("v%d", i), vec), storage.RecordRef{FileID: 1, Offset: int64(i)})
+	}
+	refs, _, err := idx.Search([]float32{1, 0}, 3)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(refs) != 3 || refs[0].Offset != 20 || refs[1].Offset != 19 || refs[2].Offset != 18 {
+		t.Errorf("expected largest inner products 20, 19, 18, got %+v", refs)
+	}
+}
+
+func TestHNSWVectorValidation(t *testing.T) {
+	idx := NewHNSWIndex(Cosine, 4, 16, 16)
+	ref := storage.RecordRef{FileID: 1}
+
+	// 1. The first insert locks the dimension
+	if err := idx.Put(EncodeKey("a", []float32{1, 0, 0}), ref); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if idx.Dimension() != 3 {
+		t.Errorf("expected dimension 3, got %d", idx.Dimension())
+	}
+
+	// 2. Malformed vectors are rejected with typed errors, in inserts and queries alike
+	cases := []struct {
+		vector []float32
+		want   error
+	}{
+		{[]float32{1, 0}, ErrDimensionMismatch},
+		{[]float32{}, ErrInvalidVector},
+		{[]float32{1, float32(math.NaN()), 0}, ErrInvalidVector},
+		{[]float32{float32(math.Inf(1)), 0, 0}, ErrInvalidVector},
+		{[]float32{0, 0, 0}, ErrZeroVector},
+	}
+	for _, c := range cases {
+		if err := idx.Put(EncodeKey("b", c.vector), ref); !errors.Is(err, c.want) {
+			t.Errorf("Put %v: expected %v, got %v", c.vector, c.want, err)
+		}
+		if _, _, err := idx.Search(c.vector, 1); !errors.Is(err, c.want) {
+			t.Errorf("Search %v: expected %v, got %v", c.vector, c.want, err)
+		}
+	}
+
+	// 3. A batch with one bad vector applies none of them
+	err := idx.ApplyBatch([]storage.IndexOp{
+		{Key: EncodeKey("c", []float32{0, 1, 0}), Ref: ref},
+		{Key: EncodeKey("d", []float32{0, 1}), Ref: ref},
+	})
+	if !errors.Is(err, ErrDimensionMismatch) {
+		t.Errorf("expected the batch to fail with ErrDimensionMismatch, got %v", err)
+	}
+	if got := idx.Stats().MemtableSize; got != 1 {
+		t.Errorf("expected 1 node after rejected writes, got %d", got)
+	}
+
+	// 4. A configured dimension is enforced before the first insert, and cannot change
+	fresh := NewHNSWIndex(Euclidean, 4, 16, 16)
+	if err := fresh.LockDimension(2); err != nil {
+		t.Fatalf("LockDimension failed: %v", err)
+	}
+	if err := fresh.Put(EncodeKey("a", []float32{1, 2, 3}), ref); !errors.Is(err, ErrDimensionMismatch) {
+		t.Errorf("expected ErrDimensionMismatch before the first insert, got %v", err)
+	}
+	if err := fresh.Put(EncodeKey("zero", []float32{0, 0}), ref); err != nil {
+		t.Errorf("expected a zero vector under Euclidean distance to be accepted, got %v", err)
+	}
+	if err := idx.LockDimension(4); !errors.Is(err, ErrDimensionMismatch) {
+		t.Errorf("expected relocking to another dimension to fail, got %v", err)
+	}
+}
+
+func TestHNSWHexLookingIDs(t *testing.T) {
+	idx := NewHNSWIndex(Euclidean, 6, 32, 16)
+	idx.Put(EncodeKey("a", []float32{1, 0}), storage.RecordRef{FileID: 1})
+
+	// "0000000161" hex-decodes to a valid composite key of the ID "a", but names a
+	// node of its own
+	hexID := []byte("0000000161")
+	if _, found, _ := idx.Get(hexID); found {
+		t.Errorf("expected %s to be absent", hexID)
+	}
+	if err := idx.Delete(hexID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, found, _ := idx.Get([]byte("a")); !found {
+		t.Fatalf("expected deleting an absent hex-looking ID to leave a indexed")
+	}
+
+	idx.Put(EncodeKey(string(hexID), []float32{2, 0}), storage.RecordRef{FileID: 2})
+	if ref, found, _ := idx.Get(hexID); !found || ref.FileID != 2 {
+		t.Errorf("expected %s at file 2, got %+v (found=%v)", hexID, ref, found)
+	}
+	if err := idx.Delete(hexID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, found, _ := idx.Get(hexID); found {
+		t.Errorf("expected %s to be deleted", hexID)
+	}
+	if ref, found, _ := idx.Get([]byte("a")); !found || ref.FileID != 1 {
+		t.Errorf("expected a to be untouched, got %+v (found=%v)", ref, found)
+	}
+}
+
+func TestHNSWDeleteAndUpsert(t *testing.T) {
+	idx := NewHNSWIndex(Euclidean, 6, 32, 16)
+	for i := 0; i < 20; i++ {
+		key := EncodeKey(fmt.Sprintf("point_%d", i), []float32{float32(i), 0})
+		idx.Put(key, storage.RecordRef{FileID: 1, Offset: int64(i)})
+	}
+
+	// 1. Deleting by ID, or by a composite key carrying its ID, removes the node;
+	// absent nodes are ignored
+	if err := idx.Delete([]byte("point_5")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	op := storage.IndexOp{Key: EncodeKey("point_6", []float32{6, 0}), ID: []byte("point_6"), Delete: true}
+	if err := idx.ApplyBatch([]storage.IndexOp{op}); err != nil {
+		t.Fatalf("Delete by composite key failed: %v", err)
+	}
+	if err := idx.Delete([]byte("missing")); err != nil {
+		t.Errorf("expected deleting an absent node to succeed, got %v", err)
+	}
+	for _, id := range []string{"point_5", "point_6"} {
+		if _, found, _ := idx.Get([]byte(id)); found {
+			t.Errorf("expected %s to be deleted", id)
+		}
+	}
+	refs, _, _ := idx.Search([]float32{5.4, 0}, 2)
+	if len(refs) != 2 || refs[0].Offset != 4 || refs[1].Offset != 7 {
+		t.Errorf("expected nearest survivors 4 and 7, got %+v", refs)
+	}
+
+	// 2. Putting an indexed ID with a new vector moves it
+	if err := idx.Put(EncodeKey("point_0", []float32{100, 0}), storage.RecordRef{FileID: 2}); err != nil {
+		t.Fatalf("upsert failed: %v", err)
+	}
+	refs, distances, _ := idx.Search([]float32{100, 0}, 1)
+	if len(refs) != 1 || refs[0].FileID != 2 || distances[0] != 0 {
+		t.Errorf("expected the moved node at its new vector, got %+v at %v", refs, distances)
+	}
+	if got := idx.Stats().MemtableSize; got != 18 {
+		t.Errorf("expected 18 nodes, got %d", got)
+	}
+
+	// 3. Deleting every node leaves an empty, usable graph
+	for i := 0; i < 20; i++ {
+		idx.Delete([]byte(fmt.Sprintf("point_%d", i)))
+	}
+	if refs, _, _ := idx.Search([]float32{1, 0}, 1); len(refs) != 0 {
+		t.Errorf("expected an empty graph, got %+v", refs)
+	}
+	idx.Put(EncodeKey("fresh", []float32{1, 0}), storage.RecordRef{FileID: 3})
+	if refs, _, _ := idx.Search([]float32{1, 0}, 1); len(refs) != 1 || refs[0].FileID != 3 {
+		t.Errorf("expected the graph to accept inserts after emptying, got %+v", refs)
+	}
+}
+
+func TestHNSWRecallAfterChurn(t *testing.T) {
+	const dims, n, k = 8, 1000, 10
+	rng := rand.New(rand.NewSource(1))
+	randomVector := func() []float32 {
+		v := make([]float32, dims)
+		for i := range v {
+			v[i] = rng.Float32()
+		}
+		return v
+	}
+
+	idx := NewHNSWIndex(Euclidean, 6, 32, 16)
+	live := make(map[int64][]float32)
+	put := func(idx *HNSWIndex, i int64, vec []float32) {
+		if err := idx.Put(EncodeKey(fmt.Sprintf("v%d", i), vec), storage.RecordRef{Offset: i}); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	for i := int64(0); i < n; i++ {
+		live[i] = randomVector()
+		put(idx, i, live[i])
+	}
+
+	// 1. Delete three quarters of the nodes, move some to new vectors and add new ones
+	for i := int64(0); i < n; i++ {
+		switch {
+		case i%4 != 0:
+			if err := idx.Delete([]byte(fmt.Sprintf("v%d", i))); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			delete(live, i)
+		case i%8 == 0:
+			live[i] = randomVector()
+			put(idx, i, live[i])
+		}
+	}
+	for i := int64(n); i < n+n/4; i++ {
+		live[i] = randomVector()
+		put(idx, i, live[i])
+	}
+
+	// 2. Build a graph of the surviving vectors from scratch for comparison
+	ids := make([]int64, 0, len(live))
+	for id := range live {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	fresh := NewHNSWIndex(Euclidean, 6, 32, 16)
+	for _, id := range ids {
+		put(fresh, id, live[id])
+	}
+
+	// 3. Churn must not cost recall compared to the fresh graph
+	var churnHits, freshHits, total int
+	for q := 0; q < 200; q++ {
+		query := randomVector()
+		sort.Slice(ids, func(a, b int) bool {
+			return idx.distance(query, live[ids[a]]) < idx.distance(query, live[ids[b]])
+		})
+		want := make(map[int64]bool)
+		for _, id := range ids[:k] {
+			want[id] = true
+		}
+
+		for _, g := range []*HNSWIndex{idx, fresh} {
+			refs, _, err := g.Search(query, k)
+			if err != nil {
+				t.Fatalf("Search failed: %v", err)
+			}
+			for _, ref := range refs {
+				if _, ok := live[ref.Offset]; !ok {
+					t.Fatalf("search returned deleted node v%d", ref.Offset)
+				}
+				if !want[ref.Offset] {
+					continue
+				}
+				if g == idx {
+					churnHits++
+				} else {
+					freshHits++
+				}
+			}
+		}
+		total += k
+	}
+
+	churnRecall := float64(churnHits) / float64(total)
+	freshRecall := float64(freshHits) / float64(total)
+	if churnRecall < 0.9 || churnRecall < freshRecall-0.05 {
+		t.Errorf("expected recall@%d after churn close to a fresh graph's %.3f, got %.3f", k, freshRecall, churnRecall)
+	}
+
+	// 4. Removed nodes' links are repaired, so nearly every surviving node is still
+	// reachable from the entry point. Pruning to the closest neighbors strands a few
+	// nodes even in a fresh graph.
+	reached := map[string]bool{idx.enterPoint.ID: true}
+	queue := []*HNSWNode{idx.enterPoint}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, level := range node.Neighbors {
+			for _, nID := range level {
+				if !reached[nID] {
+					reached[nID] = true
+					queue = append(queue, idx.nodes[nID])
+				}
+			}
+		}
+	}
+	if unreachable := len(live) - len(reached); unreachable > len(live)/100 {
+		t.Errorf("expected at most %d of %d nodes to be unreachable after churn, got %d", len(live)/100, len(live), unreachable)
+	}
+
+	// 5. The reverse links deletes follow match the links of the surviving nodes
+	linkedFrom := make(map[string]map[string]int)
+	for id, node := range idx.nodes {
+		linkedFrom[id] = node.linkedFrom
+	}
+	linkNodes(idx.nodes)
+	for id, node := range idx.nodes {
+		if !reflect.DeepEqual(linkedFrom[id], node.linkedFrom) {
+			t.Fatalf("node %s: reverse links %v do not match links %v", id, linkedFrom[id], node.linkedFrom)
+		}
+	}
+}
+
+func TestHNSWFilteredSearch(t *testing.T) {
+	idx := NewHNSWIndex(Euclidean, 8, 64, 16)
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("even_%d", i)
+		if i%2 == 1 {
+			id = fmt.Sprintf("odd_%d", i)
+		}
+		idx.Put(EncodeKey(id, []float32{float32(i), 0}), storage.RecordRef{FileID: 1, Offset: int64(i)})
+	}
+	query := []float32{500.2, 0}
+
+	// 1. A filter rejecting the nearest nodes still yields k admitted ones, closest first
+	odd := func(id string, _ storage.RecordRef) bool { return strings.HasPrefix(id, "odd_") }
+	if idx.selective(odd) {
+		t.Errorf("expected a filter admitting half the nodes to walk the graph")
+	}
+	refs, distances, err := idx.SearchFiltered(query, 4, odd)
+	if err != nil {
+		t.Fatalf("SearchFiltered failed: %v", err)
+	}
+	want := []int64{501, 499, 503, 497}
+	if len(refs) != len(want) {
+		t.Fatalf("expected %d results, got %+v", len(want), refs)
+	}
+	for i, ref := range refs {
+		if ref.Offset != want[i] {
+			t.Errorf("results[%d]: expected offset %d, got %d (distance=%f)", i, want[i], ref.Offset, distances[i])
+		}
+	}
+
+	// 2. An allow-list of a few nodes is answered by scanning every node
+	allowed := AllowRefs([]storage.RecordRef{{FileID: 1, Offset: 10}, {FileID: 1, Offset: 990}, {FileID: 1, Offset: 400}})
+	if !idx.selective(allowed) {
+		t.Errorf("expected an allow-list of 3 nodes to be scanned")
+	}
+	refs, _, _ = idx.SearchFiltered(query, 5, allowed)
+	if len(refs) != 3 || refs[0].Offset != 400 || refs[1].Offset != 990 || refs[2].Offset != 10 {
+		t.Errorf("expected the allowed nodes 400, 990, 10, got %+v", refs)
+	}
+
+	// 3. A filter admitting nothing returns nothing
+	none := func(string, storage.RecordRef) bool { return false }
+	if refs, _, _ := idx.SearchFiltered(query, 5, none); len(refs) != 0 {
+		t.Errorf("expected no results, got %+v", refs)
+	}
+}
@@ -0,0 +1,432 @@
+package hnsw
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/raman20/storage"
+)
+
+const (
+	graphMagic   uint32 = 0x484E5357 // "HNSW" in hex
+	graphVersion byte   = 3
+	graphFile           = "graph.hnsw"
+
+	// checkpointEvery bounds how many logged operations are replayed on open
+	// before the graph is rewritten as a fresh snapshot.
+	checkpointEvery = 4096
+)
+
+var ErrCorruptGraph = errors.New("corrupt HNSW graph file")
+
+// OpenHNSWIndex opens a durable HNSW index stored in dir, creating it if needed.
+// The graph is persisted as a checkpoint file plus a WAL of inserts and deletes made
+// since the checkpoint, which is synced according to policy like the other index
+// WALs. When a checkpoint exists its metric and M/ef parameters take precedence over
+// the ones passed in.
+func OpenHNSWIndex(dir string, metric DistanceMetric, m, efConstruction, efSearch int, policy storage.SyncPolicy) (*HNSWIndex, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create HNSW directory: %w", err)
+	}
+
+	h := NewHNSWIndex(metric, m, efConstruction, efSearch)
+	h.dir = dir
+	h.policy = policy
+
+	// 1. Load the last checkpoint, if any
+	if err := h.loadGraph(filepath.Join(dir, graphFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// 2. Drop logs left behind by older checkpoints
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HNSW directory: %w", err)
+	}
+	for _, entry := range entries {
+		var gen uint64
+		if _, err := fmt.Sscanf(entry.Name(), "%08d.log", &gen); err == nil && gen != h.generation {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	// 3. Replay inserts and deletes logged after the checkpoint
+	wal, err := storage.InitWalWithPolicy(h.logPath(h.generation), h.policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open HNSW WAL: %w", err)
+	}
+	ops, err := wal.Read()
+	if err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("failed to recover HNSW WAL: %w", err)
+	}
+	for _, op := range ops {
+		if op.Delete {
+			h.remove(op.Key)
+			continue
+		}
+		if err := h.insert([]byte(op.Key), decodeRef([]byte(op.Value))); err != nil {
+			wal.Close()
+			return nil, fmt.Errorf("failed to replay HNSW WAL: %w", err)
+		}
+	}
+	h.wal = wal
+	h.logged = len(ops)
+
+	return h, nil
+}
+
+func (h *HNSWIndex) logPath(gen uint64) string {
+	return filepath.Join(h.dir, fmt.Sprintf("%08d.log", gen))
+}
+
+// logOps appends ops to the WAL as one transaction, so a batch is replayed all or
+// nothing. Inserts are logged under their composite key and deletes under the node
+// ID they remove.
+func (h *HNSWIndex) logOps(rawKeys [][]byte, ops []storage.IndexOp) error {
+	if err := h.wal.WriteTxStart(0); err != nil {
+		return fmt.Errorf("failed to write WAL start: %w", err)
+	}
+	for i, op := range ops {
+		if op.Delete {
+			if err := h.wal.WriteTxDelete(0, string(rawKeys[i])); err != nil {
+				return fmt.Errorf("failed to write WAL delete: %w", err)
+			}
+			continue
+		}
+		if err := h.wal.WriteTxSet(0, string(rawKeys[i]), string(encodeRef(op.Ref))); err != nil {
+			return fmt.Errorf("failed to write WAL set: %w", err)
+		}
+	}
+	if err := h.wal.WriteTxCommit(0); err != nil {
+		return fmt.Errorf("failed to write WAL commit: %w", err)
+	}
+	h.logged += len(ops)
+	return nil
+}
+
+// Sync forces the inserts and deletes logged so far to disk, regardless of the sync
+// policy. It is a no-op for in-memory indexes created with NewHNSWIndex.
+func (h *HNSWIndex) Sync() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return storage.ErrDBClosed
+	}
+	if h.wal == nil {
+		return nil
+	}
+	return h.wal.Sync()
+}
+
+// Checkpoint writes the full graph to disk and starts a fresh WAL.
+// It is a no-op for in-memory indexes created with NewHNSWIndex.
+func (h *HNSWIndex) Checkpoint() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return storage.ErrDBClosed
+	}
+	return h.checkpoint()
+}
+
+func (h *HNSWIndex) checkpoint() error {
+	if h.wal == nil {
+		return nil
+	}
+
+	nextGen := h.generation + 1
+	if err := h.writeGraph(filepath.Join(h.dir, graphFile), nextGen); err != nil {
+		return err
+	}
+
+	// The new checkpoint is in place; operations logged so far are now redundant.
+	oldPath := h.logPath(h.generation)
+	if err := h.wal.Close(); err != nil {
+		return fmt.Errorf("failed to close HNSW WAL: %w", err)
+	}
+	wal, err := storage.InitWalWithPolicy(h.logPath(nextGen), h.policy)
+	if err != nil {
+		return fmt.Errorf("failed to open HNSW WAL: %w", err)
+	}
+	h.wal = wal
+	h.generation = nextGen
+	h.logged = 0
+
+	if err := os.Remove(oldPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove old HNSW WAL: %w", err)
+	}
+	return nil
+}
+
+// writeGraph serializes the graph to a temporary file and atomically renames it into place.
+// Format:
+//
+//	[4B magic][1B version][8B generation][1B metric][4B M][4B efConstruction][4B efSearch]
+//	[4B dim][1B quantizer][4B subspaces][4B centroids][4B trainSize]
+//	[4B codebook length][codebook length*4B codebook, empty until trained]
+//	[4B maxLayer][4B enterPoint ID length][enterPoint ID][4B node count]
+//	per node: [4B ID length][ID][4B dims][dims*4B vector, or dims bytes of code once trained]
+//	          [16B RecordRef][4B levels]
+//	          per level: [4B neighbor count] per neighbor: [4B ID length][ID]
+//	[4B CRC32 of everything above]
+func (h *HNSWIndex) writeGraph(path string, gen uint64) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create HNSW graph file: %w", err)
+	}
+	defer file.Close()
+	defer os.Remove(tmpPath)
+
+	crc := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(file, crc))
+
+	var buf [8]byte
+	putU32 := func(v uint32) {
+		binary.BigEndian.PutUint32(buf[:4], v)
+		w.Write(buf[:4])
+	}
+	putString := func(s string) {
+		putU32(uint32(len(s)))
+		w.WriteString(s)
+	}
+
+	putU32(graphMagic)
+	w.WriteByte(graphVersion)
+	binary.BigEndian.PutUint64(buf[:], gen)
+	w.Write(buf[:])
+	w.WriteByte(byte(h.metric))
+	putU32(uint32(h.m))
+	putU32(uint32(h.efConstruction))
+	putU32(uint32(h.efSearch))
+	putU32(uint32(h.dim))
+	w.WriteByte(byte(h.quant.Kind))
+	putU32(uint32(h.quant.Subspaces))
+	putU32(uint32(h.quant.Centroids))
+	putU32(uint32(h.quant.TrainSize))
+	var codebook []float32
+	if h.quantizer != nil {
+		codebook = h.quantizer.codebook()
+	}
+	putU32(uint32(len(codebook)))
+	for _, v := range codebook {
+		putU32(math.Float32bits(v))
+	}
+	putU32(uint32(int32(h.maxLayer)))
+	if h.enterPoint != nil {
+		putString(h.enterPoint.ID)
+	} else {
+		putString("")
+	}
+
+	putU32(uint32(len(h.nodes)))
+	for _, node := range h.nodes {
+		putString(node.ID)
+		if h.quantizer != nil {
+			putU32(uint32(len(node.Code)))
+			w.Write(node.Code)
+		} else {
+			putU32(uint32(len(node.Vector)))
+			for _, v := range node.Vector {
+				putU32(math.Float32bits(v))
+			}
+		}
+		w.Write(encodeRef(node.DataRef))
+		putU32(uint32(len(node.Neighbors)))
+		for _, level := range node.Neighbors {
+			putU32(uint32(len(level)))
+			for _, nID := range level {
+				putString(nID)
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write HNSW graph: %w", err)
+	}
+	binary.BigEndian.PutUint32(buf[:4], crc.Sum32())
+	if _, err := file.Write(buf[:4]); err != nil {
+		return fmt.Errorf("failed to write HNSW graph checksum: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync HNSW graph: %w", err)
+	}
+	file.Close()
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to install HNSW graph: %w", err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// loadGraph replaces the in-memory graph with the checkpoint stored at path.
+func (h *HNSWIndex) loadGraph(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) < 4 {
+		return ErrCorruptGraph
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorruptGraph)
+	}
+
+	r := &graphReader{buf: body}
+	if r.u32() != graphMagic {
+		return fmt.Errorf("%w: bad magic number", ErrCorruptGraph)
+	}
+	version := r.byte()
+	if version < 1 || version > graphVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrCorruptGraph, version)
+	}
+	gen := r.u64()
+	metric := DistanceMetric(r.byte())
+	if metric > Hamming {
+		return fmt.Errorf("%w: unknown metric %d", ErrCorruptGraph, metric)
+	}
+	m := int(r.u32())
+	efConstruction := int(r.u32())
+	efSearch := int(r.u32())
+	dim := 0 // Version 1 graphs lock the dimension of their nodes
+	if version > 1 {
+		dim = int(r.u32())
+	}
+	var quant Quantization
+	var codebook []float32
+	if version > 2 {
+		quant.Kind = QuantizerKind(r.byte())
+		quant.Subspaces = int(r.u32())
+		quant.Centroids = int(r.u32())
+		quant.TrainSize = int(r.u32())
+		codebook = make([]float32, r.u32())
+		for i := range codebook {
+			codebook[i] = math.Float32frombits(r.u32())
+		}
+	}
+	if err := quant.validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptGraph, err)
+	}
+	var q quantizer
+	if len(codebook) > 0 && r.err == nil {
+		if q, err = loadQuantizer(quant, dim, codebook); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorruptGraph, err)
+		}
+	}
+	maxLayer := int(int32(r.u32()))
+	enterID := r.string()
+
+	count := int(r.u32())
+	nodes := make(map[string]*HNSWNode, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		node := &HNSWNode{ID: r.string()}
+		if q != nil {
+			node.Code = append([]byte(nil), r.bytes(int(r.u32()))...)
+			if want := quant.codeLen(dim); len(node.Code) != want && r.err == nil {
+				return fmt.Errorf("%w: node %q has a %d-byte code, expected %d", ErrCorruptGraph, node.ID, len(node.Code), want)
+			}
+		} else {
+			node.Vector = make([]float32, r.u32())
+			for j := range node.Vector {
+				node.Vector[j] = math.Float32frombits(r.u32())
+			}
+			if dim == 0 {
+				dim = len(node.Vector)
+			}
+			if len(node.Vector) != dim && r.err == nil {
+				return fmt.Errorf("%w: node %q has %d dimensions, graph has %d", ErrCorruptGraph, node.ID, len(node.Vector), dim)
+			}
+		}
+		node.DataRef = decodeRef(r.bytes(16))
+		node.Neighbors = make([][]string, r.u32())
+		for l := range node.Neighbors {
+			node.Neighbors[l] = make([]string, r.u32())
+			for k := range node.Neighbors[l] {
+				node.Neighbors[l][k] = r.string()
+			}
+		}
+		nodes[node.ID] = node
+	}
+	if r.err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptGraph, r.err)
+	}
+
+	linkNodes(nodes)
+
+	fresh := NewHNSWIndex(metric, m, efConstruction, efSearch)
+	h.metric = fresh.metric
+	h.m = fresh.m
+	h.m0 = fresh.m0
+	h.efConstruction = fresh.efConstruction
+	h.efSearch = fresh.efSearch
+	h.levelMult = fresh.levelMult
+	h.dim = dim
+	h.quant = quant
+	h.quantizer = q
+	h.nodes = nodes
+	h.maxLayer = maxLayer
+	h.enterPoint = nodes[enterID]
+	h.generation = gen
+	return nil
+}
+
+type graphReader struct {
+	buf []byte
+	err error
+}
+
+func (r *graphReader) bytes(n int) []byte {
+	if r.err == nil && (n < 0 || n > len(r.buf)) {
+		r.err = io.ErrUnexpectedEOF
+	}
+	if r.err != nil {
+		return make([]byte, 16) // Zeroed scratch large enough for any fixed-size field
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *graphReader) byte() byte     { return r.bytes(1)[0] }
+func (r *graphReader) u32() uint32    { return binary.BigEndian.Uint32(r.bytes(4)) }
+func (r *graphReader) u64() uint64    { return binary.BigEndian.Uint64(r.bytes(8)) }
+func (r *graphReader) string() string { return string(r.bytes(int(r.u32()))) }
+
+func encodeRef(ref storage.RecordRef) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint32(buf[0:4], ref.FileID)
+	binary.BigEndian.PutUint64(buf[4:12], uint64(ref.Offset))
+	binary.BigEndian.PutUint32(buf[12:16], ref.Length)
+	return buf
+}
+
+func decodeRef(buf []byte) storage.RecordRef {
+	if len(buf) < 16 {
+		return storage.RecordRef{}
+	}
+	return storage.RecordRef{
+		FileID: binary.BigEndian.Uint32(buf[0:4]),
+		Offset: int64(binary.BigEndian.Uint64(buf[4:12])),
+		Length: binary.BigEndian.Uint32(buf[12:16]),
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,253 @@
+package hnsw
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/raman20/storage"
+)
+
+func TestHNSWPersistence(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "hnsw_persist_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	idx, err := OpenHNSWIndex(tmpDir, Euclidean, 4, 32, 16, storage.SyncPolicy{Mode: storage.SyncAlways})
+	if err != nil {
+		t.Fatalf("failed to open HNSW index: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		key := EncodeKey(fmt.Sprintf("point_%d", i), []float32{float32(i), float32(i * 2)})
+		ref := storage.RecordRef{FileID: 1, Offset: int64(i), Length: 8}
+		if err := idx.Put(key, ref); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	// 1. Clean close writes a checkpoint and restores the exact graph
+	if err := idx.Close(); err != nil {
+		t.Fatalf("failed to close index: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, graphFile)); err != nil {
+		t.Fatalf("expected checkpoint file after close: %v", err)
+	}
+
+	idx2, err := OpenHNSWIndex(tmpDir, Cosine, 16, 64, 32, storage.SyncPolicy{Mode: storage.SyncAlways})
+	if err != nil {
+		t.Fatalf("failed to reopen HNSW index: %v", err)
+	}
+	if idx2.metric != Euclidean || idx2.m != 4 {
+		t.Errorf("expected persisted parameters (Euclidean, M=4), got (%v, M=%d)", idx2.metric, idx2.m)
+	}
+	if idx2.Dimension() != 2 {
+		t.Errorf("expected the persisted dimension 2, got %d", idx2.Dimension())
+	}
+	if got := idx2.Stats().MemtableSize; got != 50 {
+		t.Errorf("expected 50 nodes after reopen, got %d", got)
+	}
+
+	refs, _, err := idx2.Search([]float32{10.1, 20.2}, 1)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(refs) != 1 || refs[0].Offset != 10 {
+		t.Errorf("expected closest point to be offset 10 after reopen, got %+v", refs)
+	}
+
+	// 2. Inserts after the checkpoint survive a crash through the WAL
+	key := EncodeKey("late", []float32{100, 200})
+	if err := idx2.Put(key, storage.RecordRef{FileID: 2, Offset: 7, Length: 8}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	idx2.wal.Close() // Simulate a crash: no checkpoint on the way out
+
+	idx3, err := OpenHNSWIndex(tmpDir, Euclidean, 4, 32, 16, storage.SyncPolicy{Mode: storage.SyncAlways})
+	if err != nil {
+		t.Fatalf("failed to recover HNSW index: %v", err)
+	}
+	defer idx3.Close()
+
+	if got := idx3.Stats().MemtableSize; got != 51 {
+		t.Errorf("expected 51 nodes after recovery, got %d", got)
+	}
+	ref, found, err := idx3.Get([]byte("late"))
+	if err != nil || !found || ref.FileID != 2 || ref.Offset != 7 {
+		t.Errorf("expected recovered node with ref {2 7 8}, got %+v (found=%v, err=%v)", ref, found, err)
+	}
+}
+
+func TestHNSWCorruptCheckpoint(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "hnsw_corrupt_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	idx, err := OpenHNSWIndex(tmpDir, Cosine, 8, 32, 16, storage.SyncPolicy{Mode: storage.SyncAlways})
+	if err != nil {
+		t.Fatalf("failed to open HNSW index: %v", err)
+	}
+	idx.Put(EncodeKey("A", []float32{1, 0}), storage.RecordRef{FileID: 1})
+	idx.Close()
+
+	path := filepath.Join(tmpDir, graphFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read checkpoint: %v", err)
+	}
+	data[len(data)/2] ^= 0xFF
+	os.WriteFile(path, data, 0644)
+
+	if _, err := OpenHNSWIndex(tmpDir, Cosine, 8, 32, 16, storage.SyncPolicy{Mode: storage.SyncAlways}); err == nil {
+		t.Errorf("expected error opening corrupted checkpoint")
+	}
+}
+
+func TestHNSWDeleteRecovery(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "hnsw_delete_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	idx, err := OpenHNSWIndex(tmpDir, Euclidean, 4, 32, 16, storage.SyncPolicy{Mode: storage.SyncAlways})
+	if err != nil {
+		t.Fatalf("failed to open HNSW index: %v", err)
+	}
+	for i, id := range []string{"a", "b", "c"} {
+		idx.Put(EncodeKey(id, []float32{float32(i), 0}), storage.RecordRef{FileID: 1, Offset: int64(i)})
+	}
+	idx.Checkpoint()
+
+	// Deletes of absent IDs are not logged
+	if err := idx.Delete([]byte("missing")); err != nil || idx.logged != 0 {
+		t.Errorf("expected deleting an absent node to log nothing, got %d ops (err=%v)", idx.logged, err)
+	}
+
+	// Deletes and upserts after the checkpoint are replayed from the WAL
+	if err := idx.Delete([]byte("b")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := idx.Put(EncodeKey("c", []float32{10, 0}), storage.RecordRef{FileID: 2, Offset: 2}); err != nil {
+		t.Fatalf("upsert failed: %v", err)
+	}
+	idx.wal.Close() // Simulate a crash: no checkpoint on the way out
+
+	for _, stage := range []string{"recovery", "checkpoint"} {
+		idx, err = OpenHNSWIndex(tmpDir, Euclidean, 4, 32, 16, storage.SyncPolicy{Mode: storage.SyncAlways})
+		if err != nil {
+			t.Fatalf("failed to reopen HNSW index after %s: %v", stage, err)
+		}
+		if _, found, _ := idx.Get([]byte("b")); found {
+			t.Errorf("after %s: expected b to stay deleted", stage)
+		}
+		if err := idx.Put(EncodeKey("d", []float32{1}), storage.RecordRef{}); !errors.Is(err, ErrDimensionMismatch) {
+			t.Errorf("after %s: expected the dimension to stay locked, got %v", stage, err)
+		}
+		refs, distances, _ := idx.Search([]float32{10, 0}, 3)
+		if len(refs) != 2 || refs[0].FileID != 2 || distances[0] != 0 {
+			t.Errorf("after %s: expected c at its new vector and a, got %+v at %v", stage, refs, distances)
+		}
+		idx.Close()
+	}
+}
+
+func TestHNSWQuantizedRecovery(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "hnsw_quantized_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	idx, err := OpenHNSWIndex(tmpDir, Euclidean, 4, 32, 16, storage.SyncPolicy{Mode: storage.SyncAlways})
+	if err != nil {
+		t.Fatalf("failed to open HNSW index: %v", err)
+	}
+	if err := idx.SetQuantization(Quantization{Kind: ProductQuantization, Subspaces: 2, Centroids: 16, TrainSize: 40}, nil); err != nil {
+		t.Fatalf("SetQuantization failed: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		key := EncodeKey(fmt.Sprintf("point_%d", i), []float32{float32(i), float32(i * 2)})
+		if err := idx.Put(key, storage.RecordRef{FileID: 1, Offset: int64(i)}); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	codes := make(map[string][]byte)
+	for id, node := range idx.nodes {
+		codes[id] = node.Code
+	}
+	idx.wal.Close() // Simulate a crash: inserts after training are only in the WAL
+
+	// 1. The codebook was checkpointed when it was trained, and logged inserts are
+	// encoded with it on recovery
+	for _, stage := range []string{"recovery", "checkpoint"} {
+		idx, err = OpenHNSWIndex(tmpDir, Euclidean, 4, 32, 16, storage.SyncPolicy{Mode: storage.SyncAlways})
+		if err != nil {
+			t.Fatalf("failed to reopen HNSW index after %s: %v", stage, err)
+		}
+		if !idx.Quantized() || len(idx.nodes) != 50 {
+			t.Fatalf("after %s: expected 50 quantized nodes, got %d (quantized=%v)", stage, len(idx.nodes), idx.Quantized())
+		}
+		for id, node := range idx.nodes {
+			if node.Vector != nil || string(node.Code) != string(codes[id]) {
+				t.Errorf("after %s: node %s has code %v, expected %v", stage, id, node.Code, codes[id])
+			}
+		}
+		refs, _, err := idx.Search([]float32{10.1, 20.2}, 3)
+		if err != nil || len(refs) != 3 {
+			t.Errorf("after %s: expected 3 results, got %+v (err=%v)", stage, refs, err)
+		}
+
+		// 2. Only re-ranking may change once the codebook is trained
+		if err := idx.SetQuantization(Quantization{Kind: ScalarQuantization}, nil); err == nil {
+			t.Errorf("after %s: expected switching quantizers to fail", stage)
+		}
+		if err := idx.SetQuantization(Quantization{Kind: ProductQuantization, Rerank: 10}, nil); err != nil {
+			t.Errorf("after %s: expected re-ranking to be configurable, got %v", stage, err)
+		}
+		idx.Close()
+	}
+}
+
+func TestHNSWSyncPolicy(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "hnsw_sync_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	policy := storage.SyncPolicy{Mode: storage.SyncGroup, Interval: time.Hour}
+	idx, err := OpenHNSWIndex(tmpDir, Euclidean, 4, 32, 16, policy)
+	if err != nil {
+		t.Fatalf("failed to open HNSW index: %v", err)
+	}
+
+	// The index is synced with the others on a forced sync
+	var syncer storage.Syncer = idx
+	if err := idx.Put(EncodeKey("a", []float32{1, 2}), storage.RecordRef{FileID: 1}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := syncer.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	idx.wal.File.Close() // Simulate a crash: no checkpoint on the way out
+
+	idx, err = OpenHNSWIndex(tmpDir, Euclidean, 4, 32, 16, policy)
+	if err != nil {
+		t.Fatalf("failed to reopen HNSW index: %v", err)
+	}
+	if _, found, _ := idx.Get([]byte("a")); !found {
+		t.Errorf("expected the synced insert to be recovered")
+	}
+	idx.Close()
+	if err := idx.Sync(); !errors.Is(err, storage.ErrDBClosed) {
+		t.Errorf("expected Sync after Close to fail with ErrDBClosed, got %v", err)
+	}
+}
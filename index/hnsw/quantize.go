@@ -0,0 +1,329 @@
+package hnsw
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+
+	"github.com/raman20/storage"
+)
+
+// QuantizerKind selects how an index compresses the vectors it keeps in memory.
+type QuantizerKind int
+
+const (
+	NoQuantization      QuantizerKind = iota
+	ScalarQuantization                // SQ8: each component as one byte between its trained bounds
+	ProductQuantization               // PQ: each subvector as the one-byte index of its nearest trained centroid
+)
+
+var quantizerNames = map[string]QuantizerKind{
+	"none": NoQuantization,
+	"sq8":  ScalarQuantization,
+	"pq":   ProductQuantization,
+}
+
+// ParseQuantizer returns the quantizer with the given name: none, sq8 or pq.
+func ParseQuantizer(name string) (QuantizerKind, error) {
+	kind, ok := quantizerNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown quantizer %q", name)
+	}
+	return kind, nil
+}
+
+func (k QuantizerKind) String() string {
+	switch k {
+	case NoQuantization:
+		return "none"
+	case ScalarQuantization:
+		return "sq8"
+	case ProductQuantization:
+		return "pq"
+	default:
+		return fmt.Sprintf("QuantizerKind(%d)", int(k))
+	}
+}
+
+const (
+	defaultTrainSize = 4096 // Vectors indexed before the quantizer is trained
+	maxCentroids     = 256  // PQ codes hold one byte per subspace
+	kmeansIterations = 10
+)
+
+// Quantization configures vector quantization. Until TrainSize vectors are indexed the
+// graph keeps full-precision vectors; then the quantizer is trained on them and every
+// node keeps a code in their place, against which graph traversal compares queries.
+// Re-ranking reads the full-precision vectors of the closest candidates back from
+// their records and orders those by exact distance.
+type Quantization struct {
+	Kind      QuantizerKind
+	Subspaces int // PQ subvectors per vector, dividing the dimension; zero selects one per 4 components
+	Centroids int // PQ centroids per subspace, at most 256; zero selects 256
+	TrainSize int // Vectors indexed before training; zero selects 4096
+	Rerank    int // Candidates re-ranked by exact distance; zero disables re-ranking
+}
+
+// withDefaults returns q with its zero parameters replaced by their defaults for
+// vectors of dim components.
+func (q Quantization) withDefaults(dim int) Quantization {
+	if q.Subspaces == 0 && dim > 0 {
+		q.Subspaces = 1
+		for s := dim / 4; s > 1; s-- {
+			if dim%s == 0 {
+				q.Subspaces = s
+				break
+			}
+		}
+	}
+	if q.Centroids == 0 {
+		q.Centroids = maxCentroids
+	}
+	if q.TrainSize == 0 {
+		q.TrainSize = defaultTrainSize
+	}
+	return q
+}
+
+func (q Quantization) validate() error {
+	if q.Kind < NoQuantization || q.Kind > ProductQuantization {
+		return fmt.Errorf("unknown quantizer %d", q.Kind)
+	}
+	if q.Subspaces < 0 || q.Centroids < 0 || q.Centroids > maxCentroids || q.TrainSize < 0 || q.Rerank < 0 {
+		return fmt.Errorf("invalid quantization parameters %+v", q)
+	}
+	return nil
+}
+
+// codeLen returns the length of the codes of vectors of dim components.
+func (q Quantization) codeLen(dim int) int {
+	if q.Kind == ProductQuantization {
+		return q.Subspaces
+	}
+	return dim
+}
+
+// checkDimension reports whether vectors of dim components split into the PQ subspaces.
+func (q Quantization) checkDimension(dim int) error {
+	if q.Kind != ProductQuantization {
+		return nil
+	}
+	if s := q.withDefaults(dim).Subspaces; s > dim || dim%s != 0 {
+		return fmt.Errorf("%w: %d dimensions do not split into %d PQ subspaces", ErrDimensionMismatch, dim, s)
+	}
+	return nil
+}
+
+// VectorReader returns the full-precision vector whose record is at ref.
+type VectorReader func(ref storage.RecordRef) ([]float32, error)
+
+// SegmentVectors returns a VectorReader that decodes vectors from the composite keys
+// of their records in db.
+func SegmentVectors(db *storage.DB) VectorReader {
+	return func(ref storage.RecordRef) ([]float32, error) {
+		key, err := db.ReadRecordKey(ref)
+		if err != nil {
+			return nil, err
+		}
+		_, vector, err := DecodeKey(key)
+		return vector, err
+	}
+}
+
+// quantizer encodes vectors as compact codes and decodes them back to approximations.
+type quantizer interface {
+	encode(vec []float32) []byte
+	decode(code []byte) []float32
+	codebook() []float32 // Trained parameters, as persisted in checkpoints
+}
+
+// trainQuantizer trains a quantizer of q's kind on vectors of dim components.
+func trainQuantizer(q Quantization, dim int, vectors [][]float32) quantizer {
+	if q.Kind == ProductQuantization {
+		return trainProduct(q, dim, vectors)
+	}
+	return trainScalar(dim, vectors)
+}
+
+// loadQuantizer restores a quantizer of q's kind from its persisted codebook.
+func loadQuantizer(q Quantization, dim int, codebook []float32) (quantizer, error) {
+	switch q.Kind {
+	case ScalarQuantization:
+		if len(codebook) != 2*dim {
+			return nil, fmt.Errorf("SQ8 codebook has %d values, expected %d", len(codebook), 2*dim)
+		}
+		return &scalarQuantizer{min: codebook[:dim], scale: codebook[dim:]}, nil
+	case ProductQuantization:
+		if q.Subspaces <= 0 || dim%q.Subspaces != 0 || len(codebook) != q.Centroids*dim {
+			return nil, fmt.Errorf("PQ codebook of %d values does not fit %d subspaces of %d centroids", len(codebook), q.Subspaces, q.Centroids)
+		}
+		return &productQuantizer{subspaces: q.Subspaces, centroids: q.Centroids, subDim: dim / q.Subspaces, values: codebook}, nil
+	default:
+		return nil, fmt.Errorf("unknown quantizer %d", q.Kind)
+	}
+}
+
+// scalarQuantizer maps each component linearly onto 256 levels between the smallest
+// and largest value it took in the training vectors.
+type scalarQuantizer struct {
+	min   []float32
+	scale []float32 // Width of one level
+}
+
+func trainScalar(dim int, vectors [][]float32) *scalarQuantizer {
+	sq := &scalarQuantizer{min: make([]float32, dim), scale: make([]float32, dim)}
+	for i := 0; i < dim; i++ {
+		lo, hi := float32(math.MaxFloat32), float32(-math.MaxFloat32)
+		for _, v := range vectors {
+			lo = float32(math.Min(float64(lo), float64(v[i])))
+			hi = float32(math.Max(float64(hi), float64(v[i])))
+		}
+		sq.min[i] = lo
+		sq.scale[i] = (hi - lo) / 255
+	}
+	return sq
+}
+
+func (sq *scalarQuantizer) encode(vec []float32) []byte {
+	code := make([]byte, len(vec))
+	for i, v := range vec {
+		if sq.scale[i] == 0 {
+			continue
+		}
+		level := math.Round(float64((v - sq.min[i]) / sq.scale[i]))
+		code[i] = byte(math.Max(0, math.Min(255, level)))
+	}
+	return code
+}
+
+func (sq *scalarQuantizer) decode(code []byte) []float32 {
+	vec := make([]float32, len(code))
+	for i, c := range code {
+		vec[i] = sq.min[i] + float32(c)*sq.scale[i]
+	}
+	return vec
+}
+
+func (sq *scalarQuantizer) codebook() []float32 {
+	return append(append([]float32{}, sq.min...), sq.scale...)
+}
+
+// productQuantizer splits vectors into subspaces and replaces each subvector with the
+// nearest of the centroids k-means found for its subspace.
+type productQuantizer struct {
+	subspaces int
+	centroids int
+	subDim    int
+	values    []float32 // Centroid c of subspace s starts at (s*centroids+c)*subDim
+}
+
+func trainProduct(q Quantization, dim int, vectors [][]float32) *productQuantizer {
+	pq := &productQuantizer{
+		subspaces: q.Subspaces,
+		centroids: q.Centroids,
+		subDim:    dim / q.Subspaces,
+	}
+	pq.values = make([]float32, 0, pq.subspaces*pq.centroids*pq.subDim)
+
+	points := make([][]float32, len(vectors))
+	for s := 0; s < pq.subspaces; s++ {
+		for i, v := range vectors {
+			points[i] = v[s*pq.subDim : (s+1)*pq.subDim]
+		}
+		pq.values = append(pq.values, kmeans(points, pq.centroids)...)
+	}
+	return pq
+}
+
+func (pq *productQuantizer) centroid(s, c int) []float32 {
+	start := (s*pq.centroids + c) * pq.subDim
+	return pq.values[start : start+pq.subDim]
+}
+
+func (pq *productQuantizer) encode(vec []float32) []byte {
+	code := make([]byte, pq.subspaces)
+	for s := range code {
+		code[s] = byte(pq.nearest(s, vec[s*pq.subDim:(s+1)*pq.subDim]))
+	}
+	return code
+}
+
+// nearest returns the centroid of subspace s closest to sub.
+func (pq *productQuantizer) nearest(s int, sub []float32) int {
+	best, bestDist := 0, float32(math.MaxFloat32)
+	for c := 0; c < pq.centroids; c++ {
+		if d := squaredDistance(sub, pq.centroid(s, c)); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+func (pq *productQuantizer) decode(code []byte) []float32 {
+	vec := make([]float32, 0, pq.subspaces*pq.subDim)
+	for s, c := range code {
+		vec = append(vec, pq.centroid(s, int(c))...)
+	}
+	return vec
+}
+
+func (pq *productQuantizer) codebook() []float32 {
+	return pq.values
+}
+
+// kmeans clusters points into k groups by Lloyd's algorithm, starting from k distinct
+// points, and returns the k centroids one after another. Clusters left empty keep
+// their previous centroid.
+func kmeans(points [][]float32, k int) []float32 {
+	dim := len(points[0])
+	centroids := make([]float32, k*dim)
+	for c, p := range rand.Perm(len(points))[:k] {
+		copy(centroids[c*dim:], points[p])
+	}
+
+	assign := make([]int, len(points))
+	sums := make([]float32, k*dim)
+	counts := make([]int, k)
+	for iter := 0; iter < kmeansIterations; iter++ {
+		// 1. Assign every point to its nearest centroid
+		for i, p := range points {
+			best, bestDist := 0, float32(math.MaxFloat32)
+			for c := 0; c < k; c++ {
+				if d := squaredDistance(p, centroids[c*dim:(c+1)*dim]); d < bestDist {
+					best, bestDist = c, d
+				}
+			}
+			assign[i] = best
+		}
+
+		// 2. Move every centroid to the mean of its points
+		clear(sums)
+		clear(counts)
+		for i, p := range points {
+			c := assign[i]
+			counts[c]++
+			for j, v := range p {
+				sums[c*dim+j] += v
+			}
+		}
+		for c := 0; c < k; c++ {
+			if counts[c] == 0 {
+				continue
+			}
+			for j := 0; j < dim; j++ {
+				centroids[c*dim+j] = sums[c*dim+j] / float32(counts[c])
+			}
+		}
+	}
+	return centroids
+}
+
+func squaredDistance(v1, v2 []float32) float32 {
+	var sum float32
+	for i := range v1 {
+		diff := v1[i] - v2[i]
+		sum += diff * diff
+	}
+	return sum
+}
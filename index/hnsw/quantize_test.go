@@ -0,0 +1,148 @@
+package hnsw
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/raman20/storage"
+)
+
+func TestHNSWQuantization(t *testing.T) {
+	const dims, n, k = 16, 1000, 10
+	rng := rand.New(rand.NewSource(1))
+	randomVector := func() []float32 {
+		v := make([]float32, dims)
+		for i := range v {
+			v[i] = rng.Float32()
+		}
+		return v
+	}
+
+	vectors := make(map[storage.RecordRef][]float32)
+	refs := make([]storage.RecordRef, n)
+	for i := range refs {
+		refs[i] = storage.RecordRef{FileID: 1, Offset: int64(i)}
+		vectors[refs[i]] = randomVector()
+	}
+	read := func(ref storage.RecordRef) ([]float32, error) {
+		return vectors[ref], nil
+	}
+	queries := make([][]float32, 100)
+	for i := range queries {
+		queries[i] = randomVector()
+	}
+
+	cases := []struct {
+		name      string
+		q         Quantization
+		codeLen   int
+		minRecall float64
+	}{
+		{"sq8", Quantization{Kind: ScalarQuantization, TrainSize: 500}, dims, 0.95},
+		{"pq", Quantization{Kind: ProductQuantization, Subspaces: 8, Centroids: 32, TrainSize: 500}, 8, 0.6},
+		{"pq+rerank", Quantization{Kind: ProductQuantization, Subspaces: 8, Centroids: 32, TrainSize: 500, Rerank: 50}, 8, 0.95},
+	}
+	for _, c := range cases {
+		idx := NewHNSWIndex(Euclidean, 8, 64, 64)
+		if err := idx.SetQuantization(c.q, read); err != nil {
+			t.Fatalf("%s: SetQuantization failed: %v", c.name, err)
+		}
+
+		// 1. The index keeps full-precision vectors until TrainSize are indexed
+		for i, ref := range refs {
+			if i == c.q.TrainSize-1 && idx.Quantized() {
+				t.Errorf("%s: expected no quantization before %d vectors", c.name, c.q.TrainSize)
+			}
+			if err := idx.Put(EncodeKey(fmt.Sprintf("v%d", i), vectors[ref]), ref); err != nil {
+				t.Fatalf("%s: Put failed: %v", c.name, err)
+			}
+		}
+		if !idx.Quantized() {
+			t.Fatalf("%s: expected the index to be quantized", c.name)
+		}
+		for _, node := range idx.nodes {
+			if node.Vector != nil || len(node.Code) != c.codeLen {
+				t.Fatalf("%s: expected node %s to keep only a %d-byte code, got %d floats and %d bytes",
+					c.name, node.ID, c.codeLen, len(node.Vector), len(node.Code))
+			}
+		}
+
+		// 2. Searching the codes keeps recall; re-ranking restores exact distances
+		hits := 0
+		for _, query := range queries {
+			exact := append([]storage.RecordRef(nil), refs...)
+			sort.Slice(exact, func(a, b int) bool {
+				return idx.distance(query, vectors[exact[a]]) < idx.distance(query, vectors[exact[b]])
+			})
+			want := make(map[storage.RecordRef]bool)
+			for _, ref := range exact[:k] {
+				want[ref] = true
+			}
+
+			got, distances, err := idx.Search(query, k)
+			if err != nil || len(got) != k {
+				t.Fatalf("%s: expected %d results, got %d (err=%v)", c.name, k, len(got), err)
+			}
+			for i, ref := range got {
+				if want[ref] {
+					hits++
+				}
+				if c.q.Rerank > 0 && distances[i] != idx.distance(query, vectors[ref]) {
+					t.Errorf("%s: expected the exact distance of %+v after re-ranking, got %v", c.name, ref, distances[i])
+				}
+			}
+		}
+		if recall := float64(hits) / float64(len(queries)*k); recall < c.minRecall {
+			t.Errorf("%s: expected recall@%d of at least %.2f, got %.3f", c.name, k, c.minRecall, recall)
+		}
+
+		// 3. The quantizer of a trained index cannot change
+		if err := idx.SetQuantization(Quantization{}, nil); err == nil {
+			t.Errorf("%s: expected disabling quantization of a quantized index to fail", c.name)
+		}
+	}
+}
+
+func TestQuantizerCodes(t *testing.T) {
+	vectors := [][]float32{{0, -1, 5}, {1, 1, 5}, {0.5, 0, 5}}
+
+	// SQ8 reproduces each component's bounds exactly and everything else within a level
+	sq := trainScalar(3, vectors)
+	for _, v := range vectors {
+		decoded := sq.decode(sq.encode(v))
+		for i := range v {
+			if diff := decoded[i] - v[i]; diff > sq.scale[i] || -diff > sq.scale[i] {
+				t.Errorf("SQ8: component %d of %v decoded to %v", i, v, decoded[i])
+			}
+		}
+	}
+	if code := sq.encode([]float32{9, -9, 5}); code[0] != 255 || code[1] != 0 {
+		t.Errorf("SQ8: expected values outside the bounds to clamp, got %v", code)
+	}
+
+	// PQ with a centroid per training vector reproduces the training vectors
+	pq := trainProduct(Quantization{Subspaces: 3, Centroids: 3}, 3, vectors)
+	for _, v := range vectors {
+		if decoded := pq.decode(pq.encode(v)); !equalVectors(decoded, v) {
+			t.Errorf("PQ: expected %v to round-trip, got %v", v, decoded)
+		}
+	}
+
+	// Codebooks restore the same quantizers
+	for _, q := range []struct {
+		kind      QuantizerKind
+		quantizer quantizer
+	}{{ScalarQuantization, sq}, {ProductQuantization, pq}} {
+		loaded, err := loadQuantizer(Quantization{Kind: q.kind, Subspaces: 3, Centroids: 3}, 3, q.quantizer.codebook())
+		if err != nil {
+			t.Fatalf("%v: failed to load codebook: %v", q.kind, err)
+		}
+		for _, v := range vectors {
+			if !equalVectors(loaded.decode(loaded.encode(v)), q.quantizer.decode(q.quantizer.encode(v))) {
+				t.Errorf("%v: loaded codebook encodes %v differently", q.kind, v)
+			}
+		}
+	}
+}
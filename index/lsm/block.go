@@ -0,0 +1,332 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+const (
+	blockSize       = 4096 // Target size of a data block before it is cut
+	restartInterval = 16   // Entries between restart points
+)
+
+// blockHandle is an entry of the sparse index of a block-format SSTable: the last
+// key of a data block and where the block lives in the file.
+type blockHandle struct {
+	lastKey string
+	offset  int64
+	size    uint32
+}
+
+// entryFormat is how the entries of a data block identify their version.
+type entryFormat uint8
+
+const (
+	formatPlain entryFormat = iota // Neither; an empty value is a tombstone
+	formatSeq                      // A sequence number; an empty value is a tombstone
+	formatTag                      // A sequence number and kind packed by packTag
+)
+
+// blockBuilder encodes entries sorted by internal key into a data block. Each entry
+// stores the length of the prefix it shares with the previous key and only the rest
+// of its key, along with its tag, which holds the sequence number of the write that
+// produced it and its kind:
+//
+//	[uvarint shared][uvarint unshared][uvarint valLen][uvarint tag][key suffix][value]
+//
+// Blocks of older tables carry a plain sequence number in place of the tag, or
+// nothing at all.
+//
+// Every restartInterval entries the full key is stored instead, and the offsets of
+// these restart points close the block so that readers can binary search them:
+//
+//	[entries...][4B restart offset]*N[4B N]
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	count    int // Entries since the last restart point
+	lastKey  string
+}
+
+func (b *blockBuilder) add(key, value string, seq uint64, kind entryKind) {
+	shared := 0
+	if b.count < restartInterval && len(b.restarts) > 0 {
+		for shared < len(key) && shared < len(b.lastKey) && key[shared] == b.lastKey[shared] {
+			shared++
+		}
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.count = 0
+	}
+
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(value)))
+	b.buf = binary.AppendUvarint(b.buf, packTag(seq, kind))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, value...)
+
+	b.lastKey = key
+	b.count++
+}
+
+// size estimates the encoded size of the block.
+func (b *blockBuilder) size() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+func (b *blockBuilder) empty() bool {
+	return len(b.restarts) == 0
+}
+
+// finish appends the restart points and returns the encoded block. The builder
+// must be reset before reuse.
+func (b *blockBuilder) finish() []byte {
+	for _, r := range b.restarts {
+		b.buf = binary.BigEndian.AppendUint32(b.buf, r)
+	}
+	return binary.BigEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+}
+
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+	b.restarts = b.restarts[:0]
+	b.count = 0
+	b.lastKey = ""
+}
+
+// block is a decoded view over an encoded data block.
+type block struct {
+	data        []byte // Entries
+	restarts    []byte // Restart point offsets, 4 bytes each
+	numRestarts int
+	format      entryFormat
+}
+
+func parseBlock(raw []byte, format entryFormat) (*block, error) {
+	if len(raw) < 4 {
+		return nil, fmt.Errorf("truncated SSTable data block")
+	}
+	n := int(binary.BigEndian.Uint32(raw[len(raw)-4:]))
+	restartsAt := len(raw) - 4 - 4*n
+	if n == 0 || restartsAt < 0 {
+		return nil, fmt.Errorf("corrupt SSTable data block: %d restart points", n)
+	}
+	return &block{data: raw[:restartsAt], restarts: raw[restartsAt : len(raw)-4], numRestarts: n, format: format}, nil
+}
+
+func (b *block) restart(i int) int {
+	return int(binary.BigEndian.Uint32(b.restarts[4*i:]))
+}
+
+// blockIter is a cursor over the entries of a block. Keys are rebuilt by decoding
+// forward from a restart point, so moving backward rescans from the restart point
+// before the current entry.
+type blockIter struct {
+	b      *block
+	offset int // Offset of the current entry
+	next   int // Offset of the entry after it
+	key    []byte
+	val    []byte
+	seq    uint64
+	kind   entryKind
+	valid  bool
+	err    error
+}
+
+func newBlockIter(b *block) *blockIter {
+	return &blockIter{b: b}
+}
+
+func (it *blockIter) seekToRestart(i int) {
+	it.key = it.key[:0]
+	it.next = it.b.restart(i)
+	it.valid = false
+}
+
+// parseNext decodes the entry at it.next and reports whether there was one.
+func (it *blockIter) parseNext() bool {
+	it.valid = false
+	if it.next >= len(it.b.data) {
+		return false
+	}
+
+	data := it.b.data[it.next:]
+	var fields [4]uint64 // Shared key length, unshared key length, value length, tag
+	numFields := 3
+	if it.b.format != formatPlain {
+		numFields = 4
+	}
+	header := 0
+	for i := range fields[:numFields] {
+		v, n := binary.Uvarint(data[header:])
+		if n <= 0 {
+			return it.corrupt()
+		}
+		fields[i] = v
+		header += n
+	}
+	shared, unshared, valLen := fields[0], fields[1], fields[2]
+	if shared > uint64(len(it.key)) || uint64(len(data)-header) < unshared+valLen {
+		return it.corrupt()
+	}
+
+	keyEnd := header + int(unshared)
+	it.key = append(it.key[:shared], data[header:keyEnd]...)
+	it.val = data[keyEnd : keyEnd+int(valLen)]
+	if it.b.format == formatTag {
+		it.seq, it.kind = unpackTag(fields[3])
+	} else {
+		it.seq, it.kind = fields[3], kindOf(string(it.val))
+	}
+	it.offset = it.next
+	it.next += keyEnd + int(valLen)
+	it.valid = true
+	return true
+}
+
+func (it *blockIter) corrupt() bool {
+	it.err = fmt.Errorf("corrupt SSTable data block entry at offset %d", it.next)
+	return false
+}
+
+func (it *blockIter) first() {
+	it.seekToRestart(0)
+	it.parseNext()
+}
+
+func (it *blockIter) last() {
+	it.seekToRestart(it.b.numRestarts - 1)
+	for it.parseNext() {
+		if it.next >= len(it.b.data) {
+			return
+		}
+	}
+}
+
+// seekGE positions the cursor at the newest version of the first key >= target.
+func (it *blockIter) seekGE(target string) {
+	// Find the last restart point whose key is below target; restart keys are stored whole
+	r := sort.Search(it.b.numRestarts, func(i int) bool {
+		it.seekToRestart(i)
+		return !it.parseNext() || string(it.key) >= target
+	})
+	if r > 0 {
+		r--
+	}
+
+	it.seekToRestart(r)
+	for it.parseNext() {
+		if string(it.key) >= target {
+			return
+		}
+	}
+}
+
+func (it *blockIter) nextEntry() {
+	it.parseNext()
+}
+
+func (it *blockIter) prevEntry() {
+	original := it.offset
+	if original == 0 {
+		it.valid = false
+		return
+	}
+
+	// Decode forward from the last restart point before the current entry
+	r := sort.Search(it.b.numRestarts, func(i int) bool { return it.b.restart(i) >= original }) - 1
+	it.seekToRestart(r)
+	for it.parseNext() {
+		if it.next >= original {
+			return
+		}
+	}
+}
+
+// blockLayer iterates a block-format SSTable one data block at a time, loading
+// blocks through the table's block cache.
+type blockLayer struct {
+	sst *SSTable
+	blk int // Index of the loaded block
+	it  *blockIter
+	err error
+}
+
+// load positions the layer on block i, leaving it invalid if i is out of range or
+// the block cannot be read.
+func (l *blockLayer) load(i int) bool {
+	l.blk = i
+	l.it = nil
+	if i < 0 || i >= len(l.sst.blocks) {
+		return false
+	}
+	b, err := l.sst.readBlock(i)
+	if err != nil {
+		l.err = err
+		return false
+	}
+	l.it = newBlockIter(b)
+	return true
+}
+
+func (l *blockLayer) first() {
+	if l.load(0) {
+		l.it.first()
+	}
+}
+
+func (l *blockLayer) last() {
+	if l.load(len(l.sst.blocks) - 1) {
+		l.it.last()
+	}
+}
+
+func (l *blockLayer) seekGE(key string) {
+	// The first block whose last key is >= key holds the target, if any block does
+	i := sort.Search(len(l.sst.blocks), func(i int) bool { return l.sst.blocks[i].lastKey >= key })
+	if l.load(i) {
+		l.it.seekGE(key)
+	}
+}
+
+func (l *blockLayer) seekLT(key string) {
+	l.seekGE(key)
+	switch {
+	case l.valid():
+		l.prev()
+	case l.error() == nil:
+		l.last() // Every key in the table is below key
+	}
+}
+
+func (l *blockLayer) next() {
+	l.it.nextEntry()
+	if !l.it.valid && l.it.err == nil && l.load(l.blk+1) {
+		l.it.first()
+	}
+}
+
+func (l *blockLayer) prev() {
+	l.it.prevEntry()
+	if !l.it.valid && l.it.err == nil && l.load(l.blk-1) {
+		l.it.last()
+	}
+}
+
+func (l *blockLayer) valid() bool            { return l.it != nil && l.it.valid }
+func (l *blockLayer) key() string            { return string(l.it.key) }
+func (l *blockLayer) value() (string, error) { return string(l.it.val), nil }
+func (l *blockLayer) seq() uint64            { return l.it.seq }
+func (l *blockLayer) kind() entryKind        { return l.it.kind }
+
+func (l *blockLayer) error() error {
+	if l.err != nil {
+		return l.err
+	}
+	if l.it != nil {
+		return l.it.err
+	}
+	return nil
+}
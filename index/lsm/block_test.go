@@ -0,0 +1,105 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlockSSTableTraversal(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "sst_block_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// 1. Enough keys with long shared prefixes to span many blocks and restart points
+	const n = 2000
+	sl := InitSL(0.5, 16)
+	for i := 0; i < n; i++ {
+		sl.Put(fmt.Sprintf("tenant:0042:user:%06d", i*2), fmt.Sprintf("value-%d", i*2))
+	}
+	sstPath := filepath.Join(tmpDir, "00001.sst")
+	if err := WriteSSTable(sstPath, sl.Iterator()); err != nil {
+		t.Fatalf("failed to write SSTable: %v", err)
+	}
+
+	cache := newBlockCache(1024 * 1024)
+	sst, err := openSSTable(sstPath, cache)
+	if err != nil {
+		t.Fatalf("failed to open SSTable: %v", err)
+	}
+	defer sst.Close()
+
+	if len(sst.blocks) < 5 || sst.index != nil {
+		t.Fatalf("expected a sparse index of many blocks, got %d blocks and %d index entries", len(sst.blocks), len(sst.index))
+	}
+	stat, _ := os.Stat(sstPath)
+	// The flat format stores each 23-byte key twice, with 24 bytes of headers
+	if flatSize := int64(n * (2*23 + 24 + 10)); stat.Size() > flatSize/2 {
+		t.Errorf("expected prefix compression to shrink the table, got %d bytes against %d flat", stat.Size(), flatSize)
+	}
+
+	// 2. Point lookups of present and absent keys
+	for i := 0; i < 2*n; i++ {
+		key := fmt.Sprintf("tenant:0042:user:%06d", i)
+		val, found, err := sst.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", key, err)
+		}
+		if found != (i%2 == 0) || (found && val != fmt.Sprintf("value-%d", i)) {
+			t.Errorf("Get(%s): got %q (found=%v)", key, val, found)
+		}
+	}
+	if cache.hits == 0 {
+		t.Errorf("expected repeated lookups to hit the block cache")
+	}
+
+	// 3. Forward and backward scans cross block and restart boundaries
+	l := sst.newLayer()
+	count := 0
+	for l.first(); l.valid(); l.next() {
+		if want := fmt.Sprintf("tenant:0042:user:%06d", count*2); l.key() != want {
+			t.Fatalf("forward scan: expected %s, got %s", want, l.key())
+		}
+		count++
+	}
+	if count != n || l.error() != nil {
+		t.Errorf("forward scan: expected %d keys, got %d (err=%v)", n, count, l.error())
+	}
+
+	count = 0
+	for l.last(); l.valid(); l.prev() {
+		if want := fmt.Sprintf("tenant:0042:user:%06d", (n-1-count)*2); l.key() != want {
+			t.Fatalf("backward scan: expected %s, got %s", want, l.key())
+		}
+		count++
+	}
+	if count != n {
+		t.Errorf("backward scan: expected %d keys, got %d", n, count)
+	}
+
+	// 4. Seeks land on the neighbours of absent keys
+	key := func(i int) string { return fmt.Sprintf("tenant:0042:user:%06d", i) }
+	for _, i := range []int{1, 31, 33, 1001, 2*n - 1} {
+		l.seekGE(key(i))
+		if i == 2*n-1 {
+			if l.valid() {
+				t.Errorf("seekGE(%s): expected invalid past the last key, got %s", key(i), l.key())
+			}
+		} else if !l.valid() || l.key() != key(i+1) {
+			t.Errorf("seekGE(%s): expected %s (valid=%v)", key(i), key(i+1), l.valid())
+		}
+
+		if l.seekLT(key(i)); !l.valid() || l.key() != key(i-1) {
+			t.Errorf("seekLT(%s): expected %s (valid=%v)", key(i), key(i-1), l.valid())
+		}
+	}
+	if l.seekLT("tenant"); l.valid() {
+		t.Errorf("seekLT before the first key: expected invalid, got %s", l.key())
+	}
+	if l.seekLT("zzz"); !l.valid() || l.key() != key((n-1)*2) {
+		t.Errorf("seekLT past the last key: expected the last key")
+	}
+}
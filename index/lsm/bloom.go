@@ -0,0 +1,90 @@
+package lsm
+
+// defaultBloomBitsPerKey gives a false positive rate of about 1%.
+const defaultBloomBitsPerKey = 10
+
+// bloomBitsPerKey resolves the configured filter size: zero selects the default
+// and a negative value disables filters.
+func bloomBitsPerKey(bitsPerKey int) int {
+	if bitsPerKey == 0 {
+		return defaultBloomBitsPerKey
+	}
+	if bitsPerKey < 0 {
+		return 0
+	}
+	return bitsPerKey
+}
+
+// bloomFilter is a bit array followed by one byte holding the number of probes per
+// key. Probes are derived from a single hash by double hashing, as in LevelDB.
+type bloomFilter []byte
+
+// newBloomFilter builds a filter over the bloomHash of each key using bitsPerKey
+// bits for each key. It returns nil when bitsPerKey is zero.
+func newBloomFilter(hashes []uint32, bitsPerKey int) bloomFilter {
+	if bitsPerKey <= 0 {
+		return nil
+	}
+
+	// k = ln(2) * bits per key minimizes the false positive rate
+	k := bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+
+	nBits := len(hashes) * bitsPerKey
+	if nBits < 64 {
+		nBits = 64 // Small filters have a high false positive rate
+	}
+	nBytes := (nBits + 7) / 8
+	nBits = nBytes * 8
+
+	filter := make(bloomFilter, nBytes+1)
+	filter[nBytes] = byte(k)
+	for _, h := range hashes {
+		delta := h>>17 | h<<15
+		for i := 0; i < k; i++ {
+			pos := h % uint32(nBits)
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	return filter
+}
+
+// mayContain reports whether key may be in the filter. An empty or malformed
+// filter matches every key.
+func (f bloomFilter) mayContain(key string) bool {
+	if len(f) < 2 {
+		return true
+	}
+	nBits := uint32(len(f)-1) * 8
+	k := int(f[len(f)-1])
+	if k < 1 || k > 30 {
+		return true
+	}
+
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	for i := 0; i < k; i++ {
+		pos := h % nBits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// bloomHash is 32-bit FNV-1a.
+func bloomHash(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
@@ -0,0 +1,42 @@
+package lsm
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	keys := make([]string, 10000)
+	hashes := make([]uint32, len(keys))
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%d", i)
+		hashes[i] = bloomHash(keys[i])
+	}
+	filter := newBloomFilter(hashes, 10)
+
+	// 1. Every added key passes
+	for _, key := range keys {
+		if !filter.mayContain(key) {
+			t.Fatalf("false negative for %s", key)
+		}
+	}
+
+	// 2. About 1% of absent keys pass at 10 bits per key
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.mayContain(fmt.Sprintf("user:%d", len(keys)+i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 10000; rate > 0.03 {
+		t.Errorf("false positive rate too high: %.2f%%", rate*100)
+	}
+
+	// 3. A disabled or missing filter admits everything
+	if f := newBloomFilter(hashes, bloomBitsPerKey(-1)); f != nil || !f.mayContain("anything") {
+		t.Errorf("expected a disabled filter to admit every key")
+	}
+	if bloomBitsPerKey(0) != defaultBloomBitsPerKey {
+		t.Errorf("expected zero bits per key to select the default")
+	}
+}
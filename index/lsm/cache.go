@@ -0,0 +1,116 @@
+package lsm
+
+import (
+	"container/list"
+	"sync"
+)
+
+// defaultBlockCacheSize bounds the block cache when Options.BlockCacheSize is zero.
+const defaultBlockCacheSize = 8 * 1024 * 1024 // 8MB
+
+// blockCacheSize resolves the configured cache size: zero selects the default and
+// a negative value disables the cache.
+func blockCacheSize(size int64) int64 {
+	if size == 0 {
+		return defaultBlockCacheSize
+	}
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
+// blockKey identifies a data block by the table it belongs to and its offset.
+type blockKey struct {
+	table  uint64
+	offset int64
+}
+
+type cacheEntry struct {
+	key  blockKey
+	data []byte
+}
+
+// blockCache is an LRU cache of raw data blocks shared by the SSTables of an
+// LSMIndex and bounded by the total size of the blocks it holds. A nil cache
+// holds nothing.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List // Most recently used first
+	entries  map[blockKey]*list.Element
+	hits     uint64
+	misses   uint64
+}
+
+// newBlockCache returns a cache holding up to capacity bytes of blocks, or nil if
+// capacity is zero.
+func newBlockCache(capacity int64) *blockCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &blockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[blockKey]*list.Element),
+	}
+}
+
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).data, true
+}
+
+// add caches a block, evicting the least recently used blocks to make room. Blocks
+// larger than the whole cache are not cached.
+func (c *blockCache) add(key blockKey, data []byte) {
+	if c == nil || int64(len(data)) > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		return // Cached by a concurrent reader
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, data: data})
+	c.size += int64(len(data))
+
+	for c.size > c.capacity {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*cacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.size -= int64(len(entry.data))
+	}
+}
+
+// evictTable drops every cached block of a table that is being deleted.
+func (c *blockCache) evictTable(table uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if key.table == table {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+			c.size -= int64(len(elem.Value.(*cacheEntry).data))
+		}
+	}
+}
@@ -0,0 +1,609 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/raman20/storage"
+)
+
+// numLevels is the number of levels under leveled compaction. Tables in the last
+// level are never compacted further.
+const numLevels = 7
+
+// levelConfig holds the compaction and write stall settings of an LSMIndex, with
+// defaults applied.
+type levelConfig struct {
+	l0Trigger    int   // L0 tables that trigger a compaction into L1
+	baseSize     int64 // Target size of L1
+	ratio        int   // Size ratio between adjacent levels
+	targetSize   int64 // Size at which compaction output is split into a new table
+	l0Stop       int   // L0 tables at which writes stall
+	maxImmutable int   // Memtables waiting to be flushed at which writes stall
+}
+
+func newLevelConfig(opts storage.Options) levelConfig {
+	c := levelConfig{
+		l0Trigger:    opts.CompactionThreshold,
+		baseSize:     opts.BaseLevelSize,
+		ratio:        opts.LevelSizeRatio,
+		targetSize:   opts.TargetFileSize,
+		l0Stop:       opts.L0StopTrigger,
+		maxImmutable: opts.MaxImmutableMemtables,
+	}
+	if c.l0Trigger <= 0 {
+		c.l0Trigger = 4
+	}
+	if c.l0Stop <= 0 {
+		c.l0Stop = 3 * c.l0Trigger
+	}
+	// Compactions leave fewer tables than the trigger, so writes stalled on L0
+	// always resume
+	c.l0Stop = max(c.l0Stop, c.l0Trigger+1)
+	if c.maxImmutable <= 0 {
+		c.maxImmutable = 4
+	}
+	if c.baseSize <= 0 {
+		c.baseSize = 8 * 1024 * 1024 // 8MB
+	}
+	if c.ratio <= 1 {
+		c.ratio = 10
+	}
+	if c.targetSize <= 0 {
+		c.targetSize = 2 * 1024 * 1024 // 2MB
+	}
+	return c
+}
+
+// maxBytes returns the target size of a level below L0.
+func (c levelConfig) maxBytes(level int) int64 {
+	size := c.baseSize
+	for l := 1; l < level; l++ {
+		size *= int64(c.ratio)
+	}
+	return size
+}
+
+// orderTables sorts tables into lookup order: L0 newest first by largest sequence
+// number, then each deeper level by key. Every level is older than the levels above
+// it and the tables of a level below L0 never overlap, so the first table holding a
+// key has its newest version, and range tombstones only hide keys in the tables
+// after their own. L0 tables without sequence numbers predate the others and keep
+// their relative order.
+func orderTables(tables []*SSTable) {
+	sort.SliceStable(tables, func(i, j int) bool {
+		if tables[i].level != tables[j].level {
+			return tables[i].level < tables[j].level
+		}
+		if tables[i].level == 0 {
+			return tables[i].maxSeq > tables[j].maxSeq
+		}
+		return tables[i].smallest < tables[j].smallest
+	})
+}
+
+// levelsOf groups tables, in lookup order, by level.
+func levelsOf(tables []*SSTable) [numLevels][]*SSTable {
+	var levels [numLevels][]*SSTable
+	for _, sst := range tables {
+		level := min(sst.level, numLevels-1)
+		levels[level] = append(levels[level], sst)
+	}
+	return levels
+}
+
+// keyRange returns the smallest and largest keys covered by tables.
+func keyRange(tables []*SSTable) (string, string) {
+	lower, upper := tables[0].smallest, tables[0].largest
+	for _, sst := range tables[1:] {
+		lower = min(lower, sst.smallest)
+		upper = max(upper, sst.largest)
+	}
+	return lower, upper
+}
+
+// overlapping returns the tables that intersect [lower, upper].
+func overlapping(tables []*SSTable, lower, upper string) []*SSTable {
+	var result []*SSTable
+	for _, sst := range tables {
+		if sst.overlaps(lower, upper) {
+			result = append(result, sst)
+		}
+	}
+	return result
+}
+
+// compaction merges input tables of one level with the tables of the next level
+// that overlap them.
+type compaction struct {
+	level    int
+	inputs   []*SSTable // Newest first
+	overlaps []*SSTable // From level+1
+	gc       tombstoneGC
+}
+
+// tombstoneGC decides which tombstones a merge may drop. A tombstone must stay as
+// long as a table outside the merge, in a deeper level, may hold an older version
+// of a key it deletes. At the bottommost level for its keys it can go once every
+// live snapshot was taken after it: no snapshot can then see the versions it
+// hides, so the merge drops them along with it.
+type tombstoneGC struct {
+	bottommost bool     // No table outside the merge holds older versions of its keys
+	snapshots  []uint64 // Sequence numbers of the live snapshots, ascending
+}
+
+// drops reports whether a point or range tombstone written at seq can be dropped.
+func (g tombstoneGC) drops(seq uint64) bool {
+	return g.bottommost && (len(g.snapshots) == 0 || seq <= g.snapshots[0])
+}
+
+// rangeTombstones returns the range tombstones of tables that must be kept.
+func (g tombstoneGC) rangeTombstones(tables []*SSTable) []RangeTombstone {
+	var kept []RangeTombstone
+	for _, sst := range tables {
+		for _, t := range sst.RangeTombstones() {
+			if !g.drops(t.Seq) {
+				kept = append(kept, t)
+			}
+		}
+	}
+	return kept
+}
+
+// collects reports whether sst holds tombstones that can be dropped.
+func (g tombstoneGC) collects(sst *SSTable) bool {
+	if !g.bottommost {
+		return false
+	}
+	if len(g.rangeTombstones([]*SSTable{sst})) < len(sst.rangeDels) {
+		return true
+	}
+	it := sst.Iterator()
+	for it.Next() {
+		if it.Deleted() && g.drops(it.Seq()) {
+			return true
+		}
+	}
+	return it.Error() != nil
+}
+
+// levelScore returns how far a level is over its budget; levels scoring 1 or more
+// need compaction.
+func (idx *LSMIndex) levelScore(levels [numLevels][]*SSTable, level int) float64 {
+	if level == 0 {
+		return float64(len(levels[0])) / float64(idx.levels.l0Trigger)
+	}
+	var size int64
+	for _, sst := range levels[level] {
+		size += sst.size
+	}
+	return float64(size) / float64(idx.levels.maxBytes(level))
+}
+
+// pickCompaction returns a compaction for the level with the highest score whose
+// tables are not claimed by a running compaction, or nil if there is none. L0 tables may overlap, so all of them are compacted together; deeper
+// levels compact one table, taking turns through the key space. Compactions that
+// claim disjoint tables run concurrently: neither writes keys into the other's key
+// range, so each keeps its levels sorted and its tombstone GC decisions sound. Must
+// hold idx.mu.
+func (idx *LSMIndex) pickCompaction() *compaction {
+	levels := levelsOf(idx.sstables)
+
+	var candidates []int
+	for level := 0; level < numLevels-1; level++ {
+		if idx.levelScore(levels, level) >= 1 {
+			candidates = append(candidates, level)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return idx.levelScore(levels, candidates[i]) > idx.levelScore(levels, candidates[j])
+	})
+
+	for _, level := range candidates {
+		if c := idx.pickLevel(levels, level); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// pickLevel returns a compaction of level made of unclaimed tables, or nil if every
+// one it could run overlaps a claimed table. Must hold idx.mu.
+func (idx *LSMIndex) pickLevel(levels [numLevels][]*SSTable, level int) *compaction {
+	var inputs [][]*SSTable
+	if level == 0 {
+		inputs = append(inputs, levels[0])
+	} else {
+		// Start after the compaction pointer and wrap around
+		start := 0
+		for start < len(levels[level]) && levels[level][start].smallest <= idx.compactPointer[level] {
+			start++
+		}
+		for i := range levels[level] {
+			inputs = append(inputs, []*SSTable{levels[level][(start+i)%len(levels[level])]})
+		}
+	}
+
+	for _, in := range inputs {
+		c := &compaction{level: level, inputs: in}
+		lower, upper := keyRange(c.inputs)
+		c.overlaps = overlapping(levels[level+1], lower, upper)
+		if anyClaimed(c.inputs) || anyClaimed(c.overlaps) {
+			continue
+		}
+		if len(c.overlaps) > 0 {
+			lower, upper = keyRange(append(c.overlaps, c.inputs...))
+		}
+
+		c.gc.snapshots = idx.snapshotSeqs()
+		c.gc.bottommost = true
+		for deeper := level + 2; deeper < numLevels; deeper++ {
+			if len(overlapping(levels[deeper], lower, upper)) > 0 {
+				c.gc.bottommost = false
+				break
+			}
+		}
+		return c
+	}
+	return nil
+}
+
+// anyClaimed reports whether one of tables is claimed by a running compaction.
+func anyClaimed(tables []*SSTable) bool {
+	for _, sst := range tables {
+		if sst.claimed {
+			return true
+		}
+	}
+	return false
+}
+
+// claim marks the tables of c as claimed, or releases them. Must hold idx.mu.
+func (c *compaction) claim(claimed bool) {
+	for _, sst := range c.inputs {
+		sst.claimed = claimed
+	}
+	for _, sst := range c.overlaps {
+		sst.claimed = claimed
+	}
+}
+
+// runLeveledCompactions compacts levels until every level is within its budget or
+// the remaining work overlaps tables claimed by other compaction jobs, which pick
+// it up once they finish. Every claimed compaction schedules another job, so free
+// slots take on disjoint work. Flushes running alongside only add L0 tables newer
+// than any being compacted.
+func (idx *LSMIndex) runLeveledCompactions() error {
+	for {
+		idx.mu.Lock()
+		if idx.closed {
+			idx.mu.Unlock()
+			return nil
+		}
+		c := idx.pickCompaction()
+		if c != nil {
+			c.claim(true)
+		}
+		epoch := idx.epoch
+		idx.mu.Unlock()
+
+		if c == nil {
+			return nil
+		}
+		idx.sched.schedule(jobCompaction)
+
+		err := idx.compact(c, epoch)
+		idx.mu.Lock()
+		c.claim(false)
+		idx.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("compaction failed: %w", err)
+		}
+	}
+}
+
+// compact runs c. A single input with nothing to merge is moved to the next level
+// instead of being rewritten, unless it holds tombstones that can be dropped.
+func (idx *LSMIndex) compact(c *compaction, epoch uint64) error {
+	if len(c.inputs) == 1 && len(c.overlaps) == 0 && !c.gc.collects(c.inputs[0]) {
+		return idx.moveTable(c.inputs[0], c.level+1, epoch)
+	}
+
+	outputs, err := idx.writeCompaction(c)
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	if idx.closed || idx.epoch != epoch {
+		idx.mu.Unlock()
+		for _, sst := range outputs {
+			sst.Close()
+			os.Remove(sst.FilePath())
+		}
+		return nil
+	}
+
+	obsolete := append(append([]*SSTable(nil), c.inputs...), c.overlaps...)
+	edit := &versionEdit{}
+	for _, sst := range obsolete {
+		edit.removeTable(sst)
+	}
+	for _, sst := range outputs {
+		edit.addTable(sst, c.level+1)
+	}
+	if err := idx.manifest.logEdit(edit); err != nil {
+		idx.mu.Unlock()
+		for _, sst := range outputs {
+			sst.Close()
+			os.Remove(sst.FilePath())
+		}
+		return fmt.Errorf("failed to log compaction: %w", err)
+	}
+
+	var remaining []*SSTable
+	for _, sst := range idx.sstables {
+		compacted := false
+		for _, old := range obsolete {
+			if sst == old {
+				compacted = true
+				break
+			}
+		}
+		if !compacted {
+			remaining = append(remaining, sst)
+		}
+	}
+	idx.sstables = append(remaining, outputs...)
+	orderTables(idx.sstables)
+	if c.level > 0 {
+		idx.compactPointer[c.level] = c.inputs[0].largest
+	}
+	for _, sst := range outputs {
+		idx.compactedBytes.Add(uint64(sst.size))
+	}
+	idx.stalls.Broadcast()
+	idx.mu.Unlock()
+
+	idx.removeTables(obsolete)
+	return nil
+}
+
+// moveTable moves sst to level by recording the move in the manifest.
+func (idx *LSMIndex) moveTable(sst *SSTable, level int, epoch uint64) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.closed || idx.epoch != epoch {
+		return nil
+	}
+
+	edit := &versionEdit{}
+	edit.addTable(sst, level)
+	if err := idx.manifest.logEdit(edit); err != nil {
+		return fmt.Errorf("failed to move SSTable to L%d: %w", level, err)
+	}
+	if sst.level > 0 {
+		idx.compactPointer[sst.level] = sst.largest
+	}
+	sst.level = level
+	orderTables(idx.sstables)
+	idx.stalls.Broadcast()
+	return nil
+}
+
+// writeCompaction merges the tables of c into new tables for the next level, split
+// at the target file size.
+func (idx *LSMIndex) writeCompaction(c *compaction) ([]*SSTable, error) {
+	tables := append(append([]*SSTable(nil), c.inputs...), c.overlaps...)
+
+	out := &compactionOutput{
+		dir:        idx.sstDir,
+		level:      c.level + 1,
+		targetSize: idx.levels.targetSize,
+		bitsPerKey: bloomBitsPerKey(idx.options.BloomBitsPerKey),
+		cache:      idx.cache,
+		rangeDels:  c.gc.rangeTombstones(tables),
+	}
+
+	err := mergeTables(tables, c.gc.snapshots, func(key, value string, seq uint64, kind entryKind) error {
+		if kind == kindDelete && c.gc.drops(seq) {
+			return nil
+		}
+		return out.add(key, value, seq, kind)
+	})
+	if err == nil {
+		err = out.finish()
+	}
+	if err != nil {
+		out.abort()
+		return nil, err
+	}
+	return out.tables, nil
+}
+
+// compactionOutput writes the merged entries of a compaction into tables of about
+// targetSize bytes. Each table covers the keys from the first key it holds up to the
+// first key of the next table, and carries the range tombstones clipped to that span.
+type compactionOutput struct {
+	dir        string
+	level      int
+	targetSize int64
+	bitsPerKey int
+	cache      *blockCache
+	rangeDels  []RangeTombstone
+
+	file   *os.File
+	w      *sstWriter
+	lower  string // First key covered by the current table
+	paths  []string
+	tables []*SSTable
+}
+
+func (o *compactionOutput) add(key, value string, seq uint64, kind entryKind) error {
+	// Tables are only cut between keys, so that each key's versions share a table
+	if o.w != nil && o.w.size() >= o.targetSize && key != o.w.lastKey {
+		if err := o.cut(key, true); err != nil {
+			return err
+		}
+	}
+	if o.w == nil {
+		if err := o.create(); err != nil {
+			return err
+		}
+	}
+	return o.w.add(key, value, seq, kind)
+}
+
+func (o *compactionOutput) create() error {
+	name := fmt.Sprintf("%020d_%03d_L%d.sst", time.Now().UnixNano(), len(o.paths), o.level)
+	path := filepath.Join(o.dir, name)
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create SSTable file: %w", err)
+	}
+	o.file = file
+	o.w = newSSTWriter(file)
+	o.paths = append(o.paths, path)
+	return nil
+}
+
+// cut finishes the current table, which covers keys below upper.
+func (o *compactionOutput) cut(upper string, hasUpper bool) error {
+	var rangeDels []RangeTombstone
+	for _, t := range o.rangeDels {
+		if t.Start < o.lower {
+			t.Start = o.lower
+		}
+		if hasUpper && t.End > upper {
+			t.End = upper
+		}
+		if t.Start < t.End {
+			rangeDels = append(rangeDels, t)
+		}
+	}
+
+	if o.w == nil {
+		if len(rangeDels) == 0 {
+			return nil
+		}
+		if err := o.create(); err != nil { // A table holding only range tombstones
+			return err
+		}
+	}
+
+	err := o.w.finish(rangeDels, o.bitsPerKey)
+	o.file.Close()
+	o.file, o.w = nil, nil
+	o.lower = upper
+	return err
+}
+
+// finish writes the last table and opens every table written.
+func (o *compactionOutput) finish() error {
+	if err := o.cut("", false); err != nil {
+		return err
+	}
+	for _, path := range o.paths {
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return fmt.Errorf("failed to rename SSTable: %w", err)
+		}
+	}
+	for _, path := range o.paths {
+		sst, err := openSSTable(path, o.cache)
+		if err != nil {
+			return fmt.Errorf("failed to open compacted SSTable: %w", err)
+		}
+		o.tables = append(o.tables, sst)
+	}
+	return nil
+}
+
+// abort removes every table written.
+func (o *compactionOutput) abort() {
+	if o.file != nil {
+		o.file.Close()
+	}
+	for _, sst := range o.tables {
+		sst.Close()
+	}
+	for _, path := range o.paths {
+		os.Remove(path + ".tmp")
+		os.Remove(path)
+	}
+}
+
+// mergeTables passes the versions of the keys in sstables, ordered newest first,
+// that a read may still see to emit in ascending internal key order. The newest
+// version of a key is kept unless a range tombstone hides it. An older version is
+// only kept for the snapshots, given as ascending sequence numbers, that were taken
+// after it was written and before it was shadowed by a newer version or a range
+// tombstone. Versions without sequence numbers are ordered by table, so only the
+// one in the newest table is kept. Tombstones are passed like any other version.
+func mergeTables(sstables []*SSTable, snapshots []uint64, emit func(key, value string, seq uint64, kind entryKind) error) error {
+	layers := make([]layerIterator, len(sstables))
+	for i, sst := range sstables {
+		layers[i] = sst.newLayer()
+		layers[i].first()
+	}
+
+	var prevKey string
+	var prevSeq uint64 // Sequence number of the last version of prevKey
+	for {
+		// Find the smallest internal key, from the newest table among equal ones
+		smallestIdx := -1
+		for i, l := range layers {
+			if l.valid() && (smallestIdx == -1 || internalLess(l.key(), l.seq(), layers[smallestIdx].key(), layers[smallestIdx].seq())) {
+				smallestIdx = i
+			}
+		}
+
+		if smallestIdx == -1 {
+			break
+		}
+
+		l := layers[smallestIdx]
+		key, seq, kind := l.key(), l.seq(), l.kind()
+		val, err := l.value()
+		if err != nil {
+			return err
+		}
+		l.next()
+
+		// The version is visible to reads from seq up to the first sequence number
+		// at which something shadows it
+		shadowed, shadowedAt := key == prevKey, prevSeq
+		for i, sst := range sstables[:smallestIdx+1] {
+			for _, t := range sst.rangeDels {
+				if t.hides(key, seq, i < smallestIdx, MaxSequence) && (!shadowed || t.Seq < shadowedAt) {
+					shadowed, shadowedAt = true, t.Seq
+				}
+			}
+		}
+		prevKey, prevSeq = key, seq
+
+		if shadowed && !visibleToSnapshot(snapshots, seq, shadowedAt) {
+			continue
+		}
+		if err := emit(key, val, seq, kind); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range layers {
+		if err := l.error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// visibleToSnapshot reports whether one of snapshots, in ascending order, falls in
+// [from, until).
+func visibleToSnapshot(snapshots []uint64, from, until uint64) bool {
+	i := sort.Search(len(snapshots), func(i int) bool { return snapshots[i] >= from })
+	return i < len(snapshots) && snapshots[i] < until
+}
@@ -0,0 +1,366 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/raman20/storage"
+)
+
+// waitForBackgroundWork waits until every memtable is flushed and no compaction is
+// pending or running.
+func waitForBackgroundWork(t *testing.T, idx *LSMIndex) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		idx.sched.wait()
+		idx.mu.RLock()
+		idle := len(idx.immutable) == 0 &&
+			(idx.options.CompactionStyle != storage.CompactionLeveled || idx.pickCompaction() == nil)
+		idx.mu.RUnlock()
+		if idle {
+			// Removals are queued before the jobs that remove tables finish
+			idx.removals.Wait()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("background flushes and compactions did not finish")
+}
+
+func loadCompactionWorkload(t *testing.T, style storage.CompactionStyle) (*LSMIndex, string, storage.Options) {
+	tmpDir, err := os.MkdirTemp("", "lsm_compaction_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	walDir := filepath.Join(tmpDir, "wal")
+	sstDir := filepath.Join(tmpDir, "sst")
+	os.MkdirAll(walDir, 0755)
+	os.MkdirAll(sstDir, 0755)
+
+	// Leveled compactions of disjoint tables run side by side
+	opts := storage.Options{
+		MemtableSize:        2048,
+		MaxConcurrency:      4,
+		CompactionThreshold: 4,
+		CompactionStyle:     style,
+		BaseLevelSize:       16 * 1024,
+		LevelSizeRatio:      4,
+		TargetFileSize:      4 * 1024,
+	}
+	idx, err := NewLSMIndex(walDir, sstDir, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSMIndex: %v", err)
+	}
+
+	// Keys are written in a scattered order and rewritten, so tables overlap. Letting
+	// background work catch up now and then keeps the number of compactions stable.
+	const n = 3000
+	for round := 0; round < 2; round++ {
+		for i := 0; i < n; i++ {
+			k := (i * 7919) % n
+			idx.Put([]byte(fmt.Sprintf("key:%05d", k)), storage.RecordRef{FileID: uint32(round + 1), Offset: int64(k)})
+			if i%200 == 199 {
+				waitForBackgroundWork(t, idx)
+			}
+		}
+	}
+	for i := 0; i < n; i += 10 {
+		idx.Delete([]byte(fmt.Sprintf("key:%05d", i)))
+	}
+	idx.DeleteRange([]byte("key:01000"), []byte("key:01100"))
+
+	waitForBackgroundWork(t, idx)
+	return idx, tmpDir, opts
+}
+
+func verifyCompactionWorkload(t *testing.T, stage string, idx *LSMIndex) {
+	const n = 3000
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key:%05d", i)
+		ref, found, err := idx.Get([]byte(key))
+		if want := i%10 != 0 && (i < 1000 || i >= 1100); err != nil || found != want {
+			t.Fatalf("%s: Get(%s): expected found=%v, got %v (err=%v)", stage, key, want, found, err)
+		}
+		if found && (ref.FileID != 2 || ref.Offset != int64(i)) {
+			t.Fatalf("%s: Get(%s): expected the rewritten ref, got %+v", stage, key, ref)
+		}
+	}
+
+	it, err := idx.NewIterator(storage.IterOptions{})
+	if err != nil {
+		t.Fatalf("%s: failed to create iterator: %v", stage, err)
+	}
+	defer it.Close()
+	count := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		count++
+	}
+	if want := n - n/10 - 90; count != want || it.Error() != nil {
+		t.Errorf("%s: expected %d live keys, iterated %d (err=%v)", stage, want, count, it.Error())
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	idx, tmpDir, opts := loadCompactionWorkload(t, storage.CompactionLeveled)
+	defer os.RemoveAll(tmpDir)
+
+	// 1. Data moves below L0, and each level below L0 is a run of disjoint tables
+	check := func(stage string) {
+		idx.mu.RLock()
+		defer idx.mu.RUnlock()
+
+		levels := levelsOf(idx.sstables)
+		if len(levels[0]) >= idx.levels.l0Trigger {
+			t.Errorf("%s: expected L0 to be compacted, has %d tables", stage, len(levels[0]))
+		}
+		deepest := 0
+		for level := 1; level < numLevels; level++ {
+			tables := levels[level]
+			if len(tables) > 0 {
+				deepest = level
+			}
+			for i := 1; i < len(tables); i++ {
+				if tables[i-1].largest > tables[i].smallest {
+					t.Errorf("%s: L%d tables overlap: [%s, %s] and [%s, %s]", stage, level,
+						tables[i-1].smallest, tables[i-1].largest, tables[i].smallest, tables[i].largest)
+				}
+			}
+		}
+		if deepest < 2 {
+			t.Errorf("%s: expected data in at least two levels below L0, deepest is L%d", stage, deepest)
+		}
+	}
+	check("compacted")
+	verifyCompactionWorkload(t, "compacted", idx)
+
+	// 2. Levels, including those of tables moved without being rewritten, are
+	// recovered from the manifest
+	levels := make(map[string]int)
+	for _, sst := range idx.sstables {
+		levels[filepath.Base(sst.FilePath())] = sst.level
+	}
+	idx.Close()
+	idx, err := NewLSMIndex(filepath.Join(tmpDir, "wal"), filepath.Join(tmpDir, "sst"), opts)
+	if err != nil {
+		t.Fatalf("failed to reopen LSMIndex: %v", err)
+	}
+	defer idx.Close()
+	for _, sst := range idx.sstables {
+		name := filepath.Base(sst.FilePath())
+		if level, ok := levels[name]; !ok || level != sst.level {
+			t.Errorf("reopen: %s is in L%d, expected L%d (known=%v)", name, sst.level, level, ok)
+		}
+	}
+	if len(idx.sstables) != len(levels) {
+		t.Errorf("reopen: expected %d tables, got %d", len(levels), len(idx.sstables))
+	}
+	check("reopen")
+	verifyCompactionWorkload(t, "reopen", idx)
+}
+
+func TestLeveledCompactionWriteAmplification(t *testing.T) {
+	full, fullDir, _ := loadCompactionWorkload(t, storage.CompactionFull)
+	defer os.RemoveAll(fullDir)
+	defer full.Close()
+	verifyCompactionWorkload(t, "full", full)
+
+	leveled, leveledDir, _ := loadCompactionWorkload(t, storage.CompactionLeveled)
+	defer os.RemoveAll(leveledDir)
+	defer leveled.Close()
+
+	// Full merges rewrite the keyspace on every compaction; leveled compaction only
+	// rewrites the overlapping tables of the next level
+	fullStats, leveledStats := full.Stats(), leveled.Stats()
+	fullAmp := float64(fullStats.CompactedBytes) / float64(fullStats.FlushedBytes)
+	leveledAmp := float64(leveledStats.CompactedBytes) / float64(leveledStats.FlushedBytes)
+	if leveledAmp >= fullAmp {
+		t.Errorf("expected leveled compaction to write less: leveled %.1fx, full %.1fx", leveledAmp, fullAmp)
+	}
+}
+
+func TestPickCompactionSkipsClaimedTables(t *testing.T) {
+	table := func(level int, smallest, largest string) *SSTable {
+		return &SSTable{level: level, smallest: smallest, largest: largest, size: 100}
+	}
+	a, b, c := table(1, "a", "c"), table(1, "d", "f"), table(1, "g", "i")
+	x, y := table(2, "b", "e"), table(2, "h", "j")
+	idx := &LSMIndex{
+		levels:    newLevelConfig(storage.Options{BaseLevelSize: 100}),
+		sstables:  []*SSTable{a, b, c, x, y},
+		snapshots: make(map[uint64]int),
+	}
+
+	// 1. Compactions of L1 that share no table are handed out together
+	first := idx.pickCompaction()
+	if first == nil || first.inputs[0] != a || len(first.overlaps) != 1 || first.overlaps[0] != x {
+		t.Fatalf("expected the first compaction to merge [a, c] into [b, e], got %+v", first)
+	}
+	first.claim(true)
+
+	// b also overlaps [b, e], so the next compaction skips to c
+	second := idx.pickCompaction()
+	if second == nil || second.inputs[0] != c || len(second.overlaps) != 1 || second.overlaps[0] != y {
+		t.Fatalf("expected the second compaction to merge [g, i] into [h, j], got %+v", second)
+	}
+	second.claim(true)
+
+	if c := idx.pickCompaction(); c != nil {
+		t.Errorf("expected no compaction while every candidate overlaps a claimed table, got %+v", c)
+	}
+
+	// 2. Released tables can be picked again
+	first.claim(false)
+	if c := idx.pickCompaction(); c == nil || c.inputs[0] != a {
+		t.Errorf("expected [a, c] to be picked once released, got %+v", c)
+	}
+}
+
+func TestMergeTablesKeepsSnapshotVersions(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "lsm_merge_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	writeTable := func(name string, entries []memEntry, rangeDels []RangeTombstone) *SSTable {
+		sl := InitSL(0.5, 16)
+		for _, e := range entries {
+			sl.add(e.key, e.value, e.seq, e.kind)
+		}
+		path := filepath.Join(tmpDir, name)
+		if err := writeSSTable(path, sl.Iterator(), rangeDels, defaultBloomBitsPerKey); err != nil {
+			t.Fatalf("failed to write SSTable: %v", err)
+		}
+		sst, err := OpenSSTable(path)
+		if err != nil {
+			t.Fatalf("failed to open SSTable: %v", err)
+		}
+		return sst
+	}
+
+	newer := writeTable("newer.sst", []memEntry{
+		{key: "a", value: "a10", seq: 10, kind: kindSet},
+		{key: "b", seq: 9, kind: kindDelete},
+	}, []RangeTombstone{{Start: "c", End: "d", Seq: 8}})
+	defer newer.Close()
+	older := writeTable("older.sst", []memEntry{
+		{key: "a", value: "a4", seq: 4, kind: kindSet},
+		{key: "a", value: "a2", seq: 2, kind: kindSet},
+		{key: "b", value: "b3", seq: 3, kind: kindSet},
+		{key: "c", value: "c5", seq: 5, kind: kindSet},
+	}, nil)
+	defer older.Close()
+
+	for _, tc := range []struct {
+		snapshots []uint64
+		want      string
+	}{
+		{nil, "[a@10 b@9-]"},
+		{[]uint64{4}, "[a@10 a@4 b@9- b@3]"},
+		{[]uint64{3, 6}, "[a@10 a@4 a@2 b@9- b@3 c@5]"},
+		{[]uint64{12}, "[a@10 b@9-]"},
+	} {
+		var merged []string
+		err := mergeTables([]*SSTable{newer, older}, tc.snapshots, func(key, value string, seq uint64, kind entryKind) error {
+			entry := fmt.Sprintf("%s@%d", key, seq)
+			if kind == kindDelete {
+				entry += "-"
+			}
+			merged = append(merged, entry)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to merge tables: %v", err)
+		}
+		if fmt.Sprint(merged) != tc.want {
+			t.Errorf("snapshots %v: expected %s, got %v", tc.snapshots, tc.want, merged)
+		}
+	}
+}
+
+func TestCompactionNeverResurrectsDeletedKeys(t *testing.T) {
+	for name, style := range map[string]storage.CompactionStyle{"leveled": storage.CompactionLeveled, "full": storage.CompactionFull} {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := newManifestTestDir(t)
+			defer os.RemoveAll(tmpDir)
+
+			opts := storage.Options{
+				MemtableSize:        1024,
+				CompactionThreshold: 2,
+				CompactionStyle:     style,
+				BaseLevelSize:       2048,
+				LevelSizeRatio:      2,
+				TargetFileSize:      1024,
+			}
+			idx := openManifestTestIndex(t, tmpDir, opts)
+			defer func() { idx.Close() }()
+
+			// 1. Push the keys down to the deepest levels
+			const n = 800
+			live := make(map[string]bool)
+			for i := 0; i < n; i++ {
+				key := fmt.Sprintf("key:%04d", i)
+				idx.Put([]byte(key), storage.RecordRef{FileID: 1, Offset: int64(i)})
+				live[key] = true
+			}
+			waitForBackgroundWork(t, idx)
+
+			// 2. Delete some of them while a snapshot still needs the deleted versions
+			snap, err := idx.NewSnapshot()
+			if err != nil {
+				t.Fatalf("failed to take snapshot: %v", err)
+			}
+			for i := 0; i < n; i += 3 {
+				key := fmt.Sprintf("key:%04d", i)
+				idx.Delete([]byte(key))
+				live[key] = false
+			}
+			idx.DeleteRange([]byte("key:0400"), []byte("key:0450"))
+			for i := 400; i < 450; i++ {
+				live[fmt.Sprintf("key:%04d", i)] = false
+			}
+
+			check := func(stage string) {
+				for i := 0; i < n; i++ {
+					key := fmt.Sprintf("key:%04d", i)
+					if _, found, err := idx.Get([]byte(key)); err != nil || found != live[key] {
+						t.Fatalf("%s: Get(%s): expected found=%v, got %v (err=%v)", stage, key, live[key], found, err)
+					}
+				}
+				entries, err := idx.ScanRange([]byte("key:"), []byte("key;"), 0)
+				if err != nil {
+					t.Fatalf("%s: failed to scan: %v", stage, err)
+				}
+				for _, e := range entries {
+					if !live[string(e.Key)] {
+						t.Fatalf("%s: deleted key %s reappeared in a scan", stage, e.Key)
+					}
+				}
+			}
+
+			// 3. Compact the tombstones through the levels with unrelated writes,
+			// releasing the snapshot halfway
+			for round := 0; round < 8; round++ {
+				if round == 4 {
+					if _, found, _ := snap.Get([]byte("key:0003")); !found {
+						t.Errorf("expected the snapshot to see key:0003 until it is released")
+					}
+					snap.Release()
+				}
+				for i := 0; i < 200; i++ {
+					idx.Put([]byte(fmt.Sprintf("fill:%d:%03d", round, i)), storage.RecordRef{FileID: 2})
+				}
+				waitForBackgroundWork(t, idx)
+				check(fmt.Sprintf("round %d", round))
+			}
+
+			idx.Close()
+			idx = openManifestTestIndex(t, tmpDir, opts)
+			check("reopen")
+		})
+	}
+}
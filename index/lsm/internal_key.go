@@ -0,0 +1,68 @@
+package lsm
+
+import "math"
+
+// entryKind tells the entries that set a key from the tombstones that delete it.
+type entryKind uint8
+
+const (
+	kindDelete entryKind = 0
+	kindSet    entryKind = 1
+)
+
+// MaxSequence is the largest sequence number a write can be assigned. Reading at
+// MaxSequence sees the latest version of every key.
+const MaxSequence = math.MaxUint64 >> 8
+
+// Every version of a key is stored under an internal key (user key, sequence
+// number, kind). Internal keys sort by user key ascending and then by sequence
+// number descending, so the newest version of a key comes first and a read at a
+// sequence number stops at the first version no newer than it. The WAL records the
+// sequence number as the ID of a write's transaction and the kind as its op type.
+
+// packTag packs the sequence number and kind of an entry into the tag stored with
+// it in a data block.
+func packTag(seq uint64, kind entryKind) uint64 {
+	return seq<<8 | uint64(kind)
+}
+
+// unpackTag splits a tag written by packTag.
+func unpackTag(tag uint64) (uint64, entryKind) {
+	return tag >> 8, entryKind(tag & 0xff)
+}
+
+// kindOf returns the kind of an entry written before kinds were recorded, when an
+// empty value marked a tombstone.
+func kindOf(value string) entryKind {
+	if value == "" {
+		return kindDelete
+	}
+	return kindSet
+}
+
+// internalLess reports whether the version (keyA, seqA) sorts before (keyB, seqB).
+func internalLess(keyA string, seqA uint64, keyB string, seqB uint64) bool {
+	if keyA != keyB {
+		return keyA < keyB
+	}
+	return seqA > seqB
+}
+
+// version is one version of a key found by a point lookup.
+type version struct {
+	value string
+	seq   uint64
+	kind  entryKind
+}
+
+// rangeDeleted reports whether one of a layer's range tombstones visible at readSeq
+// covers key, either hiding the layer's version of it, written at seq, or hiding the
+// key in older layers if the layer has no version of it (found is false).
+func rangeDeleted(tombstones []RangeTombstone, key string, seq uint64, found bool, readSeq uint64) bool {
+	for _, t := range tombstones {
+		if t.hides(key, seq, !found, readSeq) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,437 @@
+package lsm
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/raman20/storage"
+)
+
+// layerIterator is a cursor over one layer of the tree, a memtable or an SSTable,
+// yielding its entries in ascending internal key order: by key, then newest version
+// first. Seeks land on the newest version of a key and seekLT on the oldest version
+// of the key before. Entries written before sequence numbers were recorded have
+// sequence number 0. A layer that fails to read becomes invalid and reports the
+// failure from error.
+type layerIterator interface {
+	first()
+	last()
+	seekGE(key string)
+	seekLT(key string)
+	next()
+	prev()
+	valid() bool
+	key() string
+	value() (string, error)
+	seq() uint64
+	kind() entryKind
+	error() error
+}
+
+type memEntry struct {
+	key   string
+	value string
+	seq   uint64
+	kind  entryKind
+}
+
+// sliceLayer iterates a copy of the active memtable, which keeps changing after
+// the iterator is created.
+type sliceLayer struct {
+	entries []memEntry
+	pos     int
+}
+
+func (l *sliceLayer) first() { l.pos = 0 }
+func (l *sliceLayer) last()  { l.pos = len(l.entries) - 1 }
+func (l *sliceLayer) next()  { l.pos++ }
+func (l *sliceLayer) prev()  { l.pos-- }
+
+func (l *sliceLayer) seekGE(key string) {
+	l.pos = sort.Search(len(l.entries), func(i int) bool { return l.entries[i].key >= key })
+}
+
+func (l *sliceLayer) seekLT(key string) {
+	l.seekGE(key)
+	l.pos--
+}
+
+func (l *sliceLayer) valid() bool            { return l.pos >= 0 && l.pos < len(l.entries) }
+func (l *sliceLayer) key() string            { return l.entries[l.pos].key }
+func (l *sliceLayer) value() (string, error) { return l.entries[l.pos].value, nil }
+func (l *sliceLayer) seq() uint64            { return l.entries[l.pos].seq }
+func (l *sliceLayer) kind() entryKind        { return l.entries[l.pos].kind }
+func (l *sliceLayer) error() error           { return nil }
+
+// skipListLayer iterates an immutable memtable in place.
+type skipListLayer struct {
+	sl   *SkipList
+	node *SkipListNode
+}
+
+func (l *skipListLayer) first()            { l.node = l.sl.head.levels[0] }
+func (l *skipListLayer) last()             { l.node = l.sl.findLast() }
+func (l *skipListLayer) seekGE(key string) { l.node = l.sl.findGE(key) }
+func (l *skipListLayer) seekLT(key string) { l.node = l.sl.findLT(key) }
+func (l *skipListLayer) next()             { l.node = l.node.levels[0] }
+func (l *skipListLayer) prev()             { l.node = l.sl.findLT(l.node.key) }
+
+func (l *skipListLayer) valid() bool            { return l.node != nil }
+func (l *skipListLayer) key() string            { return l.node.key }
+func (l *skipListLayer) value() (string, error) { return l.node.value, nil }
+func (l *skipListLayer) seq() uint64            { return l.node.seq }
+func (l *skipListLayer) kind() entryKind        { return l.node.kind }
+func (l *skipListLayer) error() error           { return nil }
+
+// flatLayer iterates a flat-format SSTable through its in-memory index block,
+// reading values from disk only when asked for.
+type flatLayer struct {
+	sst *SSTable
+	pos int
+}
+
+func (l *flatLayer) first()            { l.pos = 0 }
+func (l *flatLayer) last()             { l.pos = len(l.sst.index) - 1 }
+func (l *flatLayer) seekGE(key string) { l.pos = sortSearchKeys(l.sst.index, key) }
+func (l *flatLayer) seekLT(key string) { l.pos = sortSearchKeys(l.sst.index, key) - 1 }
+func (l *flatLayer) next()             { l.pos++ }
+func (l *flatLayer) prev()             { l.pos-- }
+
+func (l *flatLayer) valid() bool  { return l.pos >= 0 && l.pos < len(l.sst.index) }
+func (l *flatLayer) key() string  { return l.sst.index[l.pos].Key }
+func (l *flatLayer) seq() uint64  { return 0 }
+func (l *flatLayer) error() error { return nil }
+
+// kind tells tombstones by their empty value, so that it needs no read.
+func (l *flatLayer) kind() entryKind {
+	if l.sst.index[l.pos].ValLen == 0 {
+		return kindDelete
+	}
+	return kindSet
+}
+
+func (l *flatLayer) value() (string, error) {
+	entry := l.sst.index[l.pos]
+	valBuf := make([]byte, entry.ValLen)
+	if _, err := l.sst.file.ReadAt(valBuf, entry.Offset+8+int64(len(entry.Key))); err != nil {
+		return "", fmt.Errorf("failed to read value from SSTable: %w", err)
+	}
+	return string(valBuf), nil
+}
+
+// visibleLayer hides the versions of a layer written after a snapshot's sequence
+// number. Every version of a key is newer than the ones after it in the layer, so
+// skipping forward lands on the newest visible version; skipping backward lands on
+// some visible version, which the mergingIterator then seeks to the newest one.
+type visibleLayer struct {
+	layerIterator
+	readSeq uint64
+}
+
+func (l *visibleLayer) first()            { l.layerIterator.first(); l.skipNewer() }
+func (l *visibleLayer) last()             { l.layerIterator.last(); l.skipNewerBackward() }
+func (l *visibleLayer) seekGE(key string) { l.layerIterator.seekGE(key); l.skipNewer() }
+func (l *visibleLayer) seekLT(key string) { l.layerIterator.seekLT(key); l.skipNewerBackward() }
+func (l *visibleLayer) next()             { l.layerIterator.next(); l.skipNewer() }
+func (l *visibleLayer) prev()             { l.layerIterator.prev(); l.skipNewerBackward() }
+
+func (l *visibleLayer) skipNewer() {
+	for l.valid() && l.seq() > l.readSeq {
+		l.layerIterator.next()
+	}
+}
+
+func (l *visibleLayer) skipNewerBackward() {
+	for l.valid() && l.seq() > l.readSeq {
+		l.layerIterator.prev()
+	}
+}
+
+// mergingIterator merges the layers of the tree into a single ordered stream with
+// one entry per key: the version with the highest sequence number, or from the
+// newest layer among versions without one. Range tombstones are left to the caller.
+//
+// Every layer is kept at the newest version of a key at or after the current key.
+// Moving backward finds the previous key with seekLT and then seeks every layer to it.
+type mergingIterator struct {
+	layers  []layerIterator // Newest first
+	current int             // Layer holding the current key, or -1
+}
+
+func (m *mergingIterator) first() {
+	for _, l := range m.layers {
+		l.first()
+	}
+	m.findSmallest()
+}
+
+func (m *mergingIterator) last() {
+	for _, l := range m.layers {
+		l.last()
+	}
+	m.seekLargest()
+}
+
+func (m *mergingIterator) seekGE(key string) {
+	for _, l := range m.layers {
+		l.seekGE(key)
+	}
+	m.findSmallest()
+}
+
+func (m *mergingIterator) seekLT(key string) {
+	for _, l := range m.layers {
+		l.seekLT(key)
+	}
+	m.seekLargest()
+}
+
+func (m *mergingIterator) next() {
+	key := m.key()
+	for _, l := range m.layers {
+		// Skip every version of the current key
+		for l.valid() && l.key() == key {
+			l.next()
+		}
+	}
+	m.findSmallest()
+}
+
+func (m *mergingIterator) prev() {
+	m.seekLT(m.key())
+}
+
+func (m *mergingIterator) findSmallest() {
+	m.current = -1
+	for i, l := range m.layers {
+		if l.valid() && (m.current < 0 || l.key() < m.key() || l.key() == m.key() && l.seq() > m.seq()) {
+			m.current = i
+		}
+	}
+}
+
+// seekLargest finds the largest key the layers are positioned at, which may be any
+// version of it, and seeks every layer to its newest version.
+func (m *mergingIterator) seekLargest() {
+	m.current = -1
+	for i, l := range m.layers {
+		if l.valid() && (m.current < 0 || l.key() > m.key()) {
+			m.current = i
+		}
+	}
+	if m.current >= 0 {
+		m.seekGE(m.key())
+	}
+}
+
+func (m *mergingIterator) valid() bool            { return m.current >= 0 }
+func (m *mergingIterator) key() string            { return m.layers[m.current].key() }
+func (m *mergingIterator) value() (string, error) { return m.layers[m.current].value() }
+func (m *mergingIterator) seq() uint64            { return m.layers[m.current].seq() }
+
+// error returns the first read failure of a layer.
+func (m *mergingIterator) error() error {
+	for _, l := range m.layers {
+		if err := l.error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lsmIterator is the storage.IndexIterator of an LSMIndex. It skips deleted keys and
+// keys outside its bounds, and holds the SSTables it reads so that compaction does
+// not delete them before it is closed.
+type lsmIterator struct {
+	merged    *mergingIterator
+	rangeDels [][]RangeTombstone // Range tombstones of each layer
+	readSeq   uint64             // Last write the iterator sees
+	lower     string
+	upper     string
+	hasUpper  bool
+	ssts      []*SSTable
+
+	key    []byte
+	ref    storage.RecordRef
+	valid  bool
+	err    error
+	closed bool
+}
+
+// NewIterator returns an iterator over the keys of the index in ascending order,
+// merging the active memtable, the immutable memtables and the SSTables. The active
+// memtable's entries within the bounds are copied; every other layer is read in place.
+func (idx *LSMIndex) NewIterator(opts storage.IterOptions) (storage.IndexIterator, error) {
+	return idx.newIterator(opts, MaxSequence)
+}
+
+// newIterator returns an iterator over the versions of the keys visible once the
+// write with sequence number readSeq was applied.
+func (idx *LSMIndex) newIterator(opts storage.IterOptions, readSeq uint64) (storage.IndexIterator, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if idx.closed {
+		return nil, storage.ErrDBClosed
+	}
+
+	it := &lsmIterator{
+		readSeq:  readSeq,
+		lower:    string(opts.LowerBound),
+		upper:    string(opts.UpperBound),
+		hasUpper: opts.UpperBound != nil,
+		ssts:     append([]*SSTable(nil), idx.sstables...),
+	}
+
+	// Layers are ordered newest first so the latest version of a key wins
+	layers := []layerIterator{&sliceLayer{entries: idx.currMemtable.copyRange(it.lower, it.upper, it.hasUpper)}}
+	it.rangeDels = append(it.rangeDels, idx.currMemtable.RangeTombstones())
+	for i := len(idx.immutable) - 1; i >= 0; i-- {
+		layers = append(layers, &skipListLayer{sl: idx.immutable[i].DataBlock()})
+		it.rangeDels = append(it.rangeDels, idx.immutable[i].RangeTombstones())
+	}
+	for _, sst := range it.ssts {
+		sst.readers.Add(1)
+		layers = append(layers, sst.newLayer())
+		it.rangeDels = append(it.rangeDels, sst.RangeTombstones())
+	}
+
+	if readSeq != MaxSequence {
+		for i, l := range layers {
+			layers[i] = &visibleLayer{layerIterator: l, readSeq: readSeq}
+		}
+	}
+	it.merged = &mergingIterator{layers: layers}
+	return it, nil
+}
+
+func (it *lsmIterator) First() bool {
+	if it.lower != "" {
+		it.merged.seekGE(it.lower)
+	} else {
+		it.merged.first()
+	}
+	return it.skipForward()
+}
+
+func (it *lsmIterator) Last() bool {
+	if it.hasUpper {
+		it.merged.seekLT(it.upper)
+	} else {
+		it.merged.last()
+	}
+	return it.skipBackward()
+}
+
+func (it *lsmIterator) Seek(key []byte) bool {
+	target := string(key)
+	if target < it.lower {
+		target = it.lower
+	}
+	it.merged.seekGE(target)
+	return it.skipForward()
+}
+
+func (it *lsmIterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+	it.merged.next()
+	return it.skipForward()
+}
+
+func (it *lsmIterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	it.merged.prev()
+	return it.skipBackward()
+}
+
+// skipForward moves past tombstones to the next live key within the upper bound.
+func (it *lsmIterator) skipForward() bool {
+	for it.merged.valid() {
+		if it.hasUpper && it.merged.key() >= it.upper {
+			break
+		}
+		if it.load() {
+			return true
+		}
+		if it.err != nil {
+			break
+		}
+		it.merged.next()
+	}
+	it.stop()
+	return false
+}
+
+// skipBackward moves past tombstones to the previous live key within the lower bound.
+func (it *lsmIterator) skipBackward() bool {
+	for it.merged.valid() {
+		if it.merged.key() < it.lower {
+			break
+		}
+		if it.load() {
+			return true
+		}
+		if it.err != nil {
+			break
+		}
+		it.merged.prev()
+	}
+	it.stop()
+	return false
+}
+
+// stop invalidates the iterator, keeping any read failure of the layers.
+func (it *lsmIterator) stop() {
+	it.valid = false
+	if it.err == nil {
+		it.err = it.merged.error()
+	}
+}
+
+// load reads the entry under the merged cursor and reports whether it is live.
+func (it *lsmIterator) load() bool {
+	key, seq := it.merged.key(), it.merged.seq()
+	if it.merged.layers[it.merged.current].kind() == kindDelete {
+		return false // Tombstone
+	}
+	for i, rangeDels := range it.rangeDels[:it.merged.current+1] {
+		for _, t := range rangeDels {
+			if t.hides(key, seq, i < it.merged.current, it.readSeq) {
+				return false // Deleted by a range tombstone
+			}
+		}
+	}
+
+	value, err := it.merged.value()
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.key = []byte(key)
+	it.ref = unmarshalRef(value)
+	it.valid = true
+	return true
+}
+
+func (it *lsmIterator) Valid() bool              { return it.valid }
+func (it *lsmIterator) Key() []byte              { return it.key }
+func (it *lsmIterator) Value() storage.RecordRef { return it.ref }
+func (it *lsmIterator) Error() error             { return it.err }
+
+// Close releases the SSTables held by the iterator.
+func (it *lsmIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.valid = false
+	for _, sst := range it.ssts {
+		sst.readers.Done()
+	}
+	return nil
+}
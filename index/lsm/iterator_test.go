@@ -0,0 +1,144 @@
+package lsm
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/raman20/storage"
+)
+
+func TestLSMIndexIterator(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "lsm_iterator_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	walDir := filepath.Join(tmpDir, "wal")
+	sstDir := filepath.Join(tmpDir, "sst")
+	os.MkdirAll(walDir, 0755)
+	os.MkdirAll(sstDir, 0755)
+
+	idx, err := NewLSMIndex(walDir, sstDir, storage.Options{MemtableSize: 512, CompactionThreshold: 4})
+	if err != nil {
+		t.Fatalf("failed to create LSMIndex: %v", err)
+	}
+	defer idx.Close()
+
+	// 1. Spread overwrites and deletes across memtables and SSTables
+	rng := rand.New(rand.NewSource(1))
+	model := make(map[string]storage.RecordRef)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key_%03d", rng.Intn(300))
+		if rng.Intn(4) == 0 {
+			idx.Delete([]byte(key))
+			delete(model, key)
+			continue
+		}
+		ref := storage.RecordRef{FileID: 1, Offset: int64(i), Length: 10}
+		idx.Put([]byte(key), ref)
+		model[key] = ref
+	}
+	time.Sleep(50 * time.Millisecond) // Let background flushes and compactions run
+
+	var keys []string
+	for k := range model {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	expectRange := func(opts storage.IterOptions) []string {
+		var want []string
+		for _, k := range keys {
+			if k >= string(opts.LowerBound) && (opts.UpperBound == nil || k < string(opts.UpperBound)) {
+				want = append(want, k)
+			}
+		}
+		return want
+	}
+
+	check := func(name string, opts storage.IterOptions) {
+		want := expectRange(opts)
+		it, err := idx.NewIterator(opts)
+		if err != nil {
+			t.Fatalf("%s: failed to create iterator: %v", name, err)
+		}
+		defer it.Close()
+
+		// Forward
+		var got []string
+		for ok := it.First(); ok; ok = it.Next() {
+			got = append(got, string(it.Key()))
+			if ref := model[string(it.Key())]; it.Value() != ref {
+				t.Errorf("%s: key %s: expected %+v, got %+v", name, it.Key(), ref, it.Value())
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: forward iteration mismatch:\n got %v\nwant %v", name, got, want)
+		}
+
+		// Backward
+		got = got[:0]
+		for ok := it.Last(); ok; ok = it.Prev() {
+			got = append([]string{string(it.Key())}, got...)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: backward iteration mismatch:\n got %v\nwant %v", name, got, want)
+		}
+
+		// Changing direction mid-stream revisits neighbours
+		if len(want) >= 3 {
+			it.Seek([]byte(want[1]))
+			if !it.Next() || string(it.Key()) != want[2] {
+				t.Errorf("%s: expected Next to %s, got %s", name, want[2], it.Key())
+			}
+			if !it.Prev() || !it.Prev() || string(it.Key()) != want[0] {
+				t.Errorf("%s: expected Prev twice to %s, got %s", name, want[0], it.Key())
+			}
+			if it.Prev() {
+				t.Errorf("%s: expected Prev before the first key to invalidate, got %s", name, it.Key())
+			}
+		}
+		if err := it.Error(); err != nil {
+			t.Errorf("%s: iterator error: %v", name, err)
+		}
+	}
+
+	check("unbounded", storage.IterOptions{})
+	check("bounded", storage.IterOptions{LowerBound: []byte("key_050"), UpperBound: []byte("key_150")})
+	check("prefix", storage.PrefixBounds([]byte("key_2")))
+	check("empty", storage.IterOptions{LowerBound: []byte("zzz")})
+
+	// 2. Seek lands on the first live key at or after the target, within bounds
+	it, _ := idx.NewIterator(storage.IterOptions{LowerBound: []byte("key_100")})
+	if !it.Seek([]byte("a")) || string(it.Key()) < "key_100" {
+		t.Errorf("expected Seek below the lower bound to clamp to it, got %s", it.Key())
+	}
+	want := expectRange(storage.IterOptions{LowerBound: []byte("key_2000")})
+	if it.Seek([]byte("key_2000")); len(want) > 0 && string(it.Key()) != want[0] {
+		t.Errorf("expected Seek to land on %s, got %s", want[0], it.Key())
+	}
+
+	// 3. An open iterator keeps reading its view while later writes are compacted
+	for i := 0; i < 2000; i++ {
+		idx.Delete([]byte(fmt.Sprintf("key_%03d", i%300)))
+	}
+	time.Sleep(50 * time.Millisecond)
+	n := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		n++
+	}
+	if n != len(expectRange(storage.IterOptions{LowerBound: []byte("key_100")})) || it.Error() != nil {
+		t.Errorf("expected the iterator's view to survive compaction, got %d keys (err=%v)", n, it.Error())
+	}
+	it.Close()
+
+	if refs, err := idx.Scan([]byte("key_")); err != nil || len(refs) != 0 {
+		t.Errorf("expected every key deleted, got %d (err=%v)", len(refs), err)
+	}
+}
@@ -7,12 +7,13 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
-	"github.com/google/uuid"
 	"github.com/raman20/storage"
 )
 
@@ -21,96 +22,173 @@ type LSMIndex struct {
 	immutable    []*Memtable
 	sstables     []*SSTable
 	mu           sync.RWMutex
+	sched        *scheduler     // Runs flushes and compactions
+	stalls       *sync.Cond     // On mu; signaled when background work makes room for writes
+	bgErr        error          // First flush or compaction failure; fails later writes
+	removals     sync.WaitGroup // Pending removals of flushed WALs and compacted tables
 	options      storage.Options
+	cache        *blockCache // Data blocks of every SSTable, nil if disabled
+	manifest     *manifest   // Log of the live SSTables and WALs
+	levels       levelConfig
 	walDir       string
 	sstDir       string
 	closed       bool
+	epoch        uint64         // Bumped by Reset so in-flight flushes/compactions discard their output
+	nextWAL      uint64         // Number of the next WAL file
+	seq          atomic.Uint64  // Last sequence number assigned to a write
+	snapshots    map[uint64]int // Live snapshots by sequence number
+
+	// Largest key of the last table compacted out of each level; the next leveled
+	// compaction of the level starts after it
+	compactPointer [numLevels]string
+
+	// Bloom filter probes made by Get, the probes that skipped a table, and the
+	// probes that passed for a key the table did not hold
+	bloomChecks         atomic.Uint64
+	bloomNegatives      atomic.Uint64
+	bloomFalsePositives atomic.Uint64
+
+	// Bytes of SSTables written by flushes and by compactions
+	flushedBytes   atomic.Uint64
+	compactedBytes atomic.Uint64
+
+	// Writes stalled by makeRoomForWrite and the nanoseconds they waited
+	writeStalls atomic.Uint64
+	stallTime   atomic.Int64
 }
 
-// NewLSMIndex initializes the LSM-Tree index and loads existing SSTables and WALs.
+// NewLSMIndex initializes the LSM-Tree index and loads the SSTables and WALs
+// recorded in its manifest.
 func NewLSMIndex(walDir, sstDir string, opts storage.Options) (*LSMIndex, error) {
 	idx := &LSMIndex{
-		walDir:  walDir,
-		sstDir:  sstDir,
-		options: opts,
+		walDir:    walDir,
+		sstDir:    sstDir,
+		options:   opts,
+		cache:     newBlockCache(blockCacheSize(opts.BlockCacheSize)),
+		levels:    newLevelConfig(opts),
+		snapshots: make(map[uint64]int),
+	}
+	idx.stalls = sync.NewCond(&idx.mu)
+	// Leveled compactions claim the tables they merge, so several can run at once
+	idx.sched = newScheduler(opts.MaxConcurrency, [numJobKinds]func() error{
+		jobFlush:      idx.flushImmutableMemtables,
+		jobCompaction: idx.compactTables,
+	}, [numJobKinds]bool{
+		jobCompaction: opts.CompactionStyle == storage.CompactionLeveled,
+	}, idx.backgroundFailed)
+
+	// 1. Replay the manifest, or build one from the directories of an index that
+	// predates it
+	m, found, err := loadManifest(sstDir)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		err = m.removeObsolete(walDir, sstDir)
+	} else {
+		err = m.discover(walDir, sstDir)
 	}
-
-	// 1. Load existing SSTables from sstDir
-	ssts, err := os.ReadDir(sstDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read SST directory: %w", err)
+		return nil, err
 	}
+	idx.manifest = m
 
-	var sstFiles []string
-	for _, entry := range ssts {
-		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".sst" {
-			sstFiles = append(sstFiles, entry.Name())
+	fail := func(err error) (*LSMIndex, error) {
+		for _, mt := range idx.immutable {
+			mt.Close()
 		}
+		for _, opened := range idx.sstables {
+			opened.Close()
+		}
+		m.close()
+		return nil, err
 	}
 
-	sort.Strings(sstFiles)
-
-	for i := len(sstFiles) - 1; i >= 0; i-- {
-		sstPathFile := filepath.Join(sstDir, sstFiles[i])
-		sst, err := OpenSSTable(sstPathFile)
+	// 2. Open the live SSTables, newest first
+	for i := len(m.tables) - 1; i >= 0; i-- {
+		t := m.tables[i]
+		sst, err := openSSTable(filepath.Join(sstDir, t.name), idx.cache)
 		if err != nil {
-			for _, opened := range idx.sstables {
-				opened.Close()
-			}
-			return nil, fmt.Errorf("failed to open SSTable %s: %w", sstFiles[i], err)
+			return fail(fmt.Errorf("failed to open SSTable %s: %w", t.name, err))
 		}
+		sst.level = t.level
 		idx.sstables = append(idx.sstables, sst)
 	}
+	orderTables(idx.sstables)
 
-	// 2. Recover existing WAL files as immutable memtables
-	wals, err := os.ReadDir(walDir)
-	if err != nil {
-		for _, opened := range idx.sstables {
-			opened.Close()
+	// 3. Recover the live WALs as immutable memtables, oldest first by the sequence
+	// numbers of their entries
+	for _, wal := range m.wals {
+		mt, err := InitMemtable(filepath.Join(walDir, wal), opts.MemtableSize, opts.SyncPolicy())
+		if err != nil {
+			return fail(fmt.Errorf("failed to initialize memtable from WAL %s: %w", wal, err))
+		}
+		idx.immutable = append(idx.immutable, mt)
+		if n, ok := walNumber(wal); ok {
+			idx.nextWAL = max(idx.nextWAL, n)
 		}
-		return nil, fmt.Errorf("failed to read WAL directory: %w", err)
 	}
+	sort.SliceStable(idx.immutable, func(i, j int) bool {
+		return idx.immutable[i].MaxSeq() < idx.immutable[j].MaxSeq()
+	})
+	idx.nextWAL++
 
-	for _, wal := range wals {
-		if !wal.IsDir() {
-			mt, err := InitMemtable(filepath.Join(walDir, wal.Name()), opts.MemtableSize)
-			if err != nil {
-				for _, opened := range idx.sstables {
-					opened.Close()
-				}
-				return nil, fmt.Errorf("failed to initialize memtable from WAL %s: %w", wal.Name(), err)
-			}
-			idx.immutable = append(idx.immutable, mt)
-		}
+	// New writes continue after the last sequence number recovered
+	var lastSeq uint64
+	for _, mt := range idx.immutable {
+		lastSeq = max(lastSeq, mt.MaxSeq())
 	}
+	for _, sst := range idx.sstables {
+		lastSeq = max(lastSeq, sst.maxSeq)
+	}
+	idx.seq.Store(lastSeq)
 
-	// 3. Create initial active memtable
+	// 4. Compact the manifest and create the initial active memtable
+	if err := m.rewrite(); err != nil {
+		return fail(err)
+	}
 	if err := idx.rotateMemtable(); err != nil {
-		for _, opened := range idx.sstables {
-			opened.Close()
-		}
-		return nil, err
+		return fail(err)
 	}
 
 	return idx, nil
 }
 
+// rotateMemtable starts a new active memtable, logging its WAL in the manifest
+// before anything is written to it, and queues the current one for flushing.
 func (idx *LSMIndex) rotateMemtable() error {
-	walFile := filepath.Join(idx.walDir, uuid.NewString()+".log")
-	newMemtable, err := InitMemtable(walFile, idx.options.MemtableSize)
+	walFile := filepath.Join(idx.walDir, fmt.Sprintf("%020d.log", idx.nextWAL))
+	idx.nextWAL++
+	newMemtable, err := InitMemtable(walFile, idx.options.MemtableSize, idx.options.SyncPolicy())
 	if err != nil {
 		return fmt.Errorf("failed to create active memtable: %w", err)
 	}
+	newMemtable.seq = &idx.seq
+
+	edit := &versionEdit{}
+	edit.addWAL(newMemtable)
+	if err := idx.manifest.logEdit(edit); err != nil {
+		newMemtable.Close()
+		os.Remove(walFile)
+		return fmt.Errorf("failed to log new WAL: %w", err)
+	}
 
 	if idx.currMemtable != nil {
 		idx.immutable = append(idx.immutable, idx.currMemtable)
-		go idx.flushImmutableMemtables()
+		idx.sched.schedule(jobFlush)
 	}
 
 	idx.currMemtable = newMemtable
 	return nil
 }
 
+// walNumber returns the number of a WAL file named by rotateMemtable. WAL files of
+// older indexes are named by UUID and have none.
+func walNumber(name string) (uint64, bool) {
+	n, err := strconv.ParseUint(strings.TrimSuffix(name, ".log"), 10, 64)
+	return n, err == nil
+}
+
 func marshalRef(ref storage.RecordRef) string {
 	buf := make([]byte, 16)
 	binary.BigEndian.PutUint32(buf[0:4], ref.FileID)
@@ -134,32 +212,138 @@ func unmarshalRef(data string) storage.RecordRef {
 	}
 }
 
-// Put maps a key to its RecordRef in the active memtable.
-func (idx *LSMIndex) Put(key []byte, ref storage.RecordRef) error {
+// writable returns the error a write fails with: ErrDBClosed once the index is
+// closed, or the failure of a flush or compaction. Must hold idx.mu.
+func (idx *LSMIndex) writable() error {
+	if idx.closed {
+		return storage.ErrDBClosed
+	}
+	if idx.bgErr != nil {
+		return fmt.Errorf("background work failed: %w", idx.bgErr)
+	}
+	return nil
+}
+
+// write applies a write to the active memtable, making room for it whenever the
+// memtable is full. A write that does not fit into an empty memtable fails with
+// ErrMemtableFull. Must hold idx.mu.
+func (idx *LSMIndex) write(apply func(mt *Memtable) error) error {
+	if err := idx.writable(); err != nil {
+		return err
+	}
+	for {
+		mt := idx.currMemtable
+		err := apply(mt)
+		if !errors.Is(err, ErrMemtableFull) || mt.Size() == 0 {
+			return err
+		}
+		if err := idx.makeRoomForWrite(mt); err != nil {
+			return err
+		}
+	}
+}
+
+// makeRoomForWrite replaces the full active memtable. While MaxImmutableMemtables
+// memtables wait to be flushed or L0 holds L0StopTrigger tables, the write stalls
+// until background work catches up, so that memory and read amplification stay
+// bounded. Must hold idx.mu.
+func (idx *LSMIndex) makeRoomForWrite(full *Memtable) error {
+	var stalledAt time.Time
+	for idx.currMemtable == full {
+		job, stalled := idx.stalled()
+		if !stalled {
+			break
+		}
+		if stalledAt.IsZero() {
+			stalledAt = time.Now()
+			idx.writeStalls.Add(1)
+			// Memtables and tables recovered on open have no job queued yet
+			idx.sched.schedule(job)
+		}
+		idx.stalls.Wait()
+		if err := idx.writable(); err != nil {
+			return err
+		}
+	}
+	if !stalledAt.IsZero() {
+		idx.stallTime.Add(int64(time.Since(stalledAt)))
+	}
+
+	if idx.currMemtable != full {
+		return nil // Another write made room while this one waited
+	}
+	return idx.rotateMemtable()
+}
+
+// stalled reports whether writes must wait for background work before starting a
+// new memtable, and the kind of job they wait for. Must hold idx.mu.
+func (idx *LSMIndex) stalled() (jobKind, bool) {
+	if len(idx.immutable) >= idx.levels.maxImmutable {
+		return jobFlush, true
+	}
+	l0 := 0
+	for _, sst := range idx.sstables {
+		if sst.level == 0 {
+			l0++
+		}
+	}
+	return jobCompaction, l0 >= idx.levels.l0Stop
+}
+
+// backgroundFailed records the first failure of a flush or compaction, which fails
+// every later write, and wakes stalled writes to report it.
+func (idx *LSMIndex) backgroundFailed(err error) {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	if idx.closed {
-		return storage.ErrDBClosed
+	if idx.bgErr == nil && !idx.closed {
+		idx.bgErr = err
 	}
+	idx.stalls.Broadcast()
+}
+
+// Put maps a key to its RecordRef in the active memtable.
+func (idx *LSMIndex) Put(key []byte, ref storage.RecordRef) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
 
 	valStr := marshalRef(ref)
-	err := idx.currMemtable.Set(string(key), valStr)
-	if err != nil {
-		if errors.Is(err, ErrMemtableFull) {
-			if err := idx.rotateMemtable(); err != nil {
-				return err
-			}
-			return idx.currMemtable.Set(string(key), valStr)
+	return idx.write(func(mt *Memtable) error {
+		return mt.Set(string(key), valStr)
+	})
+}
+
+// ApplyBatch applies ops to the active memtable as one WAL transaction, so a group
+// of writes costs a single WAL sync and is recovered all or nothing.
+func (idx *LSMIndex) ApplyBatch(ops []storage.IndexOp) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	entries := make([]BatchEntry, len(ops))
+	for i, op := range ops {
+		if op.End != nil && string(op.End) <= string(op.Key) {
+			return storage.ErrInvalidRange
+		}
+		entries[i] = BatchEntry{Key: string(op.Key), Delete: op.Delete, End: string(op.End)}
+		if !op.Delete {
+			entries[i].Value = marshalRef(op.Ref)
 		}
-		return err
 	}
 
-	return nil
+	return idx.write(func(mt *Memtable) error {
+		return mt.Apply(entries)
+	})
 }
 
 // Get retrieves the RecordRef for a key by searching the memtables and SSTables.
 func (idx *LSMIndex) Get(key []byte) (storage.RecordRef, bool, error) {
+	return idx.GetAt(key, MaxSequence)
+}
+
+// GetAt retrieves the RecordRef a key had once the write with sequence number seq
+// was applied. Compaction only keeps the older versions that a live Snapshot can
+// see, so reads at other sequence numbers may miss versions it discarded.
+func (idx *LSMIndex) GetAt(key []byte, seq uint64) (storage.RecordRef, bool, error) {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
@@ -169,122 +353,138 @@ func (idx *LSMIndex) Get(key []byte) (storage.RecordRef, bool, error) {
 
 	keyStr := string(key)
 
-	// 1. Check active memtable
-	if value, found := idx.currMemtable.Get(keyStr); found {
-		if value == "" {
-			return storage.RecordRef{}, false, nil // Tombstone
-		}
-		return unmarshalRef(value), true, nil
-	}
+	// Layers are searched newest first. The first layer holding a version of the key
+	// visible at seq has the answer, unless one of its range tombstones hides that
+	// version; a layer without one may still hide the key in older layers.
 
-	// 2. Check immutable memtables (newest to oldest)
+	// 1. Check active memtable, then immutable memtables (newest to oldest)
+	mts := []*Memtable{idx.currMemtable}
 	for i := len(idx.immutable) - 1; i >= 0; i-- {
-		mt := idx.immutable[i]
-		if value, found := mt.Get(keyStr); found {
-			if value == "" {
-				return storage.RecordRef{}, false, nil // Tombstone
-			}
-			return unmarshalRef(value), true, nil
+		mts = append(mts, idx.immutable[i])
+	}
+	for _, mt := range mts {
+		if v, found, deleted := mt.lookup(keyStr, seq); found || deleted {
+			return resolveVersion(v, deleted)
 		}
 	}
 
-	// 3. Check SSTables (newest to oldest)
+	// 2. Check SSTables (newest to oldest), skipping those whose filter rules the key out
 	for _, sst := range idx.sstables {
-		if value, found, err := sst.Get(keyStr); err == nil && found {
-			if value == "" {
-				return storage.RecordRef{}, false, nil // Tombstone
+		filtered := len(sst.filter) > 0
+		if filtered {
+			idx.bloomChecks.Add(1)
+		}
+		if filtered && !sst.mayContain(keyStr) {
+			idx.bloomNegatives.Add(1)
+			if rangeDeleted(sst.rangeDels, keyStr, 0, false, seq) {
+				return storage.RecordRef{}, false, nil
 			}
-			return unmarshalRef(value), true, nil
+			continue
+		}
+
+		v, found, deleted, err := sst.lookup(keyStr, seq)
+		if err != nil {
+			return storage.RecordRef{}, false, err
+		}
+		if found || deleted {
+			return resolveVersion(v, deleted)
+		}
+		if filtered {
+			idx.bloomFalsePositives.Add(1)
 		}
 	}
 
 	return storage.RecordRef{}, false, nil
 }
 
+// resolveVersion returns the RecordRef held by the version a lookup found.
+func resolveVersion(v version, deleted bool) (storage.RecordRef, bool, error) {
+	if deleted || v.kind == kindDelete {
+		return storage.RecordRef{}, false, nil // Tombstone
+	}
+	return unmarshalRef(v.value), true, nil
+}
+
 // Delete writes a tombstone for a key.
 func (idx *LSMIndex) Delete(key []byte) error {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
-	if idx.closed {
-		return storage.ErrDBClosed
+	return idx.write(func(mt *Memtable) error {
+		return mt.Delete(string(key))
+	})
+}
+
+// DeleteRange deletes every key in [start, end) with a single range tombstone.
+func (idx *LSMIndex) DeleteRange(start, end []byte) error {
+	if string(end) <= string(start) {
+		return storage.ErrInvalidRange
 	}
 
-	err := idx.currMemtable.Delete(string(key))
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.write(func(mt *Memtable) error {
+		return mt.DeleteRange(string(start), string(end))
+	})
+}
+
+// ScanRange returns up to limit entries with keys in [start, end), in key order.
+// A nil end leaves the range unbounded and a limit <= 0 returns every entry.
+func (idx *LSMIndex) ScanRange(start, end []byte, limit int) ([]storage.IterEntry, error) {
+	it, err := idx.NewIterator(storage.IterOptions{LowerBound: start, UpperBound: end})
 	if err != nil {
-		if errors.Is(err, ErrMemtableFull) {
-			if err := idx.rotateMemtable(); err != nil {
-				return err
-			}
-			return idx.currMemtable.Delete(string(key))
-		}
-		return err
+		return nil, err
 	}
+	defer it.Close()
 
-	return nil
+	var entries []storage.IterEntry
+	for ok := it.First(); ok && (limit <= 0 || len(entries) < limit); ok = it.Next() {
+		entries = append(entries, storage.IterEntry{Key: it.Key(), Ref: it.Value()})
+	}
+	return entries, it.Error()
 }
 
-// Scan returns all RecordRefs whose keys start with the prefix.
+// Scan returns all RecordRefs whose keys start with the prefix, in key order.
 func (idx *LSMIndex) Scan(prefix []byte) ([]storage.RecordRef, error) {
-	idx.mu.RLock()
-	defer idx.mu.RUnlock()
-
-	if idx.closed {
-		return nil, storage.ErrDBClosed
+	it, err := idx.NewIterator(storage.PrefixBounds(prefix))
+	if err != nil {
+		return nil, err
 	}
+	defer it.Close()
 
-	prefixStr := string(prefix)
-	results := make(map[string]string)
-
-	// 1. Scan SSTables (oldest to newest)
-	for i := len(idx.sstables) - 1; i >= 0; i-- {
-		sst := idx.sstables[i]
-		pos := sortSearchKeys(sst.IndexBlock(), prefixStr)
-
-		for j := pos; j < len(sst.IndexBlock()); j++ {
-			entry := sst.IndexBlock()[j]
-			if !strings.HasPrefix(entry.Key, prefixStr) {
-				break
-			}
-			valOffset := entry.Offset + 8 + int64(len(entry.Key))
-			valBuf := make([]byte, entry.ValLen)
-			if _, err := sst.FileHandle().ReadAt(valBuf, valOffset); err != nil {
-				return nil, fmt.Errorf("failed to read value during scan: %w", err)
-			}
-			results[entry.Key] = string(valBuf)
-		}
+	var refs []storage.RecordRef
+	for ok := it.First(); ok; ok = it.Next() {
+		refs = append(refs, it.Value())
 	}
+	return refs, it.Error()
+}
 
-	// 2. Scan immutable memtables
-	for i := 0; i < len(idx.immutable); i++ {
-		mt := idx.immutable[i]
-		it := mt.DataBlock().Iterator()
-		for it.Next() {
-			key := it.Key()
-			if strings.HasPrefix(key, prefixStr) {
-				results[key] = it.Value()
-			}
-		}
+// DropRefs writes a tombstone for every key whose current RecordRef matches dangling
+// and returns the dropped keys. Older versions of those keys are not restored.
+func (idx *LSMIndex) DropRefs(dangling func(ref storage.RecordRef) bool) ([][]byte, error) {
+	it, err := idx.NewIterator(storage.IterOptions{})
+	if err != nil {
+		return nil, err
 	}
-
-	// 3. Scan active memtable
-	it := idx.currMemtable.DataBlock().Iterator()
-	for it.Next() {
-		key := it.Key()
-		if strings.HasPrefix(key, prefixStr) {
-			results[key] = it.Value()
+	var dropped [][]byte
+	for ok := it.First(); ok; ok = it.Next() {
+		if dangling(it.Value()) {
+			dropped = append(dropped, it.Key())
 		}
 	}
+	err = it.Error()
+	it.Close()
+	if err != nil {
+		return nil, err
+	}
 
-	// 4. Resolve references and filter tombstones
-	var refs []storage.RecordRef
-	for _, v := range results {
-		if v != "" {
-			refs = append(refs, unmarshalRef(v))
+	for i, key := range dropped {
+		if err := idx.Delete(key); err != nil {
+			return dropped[:i], err
 		}
 	}
-
-	return refs, nil
+	return dropped, nil
 }
 
 func sortSearchKeys(index []IndexEntry, prefix string) int {
@@ -300,119 +500,168 @@ func sortSearchKeys(index []IndexEntry, prefix string) int {
 	return low
 }
 
-func (idx *LSMIndex) flushImmutableMemtables() {
+// flushImmutableMemtables writes the immutable memtables to L0, oldest first. If a
+// memtable fails to flush, the ones before it are still installed and the rest stay
+// queued behind it.
+func (idx *LSMIndex) flushImmutableMemtables() error {
 	idx.mu.Lock()
+	if idx.closed {
+		idx.mu.Unlock()
+		return nil
+	}
 	mts := make([]*Memtable, len(idx.immutable))
 	copy(mts, idx.immutable)
+	epoch := idx.epoch
 	idx.mu.Unlock()
 
 	var newSSTables []*SSTable
 	var flushedMts []*Memtable
+	var flushErr error
 
 	for _, mt := range mts {
 		filename := fmt.Sprintf("%020d.sst", time.Now().UnixNano())
 		sstPath := filepath.Join(idx.sstDir, filename)
 
 		iterator := mt.DataBlock().Iterator()
-		if err := WriteSSTable(sstPath, iterator); err != nil {
-			fmt.Printf("failed to write SSTable: %v\n", err)
-			continue
+		if err := writeSSTable(sstPath, iterator, mt.RangeTombstones(), bloomBitsPerKey(idx.options.BloomBitsPerKey)); err != nil {
+			flushErr = fmt.Errorf("failed to write SSTable: %w", err)
+			break
 		}
 
-		sst, err := OpenSSTable(sstPath)
+		sst, err := openSSTable(sstPath, idx.cache)
 		if err != nil {
-			fmt.Printf("failed to open written SSTable: %v\n", err)
-			continue
+			os.Remove(sstPath)
+			flushErr = fmt.Errorf("failed to open written SSTable: %w", err)
+			break
 		}
 
 		newSSTables = append(newSSTables, sst)
 		flushedMts = append(flushedMts, mt)
+		idx.flushedBytes.Add(uint64(sst.size))
 	}
 
 	if len(newSSTables) == 0 {
-		return
+		return flushErr
 	}
 
 	idx.mu.Lock()
-	for i := len(newSSTables) - 1; i >= 0; i-- {
-		idx.sstables = append([]*SSTable{newSSTables[i]}, idx.sstables...)
+	if idx.closed || idx.epoch != epoch {
+		// The index was reset while flushing; the memtables' WALs are already gone
+		idx.mu.Unlock()
+		for _, sst := range newSSTables {
+			sst.Close()
+			os.Remove(sst.FilePath())
+		}
+		return nil
 	}
 
-	var remaining []*Memtable
-	for _, mt := range idx.immutable {
-		flushed := false
-		for _, fmt := range flushedMts {
-			if mt == fmt {
-				flushed = true
-				break
-			}
-		}
-		if !flushed {
-			remaining = append(remaining, mt)
+	// The new tables replace the WALs once the edit is durable
+	edit := &versionEdit{}
+	for i, sst := range newSSTables {
+		edit.addTable(sst, 0)
+		edit.removeWAL(flushedMts[i])
+	}
+	if err := idx.manifest.logEdit(edit); err != nil {
+		idx.mu.Unlock()
+		for _, sst := range newSSTables {
+			sst.Close()
+			os.Remove(sst.FilePath())
 		}
+		return fmt.Errorf("failed to log flush: %w", err)
+	}
+
+	// Memtables are flushed oldest first, and idx.sstables is ordered newest first
+	for _, sst := range newSSTables {
+		idx.sstables = append([]*SSTable{sst}, idx.sstables...)
 	}
-	idx.immutable = remaining
+	idx.immutable = idx.immutable[len(flushedMts):]
+	idx.stalls.Broadcast()
 	idx.mu.Unlock()
 
+	// A WAL left behind is no longer live and is removed when the index is opened
+	idx.removals.Add(1)
 	go func() {
+		defer idx.removals.Done()
 		for _, mt := range flushedMts {
 			mt.Close()
-			walPath := mt.WALFile().File.Name()
-			if err := os.Remove(walPath); err != nil {
-				fmt.Printf("failed to remove WAL file %s: %v\n", walPath, err)
-			}
+			os.Remove(mt.WALFile().File.Name())
 		}
 	}()
 
 	idx.triggerCompaction()
+	return flushErr
 }
 
+// triggerCompaction schedules a compaction if the tables call for one.
 func (idx *LSMIndex) triggerCompaction() {
-	idx.mu.Lock()
-	if idx.closed || len(idx.sstables) < idx.options.CompactionThreshold {
-		idx.mu.Unlock()
-		return
+	idx.mu.RLock()
+	due := idx.options.CompactionStyle == storage.CompactionLeveled || len(idx.sstables) >= idx.options.CompactionThreshold
+	idx.mu.RUnlock()
+
+	if due {
+		idx.sched.schedule(jobCompaction)
 	}
-	idx.mu.Unlock()
+}
 
-	go idx.runCompaction()
+// compactTables runs the compactions of the configured compaction style.
+func (idx *LSMIndex) compactTables() error {
+	if idx.options.CompactionStyle == storage.CompactionLeveled {
+		return idx.runLeveledCompactions()
+	}
+	return idx.runCompaction()
 }
 
-func (idx *LSMIndex) runCompaction() {
+// runCompaction merges every SSTable into one. Compactions run one at a time, and a
+// flush running alongside only adds tables newer than the ones being merged, so the
+// merge is the bottommost level for every key.
+func (idx *LSMIndex) runCompaction() error {
 	idx.mu.Lock()
 	if idx.closed {
 		idx.mu.Unlock()
-		return
+		return nil
 	}
 	sstsToCompact := make([]*SSTable, len(idx.sstables))
 	copy(sstsToCompact, idx.sstables)
+	gc := tombstoneGC{bottommost: true, snapshots: idx.snapshotSeqs()}
+	epoch := idx.epoch
 	idx.mu.Unlock()
 
 	if len(sstsToCompact) < 2 {
-		return
+		return nil
 	}
 
 	filename := fmt.Sprintf("%020d_compact.sst", time.Now().UnixNano())
 	destPath := filepath.Join(idx.sstDir, filename)
 
-	err := mergeSSTables(destPath, sstsToCompact)
+	err := mergeSSTables(destPath, sstsToCompact, gc, bloomBitsPerKey(idx.options.BloomBitsPerKey))
 	if err != nil {
-		fmt.Printf("compaction failed: %v\n", err)
-		return
+		return fmt.Errorf("compaction failed: %w", err)
 	}
 
-	newSst, err := OpenSSTable(destPath)
+	newSst, err := openSSTable(destPath, idx.cache)
 	if err != nil {
-		fmt.Printf("failed to open compacted SSTable: %v\n", err)
-		return
+		os.Remove(destPath)
+		return fmt.Errorf("failed to open compacted SSTable: %w", err)
 	}
 
 	idx.mu.Lock()
-	if idx.closed {
+	if idx.closed || idx.epoch != epoch {
 		newSst.Close()
 		os.Remove(destPath)
 		idx.mu.Unlock()
-		return
+		return nil
+	}
+
+	edit := &versionEdit{}
+	for _, sst := range sstsToCompact {
+		edit.removeTable(sst)
+	}
+	edit.addTable(newSst, 0)
+	if err := idx.manifest.logEdit(edit); err != nil {
+		newSst.Close()
+		os.Remove(destPath)
+		idx.mu.Unlock()
+		return fmt.Errorf("failed to log compaction: %w", err)
 	}
 
 	var updatedSSTables []*SSTable
@@ -430,20 +679,109 @@ func (idx *LSMIndex) runCompaction() {
 	}
 
 	idx.sstables = append(updatedSSTables, newSst)
+	idx.compactedBytes.Add(uint64(newSst.size))
+	idx.stalls.Broadcast()
 	idx.mu.Unlock()
 
+	idx.removeTables(sstsToCompact)
+	return nil
+}
+
+// removeTables deletes the files of compacted tables in the background, once the
+// iterators reading them are closed.
+func (idx *LSMIndex) removeTables(tables []*SSTable) {
+	idx.removals.Add(1)
 	go func() {
-		for _, sst := range sstsToCompact {
+		defer idx.removals.Done()
+		for _, sst := range tables {
+			sst.readers.Wait()
 			sst.Close()
-			if err := os.Remove(sst.FilePath()); err != nil {
-				fmt.Printf("failed to remove old SSTable %s: %v\n", sst.FilePath(), err)
-			}
+			// A table left behind is no longer live and is removed when the index is opened
+			os.Remove(sst.FilePath())
 		}
 	}()
 }
 
-// Close closes all open resources.
+// Reset discards every entry in the index, removing its WAL and SSTable files,
+// and starts over with an empty active memtable.
+func (idx *LSMIndex) Reset() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.closed {
+		return storage.ErrDBClosed
+	}
+
+	mts := append(idx.immutable, idx.currMemtable)
+	edit := &versionEdit{}
+	for _, mt := range mts {
+		edit.removeWAL(mt)
+	}
+	for _, sst := range idx.sstables {
+		edit.removeTable(sst)
+	}
+	if err := idx.manifest.logEdit(edit); err != nil {
+		return fmt.Errorf("failed to log reset: %w", err)
+	}
+	idx.epoch++
+
+	for _, mt := range mts {
+		mt.Close()
+		walPath := mt.WALFile().File.Name()
+		if err := os.Remove(walPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove WAL file %s: %w", walPath, err)
+		}
+	}
+
+	for _, sst := range idx.sstables {
+		sst.Close()
+		if err := os.Remove(sst.FilePath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove SSTable %s: %w", sst.FilePath(), err)
+		}
+	}
+
+	idx.currMemtable = nil
+	idx.immutable = nil
+	idx.sstables = nil
+	idx.bgErr = nil
+	idx.stalls.Broadcast()
+	return idx.rotateMemtable()
+}
+
+// Sync forces every memtable WAL entry written so far to disk, regardless of the
+// sync policy.
+func (idx *LSMIndex) Sync() error {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if idx.closed {
+		return storage.ErrDBClosed
+	}
+
+	for _, mt := range append([]*Memtable{idx.currMemtable}, idx.immutable...) {
+		if err := mt.Sync(); err != nil {
+			return fmt.Errorf("failed to sync memtable WAL: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close waits for running flushes and compactions to finish and closes all open
+// resources. Queued compactions are dropped and a queued flush runs before the
+// files are closed; memtables that fail to flush are recovered from their WALs on
+// open.
 func (idx *LSMIndex) Close() error {
+	// 1. Drain the scheduler without holding mu, which the running jobs need. Queued
+	// compactions are dropped, but a queued flush runs now so the next open does not
+	// replay its WALs; a memtable that fails to flush is recovered from its WAL.
+	if dropped := idx.sched.close(); dropped[jobFlush] {
+		idx.flushImmutableMemtables()
+	}
+
+	// 2. Let the files of flushed WALs and compacted tables be removed
+	idx.removals.Wait()
+
+	// 3. Fail stalled and later writes, and close the files
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
@@ -451,6 +789,7 @@ func (idx *LSMIndex) Close() error {
 		return nil
 	}
 	idx.closed = true
+	idx.stalls.Broadcast()
 
 	var firstErr error
 	if err := idx.currMemtable.Close(); err != nil {
@@ -469,6 +808,10 @@ func (idx *LSMIndex) Close() error {
 		}
 	}
 
+	if err := idx.manifest.close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
 	return firstErr
 }
 
@@ -477,8 +820,13 @@ func (idx *LSMIndex) Stats() storage.IndexStats {
 	defer idx.mu.RUnlock()
 
 	var sstFiles []string
+	levelFiles := make([]int, numLevels)
+	levelBytes := make([]int64, numLevels)
 	for _, sst := range idx.sstables {
 		sstFiles = append(sstFiles, filepath.Base(sst.FilePath()))
+		level := min(sst.level, numLevels-1)
+		levelFiles[level]++
+		levelBytes[level] += sst.size
 	}
 
 	var memSize int64
@@ -487,24 +835,31 @@ func (idx *LSMIndex) Stats() storage.IndexStats {
 	}
 
 	return storage.IndexStats{
-		MemtableSize:   memSize,
-		ImmutableCount: len(idx.immutable),
-		SSTableCount:   len(idx.sstables),
-		SSTableFiles:   sstFiles,
+		MemtableSize:        memSize,
+		ImmutableCount:      len(idx.immutable),
+		SSTableCount:        len(idx.sstables),
+		SSTableFiles:        sstFiles,
+		BloomChecks:         idx.bloomChecks.Load(),
+		BloomNegatives:      idx.bloomNegatives.Load(),
+		BloomFalsePositives: idx.bloomFalsePositives.Load(),
+		LevelFiles:          levelFiles,
+		LevelBytes:          levelBytes,
+		FlushedBytes:        idx.flushedBytes.Load(),
+		CompactedBytes:      idx.compactedBytes.Load(),
+		WriteStalls:         idx.writeStalls.Load(),
+		StallTime:           time.Duration(idx.stallTime.Load()),
 	}
 }
 
-func mergeSSTables(destPath string, sstables []*SSTable) error {
+// mergeSSTables merges sstables, ordered newest first, into a single table at
+// destPath keeping the newest version of each key and the older versions visible to
+// snapshots. Tombstones are dropped as gc allows. The new table gets a bloom filter
+// of bitsPerKey bits per key unless bitsPerKey is zero.
+func mergeSSTables(destPath string, sstables []*SSTable, gc tombstoneGC, bitsPerKey int) error {
 	if len(sstables) == 0 {
 		return nil
 	}
 
-	iterators := make([]*SSTableIterator, len(sstables))
-	for i, sst := range sstables {
-		iterators[i] = sst.Iterator()
-		iterators[i].Next() // Prime iterator
-	}
-
 	tempPath := destPath + ".tmp"
 	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
@@ -513,102 +868,17 @@ func mergeSSTables(destPath string, sstables []*SSTable) error {
 	defer file.Close()
 	defer os.Remove(tempPath)
 
-	var index []IndexEntry
-	var offset int64
-
-	for {
-		smallestIdx := -1
-		var smallestKey string
-
-		for i, it := range iterators {
-			if it.CurrIdx() >= len(it.SSTable().IndexBlock()) {
-				continue
-			}
-
-			key := it.Key()
-			if smallestIdx == -1 || key < smallestKey {
-				smallestIdx = i
-				smallestKey = key
-			} else if key == smallestKey {
-				if i < smallestIdx {
-					iterators[smallestIdx].Next()
-					smallestIdx = i
-					smallestKey = key
-				} else {
-					it.Next()
-				}
-			}
-		}
-
-		if smallestIdx == -1 {
-			break
-		}
-
-		it := iterators[smallestIdx]
-		key := it.Key()
-		val := it.Value()
-		it.Next()
-
-		if val == "" {
-			continue
+	w := newSSTWriter(file)
+	err = mergeTables(sstables, gc.snapshots, func(key, value string, seq uint64, kind entryKind) error {
+		if kind == kindDelete && gc.drops(seq) {
+			return nil
 		}
-
-		keyLen := uint32(len(key))
-		valLen := uint32(len(val))
-
-		var header [8]byte
-		binary.BigEndian.PutUint32(header[0:4], keyLen)
-		binary.BigEndian.PutUint32(header[4:8], valLen)
-
-		if _, err := file.Write(header[:]); err != nil {
-			return err
-		}
-
-		index = append(index, IndexEntry{
-			Key:    key,
-			Offset: offset,
-			ValLen: valLen,
-		})
-
-		if _, err := file.WriteString(key); err != nil {
-			return err
-		}
-		if _, err := file.WriteString(val); err != nil {
-			return err
-		}
-
-		offset += 8 + int64(keyLen) + int64(valLen)
-	}
-
-	// Write index block
-	indexOffset := offset
-	for _, entry := range index {
-		keyLen := uint32(len(entry.Key))
-		var idxHeader [16]byte
-		binary.BigEndian.PutUint32(idxHeader[0:4], keyLen)
-		binary.BigEndian.PutUint64(idxHeader[4:12], uint64(entry.Offset))
-		binary.BigEndian.PutUint32(idxHeader[12:16], entry.ValLen)
-
-		if _, err := file.Write(idxHeader[:]); err != nil {
-			return err
-		}
-		if _, err := file.WriteString(entry.Key); err != nil {
-			return err
-		}
-		offset += 16 + int64(keyLen)
-	}
-
-	// Write Footer
-	var footer [16]byte
-	binary.BigEndian.PutUint64(footer[0:8], uint64(indexOffset))
-	binary.BigEndian.PutUint32(footer[8:12], uint32(len(index)))
-	binary.BigEndian.PutUint32(footer[12:16], MagicNumber)
-
-	if _, err := file.Write(footer[:]); err != nil {
+		return w.add(key, value, seq, kind)
+	})
+	if err != nil {
 		return err
 	}
-
-	if err := file.Sync(); err != nil {
+	if err := w.finish(gc.rangeTombstones(sstables), bitsPerKey); err != nil {
 		return err
 	}
 	file.Close()
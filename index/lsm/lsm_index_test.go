@@ -1,6 +1,7 @@
 package lsm
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -85,3 +86,285 @@ func TestLSMIndexBasic(t *testing.T) {
 
 	idx.Close()
 }
+
+func TestLSMIndexApplyBatch(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "lsm_batch_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	walDir := filepath.Join(tmpDir, "wal")
+	sstDir := filepath.Join(tmpDir, "sst")
+	os.MkdirAll(walDir, 0755)
+	os.MkdirAll(sstDir, 0755)
+
+	opts := storage.Options{MemtableSize: 1024 * 1024, CompactionThreshold: 4}
+	idx, err := NewLSMIndex(walDir, sstDir, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSMIndex: %v", err)
+	}
+
+	ref1 := storage.RecordRef{FileID: 1, Offset: 0, Length: 10}
+	ref2 := storage.RecordRef{FileID: 1, Offset: 10, Length: 10}
+	idx.Put([]byte("gone"), ref1)
+
+	// 1. Apply puts and deletes as one transaction
+	err = idx.ApplyBatch([]storage.IndexOp{
+		{Key: []byte("a"), Ref: ref1},
+		{Key: []byte("b"), Ref: ref1},
+		{Key: []byte("b"), Ref: ref2}, // Later ops win
+		{Key: []byte("gone"), Delete: true},
+	})
+	if err != nil {
+		t.Fatalf("failed to apply batch: %v", err)
+	}
+
+	// 2. The batch is recovered from the WAL after a restart
+	idx.Close()
+	idx, err = NewLSMIndex(walDir, sstDir, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen LSMIndex: %v", err)
+	}
+	defer idx.Close()
+
+	if ref, found, _ := idx.Get([]byte("a")); !found || ref != ref1 {
+		t.Errorf("expected a -> %v, got %v (found=%v)", ref1, ref, found)
+	}
+	if ref, found, _ := idx.Get([]byte("b")); !found || ref != ref2 {
+		t.Errorf("expected b -> %v, got %v (found=%v)", ref2, ref, found)
+	}
+	if _, found, _ := idx.Get([]byte("gone")); found {
+		t.Errorf("expected batched delete to be recovered")
+	}
+}
+
+func TestLSMIndexDeleteRange(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "lsm_range_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	walDir := filepath.Join(tmpDir, "wal")
+	sstDir := filepath.Join(tmpDir, "sst")
+	os.MkdirAll(walDir, 0755)
+	os.MkdirAll(sstDir, 0755)
+
+	opts := storage.Options{MemtableSize: 256, CompactionThreshold: 100}
+	idx, err := NewLSMIndex(walDir, sstDir, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSMIndex: %v", err)
+	}
+
+	for i := 0; i < 40; i++ {
+		idx.Put([]byte(fmt.Sprintf("k%02d", i)), storage.RecordRef{FileID: 1, Offset: int64(i)})
+	}
+	time.Sleep(100 * time.Millisecond) // Flush most keys to SSTables
+
+	// 1. One range tombstone hides every older key in range, but not newer writes
+	if err := idx.DeleteRange([]byte("k20"), []byte("k10")); err != storage.ErrInvalidRange {
+		t.Errorf("expected ErrInvalidRange, got %v", err)
+	}
+	if err := idx.DeleteRange([]byte("k10"), []byte("k20")); err != nil {
+		t.Fatalf("failed to delete range: %v", err)
+	}
+	idx.Put([]byte("k15"), storage.RecordRef{FileID: 2, Offset: 15})
+
+	verify := func(stage string) {
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("k%02d", i)
+			_, found, err := idx.Get([]byte(key))
+			if want := i < 10 || i >= 20 || i == 15; err != nil || found != want {
+				t.Errorf("%s: Get(%s): expected found=%v, got %v (err=%v)", stage, key, want, found, err)
+			}
+		}
+
+		entries, err := idx.ScanRange([]byte("k08"), nil, 5)
+		if err != nil {
+			t.Fatalf("%s: failed to scan range: %v", stage, err)
+		}
+		var keys []string
+		for _, e := range entries {
+			keys = append(keys, string(e.Key))
+		}
+		if fmt.Sprint(keys) != "[k08 k09 k15 k20 k21]" {
+			t.Errorf("%s: unexpected range scan %v", stage, keys)
+		}
+		if entries[2].Ref.FileID != 2 {
+			t.Errorf("%s: expected the rewritten k15, got %+v", stage, entries[2].Ref)
+		}
+	}
+	verify("memtable")
+
+	// 2. The range tombstone is recovered from the WAL
+	idx.Close()
+	if idx, err = NewLSMIndex(walDir, sstDir, opts); err != nil {
+		t.Fatalf("failed to reopen LSMIndex: %v", err)
+	}
+	verify("wal replay")
+
+	// 3. ... flushed to an SSTable and read back after a restart
+	for i := 0; i < 40; i++ {
+		idx.Put([]byte(fmt.Sprintf("z%02d", i)), storage.RecordRef{FileID: 3, Offset: int64(i)})
+	}
+	time.Sleep(100 * time.Millisecond)
+	verify("sstable")
+
+	idx.Close()
+	opts.CompactionThreshold = 2
+	if idx, err = NewLSMIndex(walDir, sstDir, opts); err != nil {
+		t.Fatalf("failed to reopen LSMIndex: %v", err)
+	}
+	defer idx.Close()
+	verify("reopen")
+
+	// 4. ... and applied by compaction, which drops the keys it hides
+	for i := 0; i < 40; i++ {
+		idx.Put([]byte(fmt.Sprintf("y%02d", i)), storage.RecordRef{FileID: 4, Offset: int64(i)})
+	}
+	time.Sleep(200 * time.Millisecond)
+	if stats := idx.Stats(); stats.SSTableCount > 2 {
+		t.Errorf("expected compaction to merge SSTables, have %d", stats.SSTableCount)
+	}
+	verify("compaction")
+}
+
+func TestLSMIndexBloomFilter(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "lsm_bloom_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	walDir := filepath.Join(tmpDir, "wal")
+	sstDir := filepath.Join(tmpDir, "sst")
+	os.MkdirAll(walDir, 0755)
+	os.MkdirAll(sstDir, 0755)
+
+	opts := storage.Options{MemtableSize: 256, CompactionThreshold: 100}
+	idx, err := NewLSMIndex(walDir, sstDir, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSMIndex: %v", err)
+	}
+
+	for i := 0; i < 40; i++ {
+		idx.Put([]byte(fmt.Sprintf("k%02d", i)), storage.RecordRef{FileID: 1, Offset: int64(i)})
+	}
+	time.Sleep(100 * time.Millisecond) // Flush most keys to SSTables
+	idx.Close()
+
+	// 1. Filters are loaded with the SSTables on open
+	if idx, err = NewLSMIndex(walDir, sstDir, opts); err != nil {
+		t.Fatalf("failed to reopen LSMIndex: %v", err)
+	}
+	defer idx.Close()
+	if len(idx.sstables) < 2 {
+		t.Fatalf("expected several SSTables, have %d", len(idx.sstables))
+	}
+	for _, sst := range idx.sstables {
+		if len(sst.filter) == 0 {
+			t.Errorf("SSTable %s has no bloom filter", sst.FilePath())
+		}
+	}
+
+	// 2. Lookups of absent keys skip tables through their filters
+	for i := 0; i < 100; i++ {
+		if _, found, err := idx.Get([]byte(fmt.Sprintf("missing%02d", i))); err != nil || found {
+			t.Errorf("expected missing key to be absent (found=%v, err=%v)", found, err)
+		}
+	}
+	stats := idx.Stats()
+	if stats.BloomChecks != uint64(100*len(idx.sstables)) {
+		t.Errorf("expected %d filter checks, got %d", 100*len(idx.sstables), stats.BloomChecks)
+	}
+	if stats.BloomNegatives+stats.BloomFalsePositives != stats.BloomChecks {
+		t.Errorf("every check of an absent key must be a negative or a false positive: %+v", stats)
+	}
+	if stats.BloomNegatives < stats.BloomChecks*9/10 {
+		t.Errorf("expected most checks to skip the table, got %+v", stats)
+	}
+
+	// 3. Present keys are still found
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		if ref, found, err := idx.Get([]byte(key)); err != nil || !found || ref.Offset != int64(i) {
+			t.Errorf("Get(%s): expected offset %d, got %+v (found=%v, err=%v)", key, i, ref, found, err)
+		}
+	}
+}
+
+func TestLSMIndexRecoversWALsBySequence(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "lsm_seq_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	walDir := filepath.Join(tmpDir, "wal")
+	sstDir := filepath.Join(tmpDir, "sst")
+	os.MkdirAll(walDir, 0755)
+	os.MkdirAll(sstDir, 0755)
+
+	// 1. Two WALs whose names list the newer one first, as UUID names could
+	oldRef := storage.RecordRef{FileID: 1, Offset: 1}
+	newRef := storage.RecordRef{FileID: 2, Offset: 2}
+	older, err := InitMemtable(filepath.Join(walDir, "z.log"), 0, storage.SyncPolicy{})
+	if err != nil {
+		t.Fatalf("failed to create memtable: %v", err)
+	}
+	older.Set("k", marshalRef(oldRef))
+	older.Set("only-old", marshalRef(oldRef))
+	newer, err := InitMemtable(filepath.Join(walDir, "a.log"), 0, storage.SyncPolicy{})
+	if err != nil {
+		t.Fatalf("failed to create memtable: %v", err)
+	}
+	newer.seq = older.seq
+	newer.Set("k", marshalRef(newRef))
+	older.Close()
+	newer.Close()
+
+	// 2. Recovery orders the memtables by the sequence numbers of their entries
+	opts := storage.Options{CompactionThreshold: 2}
+	idx, err := NewLSMIndex(walDir, sstDir, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSMIndex: %v", err)
+	}
+	expect := func(stage string) {
+		t.Helper()
+		if ref, found, err := idx.Get([]byte("k")); err != nil || !found || ref != newRef {
+			t.Errorf("%s: Get(k): expected %+v, got %+v (found=%v, err=%v)", stage, newRef, ref, found, err)
+		}
+		refs, err := idx.ScanRange(nil, nil, 0)
+		if err != nil || len(refs) != 2 || refs[0].Ref != newRef || refs[1].Ref != oldRef {
+			t.Errorf("%s: expected k and only-old, got %+v (err=%v)", stage, refs, err)
+		}
+	}
+	expect("recovered")
+	if got := idx.seq.Load(); got != 3 {
+		t.Errorf("expected the last recovered sequence number to be 3, got %d", got)
+	}
+
+	// 3. New writes continue the sequence in a numbered WAL, and flushes and
+	// compaction keep the newest version
+	idx.Put([]byte("later"), newRef)
+	if name := filepath.Base(idx.currMemtable.WALFile().File.Name()); name != fmt.Sprintf("%020d.log", 1) {
+		t.Errorf("expected the active WAL to be numbered, got %s", name)
+	}
+	if seq := idx.currMemtable.MaxSeq(); seq != 4 {
+		t.Errorf("expected the next write to get sequence number 4, got %d", seq)
+	}
+	idx.Delete([]byte("later"))
+	idx.mu.Lock()
+	idx.rotateMemtable()
+	idx.mu.Unlock()
+	deadline := time.Now().Add(10 * time.Second)
+	for idx.Stats().SSTableCount != 1 || idx.Stats().ImmutableCount != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the memtables to be flushed and compacted, stats %+v", idx.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect("compacted")
+	idx.Close()
+}
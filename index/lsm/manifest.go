@@ -0,0 +1,380 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const manifestFile = "MANIFEST"
+
+// Version edit entry tags
+const (
+	tagAddTable    byte = 1 // [1B tag][4B name length][name][1B level]
+	tagRemoveTable byte = 2 // [1B tag][4B name length][name]
+	tagAddWAL      byte = 3 // [1B tag][4B name length][name]
+	tagRemoveWAL   byte = 4 // [1B tag][4B name length][name]
+)
+
+var (
+	manifestCRC = crc32.MakeTable(crc32.Castagnoli)
+
+	ErrCorruptManifest = errors.New("corrupt LSM manifest")
+	ErrManifestClosed  = errors.New("LSM manifest is closed")
+)
+
+// manifestTable is a live SSTable and the level it belongs to.
+type manifestTable struct {
+	name  string
+	level int
+}
+
+// versionEdit is a change to the set of live files of an index that is logged and
+// applied as a whole. Removals are applied before additions, and adding a table
+// that is already live changes its level.
+type versionEdit struct {
+	addTables    []manifestTable
+	removeTables []string
+	addWALs      []string
+	removeWALs   []string
+}
+
+func (e *versionEdit) addTable(sst *SSTable, level int) {
+	e.addTables = append(e.addTables, manifestTable{name: filepath.Base(sst.FilePath()), level: level})
+}
+
+func (e *versionEdit) removeTable(sst *SSTable) {
+	e.removeTables = append(e.removeTables, filepath.Base(sst.FilePath()))
+}
+
+func (e *versionEdit) addWAL(mt *Memtable) {
+	e.addWALs = append(e.addWALs, filepath.Base(mt.WALFile().File.Name()))
+}
+
+func (e *versionEdit) removeWAL(mt *Memtable) {
+	e.removeWALs = append(e.removeWALs, filepath.Base(mt.WALFile().File.Name()))
+}
+
+func (e *versionEdit) encode() []byte {
+	var buf []byte
+	putName := func(tag byte, name string) {
+		buf = append(buf, tag)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(name)))
+		buf = append(buf, name...)
+	}
+	for _, name := range e.removeTables {
+		putName(tagRemoveTable, name)
+	}
+	for _, name := range e.removeWALs {
+		putName(tagRemoveWAL, name)
+	}
+	for _, t := range e.addTables {
+		putName(tagAddTable, t.name)
+		buf = append(buf, byte(t.level))
+	}
+	for _, name := range e.addWALs {
+		putName(tagAddWAL, name)
+	}
+	return buf
+}
+
+func decodeEdit(buf []byte) (*versionEdit, error) {
+	e := &versionEdit{}
+	for len(buf) > 0 {
+		if len(buf) < 5 {
+			return nil, ErrCorruptManifest
+		}
+		tag := buf[0]
+		n := int(binary.BigEndian.Uint32(buf[1:5]))
+		if n > len(buf)-5 {
+			return nil, ErrCorruptManifest
+		}
+		name := string(buf[5 : 5+n])
+		buf = buf[5+n:]
+
+		switch tag {
+		case tagAddTable:
+			if len(buf) < 1 || int(buf[0]) >= numLevels {
+				return nil, ErrCorruptManifest
+			}
+			e.addTables = append(e.addTables, manifestTable{name: name, level: int(buf[0])})
+			buf = buf[1:]
+		case tagRemoveTable:
+			e.removeTables = append(e.removeTables, name)
+		case tagAddWAL:
+			e.addWALs = append(e.addWALs, name)
+		case tagRemoveWAL:
+			e.removeWALs = append(e.removeWALs, name)
+		default:
+			return nil, fmt.Errorf("%w: unknown tag %d", ErrCorruptManifest, tag)
+		}
+	}
+	return e, nil
+}
+
+// manifest is the log of version edits that defines which SSTables and WALs make
+// up an index. Each edit is appended as one record and synced before the files it
+// adds are used or the files it removes are deleted, so recovery replays the log
+// instead of trusting whatever files are in the directories:
+//
+//	[4B body length][4B CRC32C of body][body]
+//
+// A record cut short by a crash, and everything after it, is ignored. The log is
+// rewritten as a single edit describing the current state each time it is opened.
+type manifest struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	tables []manifestTable // In the order they were added
+	wals   []string        // Oldest first
+}
+
+// loadManifest replays the manifest in dir. It reports false if there is none.
+func loadManifest(dir string) (*manifest, bool, error) {
+	m := &manifest{path: filepath.Join(dir, manifestFile)}
+
+	data, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	for len(data) >= 8 {
+		n := int(binary.BigEndian.Uint32(data[0:4]))
+		if n > len(data)-8 {
+			break // Torn record
+		}
+		body := data[8 : 8+n]
+		if crc32.Checksum(body, manifestCRC) != binary.BigEndian.Uint32(data[4:8]) {
+			break
+		}
+		e, err := decodeEdit(body)
+		if err != nil {
+			return nil, false, err
+		}
+		m.apply(e)
+		data = data[8+n:]
+	}
+	return m, true, nil
+}
+
+// discover builds the state of an index created before it had a manifest from the
+// files in its directories. Tables are ordered by name, which starts with the time
+// they were written, and take the level recorded in their name.
+func (m *manifest) discover(walDir, sstDir string) error {
+	ssts, err := os.ReadDir(sstDir)
+	if err != nil {
+		return fmt.Errorf("failed to read SST directory: %w", err)
+	}
+	var names []string
+	for _, entry := range ssts {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".sst" {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m.tables = append(m.tables, manifestTable{name: name, level: levelFromName(name)})
+	}
+
+	wals, err := os.ReadDir(walDir)
+	if err != nil {
+		return fmt.Errorf("failed to read WAL directory: %w", err)
+	}
+	for _, wal := range wals {
+		if !wal.IsDir() {
+			m.wals = append(m.wals, wal.Name())
+		}
+	}
+	return nil
+}
+
+// removeObsolete deletes the files a crash left behind: tables and WALs that are
+// not live, such as the output of an unfinished flush or compaction or the inputs
+// of a finished one, and temporary files.
+func (m *manifest) removeObsolete(walDir, sstDir string) error {
+	ssts, err := os.ReadDir(sstDir)
+	if err != nil {
+		return fmt.Errorf("failed to read SST directory: %w", err)
+	}
+	for _, entry := range ssts {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if !entry.IsDir() && (ext == ".tmp" || ext == ".sst" && !m.hasTable(name)) {
+			if err := os.Remove(filepath.Join(sstDir, name)); err != nil {
+				return fmt.Errorf("failed to remove obsolete file %s: %w", name, err)
+			}
+		}
+	}
+
+	wals, err := os.ReadDir(walDir)
+	if err != nil {
+		return fmt.Errorf("failed to read WAL directory: %w", err)
+	}
+	for _, wal := range wals {
+		if !wal.IsDir() && !m.hasWAL(wal.Name()) {
+			if err := os.Remove(filepath.Join(walDir, wal.Name())); err != nil {
+				return fmt.Errorf("failed to remove obsolete WAL %s: %w", wal.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// apply applies e to the in-memory state.
+func (m *manifest) apply(e *versionEdit) {
+	for _, name := range e.removeTables {
+		for i, t := range m.tables {
+			if t.name == name {
+				m.tables = append(m.tables[:i], m.tables[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, name := range e.removeWALs {
+		for i, wal := range m.wals {
+			if wal == name {
+				m.wals = append(m.wals[:i], m.wals[i+1:]...)
+				break
+			}
+		}
+	}
+
+	for _, add := range e.addTables {
+		found := false
+		for i, t := range m.tables {
+			if t.name == add.name {
+				m.tables[i].level = add.level
+				found = true
+				break
+			}
+		}
+		if !found {
+			m.tables = append(m.tables, add)
+		}
+	}
+	m.wals = append(m.wals, e.addWALs...)
+}
+
+// hasTable reports whether name is a live SSTable.
+func (m *manifest) hasTable(name string) bool {
+	for _, t := range m.tables {
+		if t.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasWAL reports whether name is a live WAL.
+func (m *manifest) hasWAL(name string) bool {
+	for _, wal := range m.wals {
+		if wal == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rewrite replaces the manifest with a single edit holding the current state and
+// opens it for appending further edits.
+func (m *manifest) rewrite() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.file != nil {
+		m.file.Close()
+		m.file = nil
+	}
+
+	snapshot := &versionEdit{addTables: m.tables, addWALs: m.wals}
+
+	tmpPath := m.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	if err := writeEdit(file, snapshot); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	file.Close()
+
+	if err := os.Rename(tmpPath, m.path); err != nil {
+		return fmt.Errorf("failed to install manifest: %w", err)
+	}
+	if err := syncDir(filepath.Dir(m.path)); err != nil {
+		return fmt.Errorf("failed to sync SST directory: %w", err)
+	}
+
+	m.file, err = os.OpenFile(m.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest: %w", err)
+	}
+	return nil
+}
+
+// logEdit durably appends e to the manifest and applies it. A failed write closes
+// the manifest, so no further edits can be logged until it is rewritten.
+func (m *manifest) logEdit(e *versionEdit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.file == nil {
+		return ErrManifestClosed
+	}
+	if err := writeEdit(m.file, e); err != nil {
+		// Edits appended after a partly written record would be ignored on replay
+		m.file.Close()
+		m.file = nil
+		return err
+	}
+	m.apply(e)
+	return nil
+}
+
+// writeEdit writes e as one record and syncs the file.
+func writeEdit(w *os.File, e *versionEdit) error {
+	body := e.encode()
+	record := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(body, manifestCRC))
+	record = append(record, body...)
+
+	if _, err := w.Write(record); err != nil {
+		return fmt.Errorf("failed to write manifest edit: %w", err)
+	}
+	if err := w.Sync(); err != nil {
+		return fmt.Errorf("failed to sync manifest: %w", err)
+	}
+	return nil
+}
+
+func (m *manifest) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.file == nil {
+		return nil
+	}
+	err := m.file.Close()
+	m.file = nil
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,193 @@
+package lsm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/raman20/storage"
+)
+
+func openManifestTestIndex(t *testing.T, tmpDir string, opts storage.Options) *LSMIndex {
+	idx, err := NewLSMIndex(filepath.Join(tmpDir, "wal"), filepath.Join(tmpDir, "sst"), opts)
+	if err != nil {
+		t.Fatalf("failed to open LSMIndex: %v", err)
+	}
+	return idx
+}
+
+// flushActive rotates the active memtable and waits for it to be flushed.
+func flushActive(t *testing.T, idx *LSMIndex) {
+	idx.mu.Lock()
+	err := idx.rotateMemtable()
+	idx.mu.Unlock()
+	if err != nil {
+		t.Fatalf("failed to rotate memtable: %v", err)
+	}
+	waitForBackgroundWork(t, idx)
+}
+
+func expectRef(t *testing.T, idx *LSMIndex, key string, want storage.RecordRef, wantFound bool) {
+	t.Helper()
+	ref, found, err := idx.Get([]byte(key))
+	if err != nil || found != wantFound || (found && ref != want) {
+		t.Errorf("Get(%s): expected %+v (found=%v), got %+v (found=%v, err=%v)", key, want, wantFound, ref, found, err)
+	}
+}
+
+func newManifestTestDir(t *testing.T) string {
+	tmpDir, err := os.MkdirTemp("", "lsm_manifest_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	os.MkdirAll(filepath.Join(tmpDir, "wal"), 0755)
+	os.MkdirAll(filepath.Join(tmpDir, "sst"), 0755)
+	return tmpDir
+}
+
+func TestManifestIgnoresObsoleteFiles(t *testing.T) {
+	tmpDir := newManifestTestDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	opts := storage.Options{CompactionThreshold: 2}
+	idx := openManifestTestIndex(t, tmpDir, opts)
+	old := storage.RecordRef{FileID: 1, Offset: 1}
+	updated := storage.RecordRef{FileID: 2, Offset: 2}
+
+	// 1. Write a and b, keeping copies of the WAL and of the table they are flushed to
+	idx.Put([]byte("a"), old)
+	idx.Put([]byte("b"), old)
+	walPath := idx.currMemtable.WALFile().File.Name()
+	walData, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatalf("failed to read WAL: %v", err)
+	}
+	flushActive(t, idx)
+	tablePath := idx.sstables[0].FilePath()
+	tableData, err := os.ReadFile(tablePath)
+	if err != nil {
+		t.Fatalf("failed to read SSTable: %v", err)
+	}
+
+	// 2. Delete a and update b; the full compaction drops a and both old tables
+	idx.Delete([]byte("a"))
+	idx.Put([]byte("b"), updated)
+	flushActive(t, idx)
+	deadline := time.Now().Add(10 * time.Second)
+	for idx.Stats().SSTableCount != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the tables to be compacted into one, got %d", idx.Stats().SSTableCount)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitForBackgroundWork(t, idx)
+	idx.Close()
+
+	// 3. Put the obsolete files back, as a crash before their removal would leave them
+	if err := os.WriteFile(walPath, walData, 0644); err != nil {
+		t.Fatalf("failed to restore WAL: %v", err)
+	}
+	if err := os.WriteFile(tablePath, tableData, 0644); err != nil {
+		t.Fatalf("failed to restore SSTable: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "sst", "unfinished.sst.tmp"), tableData, 0644); err != nil {
+		t.Fatalf("failed to write temporary file: %v", err)
+	}
+
+	idx = openManifestTestIndex(t, tmpDir, opts)
+	defer idx.Close()
+
+	expectRef(t, idx, "a", storage.RecordRef{}, false)
+	expectRef(t, idx, "b", updated, true)
+	for _, path := range []string{walPath, tablePath, filepath.Join(tmpDir, "sst", "unfinished.sst.tmp")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected obsolete file %s to be removed, got %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestManifestTornEdit(t *testing.T) {
+	tmpDir := newManifestTestDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	idx := openManifestTestIndex(t, tmpDir, storage.Options{})
+	ref := storage.RecordRef{FileID: 1, Offset: 10, Length: 5}
+	idx.Put([]byte("flushed"), ref)
+	flushActive(t, idx)
+	idx.Put([]byte("logged"), ref)
+	idx.Close()
+
+	// A crash in the middle of appending an edit leaves a partial record
+	file, err := os.OpenFile(filepath.Join(tmpDir, "sst", manifestFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	file.Write([]byte{0, 0, 0, 64, 1, 2, 3, 4, tagAddTable})
+	file.Close()
+
+	// The partial record is dropped when the manifest is rewritten on open
+	for i := 0; i < 2; i++ {
+		idx = openManifestTestIndex(t, tmpDir, storage.Options{})
+		expectRef(t, idx, "flushed", ref, true)
+		expectRef(t, idx, "logged", ref, true)
+		if len(idx.sstables) != 1 {
+			t.Errorf("expected 1 SSTable after reopen %d, got %d", i+1, len(idx.sstables))
+		}
+		idx.Close()
+	}
+}
+
+func TestManifestCreatedForExistingIndex(t *testing.T) {
+	tmpDir := newManifestTestDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	idx := openManifestTestIndex(t, tmpDir, storage.Options{})
+	old := storage.RecordRef{FileID: 1}
+	updated := storage.RecordRef{FileID: 2}
+	idx.Put([]byte("a"), old)
+	idx.Put([]byte("b"), old)
+	flushActive(t, idx)
+	idx.Put([]byte("b"), updated)
+	idx.Close()
+
+	// An index written before manifests existed is recovered from its directories
+	manifestPath := filepath.Join(tmpDir, "sst", manifestFile)
+	if err := os.Remove(manifestPath); err != nil {
+		t.Fatalf("failed to remove manifest: %v", err)
+	}
+
+	idx = openManifestTestIndex(t, tmpDir, storage.Options{})
+	defer idx.Close()
+	if _, err := os.Stat(manifestPath); err != nil {
+		t.Fatalf("expected a manifest to be written: %v", err)
+	}
+	expectRef(t, idx, "a", old, true)
+	expectRef(t, idx, "b", updated, true)
+}
+
+func TestVersionEditEncoding(t *testing.T) {
+	edit := &versionEdit{
+		addTables:    []manifestTable{{name: "1.sst", level: 0}, {name: "2_000_L3.sst", level: 3}},
+		removeTables: []string{"0.sst"},
+		addWALs:      []string{"b.log"},
+		removeWALs:   []string{"a.log"},
+	}
+	decoded, err := decodeEdit(edit.encode())
+	if err != nil {
+		t.Fatalf("failed to decode edit: %v", err)
+	}
+
+	m := &manifest{tables: []manifestTable{{name: "0.sst"}, {name: "1.sst", level: 1}}, wals: []string{"a.log"}}
+	m.apply(decoded)
+	if len(m.tables) != 2 || m.tables[0] != (manifestTable{name: "1.sst", level: 0}) || m.tables[1] != (manifestTable{name: "2_000_L3.sst", level: 3}) {
+		t.Errorf("unexpected tables after edit: %+v", m.tables)
+	}
+	if len(m.wals) != 1 || m.wals[0] != "b.log" {
+		t.Errorf("unexpected WALs after edit: %v", m.wals)
+	}
+
+	if _, err := decodeEdit([]byte{tagAddTable, 0, 0, 0, 9, 'x'}); err == nil {
+		t.Errorf("expected an error decoding a truncated edit")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/raman20/storage"
 )
@@ -16,6 +17,9 @@ var (
 type Memtable struct {
 	wal       *storage.WAL
 	data      *SkipList
+	rangeDels []RangeTombstone // Hide older layers and older versions in data
+	seq       *atomic.Uint64   // Last sequence number assigned, shared with the index
+	maxSeq    uint64           // Largest sequence number written to the memtable
 	mu        sync.RWMutex
 	size      int64 // Track size for flush decisions
 	maxSize   int64 // Maximum size before flush
@@ -23,12 +27,20 @@ type Memtable struct {
 	closeOnce sync.Once
 }
 
-func InitMemtable(walPath string, maxSize int64) (*Memtable, error) {
+// InitMemtable opens a memtable backed by the WAL at walPath, replaying any
+// committed entries. WAL commits are synced according to policy.
+//
+// Every write is assigned a sequence number, which is logged as the ID of its WAL
+// transaction; the entries of a batch take consecutive numbers. The memtable keeps
+// every version written to it, so reads at an older sequence number see the keys
+// as they were then. Entries recovered from WALs written before sequence numbers
+// were assigned have sequence number 0.
+func InitMemtable(walPath string, maxSize int64, policy storage.SyncPolicy) (*Memtable, error) {
 	if maxSize <= 0 {
 		maxSize = 32 * 1024 * 1024 // Default 32MB
 	}
 
-	wal, err := storage.InitWal(walPath)
+	wal, err := storage.InitWalWithPolicy(walPath, policy)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize WAL: %w", err)
 	}
@@ -40,22 +52,38 @@ func InitMemtable(walPath string, maxSize int64) (*Memtable, error) {
 		return nil, fmt.Errorf("failed to recover from WAL: %w", err)
 	}
 
-	skl := InitSL(0.5, 16)
+	m := &Memtable{
+		wal:     wal,
+		data:    InitSL(0.5, 16),
+		maxSize: maxSize,
+	}
 
 	// Replay WAL entries
-	for _, op := range entries {
-		if op.Delete {
-			skl.Put(op.Key, "") // Replay delete as tombstone
-		} else {
-			skl.Put(op.Key, op.Value)
+	var pos uint64 // Position of op within its transaction
+	for i, op := range entries {
+		if i > 0 && op.TxID != entries[i-1].TxID {
+			pos = 0
+		}
+		var seq uint64
+		if op.TxID != 0 {
+			seq = op.TxID + pos
+		}
+		pos++
+
+		switch {
+		case op.End != "":
+			m.applyRange(op.Key, op.End, seq)
+		case op.Delete:
+			m.data.add(op.Key, "", seq, kindDelete) // Replay delete as tombstone
+		default:
+			m.data.add(op.Key, op.Value, seq, kindSet)
 		}
+		m.maxSeq = max(m.maxSeq, seq)
 	}
+	m.seq = new(atomic.Uint64)
+	m.seq.Store(m.maxSeq)
 
-	return &Memtable{
-		wal:     wal,
-		data:    skl,
-		maxSize: maxSize,
-	}, nil
+	return m, nil
 }
 
 func (m *Memtable) Set(key, value string) error {
@@ -72,22 +100,103 @@ func (m *Memtable) Set(key, value string) error {
 		return ErrMemtableFull
 	}
 
-	if err := m.wal.WriteTxStart(0); err != nil {
+	seq := m.nextSeqs(1)
+	if err := m.wal.WriteTxStart(seq); err != nil {
 		return fmt.Errorf("failed to write WAL start: %w", err)
 	}
-	if err := m.wal.WriteTxSet(0, key, value); err != nil {
+	if err := m.wal.WriteTxSet(seq, key, value); err != nil {
 		return fmt.Errorf("failed to write WAL set: %w", err)
 	}
-	if err := m.wal.WriteTxCommit(0); err != nil {
+	if err := m.wal.WriteTxCommit(seq); err != nil {
+		return fmt.Errorf("failed to write WAL commit: %w", err)
+	}
+
+	m.data.add(key, value, seq, kindSet)
+	m.size = newSize
+
+	return nil
+}
+
+// BatchEntry is a single write applied through Memtable.Apply. An entry with End
+// set deletes every key in [Key, End).
+type BatchEntry struct {
+	Key    string
+	Value  string
+	Delete bool
+	End    string
+}
+
+// Apply writes entries as a single WAL transaction, so they are recovered all or
+// nothing, and then applies them in order. A batch larger than maxSize is accepted
+// into an empty memtable.
+func (m *Memtable) Apply(entries []BatchEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrMemtableClosed
+	}
+
+	newSize := m.size
+	for _, e := range entries {
+		newSize += int64(len(e.Key) + len(e.Value) + len(e.End))
+	}
+	if newSize > m.maxSize && m.size > 0 {
+		return ErrMemtableFull
+	}
+
+	first := m.nextSeqs(len(entries))
+	if err := m.wal.WriteTxStart(first); err != nil {
+		return fmt.Errorf("failed to write WAL start: %w", err)
+	}
+	for _, e := range entries {
+		var err error
+		if e.End != "" {
+			err = m.wal.WriteTxDeleteRange(first, e.Key, e.End)
+		} else if e.Delete {
+			err = m.wal.WriteTxDelete(first, e.Key)
+		} else {
+			err = m.wal.WriteTxSet(first, e.Key, e.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write WAL entry: %w", err)
+		}
+	}
+	if err := m.wal.WriteTxCommit(first); err != nil {
 		return fmt.Errorf("failed to write WAL commit: %w", err)
 	}
 
-	m.data.Put(key, value)
+	for i, e := range entries {
+		seq := first + uint64(i)
+		if e.End != "" {
+			m.applyRange(e.Key, e.End, seq)
+		} else if e.Delete {
+			m.data.add(e.Key, "", seq, kindDelete)
+		} else {
+			m.data.add(e.Key, e.Value, seq, kindSet)
+		}
+	}
 	m.size = newSize
 
 	return nil
 }
 
+// nextSeqs assigns n consecutive sequence numbers and returns the first. Must hold
+// m.mu.
+func (m *Memtable) nextSeqs(n int) uint64 {
+	last := m.seq.Add(uint64(n))
+	m.maxSeq = last
+	return last - uint64(n) + 1
+}
+
+// MaxSeq returns the largest sequence number written to the memtable.
+func (m *Memtable) MaxSeq() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.maxSeq
+}
+
+// Get returns the value of the newest version of key. A tombstone has an empty value.
 func (m *Memtable) Get(key string) (string, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -99,6 +208,35 @@ func (m *Memtable) Get(key string) (string, bool) {
 	return m.data.Get(key)
 }
 
+// lookup returns the newest version of key visible at readSeq. deleted reports that
+// a range tombstone of the memtable hides that version, or hides the key in older
+// layers when the memtable holds no visible version.
+func (m *Memtable) lookup(key string, readSeq uint64) (v version, found, deleted bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if node := m.data.findVersion(key, readSeq); node != nil {
+		v, found = version{value: node.value, seq: node.seq, kind: node.kind}, true
+	}
+	return v, found, rangeDeleted(m.rangeDels, key, v.seq, found, readSeq)
+}
+
+// copyRange returns the entries with keys in [lower, upper), tombstones included.
+// upper is ignored unless hasUpper is set.
+func (m *Memtable) copyRange(lower, upper string, hasUpper bool) []memEntry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var entries []memEntry
+	for node := m.data.findGE(lower); node != nil; node = node.levels[0] {
+		if hasUpper && node.key >= upper {
+			break
+		}
+		entries = append(entries, memEntry{key: node.key, value: node.value, seq: node.seq, kind: node.kind})
+	}
+	return entries
+}
+
 func (m *Memtable) Delete(key string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -112,22 +250,74 @@ func (m *Memtable) Delete(key string) error {
 		return ErrMemtableFull
 	}
 
-	if err := m.wal.WriteTxStart(0); err != nil {
+	seq := m.nextSeqs(1)
+	if err := m.wal.WriteTxStart(seq); err != nil {
 		return fmt.Errorf("failed to write WAL start: %w", err)
 	}
-	if err := m.wal.WriteTxDelete(0, key); err != nil {
+	if err := m.wal.WriteTxDelete(seq, key); err != nil {
 		return fmt.Errorf("failed to write WAL delete: %w", err)
 	}
-	if err := m.wal.WriteTxCommit(0); err != nil {
+	if err := m.wal.WriteTxCommit(seq); err != nil {
 		return fmt.Errorf("failed to write WAL commit: %w", err)
 	}
 
-	m.data.Put(key, "") // Put empty string tombstone
+	m.data.add(key, "", seq, kindDelete)
 	m.size = newSize
 
 	return nil
 }
 
+// DeleteRange deletes every key in [start, end) with a range tombstone.
+func (m *Memtable) DeleteRange(start, end string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrMemtableClosed
+	}
+
+	newSize := m.size + int64(len(start)+len(end))
+	if newSize > m.maxSize {
+		return ErrMemtableFull
+	}
+
+	seq := m.nextSeqs(1)
+	if err := m.wal.WriteTxStart(seq); err != nil {
+		return fmt.Errorf("failed to write WAL start: %w", err)
+	}
+	if err := m.wal.WriteTxDeleteRange(seq, start, end); err != nil {
+		return fmt.Errorf("failed to write WAL range delete: %w", err)
+	}
+	if err := m.wal.WriteTxCommit(seq); err != nil {
+		return fmt.Errorf("failed to write WAL commit: %w", err)
+	}
+
+	m.applyRange(start, end, seq)
+	m.size = newSize
+
+	return nil
+}
+
+// applyRange records a range tombstone written at seq over [start, end). It hides
+// the versions in the range written before it, here and in older layers. A tombstone
+// recovered from a WAL without sequence numbers cannot tell the entries before it
+// from those after it, so the entries it covers are dropped instead. Must hold m.mu.
+func (m *Memtable) applyRange(start, end string, seq uint64) {
+	if seq == 0 {
+		for node := m.data.findGE(start); node != nil && node.key < end; node = node.levels[0] {
+			m.data.Delete(node.key)
+		}
+	}
+	m.rangeDels = append(m.rangeDels, RangeTombstone{Start: start, End: end, Seq: seq})
+}
+
+// RangeTombstones returns the memtable's range tombstones.
+func (m *Memtable) RangeTombstones() []RangeTombstone {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]RangeTombstone(nil), m.rangeDels...)
+}
+
 func (m *Memtable) Close() error {
 	var err error
 	m.closeOnce.Do(func() {
@@ -140,6 +330,17 @@ func (m *Memtable) Close() error {
 	return err
 }
 
+// Sync forces committed WAL entries to disk.
+func (m *Memtable) Sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	return m.wal.Sync()
+}
+
 // Size returns the current size of the memtable
 func (m *Memtable) Size() int64 {
 	m.mu.RLock()
@@ -0,0 +1,125 @@
+package lsm
+
+import (
+	"runtime"
+	"sync"
+)
+
+// jobKind is a kind of background work. A job requested while one of its kind is
+// queued is merged into it. Jobs of the same kind only run at once if the kind is
+// concurrent: the jobs then claim disjoint work themselves.
+type jobKind int
+
+const (
+	jobFlush      jobKind = iota // Write immutable memtables to L0
+	jobCompaction                // Compact SSTables
+	numJobKinds
+)
+
+// scheduler runs the background jobs of an index on at most limit goroutines.
+// Flushes take priority over compactions when both are waiting for a slot. A job
+// that fails reports its error to onError.
+type scheduler struct {
+	mu         sync.Mutex
+	idle       *sync.Cond // Signaled whenever a job finishes
+	limit      int
+	jobs       [numJobKinds]func() error
+	concurrent [numJobKinds]bool // Kinds whose jobs may run alongside each other
+	onError    func(error)
+	pending    [numJobKinds]bool
+	running    [numJobKinds]int
+	active     int
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+// newScheduler returns a scheduler running at most limit jobs at once. A limit of
+// zero or less selects GOMAXPROCS.
+func newScheduler(limit int, jobs [numJobKinds]func() error, concurrent [numJobKinds]bool, onError func(error)) *scheduler {
+	if limit <= 0 {
+		limit = runtime.GOMAXPROCS(0)
+	}
+	s := &scheduler{limit: limit, jobs: jobs, concurrent: concurrent, onError: onError}
+	s.idle = sync.NewCond(&s.mu)
+	return s
+}
+
+// schedule queues a job of kind, unless one is already queued, and starts it if a
+// slot is free.
+func (s *scheduler) schedule(kind jobKind) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.pending[kind] = true
+	s.dispatch()
+}
+
+// dispatch starts queued jobs while slots are free. Must hold s.mu.
+func (s *scheduler) dispatch() {
+	for kind := jobKind(0); kind < numJobKinds; kind++ {
+		if s.closed || s.active >= s.limit {
+			return
+		}
+		if s.pending[kind] && (s.running[kind] == 0 || s.concurrent[kind]) {
+			s.pending[kind] = false
+			s.running[kind]++
+			s.active++
+			s.wg.Add(1)
+			go s.run(kind)
+		}
+	}
+}
+
+func (s *scheduler) run(kind jobKind) {
+	defer s.wg.Done()
+
+	if err := s.jobs[kind](); err != nil {
+		s.onError(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running[kind]--
+	s.active--
+	s.dispatch()
+	s.idle.Broadcast()
+}
+
+// wait blocks until no job is queued or running.
+func (s *scheduler) wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.active > 0 || s.hasPending() {
+		s.idle.Wait()
+	}
+}
+
+// hasPending reports whether a job is queued. Must hold s.mu.
+func (s *scheduler) hasPending() bool {
+	for _, pending := range s.pending {
+		if pending && !s.closed {
+			return true
+		}
+	}
+	return false
+}
+
+// close stops starting jobs, dropping the queued ones, and waits for the running
+// ones to finish. It returns the kinds of job that were still queued.
+func (s *scheduler) close() (dropped [numJobKinds]bool) {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped = s.pending
+	s.pending = [numJobKinds]bool{}
+	return dropped
+}
@@ -0,0 +1,215 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raman20/storage"
+)
+
+func TestSchedulerLimit(t *testing.T) {
+	var running, peak, runs atomic.Int32
+	job := func() error {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		running.Add(-1)
+		if runs.Add(1) == 1 {
+			return errors.New("job failed")
+		}
+		return nil
+	}
+
+	var mu sync.Mutex
+	var errs []error
+	s := newScheduler(1, [numJobKinds]func() error{jobFlush: job, jobCompaction: job}, [numJobKinds]bool{}, func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+
+	for i := 0; i < 20; i++ {
+		s.schedule(jobFlush)
+		s.schedule(jobCompaction)
+	}
+	s.wait()
+	s.close()
+
+	if peak.Load() != 1 {
+		t.Errorf("expected at most 1 job at once, got %d", peak.Load())
+	}
+	if runs.Load() < 2 {
+		t.Errorf("expected both kinds of job to run, got %d runs", runs.Load())
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected 1 reported error, got %v", errs)
+	}
+
+	// Jobs scheduled after close never run
+	before := runs.Load()
+	s.schedule(jobFlush)
+	s.wait()
+	if runs.Load() != before {
+		t.Errorf("expected no jobs to run after close")
+	}
+}
+
+func TestSchedulerConcurrentKinds(t *testing.T) {
+	for _, limit := range []int{1, 2, 3, 5} {
+		var runs atomic.Int32
+		release := make(chan struct{})
+		job := func() error {
+			runs.Add(1)
+			<-release
+			return nil
+		}
+		s := newScheduler(limit, [numJobKinds]func() error{jobFlush: job, jobCompaction: job},
+			[numJobKinds]bool{jobCompaction: true}, func(error) {})
+
+		// The started jobs block, so every request for a compaction takes a free slot
+		for i := 0; i < 2*limit; i++ {
+			s.schedule(jobFlush)
+			s.schedule(jobCompaction)
+		}
+		s.mu.Lock()
+		active, flushes := s.active, s.running[jobFlush]
+		s.mu.Unlock()
+		close(release)
+		s.wait()
+		s.close()
+
+		if active != limit {
+			t.Errorf("limit %d: expected %d jobs at once, got %d", limit, limit, active)
+		}
+		if flushes != 1 {
+			t.Errorf("limit %d: expected flushes to run one at a time, got %d at once", limit, flushes)
+		}
+		if runs.Load() < int32(limit) {
+			t.Errorf("limit %d: expected at least %d jobs to run, got %d", limit, limit, runs.Load())
+		}
+	}
+}
+
+func newSchedulerTestIndex(t *testing.T, opts storage.Options) (*LSMIndex, string) {
+	tmpDir, err := os.MkdirTemp("", "lsm_scheduler_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	walDir := filepath.Join(tmpDir, "wal")
+	sstDir := filepath.Join(tmpDir, "sst")
+	os.MkdirAll(walDir, 0755)
+	os.MkdirAll(sstDir, 0755)
+
+	idx, err := NewLSMIndex(walDir, sstDir, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSMIndex: %v", err)
+	}
+	return idx, tmpDir
+}
+
+func TestWriteStalls(t *testing.T) {
+	opts := storage.Options{
+		MemtableSize:          512,
+		MaxConcurrency:        1,
+		CompactionThreshold:   2,
+		MaxImmutableMemtables: 1,
+		L0StopTrigger:         3,
+	}
+	idx, tmpDir := newSchedulerTestIndex(t, opts)
+	defer os.RemoveAll(tmpDir)
+	defer idx.Close()
+
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := idx.Put(key, storage.RecordRef{FileID: 1, Offset: int64(i)}); err != nil {
+			t.Fatalf("failed to put %s: %v", key, err)
+		}
+		idx.mu.RLock()
+		immutable := len(idx.immutable)
+		idx.mu.RUnlock()
+		if immutable > opts.MaxImmutableMemtables {
+			t.Fatalf("expected at most %d immutable memtables, got %d", opts.MaxImmutableMemtables, immutable)
+		}
+	}
+	waitForBackgroundWork(t, idx)
+
+	stats := idx.Stats()
+	if stats.WriteStalls == 0 || stats.StallTime <= 0 {
+		t.Errorf("expected writes to stall, got %d stalls in %v", stats.WriteStalls, stats.StallTime)
+	}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		expectRef(t, idx, key, storage.RecordRef{FileID: 1, Offset: int64(i)}, true)
+	}
+}
+
+func TestBackgroundErrorFailsWrites(t *testing.T) {
+	opts := storage.Options{MemtableSize: 512, MaxImmutableMemtables: 1}
+	idx, tmpDir := newSchedulerTestIndex(t, opts)
+	defer os.RemoveAll(tmpDir)
+
+	// Flushes fail once the SST directory is gone
+	if err := os.RemoveAll(filepath.Join(tmpDir, "sst")); err != nil {
+		t.Fatalf("failed to remove SST directory: %v", err)
+	}
+
+	var err error
+	for i := 0; i < 1000 && err == nil; i++ {
+		err = idx.Put([]byte(fmt.Sprintf("key%05d", i)), storage.RecordRef{FileID: 1})
+	}
+	if err == nil {
+		t.Fatalf("expected a write to fail after a failed flush")
+	}
+	if err := idx.Put([]byte("later"), storage.RecordRef{FileID: 1}); err == nil {
+		t.Errorf("expected writes to keep failing after a failed flush")
+	}
+
+	if err := idx.Close(); err != nil {
+		t.Errorf("failed to close index: %v", err)
+	}
+}
+
+func TestCloseFlushesQueuedMemtables(t *testing.T) {
+	opts := storage.Options{MemtableSize: 512, MaxConcurrency: 1, MaxImmutableMemtables: 64, CompactionThreshold: 1000}
+	idx, tmpDir := newSchedulerTestIndex(t, opts)
+	defer os.RemoveAll(tmpDir)
+
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := idx.Put(key, storage.RecordRef{FileID: 1, Offset: int64(i)}); err != nil {
+			t.Fatalf("failed to put %s: %v", key, err)
+		}
+	}
+	if err := idx.Close(); err != nil {
+		t.Fatalf("failed to close index: %v", err)
+	}
+
+	// Only the active memtable's WAL is left once Close returns
+	wals, err := os.ReadDir(filepath.Join(tmpDir, "wal"))
+	if err != nil {
+		t.Fatalf("failed to read WAL directory: %v", err)
+	}
+	if len(wals) != 1 {
+		t.Errorf("expected 1 WAL after close, got %d", len(wals))
+	}
+
+	idx, err = NewLSMIndex(filepath.Join(tmpDir, "wal"), filepath.Join(tmpDir, "sst"), opts)
+	if err != nil {
+		t.Fatalf("failed to reopen LSMIndex: %v", err)
+	}
+	defer idx.Close()
+	for i := 0; i < 500; i++ {
+		expectRef(t, idx, fmt.Sprintf("key%05d", i), storage.RecordRef{FileID: 1, Offset: int64(i)}, true)
+	}
+}
@@ -17,9 +17,13 @@ type SkipList struct {
 	comparator func(a, b string) int // Allow custom comparators
 }
 
+// SkipListNode holds one version of a key. Versions of the same key are adjacent,
+// newest first.
 type SkipListNode struct {
 	key    string
 	value  string
+	seq    uint64    // Sequence number of the write that produced the version
+	kind   entryKind // Set or tombstone
 	levels []*SkipListNode
 }
 
@@ -45,6 +49,17 @@ func InitSL(p float64, maxLevel int) *SkipList {
 }
 
 func (sl *SkipList) Put(key string, value string) error {
+	return sl.PutSeq(key, value, 0)
+}
+
+// PutSeq sets key to value, recording seq as the sequence number of the write.
+func (sl *SkipList) PutSeq(key string, value string, seq uint64) error {
+	return sl.add(key, value, seq, kindSet)
+}
+
+// add inserts a version of key. Versions with different sequence numbers are kept
+// side by side; a version with the sequence number of an existing one replaces it.
+func (sl *SkipList) add(key string, value string, seq uint64, kind entryKind) error {
 	if key == "" {
 		return errors.New("key cannot be empty")
 	}
@@ -56,16 +71,17 @@ func (sl *SkipList) Put(key string, value string) error {
 	currentNode := sl.head
 
 	for i := sl.currLevel - 1; i >= 0; i-- {
-		for currentNode.levels[i] != nil && currentNode.levels[i].key < key {
+		for currentNode.levels[i] != nil && internalLess(currentNode.levels[i].key, currentNode.levels[i].seq, key, seq) {
 			currentNode = currentNode.levels[i]
 		}
 		levelTrack[i] = currentNode
 	}
 
-	// Check if the key already exists (it would be the next node at level 0)
+	// Check if the version already exists (it would be the next node at level 0)
 	next := currentNode.levels[0]
-	if next != nil && next.key == key {
+	if next != nil && next.key == key && next.seq == seq {
 		next.value = value
+		next.kind = kind
 		return nil
 	}
 
@@ -80,6 +96,8 @@ func (sl *SkipList) Put(key string, value string) error {
 	newNode := &SkipListNode{
 		key:    key,
 		value:  value,
+		seq:    seq,
+		kind:   kind,
 		levels: make([]*SkipListNode, newLevel),
 	}
 
@@ -92,12 +110,22 @@ func (sl *SkipList) Put(key string, value string) error {
 	return nil
 }
 
+// Get returns the value of the newest version of key. A tombstone has an empty value.
 func (sl *SkipList) Get(key string) (string, bool) {
+	if node := sl.findVersion(key, MaxSequence); node != nil {
+		return node.value, true // Key found
+	}
+	return "", false // Key not found
+}
+
+// findVersion returns the newest version of key with a sequence number of at most
+// seq, or nil.
+func (sl *SkipList) findVersion(key string, seq uint64) *SkipListNode {
 	current := sl.head
 
 	// Start from the highest level and move down
 	for i := sl.currLevel - 1; i >= 0; i-- {
-		for current.levels[i] != nil && current.levels[i].key < key {
+		for current.levels[i] != nil && internalLess(current.levels[i].key, current.levels[i].seq, key, seq) {
 			current = current.levels[i] // Move forward
 		}
 	}
@@ -105,17 +133,56 @@ func (sl *SkipList) Get(key string) (string, bool) {
 	// Move to level 0 and check the next node
 	current = current.levels[0]
 	if current != nil && current.key == key {
-		return current.value, true // Key found
+		return current
+	}
+	return nil
+}
+
+// findGE returns the newest version of the first key greater than or equal to key,
+// or nil.
+func (sl *SkipList) findGE(key string) *SkipListNode {
+	if prev := sl.findLT(key); prev != nil {
+		return prev.levels[0]
 	}
+	return sl.head.levels[0]
+}
 
-	return "", false // Key not found
+// findLT returns the oldest version of the last key less than key, or nil if there
+// is none.
+func (sl *SkipList) findLT(key string) *SkipListNode {
+	current := sl.head
+	for i := sl.currLevel - 1; i >= 0; i-- {
+		for current.levels[i] != nil && current.levels[i].key < key {
+			current = current.levels[i]
+		}
+	}
+	if current == sl.head {
+		return nil
+	}
+	return current
+}
+
+// findLast returns the oldest version of the largest key, or nil if the list is
+// empty.
+func (sl *SkipList) findLast() *SkipListNode {
+	current := sl.head
+	for i := sl.currLevel - 1; i >= 0; i-- {
+		for current.levels[i] != nil {
+			current = current.levels[i]
+		}
+	}
+	if current == sl.head {
+		return nil
+	}
+	return current
 }
 
+// Delete removes every version of key.
 func (sl *SkipList) Delete(key string) bool {
 	update := make([]*SkipListNode, sl.maxLevel)
 	current := sl.head
 
-	// Step 1: Locate node and track updates
+	// Step 1: Locate the first version and track updates
 	for i := sl.currLevel - 1; i >= 0; i-- {
 		for current.levels[i] != nil && current.levels[i].key < key {
 			current = current.levels[i]
@@ -123,18 +190,21 @@ func (sl *SkipList) Delete(key string) bool {
 		update[i] = current // Store the last node before key
 	}
 
-	// Step 2: Move to the node to be deleted
+	// Step 2: Move to the first version to be deleted
 	current = current.levels[0]
 	if current == nil || current.key != key {
 		return false // Key not found
 	}
 
-	// Step 3: Update pointers at each level
-	for i := 0; i < sl.currLevel; i++ {
-		if update[i].levels[i] != current {
-			break
+	// Step 3: Unlink each version, updating pointers at each level
+	for ; current != nil && current.key == key; current = current.levels[0] {
+		for i := 0; i < sl.currLevel; i++ {
+			if update[i].levels[i] != current {
+				break
+			}
+			update[i].levels[i] = current.levels[i]
 		}
-		update[i].levels[i] = current.levels[i]
+		sl.size--
 	}
 
 	// Step 4: Reduce currentLevel if necessary
@@ -142,7 +212,6 @@ func (sl *SkipList) Delete(key string) bool {
 		sl.currLevel--
 	}
 
-	sl.size--
 	return true
 }
 
@@ -193,3 +262,19 @@ func (it *Iterator) Value() string {
 	}
 	return it.current.value
 }
+
+// Seq returns the sequence number of the current entry.
+func (it *Iterator) Seq() uint64 {
+	if it.current == nil {
+		return 0
+	}
+	return it.current.seq
+}
+
+// kind returns whether the current entry sets its key or is a tombstone.
+func (it *Iterator) kind() entryKind {
+	if it.current == nil {
+		return kindDelete
+	}
+	return it.current.kind
+}
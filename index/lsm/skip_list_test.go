@@ -52,3 +52,44 @@ func TestSkipListDelete(t *testing.T) {
 		t.Errorf("expected size 1, got %d", sl.Size())
 	}
 }
+
+func TestSkipListVersions(t *testing.T) {
+	sl := InitSL(0.5, 16)
+
+	sl.PutSeq("key1", "v1", 1)
+	sl.PutSeq("key2", "other", 2)
+	sl.PutSeq("key1", "v3", 3)
+	sl.add("key1", "", 5, kindDelete)
+
+	// Versions of a key are kept newest first
+	var versions []uint64
+	for node := sl.findGE("key1"); node != nil && node.key == "key1"; node = node.levels[0] {
+		versions = append(versions, node.seq)
+	}
+	if len(versions) != 3 || versions[0] != 5 || versions[1] != 3 || versions[2] != 1 {
+		t.Errorf("expected versions [5 3 1], got %v", versions)
+	}
+
+	// Reads at a sequence number see the newest version no newer than it
+	for _, tc := range []struct {
+		seq   uint64
+		value string
+		kind  entryKind
+	}{{1, "v1", kindSet}, {4, "v3", kindSet}, {5, "", kindDelete}} {
+		node := sl.findVersion("key1", tc.seq)
+		if node == nil || node.value != tc.value || node.kind != tc.kind {
+			t.Errorf("findVersion(key1, %d): expected %q (kind %d), got %+v", tc.seq, tc.value, tc.kind, node)
+		}
+	}
+	if node := sl.findVersion("key1", 0); node != nil {
+		t.Errorf("expected no version of key1 at seq 0, got %+v", node)
+	}
+
+	// Delete removes every version
+	if !sl.Delete("key1") || sl.Size() != 1 {
+		t.Errorf("expected only key2 to remain, got size %d", sl.Size())
+	}
+	if v, ok := sl.Get("key2"); !ok || v != "other" {
+		t.Errorf("expected key2 to survive, got %q (ok=%v)", v, ok)
+	}
+}
@@ -0,0 +1,77 @@
+package lsm
+
+import (
+	"sort"
+
+	"github.com/raman20/storage"
+)
+
+// Snapshot is a read-only view of an LSMIndex as of a sequence number. Compaction
+// keeps every version a live snapshot can see, and the tombstones hiding versions
+// from it, until the snapshot is released.
+type Snapshot struct {
+	idx      *LSMIndex
+	seq      uint64
+	released bool // Guarded by idx.mu
+}
+
+// NewSnapshot returns a snapshot of the index as of its last write. The snapshot
+// must be released once it is no longer needed.
+func (idx *LSMIndex) NewSnapshot() (storage.IndexSnapshot, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.closed {
+		return nil, storage.ErrDBClosed
+	}
+
+	s := &Snapshot{idx: idx, seq: idx.seq.Load()}
+	idx.snapshots[s.seq]++
+	return s, nil
+}
+
+// Seq returns the sequence number of the last write the snapshot sees.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Get retrieves the RecordRef the key had when the snapshot was taken.
+func (s *Snapshot) Get(key []byte) (storage.RecordRef, bool, error) {
+	return s.idx.GetAt(key, s.seq)
+}
+
+// NewIterator returns an iterator over the keys the index held when the snapshot was
+// taken.
+func (s *Snapshot) NewIterator(opts storage.IterOptions) (storage.IndexIterator, error) {
+	return s.idx.newIterator(opts, s.seq)
+}
+
+// Release lets compaction discard the versions only the snapshot could see.
+func (s *Snapshot) Release() {
+	s.idx.mu.Lock()
+	defer s.idx.mu.Unlock()
+
+	if s.released {
+		return
+	}
+	s.released = true
+	if s.idx.snapshots[s.seq]--; s.idx.snapshots[s.seq] == 0 {
+		delete(s.idx.snapshots, s.seq)
+	}
+}
+
+// LastSequence returns the sequence number of the last write to the index.
+func (idx *LSMIndex) LastSequence() uint64 {
+	return idx.seq.Load()
+}
+
+// snapshotSeqs returns the sequence numbers of the live snapshots in ascending
+// order. Must hold idx.mu.
+func (idx *LSMIndex) snapshotSeqs() []uint64 {
+	seqs := make([]uint64, 0, len(idx.snapshots))
+	for seq := range idx.snapshots {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
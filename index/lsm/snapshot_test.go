@@ -0,0 +1,126 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/raman20/storage"
+)
+
+// expectRefAt checks the RecordRef a snapshot sees for key.
+func expectRefAt(t *testing.T, stage string, s storage.IndexSnapshot, key string, want storage.RecordRef, wantFound bool) {
+	t.Helper()
+	ref, found, err := s.Get([]byte(key))
+	if err != nil || found != wantFound || (found && ref != want) {
+		t.Errorf("%s: Get(%s) at seq %d: expected %+v (found=%v), got %+v (found=%v, err=%v)",
+			stage, key, s.Seq(), want, wantFound, ref, found, err)
+	}
+}
+
+// expectKeysAt checks the keys a snapshot iterator yields, forward and backward.
+func expectKeysAt(t *testing.T, stage string, s storage.IndexSnapshot, want ...string) {
+	t.Helper()
+	it, err := s.NewIterator(storage.IterOptions{})
+	if err != nil {
+		t.Fatalf("%s: failed to create iterator: %v", stage, err)
+	}
+	defer it.Close()
+
+	var forward, backward []string
+	for ok := it.First(); ok; ok = it.Next() {
+		forward = append(forward, string(it.Key()))
+	}
+	for ok := it.Last(); ok; ok = it.Prev() {
+		backward = append([]string{string(it.Key())}, backward...)
+	}
+	if fmt.Sprint(forward) != fmt.Sprint(want) || fmt.Sprint(backward) != fmt.Sprint(want) {
+		t.Errorf("%s: iterator at seq %d: expected %v, got %v forward and %v backward",
+			stage, s.Seq(), want, forward, backward)
+	}
+}
+
+func TestSnapshotGetAt(t *testing.T) {
+	tmpDir := newManifestTestDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	idx := openManifestTestIndex(t, tmpDir, storage.Options{CompactionThreshold: 2})
+	defer idx.Close()
+	r1 := storage.RecordRef{FileID: 1, Offset: 1}
+	r2 := storage.RecordRef{FileID: 2, Offset: 2}
+	r3 := storage.RecordRef{FileID: 3, Offset: 3}
+
+	// 1. Take a snapshot, then overwrite and delete everything it sees
+	idx.Put([]byte("a"), r1)
+	idx.Put([]byte("b"), r1)
+	idx.Put([]byte("c"), r1)
+	first, err := idx.NewSnapshot()
+	if err != nil {
+		t.Fatalf("failed to take snapshot: %v", err)
+	}
+	if first.Seq() != 3 || idx.LastSequence() != 3 {
+		t.Errorf("expected the snapshot at seq 3, got %d (last %d)", first.Seq(), idx.LastSequence())
+	}
+	idx.Put([]byte("a"), r2)
+	idx.Delete([]byte("b"))
+	idx.DeleteRange([]byte("c"), []byte("d"))
+	second, _ := idx.NewSnapshot()
+	idx.Put([]byte("a"), r3)
+	idx.Put([]byte("c"), r3)
+
+	check := func(stage string) {
+		expectRefAt(t, stage, first, "a", r1, true)
+		expectRefAt(t, stage, first, "b", r1, true)
+		expectRefAt(t, stage, first, "c", r1, true)
+		expectRefAt(t, stage, second, "a", r2, true)
+		expectRefAt(t, stage, second, "b", storage.RecordRef{}, false)
+		expectRefAt(t, stage, second, "c", storage.RecordRef{}, false)
+		expectRef(t, idx, "a", r3, true)
+		expectRef(t, idx, "b", storage.RecordRef{}, false)
+		expectRef(t, idx, "c", r3, true)
+		expectKeysAt(t, stage, first, "a", "b", "c")
+		expectKeysAt(t, stage, second, "a")
+	}
+	check("memtable")
+
+	// 2. The versions survive flushes and a full compaction while the snapshots live
+	flushActive(t, idx)
+	check("flushed")
+	idx.Put([]byte("z"), r1)
+	flushActive(t, idx)
+	waitForTableCount(t, idx, 1)
+	check("compacted")
+
+	// 3. Once the snapshots are released, compaction drops the versions only they saw
+	first.Release()
+	second.Release()
+	idx.Put([]byte("z"), r2)
+	flushActive(t, idx)
+	waitForTableCount(t, idx, 1)
+
+	versions := 0
+	it := idx.sstables[0].Iterator()
+	for it.Next() {
+		versions++
+	}
+	if versions != 3 || len(idx.sstables[0].rangeDels) != 0 {
+		t.Errorf("expected only the latest versions of a, c and z, got %d versions and %d range tombstones",
+			versions, len(idx.sstables[0].rangeDels))
+	}
+	if _, found, err := idx.GetAt([]byte("a"), first.Seq()); err != nil || found {
+		t.Errorf("expected the version of a at a released snapshot to be gone (found=%v, err=%v)", found, err)
+	}
+}
+
+// waitForTableCount waits for background compactions to leave n SSTables.
+func waitForTableCount(t *testing.T, idx *LSMIndex, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for idx.Stats().SSTableCount != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d SSTables, got %d", n, idx.Stats().SSTableCount)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitForBackgroundWork(t, idx)
+}
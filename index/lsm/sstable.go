@@ -5,93 +5,240 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"sort"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 const MagicNumber uint32 = 0x53535442 // "SSTB" in hex
 
+// MagicNumberRanges ends the footer of an SSTable that carries a range tombstone
+// block: [8B index offset][4B key count][8B range offset][4B range count][4B magic].
+const MagicNumberRanges uint32 = 0x53535452 // "SSTR" in hex
+
+// MagicNumberFilter ends the footer of an SSTable that carries a range tombstone
+// block and a bloom filter block: [8B index offset][4B key count][8B range offset]
+// [4B range count][8B filter offset][4B filter length][4B magic].
+const MagicNumberFilter uint32 = 0x53535446 // "SSTF" in hex
+
+// MagicNumberBlocks ends the footer of a block-format SSTable, whose data is split
+// into prefix-compressed blocks found through a sparse index holding the last key
+// of each block. The footer has the same layout as MagicNumberFilter's, with the
+// block count in place of the key count.
+const MagicNumberBlocks uint32 = 0x5353544B // "SSTK" in hex
+
+// MagicNumberSeqs ends the footer of a block-format SSTable whose entries carry the
+// sequence number of the write that produced them. The footer extends
+// MagicNumberBlocks' with the largest sequence number in the table:
+// [8B index offset][4B block count][8B range offset][4B range count]
+// [8B filter offset][4B filter length][8B max seq][4B magic].
+const MagicNumberSeqs uint32 = 0x53535453 // "SSTS" in hex
+
+// MagicNumberVersions ends the footer of a block-format SSTable that stores every
+// entry under its internal key, with a tag holding its sequence number and kind,
+// and the sequence number of each range tombstone. The footer has the same layout
+// as MagicNumberSeqs'.
+const MagicNumberVersions uint32 = 0x53535456 // "SSTV" in hex
+
+const (
+	footerSize       = 16
+	rangeFooterSize  = 28
+	filterFooterSize = 40
+	seqFooterSize    = 48
+)
+
+// RangeTombstone deletes every key in [Start, End) written before it: the versions
+// with a lower sequence number in its own layer and every version in older layers.
+// Tombstones written before sequence numbers were assigned have Seq 0 and only hide
+// older layers.
+type RangeTombstone struct {
+	Start string
+	End   string
+	Seq   uint64
+}
+
+// hides reports whether t, read at readSeq, deletes the version of key written at
+// seq. olderLayer tells that the version is in a layer older than the tombstone's.
+func (t RangeTombstone) hides(key string, seq uint64, olderLayer bool, readSeq uint64) bool {
+	if key < t.Start || key >= t.End || t.Seq > readSeq {
+		return false
+	}
+	if t.Seq == 0 {
+		return olderLayer
+	}
+	return olderLayer || seq < t.Seq
+}
+
 type IndexEntry struct {
 	Key    string
 	Offset int64
 	ValLen uint32
 }
 
+// SSTable is an immutable sorted table on disk. Tables in the block format keep
+// only a sparse index of their data blocks in memory and read blocks through a
+// block cache; tables in the older flat format keep an index entry per key.
 type SSTable struct {
-	filePath string
-	file     *os.File
-	index    []IndexEntry
+	id        uint64 // Identifies the table's blocks in the cache
+	filePath  string
+	file      *os.File
+	size      int64
+	level     int           // Level of the table under leveled compaction
+	claimed   bool          // Being merged by a running compaction; guarded by LSMIndex.mu
+	smallest  string        // Smallest key or range tombstone start
+	largest   string        // Largest key or range tombstone end
+	index     []IndexEntry  // Flat format only
+	blocks    []blockHandle // Block format only
+	format    entryFormat   // How data block entries identify their version
+	maxSeq    uint64        // Largest sequence number in the table, 0 if unknown
+	cache     *blockCache
+	rangeDels []RangeTombstone // Hide older tables and older versions in this table
+	filter    bloomFilter      // Empty for tables written without a filter
+	readers   sync.WaitGroup   // Open iterators; compaction waits for them before deleting the file
 }
 
+// nextTableID numbers the SSTables opened by the process.
+var nextTableID atomic.Uint64
+
 // WriteSSTable writes a SkipList/Memtable to an SSTable file.
 func WriteSSTable(filePath string, iterator *Iterator) error {
+	return writeSSTable(filePath, iterator, nil, defaultBloomBitsPerKey)
+}
+
+// writeSSTable writes a memtable's entries and range tombstones to an SSTable file,
+// with a bloom filter of bitsPerKey bits per key unless bitsPerKey is zero.
+func writeSSTable(filePath string, iterator *Iterator, rangeDels []RangeTombstone, bitsPerKey int) error {
 	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to create SSTable file: %w", err)
 	}
 	defer file.Close()
 
-	var index []IndexEntry
-	var offset int64
-
-	// Write data block
+	w := newSSTWriter(file)
 	for iterator.Next() {
-		key := iterator.Key()
-		val := iterator.Value()
+		if err := w.add(iterator.Key(), iterator.Value(), iterator.Seq(), iterator.kind()); err != nil {
+			return err
+		}
+	}
+	return w.finish(rangeDels, bitsPerKey)
+}
 
-		keyLen := uint32(len(key))
-		valLen := uint32(len(val))
+// sstWriter writes an SSTable in the block format. Entries must be added in
+// ascending internal key order:
+//
+//	[data block]*N[sparse index][range tombstone block][bloom filter block][footer]
+//
+// Sparse index entries use the layout of flat index entries, with the block's last
+// key and its size in place of the value length.
+type sstWriter struct {
+	file    *os.File
+	offset  int64
+	block   blockBuilder
+	index   []blockHandle
+	hashes  []uint32 // Bloom hashes of every distinct key
+	lastKey string
+	maxSeq  uint64
+}
 
-		// Write key length, value length
-		var header [8]byte
-		binary.BigEndian.PutUint32(header[0:4], keyLen)
-		binary.BigEndian.PutUint32(header[4:8], valLen)
+func newSSTWriter(file *os.File) *sstWriter {
+	return &sstWriter{file: file}
+}
 
-		if _, err := file.Write(header[:]); err != nil {
-			return fmt.Errorf("failed to write data header: %w", err)
-		}
+func (w *sstWriter) add(key, value string, seq uint64, kind entryKind) error {
+	w.block.add(key, value, seq, kind)
+	w.maxSeq = max(w.maxSeq, seq)
+	if key != w.lastKey {
+		w.hashes = append(w.hashes, bloomHash(key))
+	}
+	w.lastKey = key
+	if w.block.size() >= blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
 
-		// Save offset of the key-value pair in file
-		index = append(index, IndexEntry{
-			Key:    key,
-			Offset: offset,
-			ValLen: valLen,
-		})
+// size returns the bytes written so far, including the pending block.
+func (w *sstWriter) size() int64 {
+	return w.offset + int64(w.block.size())
+}
 
-		// Write key
-		if _, err := file.WriteString(key); err != nil {
-			return fmt.Errorf("failed to write data key: %w", err)
-		}
-		// Write value
-		if _, err := file.WriteString(val); err != nil {
-			return fmt.Errorf("failed to write data value: %w", err)
-		}
+func (w *sstWriter) flushBlock() error {
+	data := w.block.finish()
+	if _, err := w.file.Write(data); err != nil {
+		return fmt.Errorf("failed to write data block: %w", err)
+	}
+	w.index = append(w.index, blockHandle{lastKey: w.lastKey, offset: w.offset, size: uint32(len(data))})
+	w.offset += int64(len(data))
+	w.block.reset()
+	return nil
+}
 
-		offset += 8 + int64(keyLen) + int64(valLen)
+// finish writes the last data block, the sparse index and the trailer, and syncs
+// the file.
+func (w *sstWriter) finish(rangeDels []RangeTombstone, bitsPerKey int) error {
+	if !w.block.empty() {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
 	}
 
-	// Write index block
-	indexOffset := offset
-	for _, entry := range index {
-		keyLen := uint32(len(entry.Key))
+	indexOffset := w.offset
+	for _, h := range w.index {
 		var idxHeader [16]byte
-		binary.BigEndian.PutUint32(idxHeader[0:4], keyLen)
-		binary.BigEndian.PutUint64(idxHeader[4:12], uint64(entry.Offset))
-		binary.BigEndian.PutUint32(idxHeader[12:16], entry.ValLen)
+		binary.BigEndian.PutUint32(idxHeader[0:4], uint32(len(h.lastKey)))
+		binary.BigEndian.PutUint64(idxHeader[4:12], uint64(h.offset))
+		binary.BigEndian.PutUint32(idxHeader[12:16], h.size)
 
-		if _, err := file.Write(idxHeader[:]); err != nil {
+		if _, err := w.file.Write(idxHeader[:]); err != nil {
 			return fmt.Errorf("failed to write index header: %w", err)
 		}
-		if _, err := file.WriteString(entry.Key); err != nil {
+		if _, err := w.file.WriteString(h.lastKey); err != nil {
 			return fmt.Errorf("failed to write index key: %w", err)
 		}
-		offset += 16 + int64(keyLen)
+		w.offset += 16 + int64(len(h.lastKey))
+	}
+
+	return writeTrailer(w.file, w.offset, indexOffset, len(w.index), w.maxSeq, w.hashes, rangeDels, bitsPerKey)
+}
+
+// writeTrailer writes the range tombstone block at offset, the bloom filter block
+// over the key hashes and the footer of a block-format table, and syncs the file.
+func writeTrailer(file *os.File, offset, indexOffset int64, numBlocks int, maxSeq uint64, hashes []uint32, rangeDels []RangeTombstone, bitsPerKey int) error {
+	// 1. Range tombstone block
+	rangeOffset := offset
+	for _, t := range rangeDels {
+		var header [16]byte
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(t.Start)))
+		binary.BigEndian.PutUint32(header[4:8], uint32(len(t.End)))
+		binary.BigEndian.PutUint64(header[8:16], t.Seq)
+
+		if _, err := file.Write(header[:]); err != nil {
+			return fmt.Errorf("failed to write range tombstone header: %w", err)
+		}
+		if _, err := file.WriteString(t.Start + t.End); err != nil {
+			return fmt.Errorf("failed to write range tombstone: %w", err)
+		}
+		offset += 16 + int64(len(t.Start)+len(t.End))
+	}
+
+	// 2. Bloom filter block
+	filter := newBloomFilter(hashes, bitsPerKey)
+	if _, err := file.Write(filter); err != nil {
+		return fmt.Errorf("failed to write filter block: %w", err)
 	}
 
-	// Write Footer
-	var footer [16]byte
+	// 3. Footer
+	var footer [seqFooterSize]byte
 	binary.BigEndian.PutUint64(footer[0:8], uint64(indexOffset))
-	binary.BigEndian.PutUint32(footer[8:12], uint32(len(index)))
-	binary.BigEndian.PutUint32(footer[12:16], MagicNumber)
+	binary.BigEndian.PutUint32(footer[8:12], uint32(numBlocks))
+	binary.BigEndian.PutUint64(footer[12:20], uint64(rangeOffset))
+	binary.BigEndian.PutUint32(footer[20:24], uint32(len(rangeDels)))
+	binary.BigEndian.PutUint64(footer[24:32], uint64(offset))
+	binary.BigEndian.PutUint32(footer[32:36], uint32(len(filter)))
+	binary.BigEndian.PutUint64(footer[36:44], maxSeq)
+	binary.BigEndian.PutUint32(footer[44:48], MagicNumberVersions)
 
 	if _, err := file.Write(footer[:]); err != nil {
 		return fmt.Errorf("failed to write footer: %w", err)
@@ -102,6 +249,11 @@ func WriteSSTable(filePath string, iterator *Iterator) error {
 
 // OpenSSTable opens an SSTable file and loads its index block into memory.
 func OpenSSTable(filePath string) (*SSTable, error) {
+	return openSSTable(filePath, nil)
+}
+
+// openSSTable opens an SSTable file whose data blocks are cached in cache.
+func openSSTable(filePath string, cache *blockCache) (*SSTable, error) {
 	file, err := os.OpenFile(filePath, os.O_RDONLY, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open SSTable file: %w", err)
@@ -113,27 +265,12 @@ func OpenSSTable(filePath string) (*SSTable, error) {
 		return nil, fmt.Errorf("failed to stat SSTable file: %w", err)
 	}
 
-	fileSize := stat.Size()
-	if fileSize < 16 {
-		file.Close()
-		return nil, fmt.Errorf("invalid SSTable file size: too small")
-	}
-
-	// Read footer (last 16 bytes)
-	var footer [16]byte
-	if _, err := file.ReadAt(footer[:], fileSize-16); err != nil {
-		file.Close()
-		return nil, fmt.Errorf("failed to read footer: %w", err)
-	}
-
-	indexOffset := int64(binary.BigEndian.Uint64(footer[0:8]))
-	numKeys := binary.BigEndian.Uint32(footer[8:12])
-	magic := binary.BigEndian.Uint32(footer[12:16])
-
-	if magic != MagicNumber {
+	f, err := readFooter(file, stat.Size())
+	if err != nil {
 		file.Close()
-		return nil, fmt.Errorf("invalid SSTable magic number: %x", magic)
+		return nil, err
 	}
+	indexOffset, numKeys := f.indexOffset, f.numEntries
 
 	// Read index block
 	index := make([]IndexEntry, numKeys)
@@ -166,37 +303,266 @@ func OpenSSTable(filePath string) (*SSTable, error) {
 		}
 	}
 
-	return &SSTable{
-		filePath: filePath,
-		file:     file,
-		index:    index,
-	}, nil
+	sst := &SSTable{
+		id:        nextTableID.Add(1),
+		filePath:  filePath,
+		file:      file,
+		size:      stat.Size(),
+		level:     levelFromName(filepath.Base(filePath)),
+		format:    f.format,
+		maxSeq:    f.maxSeq,
+		cache:     cache,
+		rangeDels: f.rangeDels,
+		filter:    f.filter,
+	}
+	if f.blocks {
+		// Sparse index entries hold the last key and the size of each data block
+		sst.blocks = make([]blockHandle, len(index))
+		for i, entry := range index {
+			sst.blocks[i] = blockHandle{lastKey: entry.Key, offset: entry.Offset, size: entry.ValLen}
+		}
+	} else {
+		sst.index = index
+	}
+
+	if err := sst.loadBounds(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return sst, nil
+}
+
+// loadBounds finds the key range covered by the table's entries and range tombstones.
+func (sst *SSTable) loadBounds() error {
+	l := sst.newLayer()
+	hasKeys := false
+	if l.first(); l.valid() {
+		sst.smallest, hasKeys = l.key(), true
+		if l.last(); l.valid() {
+			sst.largest = l.key()
+		}
+	}
+	if err := l.error(); err != nil {
+		return err
+	}
+
+	for _, t := range sst.rangeDels {
+		if !hasKeys || t.Start < sst.smallest {
+			sst.smallest = t.Start
+		}
+		if !hasKeys || t.End > sst.largest {
+			sst.largest = t.End
+		}
+		hasKeys = true
+	}
+	return nil
+}
+
+// overlaps reports whether the table's key range intersects [lower, upper].
+func (sst *SSTable) overlaps(lower, upper string) bool {
+	return sst.smallest <= upper && sst.largest >= lower
+}
+
+// levelFromName returns the level encoded in a table's file name by the compaction
+// that wrote it. Tables written by flushes and full compactions are in L0. The
+// manifest is authoritative once a table is moved; names only place the tables of
+// an index that predates its manifest.
+func levelFromName(name string) int {
+	base := strings.TrimSuffix(name, ".sst")
+	if i := strings.LastIndex(base, "_L"); i >= 0 {
+		if level, err := strconv.Atoi(base[i+2:]); err == nil {
+			return level
+		}
+	}
+	return 0
+}
+
+// sstFooter holds the footer of an SSTable and the blocks it points to besides
+// the data and index blocks.
+type sstFooter struct {
+	indexOffset int64
+	numEntries  uint32 // Keys of a flat table, or data blocks of a block-format table
+	blocks      bool
+	format      entryFormat
+	maxSeq      uint64
+	rangeDels   []RangeTombstone
+	filter      bloomFilter
+}
+
+// readFooter reads the footer of an SSTable of any format version along with its
+// range tombstone and bloom filter blocks, if present.
+func readFooter(file *os.File, fileSize int64) (sstFooter, error) {
+	var f sstFooter
+	if fileSize < footerSize {
+		return f, fmt.Errorf("invalid SSTable file size: too small")
+	}
+
+	var magicBuf [4]byte
+	if _, err := file.ReadAt(magicBuf[:], fileSize-4); err != nil {
+		return f, fmt.Errorf("failed to read footer: %w", err)
+	}
+	magic := binary.BigEndian.Uint32(magicBuf[:])
+
+	var size int64
+	switch magic {
+	case MagicNumber:
+		size = footerSize
+	case MagicNumberRanges:
+		size = rangeFooterSize
+	case MagicNumberFilter, MagicNumberBlocks:
+		size = filterFooterSize
+	case MagicNumberSeqs, MagicNumberVersions:
+		size = seqFooterSize
+	default:
+		return f, fmt.Errorf("invalid SSTable magic number: %x", magic)
+	}
+	if fileSize < size {
+		return f, fmt.Errorf("invalid SSTable file size: too small")
+	}
+
+	footer := make([]byte, size)
+	if _, err := file.ReadAt(footer, fileSize-size); err != nil {
+		return f, fmt.Errorf("failed to read footer: %w", err)
+	}
+	f.indexOffset = int64(binary.BigEndian.Uint64(footer[0:8]))
+	f.numEntries = binary.BigEndian.Uint32(footer[8:12])
+	f.blocks = magic == MagicNumberBlocks || size == seqFooterSize
+	if size == seqFooterSize {
+		f.format = formatSeq
+		if magic == MagicNumberVersions {
+			f.format = formatTag
+		}
+		f.maxSeq = binary.BigEndian.Uint64(footer[36:44])
+	}
+	if magic == MagicNumber {
+		return f, nil
+	}
+
+	// The range block runs up to the filter block, or to the footer without one
+	rangeOffset := int64(binary.BigEndian.Uint64(footer[12:20]))
+	numRanges := binary.BigEndian.Uint32(footer[20:24])
+	rangeEnd := fileSize - size
+	if size >= filterFooterSize {
+		filterOffset := int64(binary.BigEndian.Uint64(footer[24:32]))
+		filterLen := int64(binary.BigEndian.Uint32(footer[32:36]))
+		if filterOffset < 0 || filterOffset+filterLen != fileSize-size {
+			return f, fmt.Errorf("invalid SSTable filter block offset: %d", filterOffset)
+		}
+		f.filter = make(bloomFilter, filterLen)
+		if _, err := file.ReadAt(f.filter, filterOffset); err != nil {
+			return f, fmt.Errorf("failed to read filter block: %w", err)
+		}
+		rangeEnd = filterOffset
+	}
+
+	if rangeOffset < 0 || rangeOffset > rangeEnd {
+		return f, fmt.Errorf("invalid SSTable range block offset: %d", rangeOffset)
+	}
+	block := make([]byte, rangeEnd-rangeOffset)
+	if _, err := file.ReadAt(block, rangeOffset); err != nil {
+		return f, fmt.Errorf("failed to read range tombstone block: %w", err)
+	}
+
+	// Range tombstones carry a sequence number in tables that store versions
+	headerSize := 8
+	if f.format == formatTag {
+		headerSize = 16
+	}
+	f.rangeDels = make([]RangeTombstone, 0, numRanges)
+	for i := uint32(0); i < numRanges; i++ {
+		if len(block) < headerSize {
+			return f, fmt.Errorf("truncated range tombstone block")
+		}
+		startLen := int(binary.BigEndian.Uint32(block[0:4]))
+		endLen := int(binary.BigEndian.Uint32(block[4:8]))
+		var seq uint64
+		if headerSize == 16 {
+			seq = binary.BigEndian.Uint64(block[8:16])
+		}
+		if len(block) < headerSize+startLen+endLen {
+			return f, fmt.Errorf("truncated range tombstone block")
+		}
+		f.rangeDels = append(f.rangeDels, RangeTombstone{
+			Start: string(block[headerSize : headerSize+startLen]),
+			End:   string(block[headerSize+startLen : headerSize+startLen+endLen]),
+			Seq:   seq,
+		})
+		block = block[headerSize+startLen+endLen:]
+	}
+	return f, nil
+}
+
+// mayContain reports whether the table's bloom filter admits key. Tables without
+// a filter admit every key.
+func (sst *SSTable) mayContain(key string) bool {
+	return sst.filter.mayContain(key)
 }
 
-// Get checks if the key exists in this SSTable and returns the value if found.
+// RangeTombstones returns the table's range tombstones.
+func (sst *SSTable) RangeTombstones() []RangeTombstone {
+	return sst.rangeDels
+}
+
+// Get checks if the key exists in this SSTable and returns the value of its newest
+// version if found. A tombstone has an empty value.
 func (sst *SSTable) Get(key string) (string, bool, error) {
-	// Binary search on index
-	idx := sort.Search(len(sst.index), func(i int) bool {
-		return sst.index[i].Key >= key
-	})
-
-	if idx < len(sst.index) && sst.index[idx].Key == key {
-		entry := sst.index[idx]
-		
-		// Read value from file
-		valOffset := entry.Offset + 8 + int64(len(key))
-		valBuf := make([]byte, entry.ValLen)
-		if _, err := sst.file.ReadAt(valBuf, valOffset); err != nil {
-			return "", false, fmt.Errorf("failed to read value from SSTable: %w", err)
+	v, found, err := sst.get(key, MaxSequence)
+	return v.value, found, err
+}
+
+// get returns the newest version of key visible at readSeq.
+func (sst *SSTable) get(key string, readSeq uint64) (version, bool, error) {
+	l := sst.newLayer()
+	for l.seekGE(key); l.valid() && l.key() == key; l.next() {
+		if l.seq() > readSeq {
+			continue
+		}
+		value, err := l.value()
+		if err != nil {
+			return version{}, false, err
 		}
-		
-		return string(valBuf), true, nil
+		return version{value: value, seq: l.seq(), kind: l.kind()}, true, nil
 	}
+	return version{}, false, l.error()
+}
+
+// lookup is get followed by a check of the table's range tombstones, as in
+// Memtable.lookup.
+func (sst *SSTable) lookup(key string, readSeq uint64) (v version, found, deleted bool, err error) {
+	v, found, err = sst.get(key, readSeq)
+	if err != nil {
+		return v, false, false, err
+	}
+	return v, found, rangeDeleted(sst.rangeDels, key, v.seq, found, readSeq), nil
+}
 
-	return "", false, nil
+// newLayer returns a cursor over the table's entries.
+func (sst *SSTable) newLayer() layerIterator {
+	if sst.blocks != nil {
+		return &blockLayer{sst: sst}
+	}
+	return &flatLayer{sst: sst}
 }
 
+// readBlock returns data block i, from the block cache if it holds it.
+func (sst *SSTable) readBlock(i int) (*block, error) {
+	h := sst.blocks[i]
+	key := blockKey{table: sst.id, offset: h.offset}
+
+	raw, ok := sst.cache.get(key)
+	if !ok {
+		raw = make([]byte, h.size)
+		if _, err := sst.file.ReadAt(raw, h.offset); err != nil {
+			return nil, fmt.Errorf("failed to read SSTable data block: %w", err)
+		}
+		sst.cache.add(key, raw)
+	}
+	return parseBlock(raw, sst.format)
+}
+
+// Close closes the table's file and drops its blocks from the cache.
 func (sst *SSTable) Close() error {
+	sst.cache.evictTable(sst.id)
 	return sst.file.Close()
 }
 
@@ -208,42 +574,51 @@ func (sst *SSTable) FileHandle() *os.File {
 	return sst.file
 }
 
-func (sst *SSTable) IndexBlock() []IndexEntry {
-	return sst.index
-}
-
+// SSTableIterator reads every entry of an SSTable in ascending internal key order,
+// so the versions of a key come newest first.
 type SSTableIterator struct {
 	sst     *SSTable
-	currIdx int
+	layer   layerIterator
+	started bool
 	currKey string
 	currVal string
+	currSeq uint64
+	currDel bool
 	err     error
 }
 
 func (sst *SSTable) Iterator() *SSTableIterator {
 	return &SSTableIterator{
-		sst:     sst,
-		currIdx: -1,
+		sst:   sst,
+		layer: sst.newLayer(),
 	}
 }
 
 func (it *SSTableIterator) Next() bool {
-	it.currIdx++
-	if it.currIdx >= len(it.sst.index) {
+	if it.err != nil {
+		return false
+	}
+	if it.started {
+		it.layer.next()
+	} else {
+		it.layer.first()
+		it.started = true
+	}
+
+	if !it.layer.valid() {
+		it.err = it.layer.error()
 		return false
 	}
-	
-	entry := it.sst.index[it.currIdx]
-	valOffset := entry.Offset + 8 + int64(len(entry.Key))
-	valBuf := make([]byte, entry.ValLen)
-	_, err := it.sst.file.ReadAt(valBuf, valOffset)
+	val, err := it.layer.value()
 	if err != nil {
-		it.err = fmt.Errorf("failed to read value at index %d: %w", it.currIdx, err)
+		it.err = err
 		return false
 	}
-	
-	it.currKey = entry.Key
-	it.currVal = string(valBuf)
+
+	it.currKey = it.layer.key()
+	it.currVal = val
+	it.currSeq = it.layer.seq()
+	it.currDel = it.layer.kind() == kindDelete
 	return true
 }
 
@@ -255,12 +630,19 @@ func (it *SSTableIterator) Value() string {
 	return it.currVal
 }
 
-func (it *SSTableIterator) Error() error {
-	return it.err
+// Seq returns the sequence number of the current entry, or 0 for tables written
+// before sequence numbers were recorded.
+func (it *SSTableIterator) Seq() uint64 {
+	return it.currSeq
 }
 
-func (it *SSTableIterator) CurrIdx() int {
-	return it.currIdx
+// Deleted reports whether the current entry is a tombstone.
+func (it *SSTableIterator) Deleted() bool {
+	return it.currDel
+}
+
+func (it *SSTableIterator) Error() error {
+	return it.err
 }
 
 func (it *SSTableIterator) SSTable() *SSTable {
@@ -1,6 +1,8 @@
 package lsm
 
 import (
+	"encoding/binary"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -81,3 +83,191 @@ func TestSSTableWriteAndRead(t *testing.T) {
 		t.Errorf("expected iterator to process 3 items, got %d", idx)
 	}
 }
+
+// writeFlatSSTable writes entries in the flat format with a 16-byte footer, as
+// tables were written before the block format.
+func writeFlatSSTable(t *testing.T, path string, entries [][2]string) {
+	var data, index []byte
+	for _, e := range entries {
+		index = binary.BigEndian.AppendUint32(index, uint32(len(e[0])))
+		index = binary.BigEndian.AppendUint64(index, uint64(len(data)))
+		index = binary.BigEndian.AppendUint32(index, uint32(len(e[1])))
+		index = append(index, e[0]...)
+
+		data = binary.BigEndian.AppendUint32(data, uint32(len(e[0])))
+		data = binary.BigEndian.AppendUint32(data, uint32(len(e[1])))
+		data = append(data, e[0]+e[1]...)
+	}
+
+	footer := binary.BigEndian.AppendUint64(nil, uint64(len(data)))
+	footer = binary.BigEndian.AppendUint32(footer, uint32(len(entries)))
+	footer = binary.BigEndian.AppendUint32(footer, MagicNumber)
+	if err := os.WriteFile(path, append(append(data, index...), footer...), 0644); err != nil {
+		t.Fatalf("failed to write flat SSTable: %v", err)
+	}
+}
+
+func TestSSTableFlatFormatCompat(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "sst_flat_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// 1. A flat table is still readable
+	flatPath := filepath.Join(tmpDir, "00001.sst")
+	writeFlatSSTable(t, flatPath, [][2]string{{"apple", "old red"}, {"banana", "yellow"}, {"fig", ""}})
+	flat, err := OpenSSTable(flatPath)
+	if err != nil {
+		t.Fatalf("failed to open flat SSTable: %v", err)
+	}
+	defer flat.Close()
+	if flat.blocks != nil || len(flat.filter) != 0 {
+		t.Errorf("expected a flat table without a filter")
+	}
+	if val, ok, err := flat.Get("banana"); err != nil || !ok || val != "yellow" {
+		t.Errorf("flat Get(banana): got %q (found=%v, err=%v)", val, ok, err)
+	}
+
+	// 2. ... and merges with a newer block-format table into the block format
+	sl := InitSL(0.5, 16)
+	sl.Put("apple", "red")
+	sl.Put("cherry", "dark red")
+	blockPath := filepath.Join(tmpDir, "00002.sst")
+	if err := WriteSSTable(blockPath, sl.Iterator()); err != nil {
+		t.Fatalf("failed to write SSTable: %v", err)
+	}
+	newer, err := OpenSSTable(blockPath)
+	if err != nil {
+		t.Fatalf("failed to open SSTable: %v", err)
+	}
+	defer newer.Close()
+
+	mergedPath := filepath.Join(tmpDir, "00003.sst")
+	if err := mergeSSTables(mergedPath, []*SSTable{newer, flat}, tombstoneGC{bottommost: true}, defaultBloomBitsPerKey); err != nil {
+		t.Fatalf("failed to merge SSTables: %v", err)
+	}
+	merged, err := OpenSSTable(mergedPath)
+	if err != nil {
+		t.Fatalf("failed to open merged SSTable: %v", err)
+	}
+	defer merged.Close()
+	if merged.blocks == nil {
+		t.Errorf("expected the merged table in the block format")
+	}
+
+	var got [][2]string
+	it := merged.Iterator()
+	for it.Next() {
+		got = append(got, [2]string{it.Key(), it.Value()})
+	}
+	want := [][2]string{{"apple", "red"}, {"banana", "yellow"}, {"cherry", "dark red"}}
+	if it.Error() != nil || len(got) != len(want) {
+		t.Fatalf("expected merged entries %v, got %v (err=%v)", want, got, it.Error())
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("merged entry %d: expected %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestSSTableSequenceNumbers(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "sst_seq_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	writeTable := func(name string, entries map[string]uint64, value string) *SSTable {
+		sl := InitSL(0.5, 16)
+		for key, seq := range entries {
+			sl.PutSeq(key, value, seq)
+		}
+		path := filepath.Join(tmpDir, name)
+		if err := WriteSSTable(path, sl.Iterator()); err != nil {
+			t.Fatalf("failed to write SSTable: %v", err)
+		}
+		sst, err := OpenSSTable(path)
+		if err != nil {
+			t.Fatalf("failed to open SSTable: %v", err)
+		}
+		return sst
+	}
+
+	newer := writeTable("newer.sst", map[string]uint64{"a": 7, "b": 9}, "new")
+	defer newer.Close()
+	older := writeTable("older.sst", map[string]uint64{"a": 3, "c": 4}, "old")
+	defer older.Close()
+
+	// 1. Sequence numbers are stored with each entry
+	if newer.maxSeq != 9 || older.maxSeq != 4 {
+		t.Errorf("expected max sequence numbers 9 and 4, got %d and %d", newer.maxSeq, older.maxSeq)
+	}
+	it := newer.Iterator()
+	for _, want := range []uint64{7, 9} {
+		if !it.Next() || it.Seq() != want {
+			t.Errorf("expected entry %s with seq %d, got seq %d (err=%v)", it.Key(), want, it.Seq(), it.Error())
+		}
+	}
+
+	// 2. Merges keep the version with the highest sequence number, wherever its table is
+	var merged []string
+	err = mergeTables([]*SSTable{older, newer}, nil, func(key, value string, seq uint64, kind entryKind) error {
+		merged = append(merged, fmt.Sprintf("%s=%s@%d", key, value, seq))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to merge tables: %v", err)
+	}
+	if want := "[a=new@7 b=new@9 c=old@4]"; fmt.Sprint(merged) != want {
+		t.Errorf("expected %s, got %v", want, merged)
+	}
+}
+
+func TestSSTableEntryKinds(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "sst_kind_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sl := InitSL(0.5, 16)
+	sl.add("empty", "", 3, kindSet)
+	sl.add("gone", "", 4, kindDelete)
+	sl.add("gone", "old", 2, kindSet)
+	path := filepath.Join(tmpDir, "kinds.sst")
+	rangeDels := []RangeTombstone{{Start: "x", End: "y", Seq: 5}}
+	if err := writeSSTable(path, sl.Iterator(), rangeDels, defaultBloomBitsPerKey); err != nil {
+		t.Fatalf("failed to write SSTable: %v", err)
+	}
+	sst, err := OpenSSTable(path)
+	if err != nil {
+		t.Fatalf("failed to open SSTable: %v", err)
+	}
+	defer sst.Close()
+
+	// 1. Kinds are stored with each version, so an empty value is not a tombstone
+	var got []string
+	it := sst.Iterator()
+	for it.Next() {
+		got = append(got, fmt.Sprintf("%s@%d:%v", it.Key(), it.Seq(), it.Deleted()))
+	}
+	if want := "[empty@3:false gone@4:true gone@2:false]"; it.Error() != nil || fmt.Sprint(got) != want {
+		t.Errorf("expected %s, got %v (err=%v)", want, got, it.Error())
+	}
+	if v, found, err := sst.get("gone", 3); err != nil || !found || v.value != "old" || v.kind != kindSet {
+		t.Errorf("get(gone, 3): expected old, got %+v (found=%v, err=%v)", v, found, err)
+	}
+
+	// 2. Range tombstones keep their sequence numbers
+	if len(sst.rangeDels) != 1 || sst.rangeDels[0] != rangeDels[0] {
+		t.Errorf("expected range tombstones %v, got %v", rangeDels, sst.rangeDels)
+	}
+	if _, _, deleted, _ := sst.lookup("xa", 4); deleted {
+		t.Errorf("expected the range tombstone to be invisible at seq 4")
+	}
+	if _, _, deleted, _ := sst.lookup("xa", 5); !deleted {
+		t.Errorf("expected the range tombstone to hide xa at seq 5")
+	}
+}
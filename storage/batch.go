@@ -0,0 +1,71 @@
+package storage
+
+// WriteBatch collects writes that DB.Write applies atomically: either every write
+// becomes visible in the segment log and in every registered index, or none does.
+// A WriteBatch is not safe for concurrent use.
+type WriteBatch struct {
+	writes []write
+	err    error
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Set queues a key-value write.
+func (b *WriteBatch) Set(key string, value string) {
+	if key == "" {
+		b.err = ErrKeyEmpty
+		return
+	}
+	b.writes = append(b.writes, write{recType: RecordWrite, key: []byte(key), value: value})
+}
+
+// Delete queues the deletion of a key.
+func (b *WriteBatch) Delete(key string) {
+	if key == "" {
+		b.err = ErrKeyEmpty
+		return
+	}
+	b.writes = append(b.writes, write{recType: RecordTombstone, key: []byte(key)})
+}
+
+// DeleteRange queues the deletion of every key in [start, end).
+func (b *WriteBatch) DeleteRange(start, end string) {
+	if end <= start {
+		b.err = ErrInvalidRange
+		return
+	}
+	b.writes = append(b.writes, write{recType: RecordRangeTombstone, key: []byte(start), value: end})
+}
+
+// InsertVector queues a vector record written under its composite key.
+func (b *WriteBatch) InsertVector(compositeKey []byte, payload string) {
+	key := append([]byte(nil), compositeKey...)
+	b.writes = append(b.writes, write{recType: RecordVector, key: key, value: payload})
+}
+
+// Len returns the number of queued writes.
+func (b *WriteBatch) Len() int {
+	return len(b.writes)
+}
+
+// Reset clears the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.writes = nil
+	b.err = nil
+}
+
+// Write applies every write in batch atomically. The batch is validated against
+// all registered indexes first, written to the segment log as a transaction whose
+// records are only replayed once its commit marker is on disk, and applied to each
+// index as a single WAL transaction.
+func (db *DB) Write(batch *WriteBatch, opts ...WriteOption) error {
+	if batch.err != nil {
+		return batch.err
+	}
+	if len(batch.writes) == 0 {
+		return nil
+	}
+	return db.submit(&commitRequest{writes: batch.writes, sync: applyWriteOptions(opts).sync})
+}
@@ -0,0 +1,154 @@
+package storage_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/raman20/index/hnsw"
+	"github.com/raman20/index/lsm"
+	"github.com/raman20/storage"
+)
+
+func TestWriteBatchAtomic(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "db_batch_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := storage.Options{
+		MemtableSize: 1024 * 1024,
+		DataDir:      tmpDir,
+	}
+
+	dbPath := filepath.Join(tmpDir, "test_batch_db")
+	walPath := filepath.Join(dbPath, "wal")
+	sstPath := filepath.Join(dbPath, "sst")
+	os.MkdirAll(walPath, 0755)
+	os.MkdirAll(sstPath, 0755)
+
+	lsmIdx, err := lsm.NewLSMIndex(walPath, sstPath, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSM index: %v", err)
+	}
+	db, err := storage.Open("test_batch_db", opts, lsmIdx)
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+
+	vecIdx := hnsw.NewHNSWIndex(hnsw.Euclidean, 4, 32, 16)
+	db.RegisterIndex("vector", vecIdx)
+
+	// 1. A committed batch is visible in every index
+	db.Set("doomed", "old value")
+	batch := storage.NewWriteBatch()
+	batch.Set("user:1", "alice")
+	batch.Set("user:2", "bob")
+	batch.Delete("doomed")
+	batch.InsertVector(hnsw.EncodeKey("vec_1", []float32{1, 2}), "vector payload")
+	if err := db.Write(batch); err != nil {
+		t.Fatalf("failed to write batch: %v", err)
+	}
+
+	if val, ok := db.Get("user:1"); !ok || val != "alice" {
+		t.Errorf("expected alice, got %q (found=%v)", val, ok)
+	}
+	if _, ok := db.Get("doomed"); ok {
+		t.Errorf("expected batched delete to apply")
+	}
+	if val, ok := db.Get("vec_1"); !ok || val != "vector payload" {
+		t.Errorf("expected vector payload by ID, got %q (found=%v)", val, ok)
+	}
+	if refs, _, err := vecIdx.Search([]float32{1, 2}, 1); err != nil || len(refs) != 1 {
+		t.Errorf("expected batched vector in HNSW, got %d refs (err=%v)", len(refs), err)
+	}
+
+	// 2. A batch rejected by one index leaves no trace anywhere
+	batch.Reset()
+	batch.Set("user:3", "carol")
+	batch.InsertVector(hnsw.EncodeKey("vec_2", []float32{3, 4}), "fresh")
+	batch.InsertVector([]byte{0, 0, 0, 9, 'x'}, "malformed")
+	if err := db.Write(batch); err == nil {
+		t.Fatalf("expected batch with malformed vector key to fail")
+	}
+	if _, ok := db.Get("user:3"); ok {
+		t.Errorf("rejected batch partially applied to primary index")
+	}
+	if refs, _, _ := vecIdx.Search([]float32{3, 4}, 2); len(refs) != 1 {
+		t.Errorf("rejected batch partially applied to vector index: %d vectors", len(refs))
+	}
+
+	// An invalid write fails the whole batch before anything is queued
+	batch.Reset()
+	batch.Set("user:4", "dave")
+	batch.Set("", "empty key")
+	if err := db.Write(batch); err != storage.ErrKeyEmpty {
+		t.Errorf("expected ErrKeyEmpty, got %v", err)
+	}
+	if _, ok := db.Get("user:4"); ok {
+		t.Errorf("batch with an empty key partially applied")
+	}
+	batch.Reset()
+	batch.Set("user:4", "dave")
+	batch.Delete("")
+	if err := db.Write(batch); err != storage.ErrKeyEmpty {
+		t.Errorf("expected ErrKeyEmpty for an empty delete, got %v", err)
+	}
+	if err := db.Delete(""); err != storage.ErrKeyEmpty {
+		t.Errorf("expected ErrKeyEmpty from Delete, got %v", err)
+	}
+
+	// 3. A batch whose commit marker was torn off is discarded on recovery
+	batch.Reset()
+	batch.Set("user:1", "overwritten")
+	batch.Set("user:5", "eve")
+	if err := db.Write(batch); err != nil {
+		t.Fatalf("failed to write batch: %v", err)
+	}
+	db.Close()
+
+	segPath := filepath.Join(dbPath, "segments", "00000001.seg")
+	stat, err := os.Stat(segPath)
+	if err != nil {
+		t.Fatalf("failed to stat segment: %v", err)
+	}
+	const commitMarkerSize = 30 // Header and checksum of an empty system record
+	if err := os.Truncate(segPath, stat.Size()-commitMarkerSize); err != nil {
+		t.Fatalf("failed to truncate segment: %v", err)
+	}
+
+	lsmIdx2, err := lsm.NewLSMIndex(walPath, sstPath, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSM index: %v", err)
+	}
+	db2, err := storage.Open("test_batch_db", opts, lsmIdx2)
+	if err != nil {
+		t.Fatalf("failed to reopen DB: %v", err)
+	}
+	defer db2.Close()
+
+	verify := func() {
+		if val, ok := db2.Get("user:1"); !ok || val != "alice" {
+			t.Errorf("expected uncommitted batch to be rolled back, user:1=%q (found=%v)", val, ok)
+		}
+		if _, ok := db2.Get("user:5"); ok {
+			t.Errorf("expected uncommitted batch to be rolled back, user:5 present")
+		}
+		if val, ok := db2.Get("user:2"); !ok || val != "bob" {
+			t.Errorf("expected committed batch to survive, user:2=%q (found=%v)", val, ok)
+		}
+	}
+	if report := db2.RecoveryReport(); report.DiscardedBytes == 0 {
+		t.Errorf("expected recovery to discard the uncommitted batch, got %+v", report)
+	}
+	verify()
+
+	if err := db2.RebuildIndex("primary"); err != nil {
+		t.Fatalf("failed to rebuild index: %v", err)
+	}
+	verify()
+	if _, ok := db2.Get("doomed"); ok {
+		t.Errorf("batched delete lost after rebuild")
+	}
+}
@@ -0,0 +1,583 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// write is a single record queued for group commit.
+type write struct {
+	recType byte
+	key     []byte
+	value   string
+}
+
+// commitRequest is one caller's writes waiting in the commit queue.
+type commitRequest struct {
+	writes []write
+	sync   bool
+	// Transactions fail with ErrTxnConflict if a key they write was committed by
+	// someone else after their snapshot.
+	checkConflicts bool
+	snapshot       IndexSnapshot
+
+	err  error
+	lead bool // Set when the request is promoted to lead the next group
+	wake chan struct{}
+}
+
+// commitQueue groups concurrent writers. The first writer to arrive while no group
+// is in flight becomes the leader: it commits every request queued so far with one
+// segment write, one segment sync and one index WAL transaction, wakes the
+// followers and hands leadership to the next waiting request, if any. Writers that
+// arrive while a group is syncing therefore share the next sync.
+type commitQueue struct {
+	mu      sync.Mutex
+	pending []*commitRequest
+	busy    bool // A leader is committing a group
+}
+
+// submit queues a request for group commit and blocks until it is applied.
+func (db *DB) submit(req *commitRequest) error {
+	req.wake = make(chan struct{})
+	q := &db.commits
+
+	q.mu.Lock()
+	q.pending = append(q.pending, req)
+	if q.busy {
+		q.mu.Unlock()
+		<-req.wake
+		if !req.lead {
+			return req.err
+		}
+		q.mu.Lock()
+	}
+	q.busy = true
+	group := q.pending
+	q.pending = nil
+	q.mu.Unlock()
+
+	db.commitGroup(group)
+
+	for _, r := range group {
+		if r != req {
+			close(r.wake)
+		}
+	}
+
+	q.mu.Lock()
+	if len(q.pending) > 0 {
+		next := q.pending[0]
+		next.lead = true
+		close(next.wake)
+	} else {
+		q.busy = false
+	}
+	q.mu.Unlock()
+
+	return req.err
+}
+
+// commitGroup appends the records of every request in group to the segment log and
+// applies their index updates, setting each request's err. The writes of a request
+// are all-or-nothing: they are validated against every index before anything is
+// written, and multi-write requests are framed as a transaction in the segment log.
+func (db *DB) commitGroup(group []*commitRequest) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		for _, r := range group {
+			r.err = ErrDBClosed
+		}
+		return
+	}
+
+	// 1. Reject requests that an index would refuse or that conflict with a commit
+	// made after their snapshot, including one earlier in this group
+	var accepted []*commitRequest
+	written := make(map[string]bool)
+	var ranges []IndexOp // Range deletions accepted so far
+	for _, r := range group {
+		ops, err := db.validate(r.writes)
+		if err == nil && r.checkConflicts {
+			for _, op := range ops {
+				key := string(op.Key)
+				if written[key] || inRanges(ranges, key) {
+					err = ErrTxnConflict
+					break
+				}
+				if err = db.checkConflict(r.snapshot, op.Key); err != nil {
+					break
+				}
+			}
+		}
+		if r.err = err; err != nil {
+			continue
+		}
+		for _, op := range ops {
+			if op.End != nil {
+				ranges = append(ranges, op)
+			} else {
+				written[string(op.Key)] = true
+			}
+		}
+		accepted = append(accepted, r)
+	}
+	if len(accepted) == 0 {
+		return
+	}
+	fail := func(err error) {
+		for _, r := range accepted {
+			r.err = err
+		}
+	}
+
+	// 2. Write every payload sequentially to the Segment Manager
+	units := make([][][]byte, len(accepted))
+	records := 0
+	force := false
+	for i, r := range accepted {
+		force = force || r.sync
+		var txID uint64
+		if len(r.writes) > 1 {
+			txID = db.nextTxID.Add(1)
+		}
+		for _, w := range r.writes {
+			units[i] = append(units[i], encodeRecord(w.recType, txID, string(w.key), w.value))
+		}
+		if txID != 0 {
+			units[i] = append(units[i], commitMarker(txID))
+		}
+		records += len(units[i])
+	}
+	refs, err := db.segmentMgr.AppendBatch(units)
+	if err != nil {
+		fail(fmt.Errorf("failed to append to SegmentManager: %w", err))
+		return
+	}
+	defer db.supersede(accepted, force)
+
+	// 3. A single sync covers the whole group
+	if err := db.segSync.commit(records, force); err != nil {
+		fail(err)
+		return
+	}
+
+	// 4. Collect the index updates of every request, and of the group per index
+	updates := make([]requestUpdates, len(accepted))
+	batches := make(map[string][]IndexOp)
+	for i, r := range accepted {
+		u := requestUpdates{req: r, secondary: make(map[string][]IndexOp)}
+		for j, w := range r.writes {
+			u.primary = db.indexOps(w, refs[i][j], u.primary, u.secondary)
+		}
+		for name, ops := range u.secondary {
+			batches[name] = append(batches[name], ops...)
+		}
+		batches["primary"] = append(batches["primary"], u.primary...)
+		updates[i] = u
+	}
+
+	// 5. Update every index with one WAL transaction for the whole group. If a batch
+	// fails, the ones already applied are undone and each request is applied on its
+	// own, to every index or to none, so only the requests that fail again are
+	// rolled back. Their records are superseded in the log once the group is done.
+	if db.applyGroup(batches) != nil {
+		for _, u := range updates {
+			db.applyRequest(u)
+		}
+	}
+
+	if force {
+		err := db.syncIndexes()
+		for _, r := range accepted {
+			if r.sync && r.err == nil {
+				r.err = err
+			}
+		}
+	}
+}
+
+// requestUpdates holds the index updates of one request.
+type requestUpdates struct {
+	req       *commitRequest
+	primary   []IndexOp
+	secondary map[string][]IndexOp
+}
+
+// indexUndo restores the entries of an index that a set of updates replaced.
+type indexUndo struct {
+	name   string
+	priors []IndexOp
+}
+
+// applyGroup applies batches, the updates of a whole group per index name, as one
+// unit per index, secondary indexes first. It fails without applying anything if
+// an index cannot apply a batch atomically; if a batch fails, the batches already
+// applied are undone.
+func (db *DB) applyGroup(batches map[string][]IndexOp) error {
+	names := make([]string, 0, len(batches))
+	for name := range batches {
+		if _, ok := db.indexes[name].(BatchIndex); !ok {
+			return fmt.Errorf("index %s does not apply batches", name)
+		}
+		if name != "primary" {
+			names = append(names, name)
+		}
+	}
+	names = append(names, "primary")
+
+	// The primary index is applied last, so its entries never need to be undone
+	var undo []indexUndo
+	for _, name := range names {
+		u := indexUndo{name: name}
+		var err error
+		if name != "primary" {
+			u, err = db.priors(name, batches[name])
+		}
+		if err == nil {
+			err = applyIndexOps(db.indexes[name], batches[name])
+		}
+		if err != nil {
+			for i := len(undo) - 1; i >= 0; i-- {
+				err = errors.Join(err, db.undo(undo[i]))
+			}
+			return err
+		}
+		undo = append(undo, u)
+	}
+	return nil
+}
+
+// applyRequest applies the updates of one request to every index or, setting the
+// request's err, to none.
+func (db *DB) applyRequest(u requestUpdates) {
+	var undo []indexUndo
+	for name, ops := range u.secondary {
+		applied, err := db.applyUndoable(name, ops)
+		if err != nil {
+			u.req.err = fmt.Errorf("failed to update index %s: %w", name, err)
+			db.rollback(u.req, undo)
+			return
+		}
+		undo = append(undo, applied)
+	}
+	if _, err := db.applyUndoable("primary", u.primary); err != nil {
+		u.req.err = err
+		db.rollback(u.req, undo)
+	}
+}
+
+// applyUndoable applies ops to the named index and returns the updates that undo
+// them. If ops fail, the updates that were made are undone before returning.
+func (db *DB) applyUndoable(name string, ops []IndexOp) (indexUndo, error) {
+	u, err := db.priors(name, ops)
+	if err != nil {
+		return u, err
+	}
+	if err := applyIndexOps(db.indexes[name], ops); err != nil {
+		if undoErr := db.undo(u); undoErr != nil {
+			return u, errors.Join(err, undoErr)
+		}
+		return u, err
+	}
+	return u, nil
+}
+
+// priors records the entries of the named index that ops would replace.
+func (db *DB) priors(name string, ops []IndexOp) (indexUndo, error) {
+	idx := db.indexes[name]
+	u := indexUndo{name: name}
+	for _, op := range ops {
+		if op.End != nil {
+			it, err := idx.NewIterator(IterOptions{LowerBound: op.Key, UpperBound: op.End})
+			if err != nil {
+				return u, err
+			}
+			for ok := it.First(); ok; ok = it.Next() {
+				u.priors = append(u.priors, IndexOp{Key: append([]byte(nil), it.Key()...), Ref: it.Value()})
+			}
+			err = it.Error()
+			it.Close()
+			if err != nil {
+				return u, err
+			}
+			continue
+		}
+		key := op.Key
+		if op.ID != nil {
+			key = op.ID
+		}
+		prior, existed, err := idx.Get(key)
+		if err != nil {
+			return u, err
+		}
+		u.priors = append(u.priors, IndexOp{Key: op.Key, ID: op.ID, Ref: prior, Delete: !existed})
+	}
+	return u, nil
+}
+
+// rollback undoes the index updates already applied for r, most recent first,
+// adding any failure to r.err.
+func (db *DB) rollback(r *commitRequest, undo []indexUndo) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err := db.undo(undo[i]); err != nil {
+			r.err = errors.Join(r.err, fmt.Errorf("failed to roll back index %s: %w", undo[i].name, err))
+		}
+	}
+}
+
+// undo restores the entries recorded in u. Entries of secondary indexes that point
+// at vector records are restored under the composite key of the record.
+func (db *DB) undo(u indexUndo) error {
+	ops := make([]IndexOp, 0, len(u.priors))
+	for i := len(u.priors) - 1; i >= 0; i-- {
+		op := u.priors[i]
+		if !op.Delete && u.name != "primary" {
+			record, err := db.segmentMgr.ReadRecord(op.Ref)
+			if err != nil {
+				return err
+			}
+			if record.Header.Type == RecordVector {
+				op.Key = record.Key
+			}
+		}
+		ops = append(ops, op)
+	}
+	return applyIndexOps(db.indexes[u.name], ops)
+}
+
+// checkConflict returns ErrTxnConflict if the version of key in the primary index
+// differs from the one visible to snapshot. Every commit writes a new record, so a
+// key committed since the snapshot points elsewhere, unless it has been deleted
+// again, in which case the transaction overwrites nothing it missed. Records moved
+// by value-log GC count as changed.
+func (db *DB) checkConflict(snapshot IndexSnapshot, key []byte) error {
+	then, existed, err := snapshot.Get(key)
+	if err != nil {
+		return err
+	}
+	now, exists, err := db.indexes["primary"].Get(key)
+	if err != nil {
+		return err
+	}
+	if existed != exists || then != now {
+		return ErrTxnConflict
+	}
+	return nil
+}
+
+// supersede appends, after the records of the failed requests in group, a copy of
+// the current version of every key they wrote, or a tombstone if the key does not
+// exist, and repoints the indexes at the copies the way value-log GC does. The
+// records of a failed request stay in the log, and without this a rebuild or
+// reconcile replaying it would resurrect them. A failure is added to the requests'
+// errors.
+func (db *DB) supersede(group []*commitRequest, force bool) {
+	var failed []*commitRequest
+	for _, r := range group {
+		if r.err != nil {
+			failed = append(failed, r)
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+
+	err := db.supersedeKeys(failed, force)
+	if err != nil {
+		for _, r := range failed {
+			r.err = errors.Join(r.err, fmt.Errorf("failed to supersede rejected records: %w", err))
+		}
+	}
+}
+
+// supersedeKeys supersedes the records of the failed requests.
+func (db *DB) supersedeKeys(failed []*commitRequest, force bool) error {
+	primary := db.indexes["primary"]
+	keys := make(map[string]bool)
+	var order [][]byte
+	add := func(key []byte) {
+		if !keys[string(key)] {
+			keys[string(key)] = true
+			order = append(order, append([]byte(nil), key...))
+		}
+	}
+	for _, r := range failed {
+		var ops []IndexOp
+		for _, w := range r.writes {
+			ops = db.indexOps(w, RecordRef{}, ops, make(map[string][]IndexOp))
+		}
+		for _, op := range ops {
+			if op.End == nil {
+				add(op.Key)
+				continue
+			}
+			it, err := primary.NewIterator(IterOptions{LowerBound: op.Key, UpperBound: op.End})
+			if err != nil {
+				return err
+			}
+			for ok := it.First(); ok; ok = it.Next() {
+				add(it.Key())
+			}
+			err = it.Error()
+			it.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// 1. Append the current version of every key
+	records := make([]liveRecord, 0, len(order))
+	for _, key := range order {
+		cur, found, err := primary.Get(key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			records = append(records, liveRecord{data: encodeRecord(RecordTombstone, 0, string(key), "")})
+			continue
+		}
+		record, err := db.segmentMgr.ReadRecord(cur)
+		if err != nil {
+			return err
+		}
+		targets, _, ok := db.recordLiveness(cur, record, true)
+		if !ok {
+			targets = []indexTarget{{idx: primary, key: key}}
+		}
+		data, err := db.segmentMgr.Read(cur)
+		if err != nil {
+			return err
+		}
+		records = append(records, liveRecord{ref: cur, data: clearTxID(data), targets: targets})
+	}
+	newRefs := make([]RecordRef, len(records))
+	for i, rec := range records {
+		ref, err := db.segmentMgr.Append(rec.data)
+		if err != nil {
+			return err
+		}
+		newRefs[i] = ref
+	}
+	if err := db.segSync.commit(len(records), force); err != nil {
+		return err
+	}
+
+	// 2. Repoint the indexes at the copies
+	for i, rec := range records {
+		for _, target := range rec.targets {
+			if err := target.idx.Put(target.key, newRefs[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// inRanges reports whether key falls inside one of the range deletions.
+func inRanges(ranges []IndexOp, key string) bool {
+	for _, r := range ranges {
+		if key >= string(r.Key) && key < string(r.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks writes against every index that can reject mutations and
+// returns their primary index updates.
+func (db *DB) validate(writes []write) ([]IndexOp, error) {
+	secondary := make(map[string][]IndexOp)
+	var primary []IndexOp
+	for _, w := range writes {
+		primary = db.indexOps(w, RecordRef{}, primary, secondary)
+	}
+	secondary["primary"] = primary
+
+	for _, op := range primary {
+		if _, ok := db.indexes["primary"].(RangeDeleter); op.End != nil && !ok {
+			return nil, errors.New("primary index does not support range deletion")
+		}
+	}
+	for name, ops := range secondary {
+		if v, ok := db.indexes[name].(Validator); ok && len(ops) > 0 {
+			if err := v.ValidateBatch(ops); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return primary, nil
+}
+
+// indexOps appends the primary index updates for w to primary and records the
+// updates for other registered indexes in secondary.
+func (db *DB) indexOps(w write, ref RecordRef, primary []IndexOp, secondary map[string][]IndexOp) []IndexOp {
+	switch w.recType {
+	case RecordTombstone:
+		for name := range db.indexes {
+			if name != "primary" {
+				secondary[name] = append(secondary[name], IndexOp{Key: w.key, ID: w.key, Delete: true})
+			}
+		}
+		return append(primary, IndexOp{Key: w.key, Delete: true})
+
+	case RecordRangeTombstone:
+		op := IndexOp{Key: w.key, Delete: true, End: []byte(w.value)}
+		for name, idx := range db.indexes {
+			if _, ok := idx.(RangeDeleter); ok && name != "primary" {
+				secondary[name] = append(secondary[name], op)
+			}
+		}
+		return append(primary, op)
+
+	case RecordVector:
+		// Index the simple ID from the composite key in the primary tree
+		id, ok := vectorRecordID(w.key)
+		if _, exists := db.indexes["vector"]; exists {
+			secondary["vector"] = append(secondary["vector"], IndexOp{Key: w.key, ID: id, Ref: ref})
+		}
+		if ok {
+			return append(primary, IndexOp{Key: id, Ref: ref})
+		}
+		return primary
+
+	default:
+		return append(primary, IndexOp{Key: w.key, Ref: ref})
+	}
+}
+
+// applyIndexOps applies ops to idx, as one unit if idx supports batches.
+func applyIndexOps(idx Index, ops []IndexOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	if b, ok := idx.(BatchIndex); ok {
+		return b.ApplyBatch(ops)
+	}
+
+	for _, op := range ops {
+		if op.End != nil {
+			if r, ok := idx.(RangeDeleter); ok {
+				if err := r.DeleteRange(op.Key, op.End); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if op.Delete {
+			if err := idx.Delete(op.Key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := idx.Put(op.Key, op.Ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/raman20/index/hnsw"
+	"github.com/raman20/index/lsm"
+	"github.com/raman20/storage"
+)
+
+func openCommitTestDB(tb testing.TB, dir string, opts storage.Options) (*storage.DB, *lsm.LSMIndex) {
+	tb.Helper()
+
+	opts.DataDir = dir
+	dbPath := filepath.Join(dir, "test_commit_db")
+	walPath := filepath.Join(dbPath, "wal")
+	sstPath := filepath.Join(dbPath, "sst")
+	os.MkdirAll(walPath, 0755)
+	os.MkdirAll(sstPath, 0755)
+
+	lsmIdx, err := lsm.NewLSMIndex(walPath, sstPath, opts)
+	if err != nil {
+		tb.Fatalf("failed to create LSM index: %v", err)
+	}
+	db, err := storage.Open("test_commit_db", opts, lsmIdx)
+	if err != nil {
+		tb.Fatalf("failed to open DB: %v", err)
+	}
+	return db, lsmIdx
+}
+
+func TestGroupCommitConcurrentWriters(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "db_commit_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := storage.Options{MemtableSize: 64 * 1024, SyncWrites: true, CompactionThreshold: 4}
+	db, _ := openCommitTestDB(t, tmpDir, opts)
+
+	// 1. Hammer the DB from many writers, mixing sets and deletes
+	const writers, perWriter = 32, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				key := fmt.Sprintf("w%02d_key_%03d", w, i)
+				if err := db.Set(key, fmt.Sprintf("value_%d_%d", w, i)); err != nil {
+					t.Errorf("failed to set %s: %v", key, err)
+				}
+				if i%10 == 0 {
+					if err := db.Delete(key); err != nil {
+						t.Errorf("failed to delete %s: %v", key, err)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	verify := func(db *storage.DB) {
+		for w := 0; w < writers; w++ {
+			for i := 0; i < perWriter; i++ {
+				key := fmt.Sprintf("w%02d_key_%03d", w, i)
+				val, ok := db.Get(key)
+				if i%10 == 0 {
+					if ok {
+						t.Errorf("deleted key %s still present", key)
+					}
+					continue
+				}
+				if expected := fmt.Sprintf("value_%d_%d", w, i); !ok || val != expected {
+					t.Errorf("key %s: expected %q, got %q (found=%v)", key, expected, val, ok)
+				}
+			}
+		}
+	}
+	verify(db)
+
+	// 2. Everything acknowledged survives a reopen and a rebuild from the log
+	db.Close()
+	db, _ = openCommitTestDB(t, tmpDir, opts)
+	defer db.Close()
+	verify(db)
+
+	if err := db.RebuildIndex("primary"); err != nil {
+		t.Fatalf("failed to rebuild index: %v", err)
+	}
+	verify(db)
+
+	// 3. Writes after Close fail for every queued writer
+	db.Close()
+	if err := db.Set("late", "value"); err != storage.ErrDBClosed {
+		t.Errorf("expected ErrDBClosed after close, got %v", err)
+	}
+}
+
+// poisonedIndex fails every update of the key "poison" while poisoned is set.
+type poisonedIndex struct {
+	*lsm.LSMIndex
+	poisoned atomic.Bool
+}
+
+func (p *poisonedIndex) ApplyBatch(ops []storage.IndexOp) error {
+	for _, op := range ops {
+		if p.poisoned.Load() && string(op.Key) == "poison" {
+			return errors.New("poisoned index update")
+		}
+	}
+	return p.LSMIndex.ApplyBatch(ops)
+}
+
+func TestGroupCommitIndexFailure(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "db_commit_failure_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := storage.Options{MemtableSize: 64 * 1024, DataDir: tmpDir}
+	dbPath := filepath.Join(tmpDir, "test_commit_db")
+	walPath := filepath.Join(dbPath, "wal")
+	sstPath := filepath.Join(dbPath, "sst")
+	os.MkdirAll(walPath, 0755)
+	os.MkdirAll(sstPath, 0755)
+
+	lsmIdx, err := lsm.NewLSMIndex(walPath, sstPath, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSM index: %v", err)
+	}
+	primary := &poisonedIndex{LSMIndex: lsmIdx}
+	db, err := storage.Open("test_commit_db", opts, primary)
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+	defer db.Close()
+	vecIdx := hnsw.NewHNSWIndex(hnsw.Euclidean, 4, 32, 16)
+	db.RegisterIndex("vector", vecIdx)
+
+	if err := db.InsertVector(hnsw.EncodeKey("poison", []float32{1, 2}), "original"); err != nil {
+		t.Fatalf("failed to insert vector: %v", err)
+	}
+	txn, err := db.Begin()
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %v", err)
+	}
+	primary.poisoned.Store(true)
+
+	// 1. A primary failure rolls back the vector lens update made before it
+	if err := db.InsertVector(hnsw.EncodeKey("poison", []float32{9, 9}), "moved"); err == nil {
+		t.Fatalf("expected poisoned insert to fail")
+	}
+	ref, found, _ := vecIdx.Get([]byte("poison"))
+	if !found {
+		t.Fatalf("expected vector lens to keep poison")
+	}
+	if vec, err := hnsw.SegmentVectors(db)(ref); err != nil || vec[0] != 1 || vec[1] != 2 {
+		t.Errorf("expected restored vector [1 2], got %v (err=%v)", vec, err)
+	}
+	if err := db.Delete("poison"); err == nil {
+		t.Fatalf("expected poisoned delete to fail")
+	}
+	if _, found, _ := vecIdx.Get([]byte("poison")); !found {
+		t.Errorf("expected failed delete to leave the vector indexed")
+	}
+	if val, ok := db.Get("poison"); !ok || val != "original" {
+		t.Errorf("expected poison to keep its value, got %q (found=%v)", val, ok)
+	}
+	batch := storage.NewWriteBatch()
+	batch.Set("bystander", "rejected")
+	batch.Set("poison", "rejected")
+	if err := db.Write(batch); err == nil {
+		t.Fatalf("expected poisoned batch to fail")
+	}
+
+	// A failed request is not a conflicting commit
+	txn.Set("bystander", "txn")
+	if err := txn.Commit(); err != nil {
+		t.Errorf("expected transaction to commit past a failed request, got %v", err)
+	}
+
+	// 2. Requests committed in the same group as a failing one are unaffected
+	const writers = 32
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key_%02d", w)
+			if w == 0 {
+				key = "poison"
+			}
+			err := db.Set(key, "value")
+			if w == 0 && err == nil {
+				t.Errorf("expected poisoned set to fail")
+			}
+			if w != 0 && err != nil {
+				t.Errorf("failed to set %s alongside a failing write: %v", key, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+	for w := 1; w < writers; w++ {
+		if val, ok := db.Get(fmt.Sprintf("key_%02d", w)); !ok || val != "value" {
+			t.Errorf("key_%02d: expected %q, got %q (found=%v)", w, "value", val, ok)
+		}
+	}
+
+	// 3. Replaying the log does not resurrect the failed writes
+	primary.poisoned.Store(false)
+	if err := db.RebuildIndex("primary"); err != nil {
+		t.Fatalf("failed to rebuild index: %v", err)
+	}
+	if val, ok := db.Get("poison"); !ok || val != "original" {
+		t.Errorf("expected poison to keep its value after a rebuild, got %q (found=%v)", val, ok)
+	}
+	if val, ok := db.Get("bystander"); !ok || val != "txn" {
+		t.Errorf("expected bystander to hold the transaction's value after a rebuild, got %q (found=%v)", val, ok)
+	}
+}
+
+// countingIndex counts the batches applied to the index it wraps.
+type countingIndex struct {
+	storage.Index
+	batches atomic.Int32
+}
+
+func (c *countingIndex) ApplyBatch(ops []storage.IndexOp) error {
+	c.batches.Add(1)
+	return c.Index.(storage.BatchIndex).ApplyBatch(ops)
+}
+
+func TestGroupCommitBatchesSecondaryIndexes(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "db_commit_vector_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := storage.Options{MemtableSize: 64 * 1024, SyncWrites: true, DataDir: tmpDir}
+	dbPath := filepath.Join(tmpDir, "test_commit_db")
+	walPath := filepath.Join(dbPath, "wal")
+	sstPath := filepath.Join(dbPath, "sst")
+	os.MkdirAll(walPath, 0755)
+	os.MkdirAll(sstPath, 0755)
+
+	lsmIdx, err := lsm.NewLSMIndex(walPath, sstPath, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSM index: %v", err)
+	}
+	primary := &countingIndex{Index: lsmIdx}
+	db, err := storage.Open("test_commit_db", opts, primary)
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+	defer db.Close()
+	vecIdx := &countingIndex{Index: hnsw.NewHNSWIndex(hnsw.Euclidean, 4, 32, 16)}
+	db.RegisterIndex("vector", vecIdx)
+
+	const writers, perWriter = 16, 20
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				key := hnsw.EncodeKey(fmt.Sprintf("vec_%d_%d", w, i), []float32{float32(w), float32(i)})
+				if err := db.InsertVector(key, "payload"); err != nil {
+					t.Errorf("failed to insert vector: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// The vector index gets one batch per group, like the primary index
+	if v, p := vecIdx.batches.Load(), primary.batches.Load(); v != p {
+		t.Errorf("expected one vector batch per group commit, got %d vector and %d primary batches", v, p)
+	}
+	if got := vecIdx.Index.Stats().MemtableSize; got != writers*perWriter {
+		t.Errorf("expected %d vectors, got %d", writers*perWriter, got)
+	}
+}
+
+func BenchmarkGroupCommit(b *testing.B) {
+	for _, writers := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("writers=%d", writers), func(b *testing.B) {
+			tmpDir, err := os.MkdirTemp("", "db_commit_bench")
+			if err != nil {
+				b.Fatalf("failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			opts := storage.Options{MemtableSize: 32 * 1024 * 1024, SyncWrites: true, CompactionThreshold: 4}
+			db, _ := openCommitTestDB(b, tmpDir, opts)
+			defer db.Close()
+
+			value := string(make([]byte, 100))
+			var next atomic.Int64
+			var wg sync.WaitGroup
+
+			b.ResetTimer()
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						i := next.Add(1)
+						if i > int64(b.N) {
+							return
+						}
+						if err := db.Set(fmt.Sprintf("key_%010d", i), value); err != nil {
+							b.Errorf("failed to set: %v", err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			b.StopTimer()
+
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "writes/s")
+		})
+	}
+}
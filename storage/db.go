@@ -1,25 +1,30 @@
 package storage
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 var (
 	ErrDBClosed = errors.New("database is closed")
 	ErrKeyEmpty = errors.New("key cannot be empty")
+
+	ErrInvalidRange = errors.New("range end must be greater than its start")
 )
 
 type DB struct {
 	Name       string
 	segmentMgr *SegmentManager
+	segSync    *logSyncer       // Applies the sync policy to segment appends
+	commits    commitQueue      // Groups concurrent writers into shared commits
+	nextTxID   atomic.Uint64    // Last TxID assigned to a multi-write transaction
 	indexes    map[string]Index // Index catalog (e.g. "primary" -> LSMIndex, "vector" -> HNSWIndex)
 	closed     bool
 	closeOnce  sync.Once
@@ -30,12 +35,57 @@ type DB struct {
 	mu         sync.RWMutex
 }
 
+// CompactionStyle selects how the LSM index compacts its SSTables.
+type CompactionStyle int
+
+const (
+	// CompactionFull merges every SSTable into one once there are CompactionThreshold
+	// of them, rewriting the whole keyspace each time.
+	CompactionFull CompactionStyle = iota
+	// CompactionLeveled keeps SSTables in levels of non-overlapping tables, each
+	// LevelSizeRatio times larger than the one above, and compacts one table at a
+	// time into the overlapping tables of the next level.
+	CompactionLeveled
+)
+
 type Options struct {
 	MemtableSize        int64
 	MaxConcurrency      int
 	SyncWrites          bool
 	DataDir             string
 	CompactionThreshold int
+
+	// Durability of the segment log and index WALs. SyncDefault follows SyncWrites;
+	// the interval and batch size only apply to SyncGroup.
+	SyncMode      SyncMode
+	SyncInterval  time.Duration
+	SyncBatchSize int
+
+	// Bits per key of the bloom filter written with each SSTable. Zero selects the
+	// default of 10, about a 1% false positive rate; a negative value disables filters.
+	BloomBitsPerKey int
+
+	// Bytes of SSTable data blocks cached in memory. Zero selects the default of 8MB;
+	// a negative value disables the cache.
+	BlockCacheSize int64
+
+	// Compaction strategy of the LSM index. Under CompactionLeveled, L0 is compacted
+	// once it holds CompactionThreshold tables and level n once it outgrows
+	// BaseLevelSize * LevelSizeRatio^(n-1) bytes, writing tables of TargetFileSize.
+	// Zero values select 8MB, 10 and 2MB.
+	CompactionStyle CompactionStyle
+	BaseLevelSize   int64
+	LevelSizeRatio  int
+	TargetFileSize  int64
+
+	// Write stalls of the LSM index. A write that needs a new memtable waits while
+	// MaxImmutableMemtables memtables are waiting to be flushed or L0 holds
+	// L0StopTrigger tables, until flushes and compactions catch up. Zero values
+	// select 4 and three times CompactionThreshold. MaxConcurrency bounds the
+	// flushes and compactions running at once: flushes run one at a time, and under
+	// leveled compaction every other slot can compact a disjoint set of tables.
+	MaxImmutableMemtables int
+	L0StopTrigger         int
 }
 
 func DefaultOptions() Options {
@@ -45,6 +95,12 @@ func DefaultOptions() Options {
 		SyncWrites:          true,
 		DataDir:             "data",
 		CompactionThreshold: 4,
+		BloomBitsPerKey:     10,
+		BlockCacheSize:      8 * 1024 * 1024, // 8MB
+		CompactionStyle:     CompactionFull,
+		BaseLevelSize:       8 * 1024 * 1024, // 8MB
+		LevelSizeRatio:      10,
+		TargetFileSize:      2 * 1024 * 1024, // 2MB
 	}
 }
 
@@ -78,38 +134,131 @@ func Open(name string, opts Options, primary Index) (*DB, error) {
 		sstDir:     sstPath,
 		segmentDir: segmentPath,
 		segmentMgr: sm,
+		segSync:    newLogSyncer(opts.SyncPolicy(), sm.Sync),
 		indexes:    make(map[string]Index),
 	}
 
 	db.indexes["primary"] = primary
+	// TxIDs only need to be unique among the transactions still in the log's tail
+	db.nextTxID.Store(uint64(time.Now().UnixNano()))
+
+	// 2. Drop index entries pointing into a torn tail discarded by the segment manager
+	if report := sm.Recovery(); report.DiscardedBytes > 0 {
+		dangling := func(ref RecordRef) bool {
+			return ref.FileID == report.SegmentID && ref.Offset+int64(ref.Length) > report.ValidBytes
+		}
+		if err := db.reconcile("primary", primary, dangling); err != nil {
+			db.segSync.close()
+			sm.Close()
+			return nil, err
+		}
+	}
 
 	return db, nil
 }
 
-func encodeRecord(key, value string) []byte {
-	keyLen := uint32(len(key))
-	valLen := uint32(len(value))
-	buf := make([]byte, 8+keyLen+valLen)
-	binary.BigEndian.PutUint32(buf[0:4], keyLen)
-	binary.BigEndian.PutUint32(buf[4:8], valLen)
-	copy(buf[8:8+keyLen], key)
-	copy(buf[8+keyLen:], value)
-	return buf
+// ReconcileIndex drops the entries of the named index whose RecordRef no longer lies
+// within its segment, such as refs into a torn tail truncated by this or an earlier
+// open, and restores the latest committed version of each affected key. Indexes
+// loaded after Open, like the vector lens, call it once they are registered.
+func (db *DB) ReconcileIndex(name string) error {
+	idx, exists := db.GetIndex(name)
+	if !exists {
+		return fmt.Errorf("index %q not registered", name)
+	}
+
+	// Each segment is stat'ed once rather than once per entry
+	ends := make(map[uint32]int64)
+	return db.reconcile(name, idx, func(ref RecordRef) bool {
+		end, seen := ends[ref.FileID]
+		if !seen {
+			end = db.segmentMgr.End(ref.FileID)
+			ends[ref.FileID] = end
+		}
+		return ref.Offset+int64(ref.Length) > end
+	})
 }
 
-func decodeValue(record []byte) string {
-	if len(record) < 8 {
-		return ""
+// reconcile removes the entries of idx, registered as name, that match dangling and
+// restores the latest committed version of each affected key from the log. Indexes
+// that cannot reconcile are left untouched; their dangling refs fail to read because
+// a truncated segment is sealed and its offsets are never reused.
+func (db *DB) reconcile(name string, idx Index, dangling func(ref RecordRef) bool) error {
+	r, ok := idx.(Reconciler)
+	if !ok {
+		return nil
 	}
-	keyLen := binary.BigEndian.Uint32(record[0:4])
-	valLen := binary.BigEndian.Uint32(record[4:8])
-	if int(8+keyLen+valLen) > len(record) {
-		return ""
+	keys, err := r.DropRefs(dangling)
+	if err != nil {
+		return fmt.Errorf("failed to reconcile index with recovered segments: %w", err)
 	}
-	if valLen == 0 {
-		return ""
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// A discarded write may have replaced a version that is still in the log. The
+	// primary index maps vector IDs to their records, secondary indexes only hold
+	// vector records under their composite keys.
+	primary := name == "primary"
+	_, ranges := idx.(RangeDeleter)
+	latest := make(map[string]*IndexOp, len(keys))
+	for _, key := range keys {
+		latest[string(key)] = nil
 	}
-	return unsafe.String(&record[8+keyLen], valLen)
+	replay := &txFilter{fn: func(ref RecordRef, record Record) error {
+		if record.Header.Type == RecordRangeTombstone {
+			if !primary && !ranges {
+				return nil
+			}
+			for k := range latest {
+				if k >= string(record.Key) && k < string(record.Value) {
+					latest[k] = nil
+				}
+			}
+			return nil
+		}
+
+		key := record.Key
+		if id, ok := vectorRecordID(key); ok && record.Header.Type == RecordVector {
+			key = id
+		}
+		if _, wanted := latest[string(key)]; !wanted {
+			return nil
+		}
+		switch record.Header.Type {
+		case RecordTombstone:
+			latest[string(key)] = nil
+		case RecordWrite:
+			if primary {
+				latest[string(key)] = &IndexOp{Key: append([]byte(nil), key...), Ref: ref}
+			}
+		case RecordVector:
+			op := &IndexOp{Key: append([]byte(nil), key...), Ref: ref}
+			if !primary {
+				op.Key = append([]byte(nil), record.Key...)
+			}
+			latest[string(key)] = op
+		}
+		return nil
+	}}
+	if err := db.segmentMgr.Iterate(replay.visit); err != nil {
+		return fmt.Errorf("failed to scan log for reconciled keys: %w", err)
+	}
+
+	for key, op := range latest {
+		if op == nil {
+			continue
+		}
+		if err := idx.Put(op.Key, op.Ref); err != nil {
+			return fmt.Errorf("failed to restore %s after recovery: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// RecoveryReport returns what crash recovery discarded from the segment log on open.
+func (db *DB) RecoveryReport() RecoveryReport {
+	return db.segmentMgr.Recovery()
 }
 
 func (db *DB) RegisterIndex(name string, idx Index) {
@@ -140,63 +289,36 @@ func (db *DB) GetOrInitIndex(name string, initFn func() Index) Index {
 }
 
 // InsertVector writes a vector record directly using the composite key, and indexes it in LSM & HNSW.
-func (db *DB) InsertVector(compositeKey []byte, payload string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	if db.closed {
-		return ErrDBClosed
-	}
-
-	// 1. Write payload to segment storage
-	record := encodeRecord(string(compositeKey), payload)
-	ref, err := db.segmentMgr.Append(record)
-	if err != nil {
-		return fmt.Errorf("failed to append to SegmentManager: %w", err)
-	}
-
-	// 2. Put in the vector index (if registered/loaded)
-	if vecIdx, exists := db.indexes["vector"]; exists {
-		if err := vecIdx.Put(compositeKey, ref); err != nil {
-			return err
-		}
-	}
-
-	// 3. Extract simple ID from first 4 bytes of compositeKey and index in LSM primary tree
-	if len(compositeKey) >= 4 {
-		idLen := binary.BigEndian.Uint32(compositeKey[0:4])
-		if len(compositeKey) >= int(4+idLen) {
-			id := compositeKey[4 : 4+idLen]
-			if primary, exists := db.indexes["primary"]; exists {
-				primary.Put(id, ref)
-			}
-		}
-	}
-
-	return nil
+func (db *DB) InsertVector(compositeKey []byte, payload string, opts ...WriteOption) error {
+	return db.submit(&commitRequest{
+		writes: []write{{recType: RecordVector, key: compositeKey, value: payload}},
+		sync:   applyWriteOptions(opts).sync,
+	})
 }
 
-func (db *DB) Set(key string, value string) error {
+// Set writes a key-value pair. Concurrent writers are committed in groups that
+// share a single sync. Pass WithSync to make the write durable before returning
+// regardless of the configured sync policy.
+func (db *DB) Set(key string, value string, opts ...WriteOption) error {
 	if key == "" {
 		return ErrKeyEmpty
 	}
+	return db.submit(&commitRequest{
+		writes: []write{{recType: RecordWrite, key: []byte(key), value: value}},
+		sync:   applyWriteOptions(opts).sync,
+	})
+}
 
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	if db.closed {
-		return ErrDBClosed
-	}
-
-	// 1. Write payload sequentially to Segment Manager
-	payload := encodeRecord(key, value)
-	ref, err := db.segmentMgr.Append(payload)
-	if err != nil {
-		return fmt.Errorf("failed to append to SegmentManager: %w", err)
+// syncIndexes forces the logs of all registered indexes to disk.
+func (db *DB) syncIndexes() error {
+	for name, idx := range db.indexes {
+		if s, ok := idx.(Syncer); ok {
+			if err := s.Sync(); err != nil {
+				return fmt.Errorf("failed to sync index %s: %w", name, err)
+			}
+		}
 	}
-
-	// 2. Map Key -> RecordRef in the primary index
-	return db.indexes["primary"].Put([]byte(key), ref)
+	return nil
 }
 
 func (db *DB) Get(key string) (string, bool) {
@@ -218,32 +340,45 @@ func (db *DB) Get(key string) (string, bool) {
 	}
 
 	// 2. Fetch value from Segment Manager using coordinate
-	record, err := db.segmentMgr.Read(ref)
+	record, err := db.segmentMgr.ReadRecord(ref)
 	if err != nil {
 		return "", false
 	}
 
-	return decodeValue(record), true
+	return recordValue(record), true
 }
 
-func (db *DB) Delete(key string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	if db.closed {
-		return ErrDBClosed
+// recordValue returns a record's value as a string without copying.
+func recordValue(record Record) string {
+	if len(record.Value) == 0 {
+		return ""
 	}
+	return unsafe.String(&record.Value[0], len(record.Value))
+}
 
-	var firstErr error
-	for _, idx := range db.indexes {
-		if err := idx.Delete([]byte(key)); err != nil && firstErr == nil {
-			if !strings.Contains(err.Error(), "not supported") {
-				firstErr = err
-			}
-		}
+// Delete removes a key. Pass WithSync to make the deletion durable before returning
+// regardless of the configured sync policy.
+func (db *DB) Delete(key string, opts ...WriteOption) error {
+	if key == "" {
+		return ErrKeyEmpty
 	}
+	// Log the deletion so that replaying the segments does not resurrect the key
+	return db.submit(&commitRequest{
+		writes: []write{{recType: RecordTombstone, key: []byte(key)}},
+		sync:   applyWriteOptions(opts).sync,
+	})
+}
 
-	return firstErr
+// DeleteRange deletes every key in [start, end) by logging a single range tombstone
+// instead of one tombstone per key. The primary index must implement RangeDeleter.
+func (db *DB) DeleteRange(start, end string, opts ...WriteOption) error {
+	if end <= start {
+		return ErrInvalidRange
+	}
+	return db.submit(&commitRequest{
+		writes: []write{{recType: RecordRangeTombstone, key: []byte(start), value: end}},
+		sync:   applyWriteOptions(opts).sync,
+	})
 }
 
 func (db *DB) Scan(prefix string) (map[string]string, error) {
@@ -261,29 +396,119 @@ func (db *DB) Scan(prefix string) (map[string]string, error) {
 	}
 
 	// 2. Resolve coordinates to values
+	return db.resolve(refs)
+}
+
+// KeyValue is a key and its value, as returned by ScanRange.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// ScanRange returns up to limit key-value pairs with keys in [start, end), in key
+// order. An empty end leaves the range unbounded and a limit <= 0 returns every pair.
+func (db *DB) ScanRange(start, end string, limit int) ([]KeyValue, error) {
+	opts := IterOptions{LowerBound: []byte(start)}
+	if end != "" {
+		opts.UpperBound = []byte(end)
+	}
+	it, err := db.NewIterator(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var results []KeyValue
+	for ok := it.First(); ok && (limit <= 0 || len(results) < limit); ok = it.Next() {
+		results = append(results, KeyValue{Key: it.Key(), Value: it.Value()})
+	}
+	return results, it.Error()
+}
+
+// resolve reads the records at refs and returns them keyed by record key. Refs that
+// no longer resolve are skipped, while corrupt records fail the whole call.
+func (db *DB) resolve(refs []RecordRef) (map[string]string, error) {
 	results := make(map[string]string)
 	for _, ref := range refs {
-		record, err := db.segmentMgr.Read(ref)
+		record, err := db.segmentMgr.ReadRecord(ref)
+		if errors.Is(err, ErrCorruptRecord) {
+			return nil, err
+		}
 		if err != nil {
 			continue
 		}
 
-		keyLen := binary.BigEndian.Uint32(record[0:4])
-		valLen := binary.BigEndian.Uint32(record[4:8])
-		
-		var k, v string
-		if keyLen > 0 {
-			k = unsafe.String(&record[8], keyLen)
+		var k string
+		if len(record.Key) > 0 {
+			k = unsafe.String(&record.Key[0], len(record.Key))
 		}
-		if valLen > 0 {
-			v = unsafe.String(&record[8+keyLen], valLen)
-		}
-		results[k] = v
+		results[k] = recordValue(record)
 	}
 
 	return results, nil
 }
 
+// RebuildIndex discards the contents of the named index and reconstructs it by
+// replaying every committed record in the segment log in file/offset order. The index must
+// implement Resetter. It can be used to recover from lost or corrupted index files
+// or to backfill a newly registered lens from existing data.
+func (db *DB) RebuildIndex(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrDBClosed
+	}
+
+	idx, exists := db.indexes[name]
+	if !exists {
+		return fmt.Errorf("index %s is not registered", name)
+	}
+	resetter, ok := idx.(Resetter)
+	if !ok {
+		return fmt.Errorf("index %s does not support rebuilding", name)
+	}
+	if err := resetter.Reset(); err != nil {
+		return fmt.Errorf("failed to reset index %s: %w", name, err)
+	}
+
+	// Only replay transactions whose commit marker made it to the log
+	replay := &txFilter{fn: func(ref RecordRef, record Record) error {
+		key := record.Key
+		switch record.Header.Type {
+		case RecordTombstone:
+			if err := idx.Delete(key); err != nil {
+				return fmt.Errorf("failed to replay delete at %d:%d: %w", ref.FileID, ref.Offset, err)
+			}
+			return nil
+		case RecordRangeTombstone:
+			if r, ok := idx.(RangeDeleter); ok {
+				if err := r.DeleteRange(key, record.Value); err != nil {
+					return fmt.Errorf("failed to replay range delete at %d:%d: %w", ref.FileID, ref.Offset, err)
+				}
+			}
+			return nil
+		case RecordSystem:
+			return nil
+		}
+
+		id, isVector := vectorRecordID(key)
+		isVector = isVector && record.Header.Type == RecordVector
+		switch {
+		case name == "primary" && isVector:
+			key = id
+		case name == "vector" && !isVector:
+			return nil
+		}
+
+		if err := idx.Put(key, ref); err != nil {
+			return fmt.Errorf("failed to replay record at %d:%d: %w", ref.FileID, ref.Offset, err)
+		}
+		return nil
+	}}
+	return db.segmentMgr.Iterate(replay.visit)
+}
+
 func (db *DB) Close() error {
 	var firstErr error
 	db.closeOnce.Do(func() {
@@ -291,6 +516,7 @@ func (db *DB) Close() error {
 		defer db.mu.Unlock()
 
 		db.closed = true
+		db.segSync.close()
 
 		for name, idx := range db.indexes {
 			if err := idx.Close(); err != nil && firstErr == nil {
@@ -310,6 +536,18 @@ type DBStats struct {
 	ImmutableCount int
 	SSTableCount   int
 	SSTableFiles   []string
+
+	BloomChecks         uint64
+	BloomNegatives      uint64
+	BloomFalsePositives uint64
+
+	LevelFiles     []int
+	LevelBytes     []int64
+	FlushedBytes   uint64
+	CompactedBytes uint64
+
+	WriteStalls uint64
+	StallTime   time.Duration
 }
 
 func (db *DB) Stats() DBStats {
@@ -326,6 +564,18 @@ func (db *DB) Stats() DBStats {
 		ImmutableCount: istats.ImmutableCount,
 		SSTableCount:   istats.SSTableCount,
 		SSTableFiles:   istats.SSTableFiles,
+
+		BloomChecks:         istats.BloomChecks,
+		BloomNegatives:      istats.BloomNegatives,
+		BloomFalsePositives: istats.BloomFalsePositives,
+
+		LevelFiles:     istats.LevelFiles,
+		LevelBytes:     istats.LevelBytes,
+		FlushedBytes:   istats.FlushedBytes,
+		CompactedBytes: istats.CompactedBytes,
+
+		WriteStalls: istats.WriteStalls,
+		StallTime:   istats.StallTime,
 	}
 }
 
@@ -337,9 +587,26 @@ func (db *DB) ReadRecord(ref RecordRef) (string, error) {
 		return "", ErrDBClosed
 	}
 
-	record, err := db.segmentMgr.Read(ref)
+	record, err := db.segmentMgr.ReadRecord(ref)
 	if err != nil {
 		return "", err
 	}
-	return decodeValue(record), nil
+	return recordValue(record), nil
+}
+
+// ReadRecordKey returns the key of the record at ref, such as the composite key that
+// holds the full-precision vector of a vector record.
+func (db *DB) ReadRecordKey(ref RecordRef) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	record, err := db.segmentMgr.ReadRecord(ref)
+	if err != nil {
+		return nil, err
+	}
+	return record.Key, nil
 }
@@ -1,12 +1,15 @@
 package storage_test
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/raman20/index/hnsw"
 	"github.com/raman20/index/lsm"
 	"github.com/raman20/storage"
 )
@@ -176,3 +179,486 @@ func TestDBScan(t *testing.T) {
 		t.Errorf("expected deleted key user:1:age to be excluded from scan")
 	}
 }
+
+func TestDBRebuildIndex(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "db_rebuild_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := storage.Options{
+		MemtableSize:        1024,
+		DataDir:             tmpDir,
+		CompactionThreshold: 3,
+	}
+
+	dbPath := filepath.Join(tmpDir, "test_rebuild_db")
+	walPath := filepath.Join(dbPath, "wal")
+	sstPath := filepath.Join(dbPath, "sst")
+	os.MkdirAll(walPath, 0755)
+	os.MkdirAll(sstPath, 0755)
+
+	lsmIdx, err := lsm.NewLSMIndex(walPath, sstPath, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSM index: %v", err)
+	}
+
+	db, err := storage.Open("test_rebuild_db", opts, lsmIdx)
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 50; i++ {
+		db.Set(fmt.Sprintf("key_%02d", i), fmt.Sprintf("old_%02d", i))
+	}
+	for i := 0; i < 50; i += 2 {
+		db.Set(fmt.Sprintf("key_%02d", i), fmt.Sprintf("new_%02d", i))
+	}
+	db.Delete("key_07")
+
+	// Backfill a brand new lens from the segment log
+	freshWal := filepath.Join(tmpDir, "fresh_wal")
+	freshSst := filepath.Join(tmpDir, "fresh_sst")
+	os.MkdirAll(freshWal, 0755)
+	os.MkdirAll(freshSst, 0755)
+	freshIdx, err := lsm.NewLSMIndex(freshWal, freshSst, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSM index: %v", err)
+	}
+	db.RegisterIndex("primary", freshIdx)
+	lsmIdx.Close()
+
+	if err := db.RebuildIndex("primary"); err != nil {
+		t.Fatalf("failed to rebuild index: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key_%02d", i)
+		val, ok := db.Get(key)
+		switch {
+		case i == 7:
+			if ok {
+				t.Errorf("deleted key %s resurrected by rebuild", key)
+			}
+		case i%2 == 0:
+			if !ok || val != fmt.Sprintf("new_%02d", i) {
+				t.Errorf("key %s: expected latest value, got %q (found=%v)", key, val, ok)
+			}
+		default:
+			if !ok || val != fmt.Sprintf("old_%02d", i) {
+				t.Errorf("key %s: expected %q, got %q (found=%v)", key, fmt.Sprintf("old_%02d", i), val, ok)
+			}
+		}
+	}
+
+	// Rebuilding an index in place resets it first
+	if err := db.RebuildIndex("primary"); err != nil {
+		t.Fatalf("failed to rebuild index in place: %v", err)
+	}
+	if val, ok := db.Get("key_10"); !ok || val != "new_10" {
+		t.Errorf("expected key_10 to survive an in-place rebuild, got %q (found=%v)", val, ok)
+	}
+
+	if err := db.RebuildIndex("missing"); err == nil {
+		t.Errorf("expected error rebuilding an unregistered index")
+	}
+}
+
+func TestDBVectorUpsertAndDelete(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "db_vector_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := storage.Options{DataDir: tmpDir}
+	dbPath := filepath.Join(tmpDir, "test_vector_db")
+	walPath := filepath.Join(dbPath, "wal")
+	sstPath := filepath.Join(dbPath, "sst")
+	os.MkdirAll(walPath, 0755)
+	os.MkdirAll(sstPath, 0755)
+
+	lsmIdx, err := lsm.NewLSMIndex(walPath, sstPath, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSM index: %v", err)
+	}
+	db, err := storage.Open("test_vector_db", opts, lsmIdx)
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	vecIdx := hnsw.NewHNSWIndex(hnsw.Euclidean, 4, 32, 16)
+	db.RegisterIndex("vector", vecIdx)
+
+	// 1. Re-inserting an ID replaces its vector and payload
+	db.InsertVector(hnsw.EncodeKey("vec_1", []float32{1, 2}), "first")
+	db.InsertVector(hnsw.EncodeKey("vec_2", []float32{5, 5}), "second")
+	if err := db.InsertVector(hnsw.EncodeKey("vec_1", []float32{9, 9}), "moved"); err != nil {
+		t.Fatalf("failed to replace vector: %v", err)
+	}
+	if val, ok := db.Get("vec_1"); !ok || val != "moved" {
+		t.Errorf("expected replaced payload, got %q (found=%v)", val, ok)
+	}
+
+	expectVectors := func(stage string, want int) {
+		t.Helper()
+		refs, distances, err := vecIdx.Search([]float32{9, 9}, 5)
+		if err != nil || len(refs) != want {
+			t.Fatalf("%s: expected %d vectors, got %d (err=%v)", stage, want, len(refs), err)
+		}
+		if ref, _, _ := vecIdx.Get([]byte("vec_1")); refs[0] != ref || distances[0] != 0 {
+			t.Errorf("%s: expected vec_1 at its new position first, got %+v at %f", stage, refs[0], distances[0])
+		}
+	}
+	expectVectors("after upsert", 2)
+
+	// 2. Deleting an ID removes it from the graph
+	if err := db.Delete("vec_2"); err != nil {
+		t.Fatalf("failed to delete vector: %v", err)
+	}
+	if _, found, _ := vecIdx.Get([]byte("vec_2")); found {
+		t.Errorf("expected vec_2 to be removed from the vector index")
+	}
+	expectVectors("after delete", 1)
+
+	// 3. Replaying the log applies upserts and deletes in order
+	if err := db.RebuildIndex("vector"); err != nil {
+		t.Fatalf("failed to rebuild vector index: %v", err)
+	}
+	expectVectors("after rebuild", 1)
+
+	// 4. Vectors the index rejects are not written
+	for _, c := range []struct {
+		vector []float32
+		want   error
+	}{
+		{[]float32{1, 2, 3}, hnsw.ErrDimensionMismatch},
+		{[]float32{1, float32(math.NaN())}, hnsw.ErrInvalidVector},
+		{[]float32{float32(math.Inf(-1)), 0}, hnsw.ErrInvalidVector},
+	} {
+		if err := db.InsertVector(hnsw.EncodeKey("bad", c.vector), "bad"); !errors.Is(err, c.want) {
+			t.Errorf("vector %v: expected %v, got %v", c.vector, c.want, err)
+		}
+	}
+	if _, ok := db.Get("bad"); ok {
+		t.Errorf("expected rejected vectors to leave no record")
+	}
+	expectVectors("after rejected inserts", 1)
+
+	// 5. Full-precision vectors are read back from their records for re-ranking
+	ref, _, _ := vecIdx.Get([]byte("vec_1"))
+	if vec, err := hnsw.SegmentVectors(db)(ref); err != nil || len(vec) != 2 || vec[0] != 9 || vec[1] != 9 {
+		t.Errorf("expected to read back vector [9 9], got %v (err=%v)", vec, err)
+	}
+}
+
+func TestDBRecoveryReconcilesTornTail(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "db_recovery_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := storage.Options{
+		MemtableSize: 1024 * 1024,
+		DataDir:      tmpDir,
+	}
+
+	dbPath := filepath.Join(tmpDir, "test_recovery_db")
+	walPath := filepath.Join(dbPath, "wal")
+	sstPath := filepath.Join(dbPath, "sst")
+	os.MkdirAll(walPath, 0755)
+	os.MkdirAll(sstPath, 0755)
+
+	lsmIdx, err := lsm.NewLSMIndex(walPath, sstPath, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSM index: %v", err)
+	}
+	db, err := storage.Open("test_recovery_db", opts, lsmIdx)
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+	db.Set("kept", "durable value")
+	db.Set("lost", "value whose segment write was torn")
+	db.Close()
+
+	// The index WAL made it to disk but the tail of the segment write did not
+	segPath := filepath.Join(dbPath, "segments", "00000001.seg")
+	stat, err := os.Stat(segPath)
+	if err != nil {
+		t.Fatalf("failed to stat segment: %v", err)
+	}
+	if err := os.Truncate(segPath, stat.Size()-10); err != nil {
+		t.Fatalf("failed to truncate segment: %v", err)
+	}
+
+	lsmIdx2, err := lsm.NewLSMIndex(walPath, sstPath, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSM index: %v", err)
+	}
+	db2, err := storage.Open("test_recovery_db", opts, lsmIdx2)
+	if err != nil {
+		t.Fatalf("failed to reopen DB: %v", err)
+	}
+	defer db2.Close()
+
+	if report := db2.RecoveryReport(); report.DiscardedBytes == 0 {
+		t.Errorf("expected recovery to discard the torn record, got %+v", report)
+	}
+	if val, ok := db2.Get("kept"); !ok || val != "durable value" {
+		t.Errorf("expected kept record to survive, got %q (found=%v)", val, ok)
+	}
+	if _, found, _ := lsmIdx2.Get([]byte("lost")); found {
+		t.Errorf("expected index entry for the torn record to be dropped")
+	}
+
+	// New writes land in a fresh segment and are readable
+	db2.Set("lost", "rewritten")
+	if val, ok := db2.Get("lost"); !ok || val != "rewritten" {
+		t.Errorf("expected rewritten value, got %q (found=%v)", val, ok)
+	}
+}
+
+func TestDBReconcileVectorIndex(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "db_reconcile_vector_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := storage.Options{
+		MemtableSize: 1024 * 1024,
+		DataDir:      tmpDir,
+	}
+
+	dbPath := filepath.Join(tmpDir, "test_reconcile_db")
+	walPath := filepath.Join(dbPath, "wal")
+	sstPath := filepath.Join(dbPath, "sst")
+	vecPath := filepath.Join(dbPath, "vector")
+	os.MkdirAll(walPath, 0755)
+	os.MkdirAll(sstPath, 0755)
+
+	open := func() *storage.DB {
+		lsmIdx, err := lsm.NewLSMIndex(walPath, sstPath, opts)
+		if err != nil {
+			t.Fatalf("failed to create LSM index: %v", err)
+		}
+		db, err := storage.Open("test_reconcile_db", opts, lsmIdx)
+		if err != nil {
+			t.Fatalf("failed to open DB: %v", err)
+		}
+		return db
+	}
+	openVectors := func(db *storage.DB) *hnsw.HNSWIndex {
+		vecIdx, err := hnsw.OpenHNSWIndex(vecPath, hnsw.Euclidean, 4, 32, 16, storage.SyncPolicy{Mode: storage.SyncAlways})
+		if err != nil {
+			t.Fatalf("failed to open HNSW index: %v", err)
+		}
+		db.RegisterIndex("vector", vecIdx)
+		return vecIdx
+	}
+
+	db := open()
+	vecIdx := openVectors(db)
+	db.InsertVector(hnsw.EncodeKey("vec_1", []float32{1, 2}), "first")
+	db.InsertVector(hnsw.EncodeKey("vec_1", []float32{9, 9}), "moved")
+	db.Close()
+	vecIdx.Close()
+
+	// The graph logged the move but the tail of its segment write was torn
+	segPath := filepath.Join(dbPath, "segments", "00000001.seg")
+	stat, err := os.Stat(segPath)
+	if err != nil {
+		t.Fatalf("failed to stat segment: %v", err)
+	}
+	if err := os.Truncate(segPath, stat.Size()-10); err != nil {
+		t.Fatalf("failed to truncate segment: %v", err)
+	}
+
+	// The open that truncates the tail does not load the vector lens
+	db = open()
+	if report := db.RecoveryReport(); report.DiscardedBytes == 0 {
+		t.Fatalf("expected recovery to discard the torn record, got %+v", report)
+	}
+	db.Close()
+
+	db = open()
+	defer db.Close()
+	vecIdx = openVectors(db)
+	defer vecIdx.Close()
+	if err := db.ReconcileIndex("vector"); err != nil {
+		t.Fatalf("failed to reconcile vector index: %v", err)
+	}
+
+	// The lens falls back to the version that survived in the log
+	ref, found, _ := vecIdx.Get([]byte("vec_1"))
+	if !found {
+		t.Fatalf("expected vec_1 to be restored")
+	}
+	if vec, err := hnsw.SegmentVectors(db)(ref); err != nil || len(vec) != 2 || vec[0] != 1 || vec[1] != 2 {
+		t.Errorf("expected restored vector [1 2], got %v (err=%v)", vec, err)
+	}
+	if refs, _, err := vecIdx.Search([]float32{9, 9}, 1); err != nil || len(refs) != 1 || refs[0] != ref {
+		t.Errorf("expected search to return the restored record, got %v (err=%v)", refs, err)
+	}
+}
+
+func TestDBSyncModes(t *testing.T) {
+	modes := []storage.Options{
+		{SyncWrites: true},
+		{SyncMode: storage.SyncGroup, SyncInterval: time.Millisecond, SyncBatchSize: 16},
+		{SyncMode: storage.SyncNone},
+	}
+
+	for _, opts := range modes {
+		mode := opts.SyncPolicy().Mode
+		tmpDir, err := os.MkdirTemp("", "db_sync_test")
+		if err != nil {
+			t.Fatalf("failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		opts.MemtableSize = 1024 * 1024
+		opts.DataDir = tmpDir
+
+		dbPath := filepath.Join(tmpDir, "test_sync_db")
+		walPath := filepath.Join(dbPath, "wal")
+		sstPath := filepath.Join(dbPath, "sst")
+		os.MkdirAll(walPath, 0755)
+		os.MkdirAll(sstPath, 0755)
+
+		open := func() (*storage.DB, error) {
+			lsmIdx, err := lsm.NewLSMIndex(walPath, sstPath, opts)
+			if err != nil {
+				return nil, err
+			}
+			return storage.Open("test_sync_db", opts, lsmIdx)
+		}
+
+		db, err := open()
+		if err != nil {
+			t.Fatalf("%v: failed to open DB: %v", mode, err)
+		}
+		for i := 0; i < 50; i++ {
+			if err := db.Set(fmt.Sprintf("key_%02d", i), "value"); err != nil {
+				t.Fatalf("%v: failed to set: %v", mode, err)
+			}
+		}
+		if err := db.Set("durable", "value", storage.WithSync()); err != nil {
+			t.Fatalf("%v: failed to set with sync: %v", mode, err)
+		}
+		if err := db.Delete("key_00", storage.WithSync()); err != nil {
+			t.Fatalf("%v: failed to delete with sync: %v", mode, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("%v: failed to close DB: %v", mode, err)
+		}
+
+		db, err = open()
+		if err != nil {
+			t.Fatalf("%v: failed to reopen DB: %v", mode, err)
+		}
+		for i := 1; i < 50; i++ {
+			if _, ok := db.Get(fmt.Sprintf("key_%02d", i)); !ok {
+				t.Errorf("%v: key_%02d lost across reopen", mode, i)
+			}
+		}
+		if _, ok := db.Get("key_00"); ok {
+			t.Errorf("%v: durable delete lost across reopen", mode)
+		}
+		if val, ok := db.Get("durable"); !ok || val != "value" {
+			t.Errorf("%v: durable write lost across reopen", mode)
+		}
+		db.Close()
+	}
+}
+
+func TestDBRangeOps(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "db_range_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, _ := openCommitTestDB(t, tmpDir, storage.Options{MemtableSize: 1024, CompactionThreshold: 3})
+	defer db.Close()
+
+	for _, tenant := range []string{"acme", "globex", "initech"} {
+		for i := 0; i < 20; i++ {
+			db.Set(fmt.Sprintf("%s:%02d", tenant, i), fmt.Sprintf("%s value %d", tenant, i))
+		}
+	}
+
+	// 1. ScanRange is ordered, bounded and limited
+	kvs, err := db.ScanRange("acme:18", "globex:02", 0)
+	if err != nil {
+		t.Fatalf("failed to scan range: %v", err)
+	}
+	if fmt.Sprint(kvs) != "[{acme:18 acme value 18} {acme:19 acme value 19} {globex:00 globex value 0} {globex:01 globex value 1}]" {
+		t.Errorf("unexpected range scan: %v", kvs)
+	}
+	if kvs, _ := db.ScanRange("initech:", "", 3); len(kvs) != 3 || kvs[2].Key != "initech:02" {
+		t.Errorf("expected 3 keys up to initech:02, got %v", kvs)
+	}
+
+	// 2. DeleteRange drops a tenant's keyspace with one record
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to take snapshot: %v", err)
+	}
+	defer snap.Release()
+	txn, _ := db.Begin()
+
+	if err := db.DeleteRange("globex:", "globex;"); err != nil {
+		t.Fatalf("failed to delete range: %v", err)
+	}
+	if err := db.DeleteRange("b", "a"); err != storage.ErrInvalidRange {
+		t.Errorf("expected ErrInvalidRange, got %v", err)
+	}
+	db.Set("globex:05", "rejoined")
+
+	verify := func(stage string) {
+		kvs, err := db.ScanRange("acme:19", "initech:01", 0)
+		if err != nil {
+			t.Fatalf("%s: failed to scan range: %v", stage, err)
+		}
+		if fmt.Sprint(kvs) != "[{acme:19 acme value 19} {globex:05 rejoined} {initech:00 initech value 0}]" {
+			t.Errorf("%s: unexpected keys after range delete: %v", stage, kvs)
+		}
+		if _, ok := db.Get("globex:06"); ok {
+			t.Errorf("%s: deleted key globex:06 still readable", stage)
+		}
+	}
+	verify("live")
+
+	// 3. Snapshots keep seeing the deleted range, and transactions writing into it conflict
+	if val, ok := snap.Get("globex:06"); !ok || val != "globex value 6" {
+		t.Errorf("expected snapshot to see globex:06, got %q (found=%v)", val, ok)
+	}
+	if results, _ := snap.Scan("globex:"); len(results) != 20 {
+		t.Errorf("expected 20 snapshot keys for globex, got %d", len(results))
+	}
+	txn.Set("globex:07", "lost update")
+	if err := txn.Commit(); err != storage.ErrTxnConflict {
+		t.Errorf("expected write into a deleted range to conflict, got %v", err)
+	}
+
+	// 4. Replaying the log applies the range tombstone in order
+	if err := db.RebuildIndex("primary"); err != nil {
+		t.Fatalf("failed to rebuild index: %v", err)
+	}
+	verify("rebuild")
+
+	batch := storage.NewWriteBatch()
+	batch.DeleteRange("acme:", "acme;")
+	batch.Set("acme:00", "only one left")
+	if err := db.Write(batch); err != nil {
+		t.Fatalf("failed to write batch: %v", err)
+	}
+	if kvs, _ := db.ScanRange("acme:", "acme;", 0); len(kvs) != 1 || kvs[0].Value != "only one left" {
+		t.Errorf("expected batched range delete followed by a set, got %v", kvs)
+	}
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"fmt"
+)
+
+// liveRecord is a record that survived a liveness check during value-log GC,
+// together with the indexes that currently point at it.
+type liveRecord struct {
+	ref     RecordRef
+	data    []byte
+	targets []indexTarget
+}
+
+// indexTarget is an index entry that must be repointed when a record moves.
+type indexTarget struct {
+	idx Index
+	key []byte
+}
+
+// RunValueLogGC reclaims space in sealed segment files. Each sealed segment whose
+// fraction of dead bytes is at least discardRatio is rewritten: its live records are
+// appended to the active segment, the indexes are repointed at the new copies and
+// the old file is scheduled for deletion. A record is live when some index still
+// maps its key to its exact RecordRef.
+//
+// Rewritten segments are deleted at the start of the next GC run (or on Close), so
+// readers holding refs obtained before a run can still resolve them until then.
+// It returns the number of segments rewritten.
+func (db *DB) RunValueLogGC(discardRatio float64) (int, error) {
+	if discardRatio <= 0 || discardRatio > 1 {
+		return 0, fmt.Errorf("invalid discard ratio %v", discardRatio)
+	}
+
+	db.mu.RLock()
+	closed := db.closed
+	db.mu.RUnlock()
+	if closed {
+		return 0, ErrDBClosed
+	}
+
+	// Segments rewritten by the previous run have had their grace period
+	if err := db.segmentMgr.PurgeObsolete(); err != nil {
+		return 0, err
+	}
+
+	sealed, err := db.segmentMgr.SealedSegments()
+	if err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for i, id := range sealed {
+		hasOlder := i > 0
+
+		// 1. Estimate the garbage ratio without blocking writers
+		db.mu.RLock()
+		live, total, movable, err := db.scanSegmentLiveness(id, hasOlder)
+		db.mu.RUnlock()
+		if err != nil {
+			return rewritten, err
+		}
+		if !movable || total == 0 || 1-float64(live)/float64(total) < discardRatio {
+			continue
+		}
+
+		// 2. Relocate live records under the write lock so no writer can race us
+		db.mu.Lock()
+		err = db.rewriteSegment(id, hasOlder)
+		db.mu.Unlock()
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+
+	return rewritten, nil
+}
+
+// scanSegmentLiveness returns the number of live and total bytes in a segment.
+// movable is false when the segment holds vector records that cannot be checked
+// because the vector index is not loaded, or range tombstones that may still
+// shadow records in older segments.
+func (db *DB) scanSegmentLiveness(id uint32, hasOlder bool) (live, total int64, movable bool, err error) {
+	movable = true
+	err = db.segmentMgr.IterateSegment(id, func(ref RecordRef, record Record) error {
+		total += int64(ref.Length)
+		targets, isLive, ok := db.recordLiveness(ref, record, hasOlder)
+		if !ok {
+			movable = false
+		}
+		if isLive || len(targets) > 0 {
+			live += int64(ref.Length)
+		}
+		return nil
+	})
+	return live, total, movable, err
+}
+
+// recordLiveness returns the index entries pointing at a record. Tombstones have no
+// targets but are kept (isLive) while older segments may still hold the key they
+// delete. ok is false when liveness cannot be determined.
+func (db *DB) recordLiveness(ref RecordRef, record Record, hasOlder bool) (targets []indexTarget, isLive, ok bool) {
+	key := record.Key
+	primary := db.indexes["primary"]
+	switch record.Header.Type {
+	case RecordTombstone:
+		_, found, err := primary.Get(key)
+		return nil, err == nil && !found && hasOlder, true
+	case RecordRangeTombstone:
+		// Relocating it past later writes in the range would delete them on replay, so
+		// the segment stays put until no older segment remains for it to shadow
+		return nil, false, !hasOlder
+	case RecordSystem:
+		return nil, false, true
+	}
+
+	lookup := key
+	id, isVector := vectorRecordID(key)
+	if isVector && record.Header.Type == RecordVector {
+		lookup = id
+		vecIdx, exists := db.indexes["vector"]
+		if !exists {
+			return nil, false, false
+		}
+		if cur, found, err := vecIdx.Get(id); err == nil && found && cur == ref {
+			targets = append(targets, indexTarget{idx: vecIdx, key: key})
+		}
+	}
+
+	if cur, found, err := primary.Get(lookup); err == nil && found && cur == ref {
+		targets = append(targets, indexTarget{idx: primary, key: lookup})
+	}
+	return targets, false, true
+}
+
+// rewriteSegment copies the live records of a sealed segment to the active segment,
+// repoints the indexes and marks the segment obsolete. Must be called with db.mu held.
+//
+// The order of operations keeps a crash at any point safe: until the indexes are
+// updated the copies are unreferenced garbage, and once they are updated the old
+// segment holds only dead records and is reclaimed by a later run.
+func (db *DB) rewriteSegment(id uint32, hasOlder bool) error {
+	var records []liveRecord
+	err := db.segmentMgr.IterateSegment(id, func(ref RecordRef, record Record) error {
+		targets, isLive, ok := db.recordLiveness(ref, record, hasOlder)
+		if !ok {
+			return fmt.Errorf("cannot determine liveness of record at %d:%d", ref.FileID, ref.Offset)
+		}
+		if isLive || len(targets) > 0 {
+			data, err := db.segmentMgr.Read(ref)
+			if err != nil {
+				return err
+			}
+			// Commit markers are not relocated, so copies stand on their own
+			data = clearTxID(data)
+			records = append(records, liveRecord{ref: ref, data: data, targets: targets})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan segment %d: %w", id, err)
+	}
+
+	// 1. Append the live records and make the copies durable
+	newRefs := make([]RecordRef, len(records))
+	for i, rec := range records {
+		ref, err := db.segmentMgr.Append(rec.data)
+		if err != nil {
+			return fmt.Errorf("failed to relocate record from segment %d: %w", id, err)
+		}
+		newRefs[i] = ref
+	}
+	if err := db.segmentMgr.Sync(); err != nil {
+		return err
+	}
+
+	// 2. Repoint every index entry at the relocated copy
+	for i, rec := range records {
+		for _, target := range rec.targets {
+			if err := target.idx.Put(target.key, newRefs[i]); err != nil {
+				return fmt.Errorf("failed to update index for relocated record: %w", err)
+			}
+		}
+	}
+
+	// 3. The old segment is now garbage
+	return db.segmentMgr.Remove(id)
+}
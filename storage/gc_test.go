@@ -0,0 +1,136 @@
+package storage_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/raman20/index/hnsw"
+	"github.com/raman20/index/lsm"
+	"github.com/raman20/storage"
+)
+
+func countSegments(t *testing.T, dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read segment dir: %v", err)
+	}
+	return len(entries)
+}
+
+func TestValueLogGC(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "db_gc_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := storage.Options{
+		MemtableSize:        1024, // Segments roll over every 2KB
+		DataDir:             tmpDir,
+		CompactionThreshold: 3,
+	}
+
+	dbPath := filepath.Join(tmpDir, "test_gc_db")
+	walPath := filepath.Join(dbPath, "wal")
+	sstPath := filepath.Join(dbPath, "sst")
+	segmentPath := filepath.Join(dbPath, "segments")
+	os.MkdirAll(walPath, 0755)
+	os.MkdirAll(sstPath, 0755)
+
+	lsmIdx, err := lsm.NewLSMIndex(walPath, sstPath, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSM index: %v", err)
+	}
+
+	db, err := storage.Open("test_gc_db", opts, lsmIdx)
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	vecIdx := hnsw.NewHNSWIndex(hnsw.Euclidean, 4, 32, 16)
+	db.RegisterIndex("vector", vecIdx)
+	if err := db.InsertVector(hnsw.EncodeKey("vec_1", []float32{1, 2}), "vector payload"); err != nil {
+		t.Fatalf("failed to insert vector: %v", err)
+	}
+
+	for i := 0; i < 60; i++ {
+		db.Set(fmt.Sprintf("key_%02d", i), fmt.Sprintf("first_version_of_the_value_%02d", i))
+	}
+	db.Delete("key_05")
+
+	staleRef, _, _ := lsmIdx.Get([]byte("key_30"))
+
+	// Overwrite most keys so the early segments are mostly garbage
+	for i := 10; i < 60; i++ {
+		db.Set(fmt.Sprintf("key_%02d", i), fmt.Sprintf("second_version_of_the_value_%02d", i))
+	}
+
+	before := countSegments(t, segmentPath)
+	n, err := db.RunValueLogGC(0.5)
+	if err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if n == 0 {
+		t.Fatalf("expected GC to rewrite at least one segment")
+	}
+
+	// Stale refs stay readable until the next GC run
+	if _, err := db.ReadRecord(staleRef); err != nil {
+		t.Errorf("expected stale ref to be readable during grace period: %v", err)
+	}
+
+	verify := func() {
+		for i := 0; i < 60; i++ {
+			key := fmt.Sprintf("key_%02d", i)
+			expected := fmt.Sprintf("first_version_of_the_value_%02d", i)
+			if i >= 10 {
+				expected = fmt.Sprintf("second_version_of_the_value_%02d", i)
+			}
+			val, ok := db.Get(key)
+			if i == 5 {
+				if ok {
+					t.Errorf("deleted key %s resurrected by GC", key)
+				}
+				continue
+			}
+			if !ok || val != expected {
+				t.Errorf("key %s: expected %q, got %q (found=%v)", key, expected, val, ok)
+			}
+		}
+
+		refs, _, err := vecIdx.Search([]float32{1, 2}, 1)
+		if err != nil || len(refs) != 1 {
+			t.Fatalf("vector search failed: %v", err)
+		}
+		if payload, err := db.ReadRecord(refs[0]); err != nil || payload != "vector payload" {
+			t.Errorf("expected relocated vector payload, got %q (err=%v)", payload, err)
+		}
+	}
+	verify()
+
+	// The next run deletes the rewritten files
+	if _, err := db.RunValueLogGC(0.5); err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if after := countSegments(t, segmentPath); after >= before {
+		t.Errorf("expected fewer segment files after GC, had %d, now %d", before, after)
+	}
+	if _, err := db.ReadRecord(staleRef); err == nil {
+		t.Errorf("expected stale ref into a purged segment to fail")
+	}
+	verify()
+
+	// Rebuilding from the compacted log yields the same state
+	if err := db.RebuildIndex("primary"); err != nil {
+		t.Fatalf("failed to rebuild index: %v", err)
+	}
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("key_%02d", i)
+		if _, ok := db.Get(key); ok == (i == 5) {
+			t.Errorf("key %s: unexpected found=%v after rebuild", key, ok)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+)
+
+// PrefixBounds returns IterOptions covering exactly the keys that start with prefix.
+func PrefixBounds(prefix []byte) IterOptions {
+	opts := IterOptions{LowerBound: prefix}
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			upper := append([]byte(nil), prefix[:i+1]...)
+			upper[i]++
+			opts.UpperBound = upper
+			break
+		}
+	}
+	return opts
+}
+
+// IterEntry is a key and the RecordRef it maps to.
+type IterEntry struct {
+	Key []byte
+	Ref RecordRef
+}
+
+type sliceIterator struct {
+	entries []IterEntry
+	pos     int
+}
+
+// NewSliceIterator returns an IndexIterator over entries, which must be sorted by
+// key. It suits indexes that hold all of their entries in memory.
+func NewSliceIterator(entries []IterEntry, opts IterOptions) IndexIterator {
+	lo, hi := 0, len(entries)
+	if opts.LowerBound != nil {
+		lo = sort.Search(len(entries), func(i int) bool {
+			return bytes.Compare(entries[i].Key, opts.LowerBound) >= 0
+		})
+	}
+	if opts.UpperBound != nil {
+		hi = sort.Search(len(entries), func(i int) bool {
+			return bytes.Compare(entries[i].Key, opts.UpperBound) >= 0
+		})
+	}
+	if hi < lo {
+		hi = lo
+	}
+	return &sliceIterator{entries: entries[lo:hi], pos: -1}
+}
+
+func (it *sliceIterator) First() bool {
+	it.pos = 0
+	return it.Valid()
+}
+
+func (it *sliceIterator) Last() bool {
+	it.pos = len(it.entries) - 1
+	return it.Valid()
+}
+
+func (it *sliceIterator) Seek(key []byte) bool {
+	it.pos = sort.Search(len(it.entries), func(i int) bool {
+		return bytes.Compare(it.entries[i].Key, key) >= 0
+	})
+	return it.Valid()
+}
+
+func (it *sliceIterator) Next() bool {
+	if !it.Valid() {
+		return false
+	}
+	it.pos++
+	return it.Valid()
+}
+
+func (it *sliceIterator) Prev() bool {
+	if !it.Valid() {
+		return false
+	}
+	it.pos--
+	return it.Valid()
+}
+
+func (it *sliceIterator) Valid() bool      { return it.pos >= 0 && it.pos < len(it.entries) }
+func (it *sliceIterator) Key() []byte      { return it.entries[it.pos].Key }
+func (it *sliceIterator) Value() RecordRef { return it.entries[it.pos].Ref }
+func (it *sliceIterator) Error() error     { return nil }
+func (it *sliceIterator) Close() error     { return nil }
+
+// Iterator walks the primary index in key order and reads each value from the
+// segment log on demand, so large ranges can be paged through without loading them
+// into memory. Segments are pinned while it is open, so value-log GC never deletes
+// a record it may still read. It must be closed after use.
+type Iterator struct {
+	it     IndexIterator
+	db     *DB
+	unpin  func()
+	value  string
+	loaded bool
+	err    error
+}
+
+// NewIterator returns an iterator over the primary index restricted to opts.
+func (db *DB) NewIterator(opts IterOptions) (*Iterator, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	it, err := db.indexes["primary"].NewIterator(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{
+		it:    it,
+		db:    db,
+		unpin: db.segmentMgr.Pin(),
+	}, nil
+}
+
+func (it *Iterator) First() bool {
+	it.loaded = false
+	return it.it.First()
+}
+
+func (it *Iterator) Last() bool {
+	it.loaded = false
+	return it.it.Last()
+}
+
+// Seek moves to the first key in range that is greater than or equal to key.
+func (it *Iterator) Seek(key string) bool {
+	it.loaded = false
+	return it.it.Seek([]byte(key))
+}
+
+func (it *Iterator) Next() bool {
+	it.loaded = false
+	return it.it.Next()
+}
+
+func (it *Iterator) Prev() bool {
+	it.loaded = false
+	return it.it.Prev()
+}
+
+func (it *Iterator) Valid() bool {
+	return it.it.Valid()
+}
+
+func (it *Iterator) Key() string {
+	return string(it.it.Key())
+}
+
+// Value returns the value at the current key, reading it from the segment log. If
+// the read fails it returns an empty string and the error is reported by Error.
+func (it *Iterator) Value() string {
+	if !it.loaded {
+		it.loaded = true
+		it.value = ""
+
+		record, err := it.db.segmentMgr.ReadRecord(it.it.Value())
+		if err != nil {
+			if it.err == nil {
+				it.err = err
+			}
+			return ""
+		}
+		it.value = recordValue(record)
+	}
+	return it.value
+}
+
+// Error returns the first error encountered while iterating, if any.
+func (it *Iterator) Error() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.it.Error()
+}
+
+// Close releases the index iterator and unpins the segment log.
+func (it *Iterator) Close() error {
+	it.unpin()
+	return it.it.Close()
+}
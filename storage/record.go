@@ -0,0 +1,297 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"time"
+)
+
+// Record types stored in RecordHeader.Type.
+const (
+	RecordWrite     byte = 1 // Key/value write
+	RecordTombstone byte = 2 // Deletion of a key
+	RecordSystem    byte = 3 // Engine-internal marker
+	RecordVector    byte = 4 // Write whose key is a composite vector key
+
+	RecordRangeTombstone byte = 5 // Deletion of the keys in [key, value)
+)
+
+const (
+	recordVersion byte = 1
+	// recordMarker prefixes every versioned record. Legacy records start with a
+	// big-endian key length whose first byte is always zero, which lets both
+	// formats coexist in the same segment.
+	recordMarker = 0x80 | recordVersion
+
+	// [1B marker][1B type][8B TxID][8B timestamp][4B keyLen][4B valLen]
+	recordHeaderSize = 26
+	// [4B CRC32C of header, key and value]
+	recordTrailerSize = 4
+
+	legacyHeaderSize = 8
+	// legacyTombstoneValLen marks a legacy record whose value length field denotes
+	// a deletion rather than a payload.
+	legacyTombstoneValLen = math.MaxUint32
+)
+
+var (
+	ErrCorruptRecord = errors.New("corrupt record")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// CorruptionError reports a record that failed validation.
+type CorruptionError struct {
+	Ref    RecordRef
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupt record in segment %d at offset %d: %s", e.Ref.FileID, e.Ref.Offset, e.Reason)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruptRecord
+}
+
+// Record is a decoded segment log entry.
+type Record struct {
+	Header RecordHeader
+	Key    []byte
+	Value  []byte
+}
+
+// encodeRecord serializes a record in the current format:
+// [1B marker][1B type][8B TxID][8B timestamp][4B keyLen][4B valLen][key][value][4B CRC32C]
+func encodeRecord(recType byte, txID uint64, key, value string) []byte {
+	keyLen := uint32(len(key))
+	valLen := uint32(len(value))
+	bodyLen := recordHeaderSize + keyLen + valLen
+	buf := make([]byte, bodyLen+recordTrailerSize)
+
+	buf[0] = recordMarker
+	buf[1] = recType
+	binary.BigEndian.PutUint64(buf[2:10], txID)
+	binary.BigEndian.PutUint64(buf[10:18], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(buf[18:22], keyLen)
+	binary.BigEndian.PutUint32(buf[22:26], valLen)
+	copy(buf[recordHeaderSize:], key)
+	copy(buf[recordHeaderSize+keyLen:], value)
+	binary.BigEndian.PutUint32(buf[bodyLen:], crc32.Checksum(buf[:bodyLen], crcTable))
+	return buf
+}
+
+// recordFrameLen peeks at the next record in r and returns its total encoded length.
+func recordFrameLen(r *bufio.Reader) (int64, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case first[0] == recordMarker:
+		header, err := r.Peek(recordHeaderSize)
+		if err != nil {
+			return 0, err
+		}
+		keyLen := int64(binary.BigEndian.Uint32(header[18:22]))
+		valLen := int64(binary.BigEndian.Uint32(header[22:26]))
+		return recordHeaderSize + keyLen + valLen + recordTrailerSize, nil
+
+	case first[0] == 0:
+		header, err := r.Peek(legacyHeaderSize)
+		if err != nil {
+			return 0, err
+		}
+		keyLen := int64(binary.BigEndian.Uint32(header[0:4]))
+		if keyLen == 0 {
+			return 0, errLegacyEmptyKey
+		}
+		valLen := binary.BigEndian.Uint32(header[4:8])
+		if valLen == legacyTombstoneValLen {
+			return legacyHeaderSize + keyLen, nil
+		}
+		return legacyHeaderSize + keyLen + int64(valLen), nil
+
+	default:
+		return 0, fmt.Errorf("unknown record marker 0x%02x", first[0])
+	}
+}
+
+// decodeRecord validates and decodes a single encoded record.
+// The returned key and value alias buf.
+func decodeRecord(buf []byte) (Record, error) {
+	if len(buf) == 0 {
+		return Record{}, errors.New("empty record")
+	}
+	if buf[0] == 0 {
+		return decodeLegacyRecord(buf)
+	}
+	if buf[0] != recordMarker {
+		return Record{}, fmt.Errorf("unknown record marker 0x%02x", buf[0])
+	}
+	if len(buf) < recordHeaderSize+recordTrailerSize {
+		return Record{}, errors.New("record shorter than its header")
+	}
+
+	hdr := RecordHeader{
+		Type:      buf[1],
+		TxID:      binary.BigEndian.Uint64(buf[2:10]),
+		Timestamp: int64(binary.BigEndian.Uint64(buf[10:18])),
+		KeyLen:    binary.BigEndian.Uint32(buf[18:22]),
+		ValLen:    binary.BigEndian.Uint32(buf[22:26]),
+	}
+	bodyLen := int64(recordHeaderSize) + int64(hdr.KeyLen) + int64(hdr.ValLen)
+	if bodyLen+recordTrailerSize != int64(len(buf)) {
+		return Record{}, fmt.Errorf("length mismatch: header describes %d bytes, have %d", bodyLen+recordTrailerSize, len(buf))
+	}
+	if crc32.Checksum(buf[:bodyLen], crcTable) != binary.BigEndian.Uint32(buf[bodyLen:]) {
+		return Record{}, errors.New("checksum mismatch")
+	}
+	if hdr.Type < RecordWrite || hdr.Type > RecordRangeTombstone {
+		return Record{}, fmt.Errorf("unknown record type %d", hdr.Type)
+	}
+
+	keyEnd := recordHeaderSize + int64(hdr.KeyLen)
+	return Record{
+		Header: hdr,
+		Key:    buf[recordHeaderSize:keyEnd],
+		Value:  buf[keyEnd:bodyLen],
+	}, nil
+}
+
+// errLegacyEmptyKey rejects a legacy header with a zero key length. Legacy writes
+// never had empty keys, so such a header is zero-filled space, e.g. a torn tail
+// the filesystem extended before the data reached it.
+var errLegacyEmptyKey = errors.New("legacy record with empty key")
+
+// decodeLegacyRecord decodes the original unversioned [keyLen][valLen][key][value]
+// format, which carries no checksum or type. Types are inferred from the payload.
+func decodeLegacyRecord(buf []byte) (Record, error) {
+	if len(buf) < legacyHeaderSize {
+		return Record{}, errors.New("record shorter than its header")
+	}
+	keyLen := binary.BigEndian.Uint32(buf[0:4])
+	if keyLen == 0 {
+		return Record{}, errLegacyEmptyKey
+	}
+	valLen := binary.BigEndian.Uint32(buf[4:8])
+
+	hdr := RecordHeader{Type: RecordWrite, KeyLen: keyLen}
+	if valLen == legacyTombstoneValLen {
+		hdr.Type = RecordTombstone
+	} else {
+		hdr.ValLen = valLen
+	}
+	total := int64(legacyHeaderSize) + int64(keyLen) + int64(hdr.ValLen)
+	if total != int64(len(buf)) {
+		return Record{}, fmt.Errorf("length mismatch: header describes %d bytes, have %d", total, len(buf))
+	}
+
+	key := buf[legacyHeaderSize : legacyHeaderSize+keyLen]
+	if _, ok := vectorRecordID(key); ok && hdr.Type == RecordWrite {
+		hdr.Type = RecordVector
+	}
+	return Record{Header: hdr, Key: key, Value: buf[legacyHeaderSize+keyLen:]}, nil
+}
+
+// vectorRecordID extracts the ID from a composite vector key
+// ([4B ID length][ID][float32 array]). ok is false for plain KV keys.
+func vectorRecordID(key []byte) (id []byte, ok bool) {
+	if len(key) < 4 {
+		return nil, false
+	}
+	idLen := int64(binary.BigEndian.Uint32(key[0:4]))
+	vecLen := int64(len(key)) - 4 - idLen
+	if vecLen <= 0 || vecLen%4 != 0 {
+		return nil, false
+	}
+	return key[4 : 4+idLen], true
+}
+
+// txFilter buffers the records of a multi-record transaction and passes them to fn
+// only once the transaction's commit marker (a RecordSystem record carrying the same
+// TxID) is seen. Records with TxID 0 are committed on their own and pass straight
+// through. Transactions are written contiguously, so a record of a new transaction
+// discards any unfinished one.
+type txFilter struct {
+	fn       func(ref RecordRef, record Record) error
+	txID     uint64
+	start    RecordRef
+	buffered []txRecord
+}
+
+type txRecord struct {
+	ref    RecordRef
+	record Record
+}
+
+func (f *txFilter) visit(ref RecordRef, record Record) error {
+	txID := record.Header.TxID
+	if txID == 0 {
+		f.discard()
+		return f.emit(ref, record)
+	}
+
+	if record.Header.Type == RecordSystem {
+		if txID != f.txID {
+			f.discard()
+			return nil
+		}
+		buffered := f.buffered
+		f.discard()
+		for _, r := range buffered {
+			if err := f.emit(r.ref, r.record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if txID != f.txID {
+		f.discard()
+		f.txID = txID
+		f.start = ref
+	}
+	f.buffered = append(f.buffered, txRecord{ref: ref, record: record})
+	return nil
+}
+
+func (f *txFilter) emit(ref RecordRef, record Record) error {
+	if f.fn == nil {
+		return nil
+	}
+	return f.fn(ref, record)
+}
+
+func (f *txFilter) discard() {
+	f.txID = 0
+	f.buffered = nil
+}
+
+// open returns the first record of a transaction still waiting for its commit marker.
+func (f *txFilter) open() (RecordRef, bool) {
+	return f.start, f.txID != 0
+}
+
+// commitMarker encodes the record that commits transaction txID.
+func commitMarker(txID uint64) []byte {
+	return encodeRecord(RecordSystem, txID, "", "")
+}
+
+// clearTxID rewrites an encoded record so that it no longer belongs to a
+// transaction, recomputing its checksum. Value-log GC uses it when relocating
+// committed records, whose commit markers are not copied.
+func clearTxID(buf []byte) []byte {
+	if len(buf) < recordHeaderSize+recordTrailerSize || buf[0] != recordMarker {
+		return buf
+	}
+	binary.BigEndian.PutUint64(buf[2:10], 0)
+	bodyLen := len(buf) - recordTrailerSize
+	binary.BigEndian.PutUint32(buf[bodyLen:], crc32.Checksum(buf[:bodyLen], crcTable))
+	return buf
+}
@@ -1,9 +1,13 @@
 package storage
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 )
 
@@ -13,10 +17,28 @@ type SegmentManager struct {
 	activeId     uint32
 	activeFile   *os.File
 	activeOffset int64
-	files        map[uint32]*os.File
+	files        map[uint32]*segmentFile
+	obsolete     []obsoleteSegment // Rewritten segments awaiting deletion
+	pins         map[uint64]bool   // Open pins by generation
+	pinGen       uint64            // Generation of the most recent pin
+	recovery     RecoveryReport
 	mu           sync.RWMutex
 }
 
+// obsoleteSegment is a removed segment that may only be deleted once every pin
+// taken up to pinGen has been released.
+type obsoleteSegment struct {
+	id     uint32
+	pinGen uint64
+}
+
+// segmentFile is an open segment handle. readers tracks in-flight reads so that a
+// removed segment is only closed once nobody is reading from it.
+type segmentFile struct {
+	file    *os.File
+	readers sync.WaitGroup
+}
+
 // NewSegmentManager initializes and returns a SegmentManager.
 func NewSegmentManager(dir string, maxSize int64) (*SegmentManager, error) {
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -28,51 +50,189 @@ func NewSegmentManager(dir string, maxSize int64) (*SegmentManager, error) {
 	}
 
 	sm := &SegmentManager{
-		dir:   dir,
+		dir:     dir,
 		maxSize: maxSize,
-		files: make(map[uint32]*os.File),
+		files:   make(map[uint32]*segmentFile),
+		pins:    make(map[uint64]bool),
 	}
 
 	// Scan directory for existing segments
-	entries, err := os.ReadDir(dir)
+	ids, err := sm.segmentIDs()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read segment directory: %w", err)
-	}
-
-	var maxId uint32
-	for _, entry := range entries {
-		var id uint32
-		if _, err := fmt.Sscanf(entry.Name(), "%08d.seg", &id); err == nil {
-			if id > maxId {
-				maxId = id
-			}
-		}
+		return nil, err
 	}
 
 	// Start with the latest existing segment, or segment ID 1
-	if maxId == 0 {
-		maxId = 1
+	sm.activeId = 1
+	if len(ids) > 0 {
+		sm.activeId = ids[len(ids)-1]
 	}
-	sm.activeId = maxId
 
-	activePath := filepath.Join(dir, fmt.Sprintf("%08d.seg", sm.activeId))
-	file, err := os.OpenFile(activePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	file, err := os.OpenFile(sm.segmentPath(sm.activeId), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open active segment: %w", err)
 	}
 	sm.activeFile = file
-	sm.files[sm.activeId] = file
+	sm.files[sm.activeId] = &segmentFile{file: file}
 
-	stat, err := file.Stat()
-	if err != nil {
+	if err := sm.recoverActive(); err != nil {
 		file.Close()
-		return nil, fmt.Errorf("failed to stat active segment: %w", err)
+		return nil, err
 	}
-	sm.activeOffset = stat.Size()
 
 	return sm, nil
 }
 
+// RecoveryReport describes the repair performed on the active segment at open.
+type RecoveryReport struct {
+	SegmentID      uint32 // Segment that was active when the log was last closed
+	ValidBytes     int64  // Length of the prefix made of complete, valid records
+	DiscardedBytes int64  // Bytes of torn or corrupt data truncated from the tail
+}
+
+// recoverActive validates the active segment record by record and truncates it at
+// the end of the last complete record, discarding anything a crash left half-written
+// including the records of a transaction whose commit marker never made it to disk.
+// If data was discarded the segment is sealed and a fresh one is started, so offsets
+// that were handed out for the lost records are never reused.
+//
+// Only a torn tail is discarded: a bad record that runs to the end of the file, or
+// one followed by nothing but zeros. A bad record followed by data is corruption in
+// the middle of the segment, which fails the open with its CorruptionError rather
+// than deleting the valid records after it.
+func (sm *SegmentManager) recoverActive() error {
+	stat, err := sm.activeFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat active segment: %w", err)
+	}
+
+	var txs txFilter
+	validEnd, err := scanSegment(sm.activeFile, sm.activeId, txs.visit)
+	var corrupt *CorruptionError
+	if errors.As(err, &corrupt) {
+		torn, tornErr := sm.tornTail(corrupt.Ref, stat.Size())
+		if tornErr != nil {
+			return tornErr
+		}
+		if !torn {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if start, open := txs.open(); open && start.Offset < validEnd {
+		validEnd = start.Offset
+	}
+
+	sm.recovery = RecoveryReport{
+		SegmentID:      sm.activeId,
+		ValidBytes:     validEnd,
+		DiscardedBytes: stat.Size() - validEnd,
+	}
+	sm.activeOffset = validEnd
+
+	if sm.recovery.DiscardedBytes == 0 {
+		return nil
+	}
+	if err := sm.activeFile.Truncate(validEnd); err != nil {
+		return fmt.Errorf("failed to truncate segment %d: %w", sm.activeId, err)
+	}
+	return sm.rollOver()
+}
+
+// tornTail reports whether the bad record at ref is the torn tail of the active
+// segment, which holds size bytes: the record runs to the end of the file, or the
+// rest of the file is zero-filled.
+func (sm *SegmentManager) tornTail(ref RecordRef, size int64) (bool, error) {
+	if ref.Length > 0 && ref.Offset+int64(ref.Length) >= size {
+		return true, nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(sm.activeFile, ref.Offset, size-ref.Offset))
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to read segment %d: %w", sm.activeId, err)
+		}
+		if b != 0 {
+			return false, nil
+		}
+	}
+}
+
+// Recovery returns the report of the crash recovery performed when the manager was opened.
+func (sm *SegmentManager) Recovery() RecoveryReport {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.recovery
+}
+
+// Contains reports whether ref lies within the data currently stored in its segment.
+func (sm *SegmentManager) Contains(ref RecordRef) bool {
+	return ref.Offset+int64(ref.Length) <= sm.End(ref.FileID)
+}
+
+// End returns the length of the data stored in segment id, or 0 if it does not exist.
+func (sm *SegmentManager) End(id uint32) int64 {
+	sm.mu.RLock()
+	if id == sm.activeId {
+		defer sm.mu.RUnlock()
+		return sm.activeOffset
+	}
+	sm.mu.RUnlock()
+
+	stat, err := os.Stat(sm.segmentPath(id))
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
+
+func (sm *SegmentManager) segmentPath(id uint32) string {
+	return filepath.Join(sm.dir, fmt.Sprintf("%08d.seg", id))
+}
+
+// segmentIDs lists the IDs of the segment files on disk in ascending order.
+func (sm *SegmentManager) segmentIDs() ([]uint32, error) {
+	entries, err := os.ReadDir(sm.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read segment directory: %w", err)
+	}
+
+	var ids []uint32
+	for _, entry := range entries {
+		var id uint32
+		if _, err := fmt.Sscanf(entry.Name(), "%08d.seg", &id); err == nil && id > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// SealedSegments returns the IDs of all read-only segments, oldest first.
+func (sm *SegmentManager) SealedSegments() ([]uint32, error) {
+	sm.mu.RLock()
+	activeId := sm.activeId
+	sm.mu.RUnlock()
+
+	ids, err := sm.segmentIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var sealed []uint32
+	for _, id := range ids {
+		if id < activeId && !sm.isObsolete(id) {
+			sealed = append(sealed, id)
+		}
+	}
+	return sealed, nil
+}
+
 // Append writes raw payload bytes sequentially to the active segment file.
 func (sm *SegmentManager) Append(data []byte) (RecordRef, error) {
 	sm.mu.Lock()
@@ -101,6 +261,71 @@ func (sm *SegmentManager) Append(data []byte) (RecordRef, error) {
 	return ref, nil
 }
 
+// AppendBatch writes groups of payloads to the active segment, issuing one write
+// per segment touched. The payloads of a group are always written to the same
+// segment so that a transaction never spans a rollover.
+func (sm *SegmentManager) AppendBatch(groups [][][]byte) ([][]RecordRef, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	refs := make([][]RecordRef, len(groups))
+	var buf []byte
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		n, err := sm.activeFile.Write(buf)
+		sm.activeOffset += int64(n)
+		if err != nil {
+			return fmt.Errorf("failed to write to segment %d: %w", sm.activeId, err)
+		}
+		buf = buf[:0]
+		return nil
+	}
+
+	for i, group := range groups {
+		var groupLen int64
+		for _, payload := range group {
+			groupLen += int64(len(payload))
+		}
+		pendingEnd := sm.activeOffset + int64(len(buf))
+		if pendingEnd > 0 && pendingEnd+groupLen > sm.maxSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			if err := sm.rollOver(); err != nil {
+				return nil, err
+			}
+		}
+
+		refs[i] = make([]RecordRef, len(group))
+		for j, payload := range group {
+			refs[i][j] = RecordRef{
+				FileID: sm.activeId,
+				Offset: sm.activeOffset + int64(len(buf)),
+				Length: uint32(len(payload)),
+			}
+			buf = append(buf, payload...)
+		}
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// Sync flushes the active segment file to stable storage.
+func (sm *SegmentManager) Sync() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if err := sm.activeFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync segment %d: %w", sm.activeId, err)
+	}
+	return nil
+}
+
 func (sm *SegmentManager) rollOver() error {
 	// Sync active file before roll over
 	if err := sm.activeFile.Sync(); err != nil {
@@ -108,65 +333,266 @@ func (sm *SegmentManager) rollOver() error {
 	}
 
 	sm.activeId++
-	activePath := filepath.Join(sm.dir, fmt.Sprintf("%08d.seg", sm.activeId))
-	file, err := os.OpenFile(activePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	file, err := os.OpenFile(sm.segmentPath(sm.activeId), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to open new segment %d: %w", sm.activeId, err)
 	}
 	sm.activeFile = file
-	sm.files[sm.activeId] = file
+	sm.files[sm.activeId] = &segmentFile{file: file}
 	sm.activeOffset = 0
 
 	return nil
 }
 
-// Read reads and returns raw payload bytes from a specific segment coordinate.
-func (sm *SegmentManager) Read(ref RecordRef) ([]byte, error) {
+// acquire returns the open handle for a segment, opening it lazily, and registers
+// an in-flight reader. Callers must call readers.Done() when finished.
+func (sm *SegmentManager) acquire(id uint32) (*segmentFile, error) {
 	sm.mu.RLock()
-	file, exists := sm.files[ref.FileID]
+	sf, exists := sm.files[id]
+	if exists {
+		sf.readers.Add(1)
+		sm.mu.RUnlock()
+		return sf, nil
+	}
 	sm.mu.RUnlock()
 
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	// Double check under write lock
+	sf, exists = sm.files[id]
 	if !exists {
-		sm.mu.Lock()
-		// Double check under write lock
-		file, exists = sm.files[ref.FileID]
-		if !exists {
-			filePath := filepath.Join(sm.dir, fmt.Sprintf("%08d.seg", ref.FileID))
-			var err error
-			file, err = os.OpenFile(filePath, os.O_RDONLY, 0644)
-			if err != nil {
-				sm.mu.Unlock()
-				return nil, fmt.Errorf("failed to open segment file %d: %w", ref.FileID, err)
-			}
-			sm.files[ref.FileID] = file
+		file, err := os.OpenFile(sm.segmentPath(id), os.O_RDONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open segment file %d: %w", id, err)
 		}
-		sm.mu.Unlock()
+		sf = &segmentFile{file: file}
+		sm.files[id] = sf
+	}
+	sf.readers.Add(1)
+	return sf, nil
+}
+
+// Read reads and returns raw payload bytes from a specific segment coordinate.
+func (sm *SegmentManager) Read(ref RecordRef) ([]byte, error) {
+	sf, err := sm.acquire(ref.FileID)
+	if err != nil {
+		return nil, err
 	}
+	defer sf.readers.Done()
 
 	buf := make([]byte, ref.Length)
-	_, err := file.ReadAt(buf, ref.Offset)
-	if err != nil {
+	if _, err := sf.file.ReadAt(buf, ref.Offset); err != nil {
 		return nil, fmt.Errorf("failed to read from segment %d at offset %d: %w", ref.FileID, ref.Offset, err)
 	}
 
 	return buf, nil
 }
 
-// Close closes all open segment files.
-func (sm *SegmentManager) Close() error {
+// ReadRecord reads the record at a segment coordinate and validates its checksum.
+// Records that fail validation are reported as a *CorruptionError.
+func (sm *SegmentManager) ReadRecord(ref RecordRef) (Record, error) {
+	buf, err := sm.Read(ref)
+	if err != nil {
+		return Record{}, err
+	}
+
+	record, err := decodeRecord(buf)
+	if err != nil {
+		return Record{}, &CorruptionError{Ref: ref, Reason: err.Error()}
+	}
+	return record, nil
+}
+
+// Iterate streams every record in the segment files in file/offset order, invoking fn
+// with each record's coordinate and decoded contents. A truncated record at the end of
+// a segment ends iteration of that segment, while a record failing validation aborts
+// iteration with a *CorruptionError. Iteration stops at the first error from fn.
+func (sm *SegmentManager) Iterate(fn func(ref RecordRef, record Record) error) error {
+	ids, err := sm.segmentIDs()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := sm.IterateSegment(id, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IterateSegment streams the records of a single segment in offset order.
+func (sm *SegmentManager) IterateSegment(id uint32, fn func(ref RecordRef, record Record) error) error {
+	file, err := os.Open(sm.segmentPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open segment file %d: %w", id, err)
+	}
+	defer file.Close()
+
+	_, err = scanSegment(file, id, fn)
+	return err
+}
+
+// scanSegment reads records from the start of file until EOF, returning the offset
+// just past the last complete, valid record. A truncated record at the tail stops the
+// scan without error; a complete record that fails validation returns a
+// *CorruptionError.
+func scanSegment(file *os.File, id uint32, fn func(ref RecordRef, record Record) error) (int64, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat segment %d: %w", id, err)
+	}
+	size := stat.Size()
+
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, size))
+	var offset int64
+	for {
+		length, err := recordFrameLen(reader)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return offset, nil // EOF or torn header
+		}
+		ref := RecordRef{FileID: id, Offset: offset, Length: uint32(length)}
+		if err != nil {
+			return offset, &CorruptionError{Ref: ref, Reason: err.Error()}
+		}
+		if offset+length > size {
+			return offset, nil // Torn record at the tail
+		}
+
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return offset, fmt.Errorf("failed to read segment %d at offset %d: %w", id, offset, err)
+		}
+
+		record, err := decodeRecord(buf)
+		if err != nil {
+			return offset, &CorruptionError{Ref: ref, Reason: err.Error()}
+		}
+		if fn != nil {
+			if err := fn(ref, record); err != nil {
+				return offset, err
+			}
+		}
+		offset += length
+	}
+}
+
+// Remove marks a sealed segment as obsolete after its live records were relocated.
+// The file stays readable until PurgeObsolete, giving readers holding refs into it
+// a grace period, and for as long as a pin taken before the removal is held.
+func (sm *SegmentManager) Remove(id uint32) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if id >= sm.activeId {
+		return fmt.Errorf("cannot remove active segment %d", id)
+	}
+	sm.obsolete = append(sm.obsolete, obsoleteSegment{id: id, pinGen: sm.pinGen})
+	return nil
+}
+
+// Pin keeps every segment existing now on disk until the returned release function
+// is called, even if it is removed in the meantime. Release is idempotent.
+func (sm *SegmentManager) Pin() (release func()) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
+	sm.pinGen++
+	gen := sm.pinGen
+	sm.pins[gen] = true
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			sm.mu.Lock()
+			delete(sm.pins, gen)
+			sm.mu.Unlock()
+		})
+	}
+}
+
+func (sm *SegmentManager) isObsolete(id uint32) bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	for _, o := range sm.obsolete {
+		if o.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// pinned reports whether a pin taken up to gen is still held. Must hold sm.mu.
+func (sm *SegmentManager) pinned(gen uint64) bool {
+	for pin := range sm.pins {
+		if pin <= gen {
+			return true
+		}
+	}
+	return false
+}
+
+// PurgeObsolete deletes segments previously passed to Remove that are no longer
+// pinned. Open handles are closed once their in-flight reads complete.
+func (sm *SegmentManager) PurgeObsolete() error {
+	return sm.purge(false)
+}
+
+func (sm *SegmentManager) purge(force bool) error {
+	sm.mu.Lock()
+	var ids []uint32
+	var kept []obsoleteSegment
+	for _, o := range sm.obsolete {
+		if !force && sm.pinned(o.pinGen) {
+			kept = append(kept, o)
+			continue
+		}
+		ids = append(ids, o.id)
+	}
+	sm.obsolete = kept
+	var handles []*segmentFile
+	for _, id := range ids {
+		if sf, exists := sm.files[id]; exists {
+			handles = append(handles, sf)
+			delete(sm.files, id)
+		}
+	}
+	sm.mu.Unlock()
+
 	var firstErr error
-	for id, file := range sm.files {
-		if file == sm.activeFile {
-			file.Sync()
+	for _, id := range ids {
+		if err := os.Remove(sm.segmentPath(id)); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = fmt.Errorf("failed to remove segment %d: %w", id, err)
+		}
+	}
+	for _, sf := range handles {
+		sf.readers.Wait()
+		sf.file.Close()
+	}
+	return firstErr
+}
+
+// Close deletes all obsolete segments, pinned or not, and closes all open segment files.
+func (sm *SegmentManager) Close() error {
+	firstErr := sm.purge(true)
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for id, sf := range sm.files {
+		if sf.file == sm.activeFile {
+			sf.file.Sync()
 		}
-		if err := file.Close(); err != nil && firstErr == nil {
+		if err := sf.file.Close(); err != nil && firstErr == nil {
 			firstErr = fmt.Errorf("failed to close segment %d: %w", id, err)
 		}
 	}
-	sm.files = make(map[uint32]*os.File)
+	sm.files = make(map[uint32]*segmentFile)
 	sm.activeFile = nil
 	return firstErr
 }
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
@@ -129,3 +130,150 @@ func TestSegmentManagerConcurrency(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestSegmentManagerTornTailRecovery(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "segment_test_recovery")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sm, err := NewSegmentManager(tmpDir, 4096)
+	if err != nil {
+		t.Fatalf("failed to create SegmentManager: %v", err)
+	}
+
+	var refs []RecordRef
+	for i := 0; i < 5; i++ {
+		ref, err := sm.Append(encodeRecord(RecordWrite, 0, fmt.Sprintf("key-%d", i), "value"))
+		if err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+		refs = append(refs, ref)
+	}
+
+	// Simulate a crash midway through writing the next record
+	torn := encodeRecord(RecordWrite, 0, "torn", "half-written value")
+	sm.Append(torn[:len(torn)/2])
+	sm.Close()
+
+	sm2, err := NewSegmentManager(tmpDir, 4096)
+	if err != nil {
+		t.Fatalf("failed to reopen SegmentManager: %v", err)
+	}
+	defer sm2.Close()
+
+	report := sm2.Recovery()
+	validEnd := refs[4].Offset + int64(refs[4].Length)
+	if report.SegmentID != 1 || report.ValidBytes != validEnd || report.DiscardedBytes != int64(len(torn)/2) {
+		t.Errorf("unexpected recovery report: %+v (expected valid=%d, discarded=%d)", report, validEnd, len(torn)/2)
+	}
+
+	stat, err := os.Stat(sm2.segmentPath(1))
+	if err != nil || stat.Size() != validEnd {
+		t.Errorf("expected segment 1 to be truncated to %d bytes, got %d (err=%v)", validEnd, stat.Size(), err)
+	}
+
+	for i, ref := range refs {
+		record, err := sm2.ReadRecord(ref)
+		if err != nil || string(record.Key) != fmt.Sprintf("key-%d", i) {
+			t.Errorf("record %d unreadable after recovery: %+v (err=%v)", i, record, err)
+		}
+	}
+
+	// The truncated segment is sealed so its offsets are never reused
+	ref, err := sm2.Append(encodeRecord(RecordWrite, 0, "after", "recovery"))
+	if err != nil {
+		t.Fatalf("failed to append after recovery: %v", err)
+	}
+	if ref.FileID != 2 || ref.Offset != 0 {
+		t.Errorf("expected post-recovery append at {2 0}, got %+v", ref)
+	}
+	if sm2.Contains(RecordRef{FileID: 1, Offset: validEnd, Length: uint32(len(torn))}) {
+		t.Errorf("expected ref into the discarded tail to be reported as missing")
+	}
+}
+
+func TestSegmentManagerZeroFilledTailRecovery(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "segment_test_zero_tail")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sm, err := NewSegmentManager(tmpDir, 4096)
+	if err != nil {
+		t.Fatalf("failed to create SegmentManager: %v", err)
+	}
+	ref, err := sm.Append(encodeRecord(RecordWrite, 0, "key", "value"))
+	if err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+
+	// A crash after the file was extended but before the data was written leaves
+	// zeros, which would otherwise parse as empty-keyed legacy records
+	sm.Append(make([]byte, 64))
+	sm.Close()
+
+	sm2, err := NewSegmentManager(tmpDir, 4096)
+	if err != nil {
+		t.Fatalf("failed to reopen SegmentManager: %v", err)
+	}
+	defer sm2.Close()
+
+	validEnd := ref.Offset + int64(ref.Length)
+	if report := sm2.Recovery(); report.ValidBytes != validEnd || report.DiscardedBytes != 64 {
+		t.Errorf("unexpected recovery report: %+v (expected valid=%d, discarded=64)", report, validEnd)
+	}
+
+	var keys []string
+	sm2.Iterate(func(ref RecordRef, record Record) error {
+		keys = append(keys, string(record.Key))
+		return nil
+	})
+	if len(keys) != 1 || keys[0] != "key" {
+		t.Errorf("expected only the written record to be replayed, got %q", keys)
+	}
+}
+
+func TestSegmentManagerMidSegmentCorruption(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "segment_test_corruption")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sm, err := NewSegmentManager(tmpDir, 4096)
+	if err != nil {
+		t.Fatalf("failed to create SegmentManager: %v", err)
+	}
+	var refs []RecordRef
+	for i := 0; i < 5; i++ {
+		ref, err := sm.Append(encodeRecord(RecordWrite, 0, fmt.Sprintf("key-%d", i), "value"))
+		if err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+		refs = append(refs, ref)
+	}
+	sm.Close()
+
+	// Flip a byte inside the third record, leaving valid records after it
+	path := sm.segmentPath(1)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read segment: %v", err)
+	}
+	data[refs[2].Offset+int64(refs[2].Length)-6] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write segment: %v", err)
+	}
+
+	_, err = NewSegmentManager(tmpDir, 4096)
+	var corrupt *CorruptionError
+	if !errors.As(err, &corrupt) || corrupt.Ref.Offset != refs[2].Offset {
+		t.Fatalf("expected a CorruptionError at offset %d, got %v", refs[2].Offset, err)
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Size() != int64(len(data)) {
+		t.Errorf("expected the corrupt segment to be left intact at %d bytes, got %d (err=%v)", len(data), stat.Size(), err)
+	}
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrSnapshotReleased    = errors.New("snapshot has been released")
+	ErrSnapshotUnsupported = errors.New("primary index does not support snapshots")
+)
+
+// Snapshot is a consistent, read-only view of the database as of its creation.
+// Writes committed afterwards are invisible to it.
+//
+// Reads go to a snapshot of the primary index (see SnapshotIndex), which keeps the
+// versions of its entries the snapshot can see until it is released. The segments
+// holding those versions are pinned as well, so value-log GC does not delete them
+// in the meantime.
+type Snapshot struct {
+	db       *DB
+	snap     IndexSnapshot
+	unpin    func()
+	release  sync.Once
+	released bool
+	mu       sync.RWMutex
+}
+
+// Snapshot returns a point-in-time view of the database. Release must be called
+// when it is no longer needed. It returns ErrSnapshotUnsupported if the primary
+// index does not implement SnapshotIndex.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+	primary, ok := db.indexes["primary"].(SnapshotIndex)
+	if !ok {
+		return nil, ErrSnapshotUnsupported
+	}
+
+	// Holding db.mu keeps value-log GC from relocating records between the two steps
+	snap, err := primary.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{
+		db:    db,
+		snap:  snap,
+		unpin: db.segmentMgr.Pin(),
+	}, nil
+}
+
+// Release frees the versions and segments held for the snapshot. It is idempotent.
+func (s *Snapshot) Release() {
+	s.release.Do(func() {
+		s.mu.Lock()
+		s.released = true
+		s.mu.Unlock()
+
+		s.snap.Release()
+		s.unpin()
+	})
+}
+
+// Get returns the value of key as of the snapshot.
+func (s *Snapshot) Get(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.released || key == "" {
+		return "", false
+	}
+
+	db := s.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return "", false
+	}
+
+	// 1. Query the snapshot of the primary index for coordinate
+	ref, found, err := s.snap.Get([]byte(key))
+	if err != nil || !found {
+		return "", false
+	}
+
+	// 2. Fetch value from Segment Manager using coordinate
+	record, err := db.segmentMgr.ReadRecord(ref)
+	if err != nil {
+		return "", false
+	}
+	return recordValue(record), true
+}
+
+// Scan returns all key-value pairs whose keys match prefix as of the snapshot.
+func (s *Snapshot) Scan(prefix string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+
+	db := s.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	it, err := s.snap.NewIterator(PrefixBounds([]byte(prefix)))
+	if err != nil {
+		return nil, err
+	}
+	var refs []RecordRef
+	for ok := it.First(); ok; ok = it.Next() {
+		refs = append(refs, it.Value())
+	}
+	err = it.Error()
+	it.Close()
+	if err != nil {
+		return nil, err
+	}
+	return db.resolve(refs)
+}
+
+// NewIterator returns an iterator over the keys of the primary index restricted to
+// opts, as of the snapshot. Like DB.NewIterator it pins the segment log until it is
+// closed, so it may outlive the snapshot.
+func (s *Snapshot) NewIterator(opts IterOptions) (*Iterator, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+
+	db := s.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	it, err := s.snap.NewIterator(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{
+		it:    it,
+		db:    db,
+		unpin: db.segmentMgr.Pin(),
+	}, nil
+}
@@ -0,0 +1,149 @@
+package storage_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/raman20/index/lsm"
+	"github.com/raman20/storage"
+)
+
+func TestSnapshotPointInTimeReads(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "db_snapshot_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Segments roll over every 2KB so GC has sealed segments to rewrite
+	db, _ := openCommitTestDB(t, tmpDir, storage.Options{MemtableSize: 1024, CompactionThreshold: 3})
+	defer db.Close()
+
+	for i := 0; i < 40; i++ {
+		db.Set(fmt.Sprintf("key_%02d", i), fmt.Sprintf("first_version_of_the_value_%02d", i))
+	}
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to take snapshot: %v", err)
+	}
+	defer snap.Release()
+
+	// 1. Writes after the snapshot are invisible to it
+	for i := 0; i < 40; i++ {
+		db.Set(fmt.Sprintf("key_%02d", i), fmt.Sprintf("second_version_of_the_value_%02d", i))
+	}
+	db.Delete("key_07")
+	db.Set("key_99", "created after the snapshot")
+
+	verify := func() {
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("key_%02d", i)
+			expected := fmt.Sprintf("first_version_of_the_value_%02d", i)
+			if val, ok := snap.Get(key); !ok || val != expected {
+				t.Errorf("snapshot %s: expected %q, got %q (found=%v)", key, expected, val, ok)
+			}
+		}
+		if _, ok := snap.Get("key_99"); ok {
+			t.Errorf("key created after the snapshot is visible to it")
+		}
+		results, err := snap.Scan("key_")
+		if err != nil {
+			t.Fatalf("failed to scan snapshot: %v", err)
+		}
+		if len(results) != 40 || results["key_07"] != "first_version_of_the_value_07" {
+			t.Errorf("expected 40 snapshot keys including key_07, got %d (key_07=%q)", len(results), results["key_07"])
+		}
+
+		it, err := snap.NewIterator(storage.IterOptions{LowerBound: []byte("key_05"), UpperBound: []byte("key_z")})
+		if err != nil {
+			t.Fatalf("failed to create snapshot iterator: %v", err)
+		}
+		defer it.Close()
+		n := 5
+		for ok := it.First(); ok; ok = it.Next() {
+			key, expected := fmt.Sprintf("key_%02d", n), fmt.Sprintf("first_version_of_the_value_%02d", n)
+			if it.Key() != key || it.Value() != expected {
+				t.Errorf("snapshot iterator: expected %s=%q, got %s=%q", key, expected, it.Key(), it.Value())
+			}
+			n++
+		}
+		if err := it.Error(); err != nil || n != 40 {
+			t.Errorf("expected the snapshot iterator to stop after key_39, stopped at key_%02d (err=%v)", n, err)
+		}
+	}
+	verify()
+
+	if val, _ := db.Get("key_00"); val != "second_version_of_the_value_00" {
+		t.Errorf("expected live read of the new version, got %q", val)
+	}
+
+	// 2. Value-log GC keeps the segments holding snapshot versions while it is open
+	segmentPath := filepath.Join(tmpDir, "test_commit_db", "segments")
+	if n, err := db.RunValueLogGC(0.5); err != nil || n == 0 {
+		t.Fatalf("expected GC to rewrite segments, rewrote %d (err=%v)", n, err)
+	}
+	pinned := countSegments(t, segmentPath)
+	if _, err := db.RunValueLogGC(0.5); err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if after := countSegments(t, segmentPath); after < pinned {
+		t.Errorf("GC purged segments pinned by a snapshot: had %d, now %d", pinned, after)
+	}
+	verify()
+
+	// 3. Released snapshots stop pinning segments and reading
+	snap.Release()
+	if _, err := snap.Scan("key_"); err != storage.ErrSnapshotReleased {
+		t.Errorf("expected ErrSnapshotReleased, got %v", err)
+	}
+	if _, err := snap.NewIterator(storage.IterOptions{}); err != storage.ErrSnapshotReleased {
+		t.Errorf("expected ErrSnapshotReleased from NewIterator, got %v", err)
+	}
+	if _, err := db.RunValueLogGC(0.5); err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if after := countSegments(t, segmentPath); after >= pinned {
+		t.Errorf("expected segments to be purged after release, had %d, now %d", pinned, after)
+	}
+	if val, ok := db.Get("key_07"); ok {
+		t.Errorf("deleted key resurrected after GC: %q", val)
+	}
+	if val, _ := db.Get("key_10"); val != "second_version_of_the_value_10" {
+		t.Errorf("expected live value after GC, got %q", val)
+	}
+}
+
+func TestSnapshotRequiresSnapshotIndex(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "db_snapshot_unsupported_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := storage.Options{MemtableSize: 1024, DataDir: tmpDir}
+	walPath := filepath.Join(tmpDir, "test_commit_db", "wal")
+	sstPath := filepath.Join(tmpDir, "test_commit_db", "sst")
+	os.MkdirAll(walPath, 0755)
+	os.MkdirAll(sstPath, 0755)
+
+	lsmIdx, err := lsm.NewLSMIndex(walPath, sstPath, opts)
+	if err != nil {
+		t.Fatalf("failed to create LSM index: %v", err)
+	}
+	// countingIndex hides every method of the LSM index outside storage.Index
+	db, err := storage.Open("test_commit_db", opts, &countingIndex{Index: lsmIdx})
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Snapshot(); err != storage.ErrSnapshotUnsupported {
+		t.Errorf("expected ErrSnapshotUnsupported, got %v", err)
+	}
+	if _, err := db.Begin(); err != storage.ErrSnapshotUnsupported {
+		t.Errorf("expected ErrSnapshotUnsupported from Begin, got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// SyncMode selects when appended log data is flushed to stable storage.
+type SyncMode int
+
+const (
+	// SyncDefault derives the mode from Options.SyncWrites: SyncAlways when set,
+	// SyncNone otherwise.
+	SyncDefault SyncMode = iota
+	// SyncAlways fsyncs after every write before it is acknowledged.
+	SyncAlways
+	// SyncGroup acknowledges writes immediately and fsyncs once SyncBatchSize writes
+	// are pending or SyncInterval has elapsed, whichever comes first. A crash loses
+	// at most one batch or interval worth of writes.
+	SyncGroup
+	// SyncNone leaves flushing to the OS page cache. Writes survive a process crash
+	// but not a power failure; logs are only fsynced on rollover and close.
+	SyncNone
+)
+
+const defaultSyncInterval = 10 * time.Millisecond
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncAlways:
+		return "always"
+	case SyncGroup:
+		return "group"
+	case SyncNone:
+		return "none"
+	default:
+		return "default"
+	}
+}
+
+// SyncPolicy is the resolved durability policy applied to the segment log and to
+// index WALs.
+type SyncPolicy struct {
+	Mode      SyncMode
+	Interval  time.Duration // SyncGroup: maximum time a write stays unsynced
+	BatchSize int           // SyncGroup: number of pending writes that forces a sync
+}
+
+// SyncPolicy resolves the durability settings in o.
+func (o Options) SyncPolicy() SyncPolicy {
+	policy := SyncPolicy{Mode: o.SyncMode, Interval: o.SyncInterval, BatchSize: o.SyncBatchSize}
+	if policy.Mode == SyncDefault {
+		policy.Mode = SyncNone
+		if o.SyncWrites {
+			policy.Mode = SyncAlways
+		}
+	}
+	if policy.Mode == SyncGroup && policy.Interval <= 0 && policy.BatchSize <= 0 {
+		policy.Interval = defaultSyncInterval
+	}
+	return policy
+}
+
+// logSyncer applies a SyncPolicy to an append-only log. Writers call commit after
+// each write; syncFn performs the actual fsync and must be safe to call concurrently
+// with writes.
+type logSyncer struct {
+	policy  SyncPolicy
+	syncFn  func() error
+	mu      sync.Mutex
+	pending int   // Writes acknowledged since the last sync
+	err     error // A failed fsync leaves the log in an unknown state, so it sticks
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newLogSyncer(policy SyncPolicy, syncFn func() error) *logSyncer {
+	s := &logSyncer{policy: policy, syncFn: syncFn}
+	if policy.Mode == SyncGroup && policy.Interval > 0 {
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.loop(s.stop)
+	}
+	return s
+}
+
+// commit records completed writes and syncs if the policy (or force) requires it.
+// A group of writes committed together is covered by a single sync.
+func (s *logSyncer) commit(writes int, force bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	s.pending += writes
+
+	switch {
+	case force, s.policy.Mode == SyncAlways:
+	case s.policy.Mode == SyncGroup && s.policy.BatchSize > 0 && s.pending >= s.policy.BatchSize:
+	default:
+		return nil
+	}
+	return s.syncLocked()
+}
+
+// sync flushes any pending writes regardless of the policy.
+func (s *logSyncer) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	return s.syncLocked()
+}
+
+func (s *logSyncer) syncLocked() error {
+	if s.pending == 0 {
+		return nil
+	}
+	if err := s.syncFn(); err != nil {
+		s.err = err
+		return err
+	}
+	s.pending = 0
+	return nil
+}
+
+func (s *logSyncer) loop(stop <-chan struct{}) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sync()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// close stops the background syncer. It does not sync; the log's own Close does.
+func (s *logSyncer) close() {
+	s.mu.Lock()
+	stop := s.stop
+	s.stop = nil
+	s.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-s.done
+	}
+}
+
+// WriteOption customizes a single write.
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	sync bool
+}
+
+// WithSync makes a write durable before it returns, overriding the configured
+// SyncPolicy for that call.
+func WithSync() WriteOption {
+	return func(o *writeOptions) {
+		o.sync = true
+	}
+}
+
+func applyWriteOptions(opts []WriteOption) writeOptions {
+	var wo writeOptions
+	for _, opt := range opts {
+		opt(&wo)
+	}
+	return wo
+}
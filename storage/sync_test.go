@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOptionsSyncPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want SyncPolicy
+	}{
+		{"sync writes", Options{SyncWrites: true}, SyncPolicy{Mode: SyncAlways}},
+		{"buffered", Options{SyncWrites: false}, SyncPolicy{Mode: SyncNone}},
+		{"explicit mode wins", Options{SyncWrites: true, SyncMode: SyncNone}, SyncPolicy{Mode: SyncNone}},
+		{"group default interval", Options{SyncMode: SyncGroup}, SyncPolicy{Mode: SyncGroup, Interval: defaultSyncInterval}},
+		{"group batch only", Options{SyncMode: SyncGroup, SyncBatchSize: 8}, SyncPolicy{Mode: SyncGroup, BatchSize: 8}},
+	}
+
+	for _, tt := range tests {
+		if got := tt.opts.SyncPolicy(); got != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestLogSyncerModes(t *testing.T) {
+	var syncs atomic.Int32
+	syncFn := func() error {
+		syncs.Add(1)
+		return nil
+	}
+
+	// 1. Always: one sync per commit
+	s := newLogSyncer(SyncPolicy{Mode: SyncAlways}, syncFn)
+	for i := 0; i < 5; i++ {
+		s.commit(1, false)
+	}
+	s.close()
+	if n := syncs.Swap(0); n != 5 {
+		t.Errorf("SyncAlways: expected 5 syncs, got %d", n)
+	}
+
+	// 2. None: only forced commits sync
+	s = newLogSyncer(SyncPolicy{Mode: SyncNone}, syncFn)
+	for i := 0; i < 5; i++ {
+		s.commit(1, false)
+	}
+	s.commit(1, true)
+	s.close()
+	if n := syncs.Swap(0); n != 1 {
+		t.Errorf("SyncNone: expected 1 forced sync, got %d", n)
+	}
+
+	// 3. Group by batch size
+	s = newLogSyncer(SyncPolicy{Mode: SyncGroup, BatchSize: 4}, syncFn)
+	for i := 0; i < 10; i++ {
+		s.commit(1, false)
+	}
+	if n := syncs.Load(); n != 2 {
+		t.Errorf("SyncGroup batch: expected 2 syncs after 10 commits, got %d", n)
+	}
+	s.sync()
+	s.sync() // Nothing pending
+	s.close()
+	if n := syncs.Swap(0); n != 3 {
+		t.Errorf("SyncGroup batch: expected explicit sync to flush the remainder, got %d syncs", n)
+	}
+
+	// 4. Group by interval
+	s = newLogSyncer(SyncPolicy{Mode: SyncGroup, Interval: time.Millisecond}, syncFn)
+	s.commit(1, false)
+	deadline := time.Now().Add(time.Second)
+	for syncs.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	s.close()
+	if n := syncs.Load(); n != 1 {
+		t.Errorf("SyncGroup interval: expected background sync, got %d syncs", n)
+	}
+}
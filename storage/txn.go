@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrTxnConflict = errors.New("transaction conflicts with a concurrent commit")
+	ErrTxnDone     = errors.New("transaction has already been committed or rolled back")
+)
+
+// Txn is an interactive read-write transaction with snapshot isolation. Reads see
+// the database as of Begin plus the transaction's own writes, which are buffered
+// until Commit. Commit fails with ErrTxnConflict if another writer committed any of
+// the transaction's keys after Begin (first committer wins), in which case nothing
+// is written and the caller may retry. A Txn is not safe for concurrent use.
+type Txn struct {
+	db       *DB
+	snapshot *Snapshot
+	writes   []write
+	latest   map[string]int // Index in writes of the last write to each key
+	done     bool
+}
+
+// Begin starts a transaction reading from a snapshot of the current state. Every
+// transaction must end with Commit or Rollback to release its snapshot.
+func (db *DB) Begin() (*Txn, error) {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Txn{
+		db:       db,
+		snapshot: snap,
+		latest:   make(map[string]int),
+	}, nil
+}
+
+// Get returns the value of key as seen by the transaction.
+func (t *Txn) Get(key string) (string, bool) {
+	if t.done || key == "" {
+		return "", false
+	}
+	if i, buffered := t.latest[key]; buffered {
+		w := t.writes[i]
+		return w.value, w.recType != RecordTombstone
+	}
+	return t.snapshot.Get(key)
+}
+
+// Set buffers a key-value write.
+func (t *Txn) Set(key string, value string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if key == "" {
+		return ErrKeyEmpty
+	}
+	t.buffer(write{recType: RecordWrite, key: []byte(key), value: value})
+	return nil
+}
+
+// Delete buffers the deletion of a key.
+func (t *Txn) Delete(key string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if key == "" {
+		return ErrKeyEmpty
+	}
+	t.buffer(write{recType: RecordTombstone, key: []byte(key)})
+	return nil
+}
+
+func (t *Txn) buffer(w write) {
+	t.latest[string(w.key)] = len(t.writes)
+	t.writes = append(t.writes, w)
+}
+
+// Scan returns all key-value pairs whose keys match prefix as seen by the transaction.
+func (t *Txn) Scan(prefix string) (map[string]string, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+
+	results, err := t.snapshot.Scan(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for key, i := range t.latest {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if w := t.writes[i]; w.recType == RecordTombstone {
+			delete(results, key)
+		} else {
+			results[key] = w.value
+		}
+	}
+	return results, nil
+}
+
+// Commit atomically applies the transaction's writes, as DB.Write does for a
+// WriteBatch, unless one of its keys was committed by another writer since Begin.
+func (t *Txn) Commit(opts ...WriteOption) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	defer t.snapshot.Release()
+
+	if len(t.writes) == 0 {
+		return nil
+	}
+	return t.db.submit(&commitRequest{
+		writes:         t.writes,
+		sync:           applyWriteOptions(opts).sync,
+		checkConflicts: true,
+		snapshot:       t.snapshot.snap,
+	})
+}
+
+// Rollback discards the transaction's writes. It returns ErrTxnDone if the
+// transaction already ended, so it is safe to defer after Begin.
+func (t *Txn) Rollback() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	t.snapshot.Release()
+	return nil
+}
@@ -0,0 +1,145 @@
+package storage_test
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/raman20/storage"
+)
+
+func TestTxnSnapshotIsolation(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "db_txn_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, _ := openCommitTestDB(t, tmpDir, storage.Options{MemtableSize: 1024 * 1024, CompactionThreshold: 4})
+	defer db.Close()
+
+	db.Set("acct:a", "100")
+	db.Set("acct:b", "50")
+	db.Set("acct:c", "25")
+
+	// 1. Reads come from the snapshot taken at Begin
+	txn, err := db.Begin()
+	if err != nil {
+		t.Fatalf("failed to begin: %v", err)
+	}
+	db.Set("acct:a", "999")
+	db.Set("acct:d", "new")
+	db.Delete("acct:c")
+
+	if val, ok := txn.Get("acct:a"); !ok || val != "100" {
+		t.Errorf("expected snapshot value 100, got %q (found=%v)", val, ok)
+	}
+	if _, ok := txn.Get("acct:d"); ok {
+		t.Errorf("key created after Begin is visible to the transaction")
+	}
+	if val, ok := txn.Get("acct:c"); !ok || val != "25" {
+		t.Errorf("key deleted after Begin is not visible to the transaction: %q (found=%v)", val, ok)
+	}
+
+	// 2. The transaction sees its own writes
+	txn.Set("acct:b", "40")
+	txn.Delete("acct:a")
+	txn.Set("acct:e", "10")
+	results, err := txn.Scan("acct:")
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	expected := map[string]string{"acct:b": "40", "acct:c": "25", "acct:e": "10"}
+	if len(results) != len(expected) {
+		t.Errorf("expected scan %v, got %v", expected, results)
+	}
+	for k, v := range expected {
+		if results[k] != v {
+			t.Errorf("scan %s: expected %q, got %q", k, v, results[k])
+		}
+	}
+	if _, ok := db.Get("acct:e"); ok {
+		t.Errorf("uncommitted write is visible outside the transaction")
+	}
+
+	// 3. acct:a was committed by someone else after Begin, so the commit fails
+	if err := txn.Commit(); !errors.Is(err, storage.ErrTxnConflict) {
+		t.Fatalf("expected ErrTxnConflict, got %v", err)
+	}
+	if val, _ := db.Get("acct:b"); val != "50" {
+		t.Errorf("conflicting transaction partially applied: acct:b=%q", val)
+	}
+	if err := txn.Rollback(); err != storage.ErrTxnDone {
+		t.Errorf("expected ErrTxnDone after commit, got %v", err)
+	}
+
+	// 4. Disjoint writes commit, rolled back writes never do
+	txn, _ = db.Begin()
+	db.Set("acct:a", "1000")
+	txn.Set("acct:b", "45")
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("expected non-conflicting commit to succeed: %v", err)
+	}
+	if val, _ := db.Get("acct:b"); val != "45" {
+		t.Errorf("expected committed value 45, got %q", val)
+	}
+
+	txn, _ = db.Begin()
+	txn.Set("acct:b", "0")
+	txn.Rollback()
+	if val, _ := db.Get("acct:b"); val != "45" {
+		t.Errorf("rolled back write applied: acct:b=%q", val)
+	}
+	if err := txn.Set("acct:b", "1"); err != storage.ErrTxnDone {
+		t.Errorf("expected ErrTxnDone after rollback, got %v", err)
+	}
+}
+
+func TestTxnConcurrentIncrements(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "db_txn_counter_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, _ := openCommitTestDB(t, tmpDir, storage.Options{MemtableSize: 1024 * 1024, CompactionThreshold: 4})
+	defer db.Close()
+	db.Set("counter", "0")
+
+	// Read-modify-write loops retried on conflict must not lose updates
+	const workers, increments = 8, 25
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				for {
+					txn, err := db.Begin()
+					if err != nil {
+						t.Errorf("failed to begin: %v", err)
+						return
+					}
+					val, _ := txn.Get("counter")
+					n, _ := strconv.Atoi(val)
+					txn.Set("counter", strconv.Itoa(n+1))
+					err = txn.Commit()
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, storage.ErrTxnConflict) {
+						t.Errorf("unexpected commit error: %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if val, _ := db.Get("counter"); val != strconv.Itoa(workers*increments) {
+		t.Errorf("expected counter %d, got %s", workers*increments, val)
+	}
+}
@@ -1,5 +1,7 @@
 package storage
 
+import "time"
+
 // RecordRef represents the physical location of a record in the segment files.
 type RecordRef struct {
 	FileID uint32 // Segment file identifier
@@ -11,7 +13,7 @@ type RecordRef struct {
 type RecordHeader struct {
 	Timestamp int64  // Unix nano timestamp of the record
 	TxID      uint64 // Transaction identifier
-	Type      byte   // Type of record (e.g., Write, Tombstone, System)
+	Type      byte   // Type of record (RecordWrite, RecordTombstone, RecordSystem, RecordVector, RecordRangeTombstone)
 	KeyLen    uint32 // Length of the key in bytes
 	ValLen    uint32 // Length of the value in bytes
 }
@@ -30,6 +32,10 @@ type Index interface {
 	// Scan returns all RecordRefs whose keys match the given prefix.
 	Scan(prefix []byte) ([]RecordRef, error)
 
+	// NewIterator returns an iterator over the index's keys in ascending order,
+	// restricted to the bounds in opts. It must be closed after use.
+	NewIterator(opts IterOptions) (IndexIterator, error)
+
 	// Close closes any open file handles or resources held by the index.
 	Close() error
 
@@ -37,9 +43,134 @@ type Index interface {
 	Stats() IndexStats
 }
 
+// IterOptions restricts an iterator to keys in [LowerBound, UpperBound). A nil
+// bound leaves that side of the range open.
+type IterOptions struct {
+	LowerBound []byte
+	UpperBound []byte
+}
+
+// IndexIterator walks the entries of an index in key order. Positioning methods
+// return whether the iterator is valid afterwards; Key and Value may only be called
+// while it is. The iterator reads a consistent view of the index taken when it was
+// created and is not safe for concurrent use.
+type IndexIterator interface {
+	// First moves to the first key in range.
+	First() bool
+
+	// Last moves to the last key in range.
+	Last() bool
+
+	// Seek moves to the first key in range that is greater than or equal to key.
+	Seek(key []byte) bool
+
+	// Next moves to the following key.
+	Next() bool
+
+	// Prev moves to the preceding key.
+	Prev() bool
+
+	Valid() bool
+	Key() []byte
+	Value() RecordRef
+
+	// Error returns the first error encountered while iterating, if any.
+	Error() error
+
+	// Close releases the resources held by the iterator.
+	Close() error
+}
+
+// Resetter is implemented by indexes that can discard all of their entries,
+// allowing DB.RebuildIndex to replay the segment log into an empty lens.
+type Resetter interface {
+	Reset() error
+}
+
+// Reconciler is implemented by indexes that can drop entries whose RecordRef no
+// longer resolves, such as refs into a torn segment tail truncated during recovery.
+type Reconciler interface {
+	// DropRefs removes every entry whose current RecordRef matches dangling and
+	// returns the keys of the removed entries.
+	DropRefs(dangling func(ref RecordRef) bool) ([][]byte, error)
+}
+
+// RangeDeleter is implemented by indexes that can delete every key in [start, end)
+// at once, e.g. with a range tombstone. DB.DeleteRange requires it of the primary
+// index; other indexes without it are left untouched by range deletions.
+type RangeDeleter interface {
+	DeleteRange(start, end []byte) error
+}
+
+// IndexOp is a single index mutation: a Put of Key -> Ref, a Delete of Key, or a
+// Delete of every key in [Key, End) when End is set. ID, when set, names the
+// entry an op on a composite key refers to, like the node ID of a vector; indexes
+// keyed by ID look entries up by it and never derive it from Key.
+type IndexOp struct {
+	Key    []byte
+	ID     []byte
+	Ref    RecordRef
+	Delete bool
+	End    []byte
+}
+
+// BatchIndex is implemented by indexes that can apply several mutations as one
+// atomic, durable unit. DB uses it to group concurrent writes into a single log
+// sync; indexes without it receive the mutations one at a time.
+type BatchIndex interface {
+	ApplyBatch(ops []IndexOp) error
+}
+
+// Validator is implemented by indexes that can reject mutations. DB validates
+// every write of a batch before anything is written, so a rejected batch leaves
+// no trace in the segment log or in any index.
+type Validator interface {
+	ValidateBatch(ops []IndexOp) error
+}
+
+// SnapshotIndex is implemented by indexes that keep the versions of their entries a
+// snapshot can still see. DB snapshots and transactions require it of the primary
+// index.
+type SnapshotIndex interface {
+	NewSnapshot() (IndexSnapshot, error)
+}
+
+// IndexSnapshot is a read-only view of an index as of the write it was taken after.
+// It must be released once it is no longer needed.
+type IndexSnapshot interface {
+	// Seq returns the sequence number of the last write the snapshot sees.
+	Seq() uint64
+	Get(key []byte) (RecordRef, bool, error)
+	NewIterator(opts IterOptions) (IndexIterator, error)
+	Release()
+}
+
+// Syncer is implemented by indexes that buffer their log writes according to a
+// SyncPolicy. DB calls Sync for writes that must be durable before returning.
+type Syncer interface {
+	Sync() error
+}
+
 type IndexStats struct {
 	MemtableSize   int64
 	ImmutableCount int
 	SSTableCount   int
 	SSTableFiles   []string
+
+	// Bloom filter probes made by point lookups, the probes that ruled the key out,
+	// and the probes that passed for a key the table did not hold
+	BloomChecks         uint64
+	BloomNegatives      uint64
+	BloomFalsePositives uint64
+
+	// Tables and bytes per level, and bytes written by flushes and by compactions;
+	// their ratio to FlushedBytes is the write amplification of compaction
+	LevelFiles     []int
+	LevelBytes     []int64
+	FlushedBytes   uint64
+	CompactedBytes uint64
+
+	// Writes stalled waiting for flushes and compactions, and the time they waited
+	WriteStalls uint64
+	StallTime   time.Duration
 }
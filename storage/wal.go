@@ -14,21 +14,32 @@ const (
 	TxCommit byte = 2
 	TxSet    byte = 3
 	TxDelete byte = 4
+
+	TxDeleteRange byte = 5
 )
 
 type WAL struct {
 	File   *os.File
 	writer *bufio.Writer
+	syncer *logSyncer
 }
 
 type RecoveredOp struct {
 	Key    string
 	Value  string
 	Delete bool
+	End    string // Set for a range deletion of [Key, End)
+	TxID   uint64 // Transaction the operation was committed in
 }
 
-// InitWal initializes and opens a WAL file at the given path.
+// InitWal initializes and opens a WAL file at the given path. Every commit is
+// synced to disk.
 func InitWal(path string) (*WAL, error) {
+	return InitWalWithPolicy(path, SyncPolicy{Mode: SyncAlways})
+}
+
+// InitWalWithPolicy opens a WAL file whose commits are synced according to policy.
+func InitWalWithPolicy(path string, policy SyncPolicy) (*WAL, error) {
 	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open WAL file: %w", err)
@@ -37,11 +48,25 @@ func InitWal(path string) (*WAL, error) {
 	return &WAL{
 		File:   file,
 		writer: bufio.NewWriter(file),
+		syncer: newLogSyncer(policy, file.Sync),
 	}, nil
 }
 
+// Sync flushes buffered entries and forces committed transactions to disk,
+// regardless of the sync policy.
+func (wl *WAL) Sync() error {
+	if err := wl.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush WAL buffer: %w", err)
+	}
+	if err := wl.syncer.sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL file: %w", err)
+	}
+	return nil
+}
+
 // Close flushes the writer and closes the file descriptor.
 func (wl *WAL) Close() error {
+	wl.syncer.close()
 	if err := wl.writer.Flush(); err != nil {
 		return fmt.Errorf("failed to flush WAL buffer: %w", err)
 	}
@@ -60,7 +85,8 @@ func (wl *WAL) WriteTxStart(txID uint64) error {
 	return err
 }
 
-// WriteTxCommit writes the transaction commit marker and syncs changes to disk.
+// WriteTxCommit writes the transaction commit marker and hands the transaction to
+// the OS. It is synced to disk as dictated by the WAL's sync policy.
 func (wl *WAL) WriteTxCommit(txID uint64) error {
 	var buf [9]byte
 	buf[0] = TxCommit
@@ -71,7 +97,7 @@ func (wl *WAL) WriteTxCommit(txID uint64) error {
 	if err := wl.writer.Flush(); err != nil {
 		return err
 	}
-	return wl.File.Sync()
+	return wl.syncer.commit(1, false)
 }
 
 // WriteTxSet writes a key-value write operation inside a transaction.
@@ -115,6 +141,27 @@ func (wl *WAL) WriteTxDelete(txID uint64, key string) error {
 	return nil
 }
 
+// WriteTxDeleteRange writes the deletion of every key in [start, end) inside a
+// transaction.
+func (wl *WAL) WriteTxDeleteRange(txID uint64, start, end string) error {
+	var header [17]byte
+	header[0] = TxDeleteRange
+	binary.BigEndian.PutUint64(header[1:9], txID)
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(start)))
+	binary.BigEndian.PutUint32(header[13:17], uint32(len(end)))
+
+	if _, err := wl.writer.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := wl.writer.WriteString(start); err != nil {
+		return err
+	}
+	if _, err := wl.writer.WriteString(end); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Read reads the WAL sequentially and returns all recovered committed operations.
 // Transactions that do not have a TX_COMMIT are discarded.
 func (wl *WAL) Read() ([]RecoveredOp, error) {
@@ -154,7 +201,7 @@ func (wl *WAL) Read() ([]RecoveredOp, error) {
 				delete(txBuffers, txID)
 			}
 
-		case TxSet:
+		case TxSet, TxDeleteRange:
 			var lenBuf [8]byte
 			if _, err := io.ReadFull(reader, lenBuf[:]); err != nil {
 				if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
@@ -185,6 +232,10 @@ func (wl *WAL) Read() ([]RecoveredOp, error) {
 				Key:    string(keyBuf),
 				Value:  string(valBuf),
 				Delete: false,
+				TxID:   txID,
+			}
+			if entryTypeByte == TxDeleteRange {
+				op = RecoveredOp{Key: string(keyBuf), Delete: true, End: string(valBuf), TxID: txID}
 			}
 			txBuffers[txID] = append(txBuffers[txID], op)
 
@@ -209,6 +260,7 @@ func (wl *WAL) Read() ([]RecoveredOp, error) {
 			op := RecoveredOp{
 				Key:    string(keyBuf),
 				Delete: true,
+				TxID:   txID,
 			}
 			txBuffers[txID] = append(txBuffers[txID], op)
 		}
@@ -54,10 +54,10 @@ func TestWALTransactions(t *testing.T) {
 
 	// Verify only committed transactions (Tx 1 and Tx 3) are returned
 	expectedOps := []RecoveredOp{
-		{Key: "key1", Value: "val1", Delete: false},
-		{Key: "key2", Value: "val2", Delete: false},
-		{Key: "key4", Value: "val4", Delete: false},
-		{Key: "key2", Value: "", Delete: true},
+		{Key: "key1", Value: "val1", Delete: false, TxID: 1},
+		{Key: "key2", Value: "val2", Delete: false, TxID: 1},
+		{Key: "key4", Value: "val4", Delete: false, TxID: 3},
+		{Key: "key2", Value: "", Delete: true, TxID: 3},
 	}
 
 	if len(ops) != len(expectedOps) {
@@ -66,8 +66,67 @@ func TestWALTransactions(t *testing.T) {
 
 	for i, op := range ops {
 		expected := expectedOps[i]
-		if op.Key != expected.Key || op.Value != expected.Value || op.Delete != expected.Delete {
+		if op.Key != expected.Key || op.Value != expected.Value || op.Delete != expected.Delete || op.TxID != expected.TxID {
 			t.Errorf("op %d: expected %+v, got %+v", i, expected, op)
 		}
 	}
 }
+
+func TestWALSyncPolicy(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "wal_sync_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	walPath := filepath.Join(tmpDir, "test.wal")
+	wal, err := InitWalWithPolicy(walPath, SyncPolicy{Mode: SyncGroup, BatchSize: 3})
+	if err != nil {
+		t.Fatalf("failed to init WAL: %v", err)
+	}
+
+	// 1. Commits below the batch size are handed to the OS but not synced
+	for i := uint64(1); i <= 2; i++ {
+		wal.WriteTxStart(i)
+		wal.WriteTxSet(i, "key", "val")
+		if err := wal.WriteTxCommit(i); err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+	}
+	if wal.syncer.pending != 2 {
+		t.Errorf("expected 2 pending commits, got %d", wal.syncer.pending)
+	}
+
+	// Buffered commits are already visible to a reader of the file
+	wal2, err := InitWal(walPath)
+	if err != nil {
+		t.Fatalf("failed to reopen WAL: %v", err)
+	}
+	ops, err := wal2.Read()
+	wal2.Close()
+	if err != nil || len(ops) != 2 {
+		t.Errorf("expected 2 recovered ops from unsynced WAL, got %d (err=%v)", len(ops), err)
+	}
+
+	// 2. An explicit sync flushes them
+	if err := wal.Sync(); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if wal.syncer.pending != 0 {
+		t.Errorf("expected no pending commits after Sync, got %d", wal.syncer.pending)
+	}
+
+	// 3. Reaching the batch size syncs automatically
+	for i := uint64(3); i <= 5; i++ {
+		wal.WriteTxStart(i)
+		wal.WriteTxSet(i, "key", "val")
+		wal.WriteTxCommit(i)
+	}
+	if wal.syncer.pending != 0 {
+		t.Errorf("expected batch of 3 commits to be synced, got %d pending", wal.syncer.pending)
+	}
+
+	if err := wal.Close(); err != nil {
+		t.Fatalf("failed to close WAL: %v", err)
+	}
+}